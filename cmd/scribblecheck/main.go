@@ -0,0 +1,83 @@
+// Command scribblecheck model checks a global protocol.
+//
+// The protocol is checked for well-formedness, and every session of its
+// participants is explored for each value of the parameters from 1 to -max
+// (see package modelcheck):
+//
+//	scribblecheck -max 3 example/nested/nested.scr
+//
+// A counterexample is printed as the steps of the session leading to it, and
+// scribblecheck exits with status 1.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/nickng/scribble-foreach-experiment/modelcheck"
+	"github.com/nickng/scribble-foreach-experiment/scribble"
+)
+
+var (
+	maxValue = flag.Int("max", 3, "check every parameter value from 1 to max")
+	bound    = flag.Int("bound", modelcheck.DefaultBound, "capacity of the queue between two participants")
+)
+
+func init() {
+	log.SetPrefix("scribblecheck: ")
+	log.SetFlags(0)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: scribblecheck [flags] protocol.scr\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	src, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	proto, err := scribble.Parse(flag.Arg(0), string(src))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := scribble.Check(proto); err != nil {
+		log.Fatal(err)
+	}
+	failed := false
+	for _, params := range modelcheck.Params(proto, *maxValue) {
+		skip := false
+		for _, a := range scribble.Assumptions(proto) {
+			if err := a.Check(params); err != nil {
+				fmt.Printf("%s: skipped, %v\n", modelcheck.FormatParams(params), err)
+				skip = true
+				break
+			}
+		}
+		if skip {
+			continue
+		}
+		n, err := modelcheck.Check(proto, params, *bound)
+		if cex, ok := err.(*modelcheck.Counterexample); ok {
+			fmt.Println(cex)
+			cex.Dump(os.Stdout)
+			failed = true
+			continue
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s: ok, %d states\n", modelcheck.FormatParams(params), n)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,76 @@
+// Command scribbledot renders the FSMs of a global protocol in Graphviz DOT.
+//
+// The protocol is checked for well-formedness and projected onto each role,
+// and the FSM of each role is written as a digraph, with each foreach drawn
+// as a cluster:
+//
+//	scribbledot -role Coordinator example/nested/nested.scr | dot -Tsvg > nested.svg
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"github.com/nickng/scribble-foreach-experiment/scribble"
+)
+
+var (
+	output = flag.String("o", "", "output file (default stdout)")
+	role   = flag.String("role", "", "only render the FSM of this role")
+)
+
+func init() {
+	log.SetPrefix("scribbledot: ")
+	log.SetFlags(0)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: scribbledot [flags] protocol.scr\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	src, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	proto, err := scribble.Parse(flag.Arg(0), string(src))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := scribble.Check(proto); err != nil {
+		log.Fatal(err)
+	}
+	if *role != "" && proto.Role(*role) == nil {
+		log.Fatalf("role %s is not declared in protocol %s", *role, proto.Name)
+	}
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.Create(*output); err != nil {
+			log.Fatal(err)
+		}
+		defer out.Close()
+	}
+	for _, r := range proto.Roles {
+		if *role != "" && r.Name != *role {
+			continue
+		}
+		local, err := scribble.Project(proto, r.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(local.Body) == 0 {
+			continue // not involved
+		}
+		if _, err := fmt.Fprint(out, scribble.NewFSM(local).Dot()); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
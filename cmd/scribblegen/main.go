@@ -0,0 +1,87 @@
+// Command scribblegen generates foreach APIs from a global protocol.
+//
+// The protocol is checked for well-formedness, projected onto each role, and
+// the API of each role is written to its own package directory:
+//
+//	scribblegen -o example/nested example/nested/nested.scr
+//
+// writes the packages example/nested/coordinator and example/nested/a.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/nickng/scribble-foreach-experiment/gen"
+	"github.com/nickng/scribble-foreach-experiment/scribble"
+)
+
+var (
+	outDir = flag.String("o", ".", "output directory of the generated packages")
+	role   = flag.String("role", "", "only generate the API of this role")
+)
+
+func init() {
+	log.SetPrefix("scribblegen: ")
+	log.SetFlags(0)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(flag.CommandLine.Output(), "usage: scribblegen [flags] protocol.scr\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	src, err := ioutil.ReadFile(flag.Arg(0))
+	if err != nil {
+		log.Fatal(err)
+	}
+	proto, err := scribble.Parse(flag.Arg(0), string(src))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := scribble.Check(proto); err != nil {
+		log.Fatal(err)
+	}
+	for _, r := range proto.Roles {
+		if *role != "" && r.Name != *role {
+			continue
+		}
+		local, err := scribble.Project(proto, r.Name)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(local.Body) == 0 {
+			log.Printf("skipping role %s: not involved in protocol %s", r.Name, proto.Name)
+			continue
+		}
+		pkg := gen.PackageName(r.Name)
+		files, err := gen.Generate(local, pkg)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeFiles(filepath.Join(*outDir, pkg), files); err != nil {
+			log.Fatal(err)
+		}
+	}
+}
+
+func writeFiles(dir string, files map[string][]byte) error {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	for name, src := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), src, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
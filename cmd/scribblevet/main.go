@@ -0,0 +1,24 @@
+// Command scribblevet checks the code driving the foreach APIs, it is run
+// by go vet:
+//
+//	go build -o scribblevet ./cmd/scribblevet
+//	go vet -vettool=$(pwd)/scribblevet ./...
+//
+// The linear analyzer reports states which are not used exactly once (see
+// package linear), and the loopshape analyzer reports HasNext, Foreach and
+// EndForeach of the proto style which are not in the shape of a foreach loop
+// (see package loopshape). The suggested fixes of loopshape are applied by
+// go fix:
+//
+//	go fix -fixtool=$(pwd)/scribblevet ./...
+package main
+
+import (
+	"github.com/nickng/scribble-foreach-experiment/linear"
+	"github.com/nickng/scribble-foreach-experiment/loopshape"
+	"golang.org/x/tools/go/analysis/unitchecker"
+)
+
+func main() {
+	unitchecker.Main(linear.Analyzer, loopshape.Analyzer)
+}
@@ -0,0 +1,11 @@
+// Package equiv checks that the API styles of the nested one-to-many
+// protocol (proto, fused, nested, recur, forrange, final, value and the
+// generated Coordinator) behave the same.
+//
+// The tests drive each style for a range of k and with different nestings
+// of the driving code, record the transitions of each session with the Trace
+// of the style, and compare them with the trace of the reference FSM of the
+// Coordinator projected from example/nested/nested.scr (see trace.Expected).
+// Each style also sends its messages to scripted peers (see mockpeer), which
+// check that every message reaches the participant of the loop index.
+package equiv
@@ -0,0 +1,335 @@
+package equiv
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/example/nested/coordinator"
+	"github.com/nickng/scribble-foreach-experiment/final"
+	"github.com/nickng/scribble-foreach-experiment/forrange"
+	"github.com/nickng/scribble-foreach-experiment/fused"
+	"github.com/nickng/scribble-foreach-experiment/mockpeer"
+	"github.com/nickng/scribble-foreach-experiment/nested"
+	"github.com/nickng/scribble-foreach-experiment/proto"
+	"github.com/nickng/scribble-foreach-experiment/recur"
+	"github.com/nickng/scribble-foreach-experiment/scribble"
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+	"github.com/nickng/scribble-foreach-experiment/value"
+)
+
+// The drivers send foo(10*i+j) to A[j] and bar("bar i") to A[i].
+func foo(i, j int) int { return 10*i + j }
+func bar(i int) string { return fmt.Sprintf("bar %d", i) }
+func payload(label string, env map[string]int) string {
+	if label == "foo" {
+		return fmt.Sprint(foo(env["i"], env["j"]))
+	}
+	return bar(env["i"])
+}
+
+// style is a driver of an API style for k participants, trace and conn are
+// the Trace and Conn variables of the style.
+type style struct {
+	name  string
+	param map[string]int
+	trace **trace.Recorder
+	conn  *transport.Conn
+	hello bool // hello is true if the session starts with the handshake of the generated APIs
+	run   func(k int)
+}
+
+// valueConn and generatedConn are the connections of the value sessions and
+// the generated Coordinator started by the drivers.
+var valueConn, generatedConn transport.Conn
+
+var styles = []style{
+	{"proto", proto.ProtoParam, &proto.Trace, &proto.Conn, false, runProto},
+	{"fused", fused.ProtoParam, &fused.Trace, &fused.Conn, false, runFused},
+	{"nested", nested.ProtoParam, &nested.Trace, &nested.Conn, false, runNested},
+	{"nested/named", nested.ProtoParam, &nested.Trace, &nested.Conn, false, runNestedNamed},
+	{"recur", recur.ProtoParam, &recur.Trace, &recur.Conn, false, runRecur},
+	{"recur/named", recur.ProtoParam, &recur.Trace, &recur.Conn, false, runRecurNamed},
+	{"forrange", forrange.ProtoParam, &forrange.Trace, &forrange.Conn, false, runForrange},
+	{"final", final.ProtoParam, &final.Trace, &final.Conn, false, runFinal},
+	{"final/named", final.ProtoParam, &final.Trace, &final.Conn, false, runFinalNamed},
+	{"value", value.ProtoParam, &value.Trace, &valueConn, false, runValue},
+	{"value/named", value.ProtoParam, &value.Trace, &valueConn, false, runValueNamed},
+	{"generated", coordinator.ProtoParam, &coordinator.Trace, &generatedConn, true, runGenerated},
+}
+
+func runProto(k int) {
+	s := new(proto.S0)
+	for i := 1; s.HasNext(); i++ {
+		s1 := s.Foreach()
+		for j := 1; s1.HasNext(); j++ {
+			s1 = s1.Foreach().Send_Aj_foo(foo(i, j))
+		}
+		s = s1.EndForeach().Send_Ai_bar(bar(i))
+	}
+	s.EndForeach().End()
+}
+
+// runFused counts the iterations, as fused.S0.Foreach uses up its state
+// when the loop exits.
+func runFused(k int) {
+	s := new(fused.S0)
+	for i := 1; i <= k; i++ {
+		s1, _ := s.Foreach()
+		for j := 1; j <= k; j++ {
+			s2, _ := s1.Foreach()
+			s1 = s2.Send_Aj_foo(foo(i, j))
+		}
+		s = s1.EndForeach().Send_Ai_bar(bar(i))
+	}
+	s.EndForeach().End()
+}
+
+func runNested(k int) {
+	i := 0
+	new(nested.S0).Foreach(func(s *nested.S1) *nested.S4 {
+		i++
+		j := 0
+		return s.Foreach(func(s *nested.S2) *nested.S5 {
+			j++
+			return s.Send_Aj_foo(foo(i, j))
+		}).Send_Ai_bar(bar(i))
+	}).End()
+}
+
+func runNestedNamed(k int) {
+	var i, j int
+	inner := func(s *nested.S2) *nested.S5 {
+		j++
+		return s.Send_Aj_foo(foo(i, j))
+	}
+	outer := func(s *nested.S1) *nested.S4 {
+		i, j = i+1, 0
+		s3 := s.Foreach(inner)
+		return s3.Send_Ai_bar(bar(i))
+	}
+	s := new(nested.S0)
+	end := s.Foreach(outer)
+	end.End()
+}
+
+func runRecur(k int) {
+	i := 0
+	new(recur.S0).Foreach(func(s *recur.S1) *recur.S0 {
+		i++
+		j := 0
+		return s.Foreach(func(s *recur.S2) *recur.S1 {
+			j++
+			return s.Send_Aj_foo(foo(i, j))
+		}).Send_Ai_bar(bar(i))
+	}).End()
+}
+
+func runRecurNamed(k int) {
+	var i, j int
+	inner := func(s *recur.S2) *recur.S1 {
+		j++
+		return s.Send_Aj_foo(foo(i, j))
+	}
+	outer := func(s *recur.S1) *recur.S0 {
+		i, j = i+1, 0
+		return s.Foreach(inner).Send_Ai_bar(bar(i))
+	}
+	new(recur.S0).Foreach(outer).End()
+}
+
+func runForrange(k int) {
+	loop0, end0 := new(forrange.S0).Foreach()
+	i := 0
+	for s1 := range loop0 {
+		i++
+		loop1, end1 := s1.Foreach()
+		j := 0
+		for s2 := range loop1 {
+			j++
+			s2.Send_Aj_foo(foo(i, j)).End()
+		}
+		end1.Send_Ai_bar(bar(i)).End()
+	}
+	end0.End()
+}
+
+func runFinal(k int) {
+	i := 0
+	new(final.S0).Foreach(func(s *final.S1) *final.S4 {
+		i++
+		j := 0
+		return s.Foreach(func(s *final.S2) *final.S5 {
+			j++
+			return s.Send_Aj_foo(foo(i, j))
+		}).Send_Ai_bar(bar(i))
+	}).End()
+}
+
+func runFinalNamed(k int) {
+	var i, j int
+	inner := func(s *final.S2) *final.S5 {
+		j++
+		return s.Send_Aj_foo(foo(i, j))
+	}
+	outer := func(s *final.S1) *final.S4 {
+		i, j = i+1, 0
+		return s.Foreach(inner).Send_Ai_bar(bar(i))
+	}
+	new(final.S0).Foreach(outer).End()
+}
+
+func runValue(k int) {
+	i := 0
+	(&value.Session{Conn: valueConn}).Start().Foreach(func(s value.S1) value.S4 {
+		i++
+		j := 0
+		return s.Foreach(func(s value.S2) value.S5 {
+			j++
+			return s.Send_Aj_foo(foo(i, j))
+		}).Send_Ai_bar(bar(i))
+	}).End()
+}
+
+func runValueNamed(k int) {
+	var i, j int
+	inner := func(s value.S2) value.S5 {
+		j++
+		return s.Send_Aj_foo(foo(i, j))
+	}
+	outer := func(s value.S1) value.S4 {
+		i, j = i+1, 0
+		return s.Foreach(inner).Send_Ai_bar(bar(i))
+	}
+	(&value.Session{Conn: valueConn}).Start().Foreach(outer).End()
+}
+
+func runGenerated(k int) {
+	s, err := coordinator.New(generatedConn)
+	if err != nil {
+		panic(err)
+	}
+	i := 0
+	s.Foreach(func(s *coordinator.S1) *coordinator.S4 {
+		i++
+		j := 0
+		return s.Foreach(func(s *coordinator.S2) *coordinator.S5 {
+			j++
+			return s.Send_Aj_foo(foo(i, j))
+		}).Send_Ai_bar(bar(i))
+	}).End()
+}
+
+// peers returns the mock peers A[1..k] of a session of st, expecting the
+// messages of the drivers.
+func peers(t *testing.T, st style, k int) *mockpeer.Conn {
+	conn := mockpeer.New(t)
+	if st.hello {
+		for j := 1; j <= k; j++ {
+			conn.Peer("A", j).Handshake("Nested", coordinator.Fingerprint, map[string]int{"k": k})
+		}
+	}
+	for i := 1; i <= k; i++ {
+		for j := 1; j <= k; j++ {
+			conn.Peer("A", j).Expect("foo", foo(i, j))
+		}
+		conn.Peer("A", i).Expect("bar", bar(i))
+	}
+	return conn
+}
+
+// reference returns the FSM of the Coordinator in nested.scr.
+func reference(t *testing.T) *scribble.FSM {
+	t.Helper()
+	src, err := ioutil.ReadFile("../example/nested/nested.scr")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := scribble.Parse("nested.scr", string(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := scribble.Project(p, "Coordinator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return scribble.NewFSM(l)
+}
+
+func dump(events []trace.Event) string {
+	var b strings.Builder
+	trace.Dump(&b, events)
+	return b.String()
+}
+
+func TestEquivalence(t *testing.T) {
+	fsm := reference(t)
+	for k := 1; k <= 4; k++ {
+		expected, err := trace.Expected(fsm, map[string]int{"k": k}, payload)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n := 2*k*k + 3*k + 2; len(expected) != n {
+			t.Fatalf("k=%d: expected %d events in the reference trace but got %d", k, n, len(expected))
+		}
+		for _, st := range styles {
+			st.param["k"] = k
+			rec := new(trace.Recorder)
+			*st.trace = rec
+			*st.conn = peers(t, st, k)
+			st.run(k)
+			*st.trace, *st.conn = nil, nil
+			if got := dump(rec.Events()); got != dump(expected) {
+				t.Errorf("%s k=%d: expected trace:\n%s\nbut got:\n%s", st.name, k, dump(expected), got)
+			}
+		}
+	}
+}
+
+// TestDelivery checks that every style sends each message to the peer
+// picked by the current loop index, and closes its connection.
+func TestDelivery(t *testing.T) {
+	const k = 3
+	for _, st := range styles {
+		t.Run(st.name, func(t *testing.T) {
+			conn := peers(t, st, k)
+			st.param["k"] = k
+			*st.conn = conn
+			st.run(k)
+			*st.conn = nil
+			conn.Verify()
+			if err := conn.Close(); err != transport.ErrClosed {
+				t.Errorf("expected the connection to be closed by End but got %v", err)
+			}
+		})
+	}
+}
+
+func TestExpected(t *testing.T) {
+	expected := `S0 iterate foreach 0: i = 1
+S1 iterate foreach 1: j = 1
+S2 send Coordinator -> A[1]: foo(11)
+S1 iterate foreach 1: j = 2
+S2 send Coordinator -> A[2]: foo(12)
+S1 exit foreach 1
+S3 send Coordinator -> A[1]: bar(bar 1)
+S0 iterate foreach 0: i = 2
+S1 iterate foreach 1: j = 1
+S2 send Coordinator -> A[1]: foo(21)
+S1 iterate foreach 1: j = 2
+S2 send Coordinator -> A[2]: foo(22)
+S1 exit foreach 1
+S3 send Coordinator -> A[2]: bar(bar 2)
+S0 exit foreach 0
+SEnd end
+`
+	events, err := trace.Expected(reference(t), map[string]int{"k": 2}, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := dump(events); got != expected {
+		t.Errorf("expected:\n%s\nbut got:\n%s", expected, got)
+	}
+}
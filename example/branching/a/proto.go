@@ -0,0 +1,263 @@
+// Code generated by scribblegen. DO NOT EDIT.
+
+// Package a is the API of role A in protocol Branching.
+//
+// Local protocol:
+//
+//	local protocol Branching at A[self:1..k] {
+//	  foreach A[i:1..k] {
+//	    choice at Coordinator {
+//	      ok(int) from Coordinator;
+//	    } or {
+//	      fail(string) from Coordinator;
+//	    }
+//	    if self == i {
+//	      bar(string) from Coordinator;
+//	    }
+//	  }
+//	}
+package a
+
+import (
+	"fmt"
+
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// ProtoParam is the lookup table for protocol parameters (k).
+// Parameters must be set before the session starts.
+var ProtoParam = make(map[string]int)
+
+// Trace records the transitions of the participants if not nil.
+var Trace *trace.Recorder
+
+// checkParams returns an error if a protocol parameter is not set, or if
+// a range of the protocol is empty.
+func checkParams() error {
+	for _, name := range []string{"k"} {
+		if _, ok := ProtoParam[name]; !ok {
+			return fmt.Errorf("Branching: protocol parameter %s is not set", name)
+		}
+	}
+	if lo, hi := 1, ProtoParam["k"]; lo > hi {
+		return fmt.Errorf("Branching: range 1..k is empty (%d..%d)", lo, hi)
+	}
+	return nil
+}
+
+// Fingerprint is the hash of protocol Branching, a session only starts if all
+// participants have the same fingerprint and protocol parameters.
+const Fingerprint = "98a0ceb58c742f8a"
+
+// hello returns the announcement of participant name in the handshake.
+func hello(name string) transport.Hello {
+	return transport.Hello{Protocol: "Branching", Participant: name, Fingerprint: Fingerprint, Params: map[string]int{"k": ProtoParam["k"]}}
+}
+
+// peers returns the participants other than name in the handshake.
+func peers(name string) []string {
+	return []string{"Coordinator"}
+}
+
+// endpoint is a participant of the session.
+// The foreach stack is kept per participant so that the participants of
+// an indexed role can run side by side.
+type endpoint struct {
+	self    int                          // self is the index of this participant
+	name    string                       // name is the name of this participant in the transport
+	conn    transport.Conn               // conn is the connection to the other participants
+	pending map[string]transport.Message // pending are the messages received by Branch
+	sstack  *fsmStack                    // sstack is the foreach stack of this participant
+}
+
+// send sends a message to the participant to from state, it panics with
+// the error of the connection if the message cannot be sent.
+func (ep *endpoint) send(state int, to, label string, payload ...interface{}) {
+	if err := ep.conn.Send(to, transport.Message{Label: label, Payload: payload}); err != nil {
+		panic(fmt.Errorf("%s: cannot send %s to %s: %w", ep.name, label, to, err))
+	}
+	Trace.Record(trace.Event{Kind: trace.Send, State: state, From: ep.name, To: to, Label: label, Payload: formatPayload(payload)})
+}
+
+// peek returns the next message from the participant from without
+// consuming it, it panics with the error of the connection if no message
+// can be received.
+func (ep *endpoint) peek(from string) transport.Message {
+	if m, ok := ep.pending[from]; ok {
+		return m
+	}
+	m, err := ep.conn.Recv(from)
+	if err != nil {
+		panic(fmt.Errorf("%s: cannot receive from %s: %w", ep.name, from, err))
+	}
+	ep.pending[from] = m
+	return m
+}
+
+// iterate tells the connection that the participant starts the iteration
+// (from 1) of the foreach loop ID, or exits the loop if iteration is 0.
+func (ep *endpoint) iterate(loop, iteration int) {
+	if o, ok := ep.conn.(transport.LoopObserver); ok {
+		o.Iterate(loop, iteration)
+	}
+}
+
+// recv receives the next message from the participant from in state,
+// which must have the given label, or it panics with ErrUnexpectedLabel.
+func (ep *endpoint) recv(state int, from, label string) []interface{} {
+	m := ep.peek(from)
+	delete(ep.pending, from)
+	if m.Label != label {
+		panic(fmt.Errorf("%s: %w from %s: expected %s but got %s", ep.name, ErrUnexpectedLabel, from, label, m.Label))
+	}
+	Trace.Record(trace.Event{Kind: trace.Recv, State: state, From: from, To: ep.name, Label: label, Payload: formatPayload(m.Payload)})
+	return m.Payload
+}
+
+// formatPayload returns the payload of a message in a trace, e.g. 1, x.
+func formatPayload(payload []interface{}) string {
+	var b []byte
+	for i, v := range payload {
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+		b = fmt.Append(b, v)
+	}
+	return string(b)
+}
+
+// New returns the initial state of participant A[self], 1 <= self <= k,
+// conn is the connection of A[self] to the other participants.
+// It returns an error if the protocol parameters are not set correctly, or
+// if the other participants run a different protocol (see Fingerprint).
+func New(self int, conn transport.Conn) (*S0, error) {
+	if err := checkParams(); err != nil {
+		return nil, err
+	}
+	if lo, hi := 1, ProtoParam["k"]; self < lo || self > hi {
+		return nil, fmt.Errorf("Branching: participant A[%d] is not in range 1..k (%d..%d)", self, lo, hi)
+	}
+	name := transport.Name("A", self)
+	if conn == nil {
+		return nil, fmt.Errorf("Branching: %s has no connection", name)
+	}
+	if err := transport.Handshake(conn, hello(name), peers(name)); err != nil {
+		return nil, err
+	}
+	ep := &endpoint{self: self, name: name, conn: conn, pending: make(map[string]transport.Message), sstack: newStack()}
+	return &S0{ep: ep}, nil
+}
+
+// S0 is the init state of foreach A[i:1..k] (loop ID 0).
+type S0 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S0) ID() int { return 0 }
+
+// Foreach runs bodyFn for each i in 1..k, then moves to SEnd.
+func (s *S0) Foreach(bodyFn func(*S1) *S6) *SEnd {
+	s.Use()
+	sstack := s.ep.sstack
+	if sstack.isEmpty() || sstack.top().ID != 0 {
+		// first time enter loop
+		sstack.push(0, 1, ProtoParam["k"])
+	} else if sstack.top().ID == 0 {
+		// re-enter loop
+		sstack.top().increment()
+	} else {
+		panic("shouldn't get here")
+	}
+
+	for n := 1; sstack.top().canEnter(); n++ {
+		s.ep.iterate(0, n)
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: 0, Loop: 0, Index: "i", Value: sstack.top().curr})
+		bodyFn(&S1{ep: s.ep}).end()
+	}
+	s.ep.iterate(0, 0)
+	Trace.Record(trace.Event{Kind: trace.Exit, State: 0, Loop: 0})
+	sstack.pop()
+	return &SEnd{ep: s.ep}
+}
+
+// S1 is a choice at Coordinator, each branch is a method of S1.
+type S1 struct {
+	resource
+	ep *endpoint
+}
+
+// Branch returns the label of the branch chosen by Coordinator (ok or fail),
+// the message is received by the method of the branch.
+func (s *S1) Branch() string {
+	return s.ep.peek("Coordinator").Label
+}
+
+// Recv_Coordinator_ok receives ok from Coordinator, then moves to S4.
+func (s *S1) Recv_Coordinator_ok() (int, *S4) {
+	s.Use()
+	payload := s.ep.recv(2, "Coordinator", "ok")
+	return payload[0].(int), &S4{ep: s.ep}
+}
+
+// Recv_Coordinator_fail receives fail from Coordinator, then moves to S4.
+func (s *S1) Recv_Coordinator_fail() (string, *S4) {
+	s.Use()
+	payload := s.ep.recv(3, "Coordinator", "fail")
+	return payload[0].(string), &S4{ep: s.ep}
+}
+
+// S4 is a guard on the index of this participant.
+type S4 struct {
+	resource
+	ep *endpoint
+}
+
+// IfSelf runs thenFn if this participant is A[i], otherwise it skips to S6.
+func (s *S4) IfSelf(thenFn func(*S5) *S6) *S6 {
+	s.Use()
+	if s.ep.self == s.ep.sstack.find(0).curr {
+		return thenFn(&S5{ep: s.ep})
+	}
+	return &S6{ep: s.ep}
+}
+
+// S5 is the state before bar(string) from Coordinator.
+type S5 struct {
+	resource
+	ep *endpoint
+}
+
+// Recv_Coordinator_bar receives bar from Coordinator, then moves to S6.
+func (s *S5) Recv_Coordinator_bar() (string, *S6) {
+	s.Use()
+	payload := s.ep.recv(5, "Coordinator", "bar")
+	return payload[0].(string), &S6{ep: s.ep}
+}
+
+// S6 is the ending state of foreach loop ID 0.
+type S6 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S6) end() {
+	s.Use()
+	s.ep.sstack.top().increment()
+}
+
+// SEnd is the usual final state of a protocol.
+type SEnd struct {
+	resource
+	ep *endpoint
+}
+
+// End closes the connection to the other participants.
+func (s *SEnd) End() {
+	s.Use()
+	if err := s.ep.conn.Close(); err != nil {
+		panic(fmt.Errorf("%s: cannot close connection: %w", s.ep.name, err))
+	}
+	Trace.Record(trace.Event{Kind: trace.End})
+}
@@ -0,0 +1,87 @@
+package branching_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/example/branching/a"
+	"github.com/nickng/scribble-foreach-experiment/example/branching/coordinator"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// TestBranches runs both ends, taking a different branch in each iteration,
+// every branch goes to the end of the inner loop body. The participants
+// follow the branch chosen by the Coordinator.
+func TestBranches(t *testing.T) {
+	const k = 3
+	coordinator.ProtoParam["k"] = k
+	a.ProtoParam["k"] = k
+	tr := transport.NewChan(0)
+
+	var wg sync.WaitGroup
+	received := make([][]string, k+1)
+	for self := 1; self <= k; self++ {
+		wg.Add(1)
+		go func(self int) {
+			defer wg.Done()
+			s0, err := a.New(self, tr.Conn(transport.Name("A", self)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			s0.Foreach(func(s *a.S1) *a.S6 {
+				var next *a.S4
+				label := s.Branch()
+				switch label {
+				case "ok":
+					_, next = s.Recv_Coordinator_ok()
+				case "fail":
+					_, next = s.Recv_Coordinator_fail()
+				}
+				received[self] = append(received[self], label)
+				return next.IfSelf(func(s *a.S5) *a.S6 {
+					_, end := s.Recv_Coordinator_bar()
+					return end
+				})
+			}).End()
+		}(self)
+	}
+
+	s0, err := coordinator.New(tr.Conn("Coordinator"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sent []string
+	s0.Foreach(func(s *coordinator.S1) *coordinator.S6 {
+		j := 0
+		return s.Foreach(func(s *coordinator.S2) *coordinator.S7 {
+			j++
+			if j%2 == 0 {
+				sent = append(sent, "ok")
+				return s.Send_Aj_ok(j)
+			}
+			sent = append(sent, "fail")
+			return s.Send_Aj_fail("odd")
+		}).Send_Ai_bar("bar")
+	}).End()
+	wg.Wait()
+
+	if len(sent) != k*k {
+		t.Fatalf("expected %d choices but got %v", k*k, sent)
+	}
+	for self := 1; self <= k; self++ {
+		expected := "fail"
+		if self%2 == 0 {
+			expected = "ok"
+		}
+		if len(received[self]) != k {
+			t.Errorf("A[%d] expected %d choices but got %v", self, k, received[self])
+		}
+		for _, label := range received[self] {
+			if label != expected {
+				t.Errorf("A[%d] expected %s but got %v", self, expected, received[self])
+				break
+			}
+		}
+	}
+}
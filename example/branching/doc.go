@@ -0,0 +1,5 @@
+// Package branching contains the generated APIs of the example protocol in
+// branching.scr, a choice inside the body of a foreach.
+package branching
+
+//go:generate go run ../../cmd/scribblegen branching.scr
@@ -0,0 +1,5 @@
+// Package nested contains the generated APIs of the nested one-to-many
+// example protocol in nested.scr, one package per role.
+package nested
+
+//go:generate go run ../../cmd/scribblegen nested.scr
@@ -0,0 +1,228 @@
+package nested_test
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/example/nested/a"
+	"github.com/nickng/scribble-foreach-experiment/example/nested/coordinator"
+	"github.com/nickng/scribble-foreach-experiment/mockpeer"
+	"github.com/nickng/scribble-foreach-experiment/panictest"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// TestParticipants runs the Coordinator and the participants A[1..k] side by
+// side, and checks that each A[self] receives foo in every iteration and bar
+// only in its own iteration, addressed by the loop indices of the Coordinator.
+func TestParticipants(t *testing.T) {
+	const k = 3
+	coordinator.ProtoParam["k"] = k
+	a.ProtoParam["k"] = k
+	tr := transport.NewChan(0)
+
+	var wg sync.WaitGroup
+	foos := make([][]int, k+1)
+	bars := make([][]string, k+1)
+	for self := 1; self <= k; self++ {
+		wg.Add(1)
+		go func(self int) {
+			defer wg.Done()
+			s0, err := a.New(self, tr.Conn(transport.Name("A", self)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			s0.Foreach(func(s *a.S1) *a.S4 {
+				foo, s2 := s.Recv_Coordinator_foo()
+				foos[self] = append(foos[self], foo)
+				return s2.IfSelf(func(s *a.S3) *a.S4 {
+					bar, end := s.Recv_Coordinator_bar()
+					bars[self] = append(bars[self], bar)
+					return end
+				})
+			}).End()
+		}(self)
+	}
+
+	s0, err := coordinator.New(tr.Conn("Coordinator"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	s0.Foreach(func(s *coordinator.S1) *coordinator.S4 {
+		i++
+		j := 0
+		return s.Foreach(func(s *coordinator.S2) *coordinator.S5 {
+			j++
+			return s.Send_Aj_foo(j)
+		}).Send_Ai_bar(fmt.Sprintf("bar %d", i))
+	}).End()
+	wg.Wait()
+
+	for self := 1; self <= k; self++ {
+		if len(foos[self]) != k {
+			t.Errorf("A[%d] expected %d foo but got %v", self, k, foos[self])
+		}
+		for _, foo := range foos[self] {
+			if foo != self {
+				t.Errorf("A[%d] expected foo(%d) but got foo(%d)", self, self, foo)
+			}
+		}
+		if expected := fmt.Sprintf("bar %d", self); len(bars[self]) != 1 || bars[self][0] != expected {
+			t.Errorf("A[%d] expected [%s] but got %v", self, expected, bars[self])
+		}
+	}
+}
+
+// TestHandshakeMismatch checks that the session does not start if A[1]
+// runs another revision of the protocol, or with other parameters.
+func TestHandshakeMismatch(t *testing.T) {
+	coordinator.ProtoParam["k"] = 1
+	tr := transport.NewChan(0)
+	done := make(chan error)
+	go func() {
+		// A[1] of an older revision of the protocol.
+		hello := transport.Hello{Protocol: "Nested", Participant: "A[1]", Fingerprint: "0123456789abcdef", Params: map[string]int{"k": 1}}
+		done <- transport.Handshake(tr.Conn("A[1]"), hello, []string{"Coordinator"})
+	}()
+	_, err := coordinator.New(tr.Conn("Coordinator"))
+	expected := "transport: handshake with A[1]: protocol Nested has fingerprint 0123456789abcdef at A[1] but " +
+		coordinator.Fingerprint + " at Coordinator (different revisions of the protocol)"
+	if err == nil || err.Error() != expected {
+		t.Errorf("expected error %q but got %v", expected, err)
+	}
+	if err := <-done; err == nil {
+		t.Error("expected A[1] to refuse the session")
+	}
+
+	a.ProtoParam["k"] = 2
+	tr = transport.NewChan(0)
+	go func() {
+		_, err := a.New(1, tr.Conn("A[1]"))
+		done <- err
+	}()
+	_, err = coordinator.New(tr.Conn("Coordinator"))
+	if _, ok := err.(*transport.HandshakeError); !ok {
+		t.Errorf("expected handshake error for parameter k but got %v", err)
+	}
+	if err, ok := (<-done).(*transport.HandshakeError); !ok || err.Error() != "transport: handshake with Coordinator: parameter k is 1 at Coordinator but 2 at A[1]" {
+		t.Errorf("expected A[1] to refuse the session but got %v", err)
+	}
+}
+
+// TestFaultyReorder reorders the first foo sent in the 2nd iteration of
+// the inner loop (loop ID 1) of the Coordinator, so A[2] receives it after
+// the next foo.
+func TestFaultyReorder(t *testing.T) {
+	const k = 3
+	coordinator.ProtoParam["k"] = k
+	a.ProtoParam["k"] = k
+	tr := transport.NewChan(0)
+
+	var wg sync.WaitGroup
+	foos := make([][]int, k+1)
+	for self := 1; self <= k; self++ {
+		wg.Add(1)
+		go func(self int) {
+			defer wg.Done()
+			s0, err := a.New(self, tr.Conn(transport.Name("A", self)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			s0.Foreach(func(s *a.S1) *a.S4 {
+				foo, s2 := s.Recv_Coordinator_foo()
+				foos[self] = append(foos[self], foo)
+				return s2.IfSelf(func(s *a.S3) *a.S4 {
+					_, end := s.Recv_Coordinator_bar()
+					return end
+				})
+			}).End()
+		}(self)
+	}
+
+	conn := transport.NewFaulty(tr.Conn("Coordinator"), 1, transport.Rule{Fault: transport.Reorder, Loop: 1, Iteration: 2, Nth: 1})
+	s0, err := coordinator.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	s0.Foreach(func(s *coordinator.S1) *coordinator.S4 {
+		i++
+		j := 0
+		return s.Foreach(func(s *coordinator.S2) *coordinator.S5 {
+			j++
+			return s.Send_Aj_foo(10*i + j)
+		}).Send_Ai_bar("bar")
+	}).End()
+	wg.Wait()
+
+	for self, expected := range [][]int{1: {11, 21, 31}, 2: {22, 12, 32}, 3: {13, 23, 33}} {
+		if self > 0 && fmt.Sprint(foos[self]) != fmt.Sprint(expected) {
+			t.Errorf("A[%d] expected foo %v but got %v", self, expected, foos[self])
+		}
+	}
+	if injected := conn.Injected(); len(injected) != 1 || injected[0] != "reorder foo to A[2]" {
+		t.Errorf("expected foo to A[2] reordered but got %v", injected)
+	}
+}
+
+// TestMisuse checks the errors the generated API panics with when a peer
+// does not follow the protocol or the connection is closed, with k = 1 and
+// scripted peers.
+func TestMisuse(t *testing.T) {
+	a.ProtoParam["k"] = 1
+	coordinator.ProtoParam["k"] = 1
+	params := map[string]int{"k": 1}
+	outer := func(s *coordinator.S1) *coordinator.S4 {
+		return s.Foreach(func(s *coordinator.S2) *coordinator.S5 {
+			return s.Send_Aj_foo(1)
+		}).Send_Ai_bar("bar")
+	}
+	for _, tc := range []struct {
+		name string
+		run  func(conn *mockpeer.Conn)
+		err  error
+	}{
+		{"UnexpectedLabel", func(conn *mockpeer.Conn) {
+			conn.Named("Coordinator").Handshake("Nested", a.Fingerprint, params).Send("bar", "bar")
+			s0, err := a.New(1, conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s0.Foreach(func(s *a.S1) *a.S4 {
+				_, s2 := s.Recv_Coordinator_foo()
+				return s2.IfSelf(func(s *a.S3) *a.S4 {
+					_, end := s.Recv_Coordinator_bar()
+					return end
+				})
+			}).End()
+		}, a.ErrUnexpectedLabel},
+		{"SendClosed", func(conn *mockpeer.Conn) {
+			conn.Peer("A", 1).Handshake("Nested", coordinator.Fingerprint, params)
+			s0, err := coordinator.New(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			conn.Close()
+			s0.Foreach(outer).End()
+		}, transport.ErrClosed},
+		{"CloseClosed", func(conn *mockpeer.Conn) {
+			conn.Peer("A", 1).Handshake("Nested", coordinator.Fingerprint, params)
+			s0, err := coordinator.New(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			end := s0.Foreach(outer)
+			conn.Close()
+			end.End()
+		}, transport.ErrClosed},
+	} {
+		conn := mockpeer.New(t)
+		if err := panictest.Recover(t, func() { tc.run(conn) }); !errors.Is(err, tc.err) {
+			t.Errorf("%s: expected %v but got %v", tc.name, tc.err, err)
+		}
+	}
+}
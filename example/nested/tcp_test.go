@@ -0,0 +1,147 @@
+package nested_test
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/example/nested/a"
+	"github.com/nickng/scribble-foreach-experiment/example/nested/coordinator"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// participantEnv is set to the index of a participant A[self] when the test
+// binary is spawned as that participant by TestTCP.
+const participantEnv = "NESTED_PARTICIPANT"
+
+func TestMain(m *testing.M) {
+	if self := os.Getenv(participantEnv); self != "" {
+		if err := participantProcess(self); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// participantProcess runs A[self] over TCP: it prints its address, reads
+// the addresses of its peers as name=addr fields, then prints the payloads
+// it receives.
+func participantProcess(self string) error {
+	index, err := strconv.Atoi(self)
+	if err != nil {
+		return err
+	}
+	if a.ProtoParam["k"], err = strconv.Atoi(os.Getenv("NESTED_K")); err != nil {
+		return err
+	}
+	conn, err := transport.ListenTCP(transport.Name("A", index), "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	fmt.Println(conn.Addr())
+	peers, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+	for _, peer := range strings.Fields(peers) {
+		kv := strings.SplitN(peer, "=", 2)
+		conn.AddPeer(kv[0], kv[1])
+	}
+	s0, err := a.New(index, conn)
+	if err != nil {
+		return err
+	}
+	s0.Foreach(func(s *a.S1) *a.S4 {
+		foo, s2 := s.Recv_Coordinator_foo()
+		fmt.Println("foo", foo)
+		return s2.IfSelf(func(s *a.S3) *a.S4 {
+			bar, end := s.Recv_Coordinator_bar()
+			fmt.Println("bar", bar)
+			return end
+		})
+	}).End()
+	return nil
+}
+
+// TestTCP spawns the participants A[1..k] as processes connected to the
+// Coordinator over TCP on loopback ports.
+func TestTCP(t *testing.T) {
+	if testing.Short() {
+		t.Skip("spawns processes")
+	}
+	const k = 3
+	coordinator.ProtoParam["k"] = k
+	conn, err := transport.ListenTCP("Coordinator", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type process struct {
+		cmd    *exec.Cmd
+		stdout *bufio.Scanner
+	}
+	procs := make([]process, k+1)
+	for self := 1; self <= k; self++ {
+		cmd := exec.Command(os.Args[0], "-test.run=^$")
+		cmd.Env = append(os.Environ(), fmt.Sprintf("%s=%d", participantEnv, self), fmt.Sprintf("NESTED_K=%d", k))
+		cmd.Stderr = os.Stderr
+		stdin, err := cmd.StdinPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		stdout, err := cmd.StdoutPipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cmd.Start(); err != nil {
+			t.Fatal(err)
+		}
+		defer cmd.Process.Kill()
+		procs[self] = process{cmd: cmd, stdout: bufio.NewScanner(stdout)}
+		if !procs[self].stdout.Scan() {
+			t.Fatalf("A[%d] did not print its address", self)
+		}
+		conn.AddPeer(transport.Name("A", self), procs[self].stdout.Text())
+		fmt.Fprintf(stdin, "Coordinator=%s\n", conn.Addr())
+	}
+
+	s0, err := coordinator.New(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	i := 0
+	s0.Foreach(func(s *coordinator.S1) *coordinator.S4 {
+		i++
+		j := 0
+		return s.Foreach(func(s *coordinator.S2) *coordinator.S5 {
+			j++
+			return s.Send_Aj_foo(j)
+		}).Send_Ai_bar(fmt.Sprintf("to-A[%d]", i))
+	}).End()
+
+	for self := 1; self <= k; self++ {
+		var lines []string
+		for procs[self].stdout.Scan() {
+			lines = append(lines, procs[self].stdout.Text())
+		}
+		if err := procs[self].cmd.Wait(); err != nil {
+			t.Fatalf("A[%d]: %v", self, err)
+		}
+		var expected []string
+		for i := 1; i <= k; i++ {
+			expected = append(expected, fmt.Sprintf("foo %d", self))
+			if i == self {
+				expected = append(expected, fmt.Sprintf("bar to-A[%d]", self))
+			}
+		}
+		if strings.Join(lines, "\n") != strings.Join(expected, "\n") {
+			t.Errorf("A[%d] expected to receive:\n%s\nbut got:\n%s", self, strings.Join(expected, "\n"), strings.Join(lines, "\n"))
+		}
+	}
+}
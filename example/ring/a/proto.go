@@ -0,0 +1,455 @@
+// Code generated by scribblegen. DO NOT EDIT.
+
+// Package a is the API of role A in protocol Ring.
+//
+// Local protocol:
+//
+//	local protocol Ring at A[self:1..k] {
+//	  if self == 1 {
+//	    start() from Coordinator;
+//	  }
+//	  foreach A[i:1..k] {
+//	    if self == i {
+//	      token(int) to A[(i mod k)+1];
+//	    }
+//	    if self == (i mod k)+1 {
+//	      token(int) from A[i];
+//	    }
+//	  }
+//	  foreach A[i:1..k-1] {
+//	    if self == i {
+//	      value(int) to A[i+1];
+//	    }
+//	    if self == i+1 {
+//	      value(int) from A[i];
+//	    }
+//	  }
+//	  if self == k {
+//	    result(int) to Coordinator;
+//	  }
+//	}
+package a
+
+import (
+	"fmt"
+
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// ProtoParam is the lookup table for protocol parameters (k).
+// Parameters must be set before the session starts.
+var ProtoParam = make(map[string]int)
+
+// Trace records the transitions of the participants if not nil.
+var Trace *trace.Recorder
+
+// checkParams returns an error if a protocol parameter is not set, or if
+// a range of the protocol is empty.
+func checkParams() error {
+	for _, name := range []string{"k"} {
+		if _, ok := ProtoParam[name]; !ok {
+			return fmt.Errorf("Ring: protocol parameter %s is not set", name)
+		}
+	}
+	if lo, hi := 1, ProtoParam["k"]; lo > hi {
+		return fmt.Errorf("Ring: range 1..k is empty (%d..%d)", lo, hi)
+	}
+	if lo, hi := 1, (ProtoParam["k"] - 1); lo > hi {
+		return fmt.Errorf("Ring: range 1..k-1 is empty (%d..%d)", lo, hi)
+	}
+	for i, hi := 1, ProtoParam["k"]; i <= hi; i++ {
+		if from, to := i, (mod(i, ProtoParam["k"]) + 1); from == to {
+			return fmt.Errorf("Ring: A[i] sends to itself when i = %d (A[%d])", i, from)
+		}
+	}
+	return nil
+}
+
+// Fingerprint is the hash of protocol Ring, a session only starts if all
+// participants have the same fingerprint and protocol parameters.
+const Fingerprint = "87f0550744362b0e"
+
+// hello returns the announcement of participant name in the handshake.
+func hello(name string) transport.Hello {
+	return transport.Hello{Protocol: "Ring", Participant: name, Fingerprint: Fingerprint, Params: map[string]int{"k": ProtoParam["k"]}}
+}
+
+// peers returns the participants other than name in the handshake.
+func peers(name string) []string {
+	names := []string{"Coordinator"}
+	for i, hi := 1, ProtoParam["k"]; i <= hi; i++ {
+		if peer := transport.Name("A", i); peer != name {
+			names = append(names, peer)
+		}
+	}
+	return names
+}
+
+// endpoint is a participant of the session.
+// The foreach stack is kept per participant so that the participants of
+// an indexed role can run side by side.
+type endpoint struct {
+	self    int                          // self is the index of this participant
+	name    string                       // name is the name of this participant in the transport
+	conn    transport.Conn               // conn is the connection to the other participants
+	pending map[string]transport.Message // pending are the messages received by Branch
+	sstack  *fsmStack                    // sstack is the foreach stack of this participant
+}
+
+// send sends a message to the participant to from state, it panics with
+// the error of the connection if the message cannot be sent.
+func (ep *endpoint) send(state int, to, label string, payload ...interface{}) {
+	if err := ep.conn.Send(to, transport.Message{Label: label, Payload: payload}); err != nil {
+		panic(fmt.Errorf("%s: cannot send %s to %s: %w", ep.name, label, to, err))
+	}
+	Trace.Record(trace.Event{Kind: trace.Send, State: state, From: ep.name, To: to, Label: label, Payload: formatPayload(payload)})
+}
+
+// peek returns the next message from the participant from without
+// consuming it, it panics with the error of the connection if no message
+// can be received.
+func (ep *endpoint) peek(from string) transport.Message {
+	if m, ok := ep.pending[from]; ok {
+		return m
+	}
+	m, err := ep.conn.Recv(from)
+	if err != nil {
+		panic(fmt.Errorf("%s: cannot receive from %s: %w", ep.name, from, err))
+	}
+	ep.pending[from] = m
+	return m
+}
+
+// iterate tells the connection that the participant starts the iteration
+// (from 1) of the foreach loop ID, or exits the loop if iteration is 0.
+func (ep *endpoint) iterate(loop, iteration int) {
+	if o, ok := ep.conn.(transport.LoopObserver); ok {
+		o.Iterate(loop, iteration)
+	}
+}
+
+// recv receives the next message from the participant from in state,
+// which must have the given label, or it panics with ErrUnexpectedLabel.
+func (ep *endpoint) recv(state int, from, label string) []interface{} {
+	m := ep.peek(from)
+	delete(ep.pending, from)
+	if m.Label != label {
+		panic(fmt.Errorf("%s: %w from %s: expected %s but got %s", ep.name, ErrUnexpectedLabel, from, label, m.Label))
+	}
+	Trace.Record(trace.Event{Kind: trace.Recv, State: state, From: from, To: ep.name, Label: label, Payload: formatPayload(m.Payload)})
+	return m.Payload
+}
+
+// formatPayload returns the payload of a message in a trace, e.g. 1, x.
+func formatPayload(payload []interface{}) string {
+	var b []byte
+	for i, v := range payload {
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+		b = fmt.Append(b, v)
+	}
+	return string(b)
+}
+
+// New returns the initial state of participant A[self], 1 <= self <= k,
+// conn is the connection of A[self] to the other participants.
+// It returns an error if the protocol parameters are not set correctly, or
+// if the other participants run a different protocol (see Fingerprint).
+func New(self int, conn transport.Conn) (*S0, error) {
+	if err := checkParams(); err != nil {
+		return nil, err
+	}
+	if lo, hi := 1, ProtoParam["k"]; self < lo || self > hi {
+		return nil, fmt.Errorf("Ring: participant A[%d] is not in range 1..k (%d..%d)", self, lo, hi)
+	}
+	name := transport.Name("A", self)
+	if conn == nil {
+		return nil, fmt.Errorf("Ring: %s has no connection", name)
+	}
+	if err := transport.Handshake(conn, hello(name), peers(name)); err != nil {
+		return nil, err
+	}
+	ep := &endpoint{self: self, name: name, conn: conn, pending: make(map[string]transport.Message), sstack: newStack()}
+	return &S0{ep: ep}, nil
+}
+
+// S0 is a guard on the index of this participant.
+type S0 struct {
+	resource
+	ep *endpoint
+}
+
+// IfSelf runs thenFn if this participant is A[1], otherwise it skips to S2.
+func (s *S0) IfSelf(thenFn func(*S1) *S2) *S2 {
+	s.Use()
+	if s.ep.self == 1 {
+		return thenFn(&S1{ep: s.ep})
+	}
+	return &S2{ep: s.ep}
+}
+
+// S1 is the state before start() from Coordinator.
+type S1 struct {
+	resource
+	ep *endpoint
+}
+
+// Recv_Coordinator_start receives start from Coordinator, then moves to S2.
+func (s *S1) Recv_Coordinator_start() *S2 {
+	s.Use()
+	s.ep.recv(1, "Coordinator", "start")
+	return &S2{ep: s.ep}
+}
+
+// S2 is the init state of foreach A[i:1..k] (loop ID 2).
+type S2 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S2) ID() int { return 2 }
+
+// Foreach runs bodyFn for each i in 1..k, then moves to S7.
+func (s *S2) Foreach(bodyFn func(*S3) *S14) *S7 {
+	s.Use()
+	sstack := s.ep.sstack
+	if sstack.isEmpty() || sstack.top().ID != 2 {
+		// first time enter loop
+		sstack.push(2, 1, ProtoParam["k"])
+	} else if sstack.top().ID == 2 {
+		// re-enter loop
+		sstack.top().increment()
+	} else {
+		panic("shouldn't get here")
+	}
+
+	for n := 1; sstack.top().canEnter(); n++ {
+		s.ep.iterate(2, n)
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: 2, Loop: 2, Index: "i", Value: sstack.top().curr})
+		bodyFn(&S3{ep: s.ep}).end()
+	}
+	s.ep.iterate(2, 0)
+	Trace.Record(trace.Event{Kind: trace.Exit, State: 2, Loop: 2})
+	sstack.pop()
+	return &S7{ep: s.ep}
+}
+
+// S3 is a guard on the index of this participant.
+type S3 struct {
+	resource
+	ep *endpoint
+}
+
+// IfSelf runs thenFn if this participant is A[i], otherwise it skips to S5.
+func (s *S3) IfSelf(thenFn func(*S4) *S5) *S5 {
+	s.Use()
+	if s.ep.self == s.ep.sstack.find(2).curr {
+		return thenFn(&S4{ep: s.ep})
+	}
+	return &S5{ep: s.ep}
+}
+
+// S4 is the state before token(int) to A[(i mod k)+1].
+type S4 struct {
+	resource
+	ep *endpoint
+}
+
+// Send_AiModkPlus1_token sends token to A[(i mod k)+1], then moves to S5.
+func (s *S4) Send_AiModkPlus1_token(v int) *S5 {
+	s.Use()
+	s.ep.send(4, transport.Name("A", (mod(s.ep.sstack.find(2).curr, ProtoParam["k"])+1)), "token", v)
+	return &S5{ep: s.ep}
+}
+
+// S5 is a guard on the index of this participant.
+type S5 struct {
+	resource
+	ep *endpoint
+}
+
+// IfSelf runs thenFn if this participant is A[(i mod k)+1], otherwise it skips to S14.
+func (s *S5) IfSelf(thenFn func(*S6) *S14) *S14 {
+	s.Use()
+	if s.ep.self == (mod(s.ep.sstack.find(2).curr, ProtoParam["k"]) + 1) {
+		return thenFn(&S6{ep: s.ep})
+	}
+	return &S14{ep: s.ep}
+}
+
+// S6 is the state before token(int) from A[i].
+type S6 struct {
+	resource
+	ep *endpoint
+}
+
+// Recv_Ai_token receives token from A[i], then moves to S14.
+func (s *S6) Recv_Ai_token() (int, *S14) {
+	s.Use()
+	payload := s.ep.recv(6, transport.Name("A", s.ep.sstack.find(2).curr), "token")
+	return payload[0].(int), &S14{ep: s.ep}
+}
+
+// S7 is the init state of foreach A[i:1..k-1] (loop ID 7).
+type S7 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S7) ID() int { return 7 }
+
+// Foreach runs bodyFn for each i in 1..k-1, then moves to S12.
+func (s *S7) Foreach(bodyFn func(*S8) *S15) *S12 {
+	s.Use()
+	sstack := s.ep.sstack
+	if sstack.isEmpty() || sstack.top().ID != 7 {
+		// first time enter loop
+		sstack.push(7, 1, (ProtoParam["k"] - 1))
+	} else if sstack.top().ID == 7 {
+		// re-enter loop
+		sstack.top().increment()
+	} else {
+		panic("shouldn't get here")
+	}
+
+	for n := 1; sstack.top().canEnter(); n++ {
+		s.ep.iterate(7, n)
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: 7, Loop: 7, Index: "i", Value: sstack.top().curr})
+		bodyFn(&S8{ep: s.ep}).end()
+	}
+	s.ep.iterate(7, 0)
+	Trace.Record(trace.Event{Kind: trace.Exit, State: 7, Loop: 7})
+	sstack.pop()
+	return &S12{ep: s.ep}
+}
+
+// S8 is a guard on the index of this participant.
+type S8 struct {
+	resource
+	ep *endpoint
+}
+
+// IfSelf runs thenFn if this participant is A[i], otherwise it skips to S10.
+func (s *S8) IfSelf(thenFn func(*S9) *S10) *S10 {
+	s.Use()
+	if s.ep.self == s.ep.sstack.find(7).curr {
+		return thenFn(&S9{ep: s.ep})
+	}
+	return &S10{ep: s.ep}
+}
+
+// S9 is the state before value(int) to A[i+1].
+type S9 struct {
+	resource
+	ep *endpoint
+}
+
+// Send_AiPlus1_value sends value to A[i+1], then moves to S10.
+func (s *S9) Send_AiPlus1_value(v int) *S10 {
+	s.Use()
+	s.ep.send(9, transport.Name("A", (s.ep.sstack.find(7).curr+1)), "value", v)
+	return &S10{ep: s.ep}
+}
+
+// S10 is a guard on the index of this participant.
+type S10 struct {
+	resource
+	ep *endpoint
+}
+
+// IfSelf runs thenFn if this participant is A[i+1], otherwise it skips to S15.
+func (s *S10) IfSelf(thenFn func(*S11) *S15) *S15 {
+	s.Use()
+	if s.ep.self == (s.ep.sstack.find(7).curr + 1) {
+		return thenFn(&S11{ep: s.ep})
+	}
+	return &S15{ep: s.ep}
+}
+
+// S11 is the state before value(int) from A[i].
+type S11 struct {
+	resource
+	ep *endpoint
+}
+
+// Recv_Ai_value receives value from A[i], then moves to S15.
+func (s *S11) Recv_Ai_value() (int, *S15) {
+	s.Use()
+	payload := s.ep.recv(11, transport.Name("A", s.ep.sstack.find(7).curr), "value")
+	return payload[0].(int), &S15{ep: s.ep}
+}
+
+// S12 is a guard on the index of this participant.
+type S12 struct {
+	resource
+	ep *endpoint
+}
+
+// IfSelf runs thenFn if this participant is A[k], otherwise it skips to SEnd.
+func (s *S12) IfSelf(thenFn func(*S13) *SEnd) *SEnd {
+	s.Use()
+	if s.ep.self == ProtoParam["k"] {
+		return thenFn(&S13{ep: s.ep})
+	}
+	return &SEnd{ep: s.ep}
+}
+
+// S13 is the state before result(int) to Coordinator.
+type S13 struct {
+	resource
+	ep *endpoint
+}
+
+// Send_Coordinator_result sends result to Coordinator, then moves to SEnd.
+func (s *S13) Send_Coordinator_result(v int) *SEnd {
+	s.Use()
+	s.ep.send(13, "Coordinator", "result", v)
+	return &SEnd{ep: s.ep}
+}
+
+// S14 is the ending state of foreach loop ID 2.
+type S14 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S14) end() {
+	s.Use()
+	s.ep.sstack.top().increment()
+}
+
+// S15 is the ending state of foreach loop ID 7.
+type S15 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S15) end() {
+	s.Use()
+	s.ep.sstack.top().increment()
+}
+
+// SEnd is the usual final state of a protocol.
+type SEnd struct {
+	resource
+	ep *endpoint
+}
+
+// End closes the connection to the other participants.
+func (s *SEnd) End() {
+	s.Use()
+	if err := s.ep.conn.Close(); err != nil {
+		panic(fmt.Errorf("%s: cannot close connection: %w", s.ep.name, err))
+	}
+	Trace.Record(trace.Event{Kind: trace.End})
+}
+
+// mod returns x mod y, which is always in 0..y-1 as in the protocol.
+func mod(x, y int) int {
+	if m := x % y; m < 0 {
+		return m + y
+	}
+	return x % y
+}
@@ -0,0 +1,201 @@
+// Code generated by scribblegen. DO NOT EDIT.
+
+// Package coordinator is the API of role Coordinator in protocol Ring.
+//
+// Local protocol:
+//
+//	local protocol Ring at Coordinator {
+//	  start() to A[1];
+//	  result(int) from A[k];
+//	}
+package coordinator
+
+import (
+	"fmt"
+
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// ProtoParam is the lookup table for protocol parameters (k).
+// Parameters must be set before the session starts.
+var ProtoParam = make(map[string]int)
+
+// Trace records the transitions of the participants if not nil.
+var Trace *trace.Recorder
+
+// checkParams returns an error if a protocol parameter is not set, or if
+// a range of the protocol is empty.
+func checkParams() error {
+	for _, name := range []string{"k"} {
+		if _, ok := ProtoParam[name]; !ok {
+			return fmt.Errorf("Ring: protocol parameter %s is not set", name)
+		}
+	}
+	if lo, hi := 1, ProtoParam["k"]; lo > hi {
+		return fmt.Errorf("Ring: range 1..k is empty (%d..%d)", lo, hi)
+	}
+	if lo, hi := 1, (ProtoParam["k"] - 1); lo > hi {
+		return fmt.Errorf("Ring: range 1..k-1 is empty (%d..%d)", lo, hi)
+	}
+	for i, hi := 1, ProtoParam["k"]; i <= hi; i++ {
+		if from, to := i, (mod(i, ProtoParam["k"]) + 1); from == to {
+			return fmt.Errorf("Ring: A[i] sends to itself when i = %d (A[%d])", i, from)
+		}
+	}
+	return nil
+}
+
+// Fingerprint is the hash of protocol Ring, a session only starts if all
+// participants have the same fingerprint and protocol parameters.
+const Fingerprint = "87f0550744362b0e"
+
+// hello returns the announcement of participant name in the handshake.
+func hello(name string) transport.Hello {
+	return transport.Hello{Protocol: "Ring", Participant: name, Fingerprint: Fingerprint, Params: map[string]int{"k": ProtoParam["k"]}}
+}
+
+// peers returns the participants other than name in the handshake.
+func peers(name string) []string {
+	var names []string
+	for i, hi := 1, ProtoParam["k"]; i <= hi; i++ {
+		if peer := transport.Name("A", i); peer != name {
+			names = append(names, peer)
+		}
+	}
+	return names
+}
+
+// endpoint is a participant of the session.
+// The foreach stack is kept per participant so that the participants of
+// an indexed role can run side by side.
+type endpoint struct {
+	name    string                       // name is the name of this participant in the transport
+	conn    transport.Conn               // conn is the connection to the other participants
+	pending map[string]transport.Message // pending are the messages received by Branch
+	sstack  *fsmStack                    // sstack is the foreach stack of this participant
+}
+
+// send sends a message to the participant to from state, it panics with
+// the error of the connection if the message cannot be sent.
+func (ep *endpoint) send(state int, to, label string, payload ...interface{}) {
+	if err := ep.conn.Send(to, transport.Message{Label: label, Payload: payload}); err != nil {
+		panic(fmt.Errorf("%s: cannot send %s to %s: %w", ep.name, label, to, err))
+	}
+	Trace.Record(trace.Event{Kind: trace.Send, State: state, From: ep.name, To: to, Label: label, Payload: formatPayload(payload)})
+}
+
+// peek returns the next message from the participant from without
+// consuming it, it panics with the error of the connection if no message
+// can be received.
+func (ep *endpoint) peek(from string) transport.Message {
+	if m, ok := ep.pending[from]; ok {
+		return m
+	}
+	m, err := ep.conn.Recv(from)
+	if err != nil {
+		panic(fmt.Errorf("%s: cannot receive from %s: %w", ep.name, from, err))
+	}
+	ep.pending[from] = m
+	return m
+}
+
+// iterate tells the connection that the participant starts the iteration
+// (from 1) of the foreach loop ID, or exits the loop if iteration is 0.
+func (ep *endpoint) iterate(loop, iteration int) {
+	if o, ok := ep.conn.(transport.LoopObserver); ok {
+		o.Iterate(loop, iteration)
+	}
+}
+
+// recv receives the next message from the participant from in state,
+// which must have the given label, or it panics with ErrUnexpectedLabel.
+func (ep *endpoint) recv(state int, from, label string) []interface{} {
+	m := ep.peek(from)
+	delete(ep.pending, from)
+	if m.Label != label {
+		panic(fmt.Errorf("%s: %w from %s: expected %s but got %s", ep.name, ErrUnexpectedLabel, from, label, m.Label))
+	}
+	Trace.Record(trace.Event{Kind: trace.Recv, State: state, From: from, To: ep.name, Label: label, Payload: formatPayload(m.Payload)})
+	return m.Payload
+}
+
+// formatPayload returns the payload of a message in a trace, e.g. 1, x.
+func formatPayload(payload []interface{}) string {
+	var b []byte
+	for i, v := range payload {
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+		b = fmt.Append(b, v)
+	}
+	return string(b)
+}
+
+// New returns the initial state of Coordinator,
+// conn is the connection of Coordinator to the other participants.
+// It returns an error if the protocol parameters are not set correctly, or
+// if the other participants run a different protocol (see Fingerprint).
+func New(conn transport.Conn) (*S0, error) {
+	if err := checkParams(); err != nil {
+		return nil, err
+	}
+	name := "Coordinator"
+	if conn == nil {
+		return nil, fmt.Errorf("Ring: %s has no connection", name)
+	}
+	if err := transport.Handshake(conn, hello(name), peers(name)); err != nil {
+		return nil, err
+	}
+	ep := &endpoint{name: name, conn: conn, pending: make(map[string]transport.Message), sstack: newStack()}
+	return &S0{ep: ep}, nil
+}
+
+// S0 is the state before start() to A[1].
+type S0 struct {
+	resource
+	ep *endpoint
+}
+
+// Send_A1_start sends start to A[1], then moves to S1.
+func (s *S0) Send_A1_start() *S1 {
+	s.Use()
+	s.ep.send(0, transport.Name("A", 1), "start")
+	return &S1{ep: s.ep}
+}
+
+// S1 is the state before result(int) from A[k].
+type S1 struct {
+	resource
+	ep *endpoint
+}
+
+// Recv_Ak_result receives result from A[k], then moves to SEnd.
+func (s *S1) Recv_Ak_result() (int, *SEnd) {
+	s.Use()
+	payload := s.ep.recv(1, transport.Name("A", ProtoParam["k"]), "result")
+	return payload[0].(int), &SEnd{ep: s.ep}
+}
+
+// SEnd is the usual final state of a protocol.
+type SEnd struct {
+	resource
+	ep *endpoint
+}
+
+// End closes the connection to the other participants.
+func (s *SEnd) End() {
+	s.Use()
+	if err := s.ep.conn.Close(); err != nil {
+		panic(fmt.Errorf("%s: cannot close connection: %w", s.ep.name, err))
+	}
+	Trace.Record(trace.Event{Kind: trace.End})
+}
+
+// mod returns x mod y, which is always in 0..y-1 as in the protocol.
+func mod(x, y int) int {
+	if m := x % y; m < 0 {
+		return m + y
+	}
+	return x % y
+}
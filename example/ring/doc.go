@@ -0,0 +1,5 @@
+// Package ring contains the generated APIs of the example protocol in
+// ring.scr, a ring and a pipeline with index arithmetic on the role A.
+package ring
+
+//go:generate go run ../../cmd/scribblegen ring.scr
@@ -0,0 +1,82 @@
+package ring_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/example/ring/a"
+	"github.com/nickng/scribble-foreach-experiment/example/ring/coordinator"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// TestRing runs every participant A[self] and checks that each sends and
+// receives the token once from its predecessor in the ring, and that the
+// pipeline skips the ends: A[1] does not receive a value and A[k] does not
+// send one.
+func TestRing(t *testing.T) {
+	const k = 4
+	coordinator.ProtoParam["k"] = k
+	a.ProtoParam["k"] = k
+	tr := transport.NewChan(0)
+
+	var wg sync.WaitGroup
+	tokens := make([]int, k+1)
+	for self := 1; self <= k; self++ {
+		wg.Add(1)
+		go func(self int) {
+			defer wg.Done()
+			s0, err := a.New(self, tr.Conn(transport.Name("A", self)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			value := 1
+			s0.IfSelf(func(s *a.S1) *a.S2 {
+				return s.Recv_Coordinator_start()
+			}).Foreach(func(s *a.S3) *a.S14 {
+				return s.IfSelf(func(s *a.S4) *a.S5 {
+					return s.Send_AiModkPlus1_token(self)
+				}).IfSelf(func(s *a.S6) *a.S14 {
+					token, end := s.Recv_Ai_token()
+					tokens[self] = token
+					return end
+				})
+			}).Foreach(func(s *a.S8) *a.S15 {
+				return s.IfSelf(func(s *a.S9) *a.S10 {
+					return s.Send_AiPlus1_value(value)
+				}).IfSelf(func(s *a.S11) *a.S15 {
+					v, end := s.Recv_Ai_value()
+					value = v + 1
+					return end
+				})
+			}).IfSelf(func(s *a.S13) *a.SEnd {
+				return s.Send_Coordinator_result(value)
+			}).End()
+		}(self)
+	}
+
+	s0, err := coordinator.New(tr.Conn("Coordinator"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, end := s0.Send_A1_start().Recv_Ak_result()
+	end.End()
+	wg.Wait()
+
+	if result != k {
+		t.Errorf("expected result %d through the pipeline but got %d", k, result)
+	}
+	for self := 1; self <= k; self++ {
+		if prev := (self+k-2)%k + 1; tokens[self] != prev {
+			t.Errorf("A[%d] expected token from A[%d] but got %d", self, prev, tokens[self])
+		}
+	}
+}
+
+// TestPipelineTooShort checks the assumption 1 <= k-1 of the pipeline.
+func TestPipelineTooShort(t *testing.T) {
+	a.ProtoParam["k"] = 1
+	if _, err := a.New(1, transport.NewChan(0).Conn("A[1]")); err == nil || err.Error() != "Ring: range 1..k-1 is empty (1..0)" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
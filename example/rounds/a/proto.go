@@ -0,0 +1,217 @@
+// Code generated by scribblegen. DO NOT EDIT.
+
+// Package a is the API of role A in protocol Rounds.
+//
+// Local protocol:
+//
+//	local protocol Rounds at A[self:1..k] {
+//	  rec Round {
+//	    work(int) from Coordinator;
+//	    result(int) to Coordinator;
+//	    choice at Coordinator {
+//	      more() from Coordinator;
+//	      continue Round;
+//	    } or {
+//	      stop() from Coordinator;
+//	    }
+//	  }
+//	}
+package a
+
+import (
+	"fmt"
+
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// ProtoParam is the lookup table for protocol parameters (k).
+// Parameters must be set before the session starts.
+var ProtoParam = make(map[string]int)
+
+// Trace records the transitions of the participants if not nil.
+var Trace *trace.Recorder
+
+// checkParams returns an error if a protocol parameter is not set, or if
+// a range of the protocol is empty.
+func checkParams() error {
+	for _, name := range []string{"k"} {
+		if _, ok := ProtoParam[name]; !ok {
+			return fmt.Errorf("Rounds: protocol parameter %s is not set", name)
+		}
+	}
+	if lo, hi := 1, ProtoParam["k"]; lo > hi {
+		return fmt.Errorf("Rounds: range 1..k is empty (%d..%d)", lo, hi)
+	}
+	return nil
+}
+
+// Fingerprint is the hash of protocol Rounds, a session only starts if all
+// participants have the same fingerprint and protocol parameters.
+const Fingerprint = "e028860fbbdb612d"
+
+// hello returns the announcement of participant name in the handshake.
+func hello(name string) transport.Hello {
+	return transport.Hello{Protocol: "Rounds", Participant: name, Fingerprint: Fingerprint, Params: map[string]int{"k": ProtoParam["k"]}}
+}
+
+// peers returns the participants other than name in the handshake.
+func peers(name string) []string {
+	return []string{"Coordinator"}
+}
+
+// endpoint is a participant of the session.
+// The foreach stack is kept per participant so that the participants of
+// an indexed role can run side by side.
+type endpoint struct {
+	self    int                          // self is the index of this participant
+	name    string                       // name is the name of this participant in the transport
+	conn    transport.Conn               // conn is the connection to the other participants
+	pending map[string]transport.Message // pending are the messages received by Branch
+	sstack  *fsmStack                    // sstack is the foreach stack of this participant
+}
+
+// send sends a message to the participant to from state, it panics with
+// the error of the connection if the message cannot be sent.
+func (ep *endpoint) send(state int, to, label string, payload ...interface{}) {
+	if err := ep.conn.Send(to, transport.Message{Label: label, Payload: payload}); err != nil {
+		panic(fmt.Errorf("%s: cannot send %s to %s: %w", ep.name, label, to, err))
+	}
+	Trace.Record(trace.Event{Kind: trace.Send, State: state, From: ep.name, To: to, Label: label, Payload: formatPayload(payload)})
+}
+
+// peek returns the next message from the participant from without
+// consuming it, it panics with the error of the connection if no message
+// can be received.
+func (ep *endpoint) peek(from string) transport.Message {
+	if m, ok := ep.pending[from]; ok {
+		return m
+	}
+	m, err := ep.conn.Recv(from)
+	if err != nil {
+		panic(fmt.Errorf("%s: cannot receive from %s: %w", ep.name, from, err))
+	}
+	ep.pending[from] = m
+	return m
+}
+
+// iterate tells the connection that the participant starts the iteration
+// (from 1) of the foreach loop ID, or exits the loop if iteration is 0.
+func (ep *endpoint) iterate(loop, iteration int) {
+	if o, ok := ep.conn.(transport.LoopObserver); ok {
+		o.Iterate(loop, iteration)
+	}
+}
+
+// recv receives the next message from the participant from in state,
+// which must have the given label, or it panics with ErrUnexpectedLabel.
+func (ep *endpoint) recv(state int, from, label string) []interface{} {
+	m := ep.peek(from)
+	delete(ep.pending, from)
+	if m.Label != label {
+		panic(fmt.Errorf("%s: %w from %s: expected %s but got %s", ep.name, ErrUnexpectedLabel, from, label, m.Label))
+	}
+	Trace.Record(trace.Event{Kind: trace.Recv, State: state, From: from, To: ep.name, Label: label, Payload: formatPayload(m.Payload)})
+	return m.Payload
+}
+
+// formatPayload returns the payload of a message in a trace, e.g. 1, x.
+func formatPayload(payload []interface{}) string {
+	var b []byte
+	for i, v := range payload {
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+		b = fmt.Append(b, v)
+	}
+	return string(b)
+}
+
+// New returns the initial state of participant A[self], 1 <= self <= k,
+// conn is the connection of A[self] to the other participants.
+// It returns an error if the protocol parameters are not set correctly, or
+// if the other participants run a different protocol (see Fingerprint).
+func New(self int, conn transport.Conn) (*S0, error) {
+	if err := checkParams(); err != nil {
+		return nil, err
+	}
+	if lo, hi := 1, ProtoParam["k"]; self < lo || self > hi {
+		return nil, fmt.Errorf("Rounds: participant A[%d] is not in range 1..k (%d..%d)", self, lo, hi)
+	}
+	name := transport.Name("A", self)
+	if conn == nil {
+		return nil, fmt.Errorf("Rounds: %s has no connection", name)
+	}
+	if err := transport.Handshake(conn, hello(name), peers(name)); err != nil {
+		return nil, err
+	}
+	ep := &endpoint{self: self, name: name, conn: conn, pending: make(map[string]transport.Message), sstack: newStack()}
+	return &S0{ep: ep}, nil
+}
+
+// S0 is the state before work(int) from Coordinator.
+type S0 struct {
+	resource
+	ep *endpoint
+}
+
+// Recv_Coordinator_work receives work from Coordinator, then moves to S1.
+func (s *S0) Recv_Coordinator_work() (int, *S1) {
+	s.Use()
+	payload := s.ep.recv(0, "Coordinator", "work")
+	return payload[0].(int), &S1{ep: s.ep}
+}
+
+// S1 is the state before result(int) to Coordinator.
+type S1 struct {
+	resource
+	ep *endpoint
+}
+
+// Send_Coordinator_result sends result to Coordinator, then moves to S2.
+func (s *S1) Send_Coordinator_result(v int) *S2 {
+	s.Use()
+	s.ep.send(1, "Coordinator", "result", v)
+	return &S2{ep: s.ep}
+}
+
+// S2 is a choice at Coordinator, each branch is a method of S2.
+type S2 struct {
+	resource
+	ep *endpoint
+}
+
+// Branch returns the label of the branch chosen by Coordinator (more or stop),
+// the message is received by the method of the branch.
+func (s *S2) Branch() string {
+	return s.ep.peek("Coordinator").Label
+}
+
+// Recv_Coordinator_more receives more from Coordinator, then moves to S0.
+func (s *S2) Recv_Coordinator_more() *S0 {
+	s.Use()
+	s.ep.recv(3, "Coordinator", "more")
+	return &S0{ep: s.ep}
+}
+
+// Recv_Coordinator_stop receives stop from Coordinator, then moves to SEnd.
+func (s *S2) Recv_Coordinator_stop() *SEnd {
+	s.Use()
+	s.ep.recv(4, "Coordinator", "stop")
+	return &SEnd{ep: s.ep}
+}
+
+// SEnd is the usual final state of a protocol.
+type SEnd struct {
+	resource
+	ep *endpoint
+}
+
+// End closes the connection to the other participants.
+func (s *SEnd) End() {
+	s.Use()
+	if err := s.ep.conn.Close(); err != nil {
+		panic(fmt.Errorf("%s: cannot close connection: %w", s.ep.name, err))
+	}
+	Trace.Record(trace.Event{Kind: trace.End})
+}
@@ -0,0 +1,347 @@
+// Code generated by scribblegen. DO NOT EDIT.
+
+// Package coordinator is the API of role Coordinator in protocol Rounds.
+//
+// Local protocol:
+//
+//	local protocol Rounds at Coordinator {
+//	  rec Round {
+//	    foreach A[i:1..k] {
+//	      work(int) to A[i];
+//	      result(int) from A[i];
+//	    }
+//	    choice at Coordinator {
+//	      foreach A[i:1..k] {
+//	        more() to A[i];
+//	      }
+//	      continue Round;
+//	    } or {
+//	      foreach A[i:1..k] {
+//	        stop() to A[i];
+//	      }
+//	    }
+//	  }
+//	}
+package coordinator
+
+import (
+	"fmt"
+
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// ProtoParam is the lookup table for protocol parameters (k).
+// Parameters must be set before the session starts.
+var ProtoParam = make(map[string]int)
+
+// Trace records the transitions of the participants if not nil.
+var Trace *trace.Recorder
+
+// checkParams returns an error if a protocol parameter is not set, or if
+// a range of the protocol is empty.
+func checkParams() error {
+	for _, name := range []string{"k"} {
+		if _, ok := ProtoParam[name]; !ok {
+			return fmt.Errorf("Rounds: protocol parameter %s is not set", name)
+		}
+	}
+	if lo, hi := 1, ProtoParam["k"]; lo > hi {
+		return fmt.Errorf("Rounds: range 1..k is empty (%d..%d)", lo, hi)
+	}
+	return nil
+}
+
+// Fingerprint is the hash of protocol Rounds, a session only starts if all
+// participants have the same fingerprint and protocol parameters.
+const Fingerprint = "e028860fbbdb612d"
+
+// hello returns the announcement of participant name in the handshake.
+func hello(name string) transport.Hello {
+	return transport.Hello{Protocol: "Rounds", Participant: name, Fingerprint: Fingerprint, Params: map[string]int{"k": ProtoParam["k"]}}
+}
+
+// peers returns the participants other than name in the handshake.
+func peers(name string) []string {
+	var names []string
+	for i, hi := 1, ProtoParam["k"]; i <= hi; i++ {
+		if peer := transport.Name("A", i); peer != name {
+			names = append(names, peer)
+		}
+	}
+	return names
+}
+
+// endpoint is a participant of the session.
+// The foreach stack is kept per participant so that the participants of
+// an indexed role can run side by side.
+type endpoint struct {
+	name    string                       // name is the name of this participant in the transport
+	conn    transport.Conn               // conn is the connection to the other participants
+	pending map[string]transport.Message // pending are the messages received by Branch
+	sstack  *fsmStack                    // sstack is the foreach stack of this participant
+}
+
+// send sends a message to the participant to from state, it panics with
+// the error of the connection if the message cannot be sent.
+func (ep *endpoint) send(state int, to, label string, payload ...interface{}) {
+	if err := ep.conn.Send(to, transport.Message{Label: label, Payload: payload}); err != nil {
+		panic(fmt.Errorf("%s: cannot send %s to %s: %w", ep.name, label, to, err))
+	}
+	Trace.Record(trace.Event{Kind: trace.Send, State: state, From: ep.name, To: to, Label: label, Payload: formatPayload(payload)})
+}
+
+// peek returns the next message from the participant from without
+// consuming it, it panics with the error of the connection if no message
+// can be received.
+func (ep *endpoint) peek(from string) transport.Message {
+	if m, ok := ep.pending[from]; ok {
+		return m
+	}
+	m, err := ep.conn.Recv(from)
+	if err != nil {
+		panic(fmt.Errorf("%s: cannot receive from %s: %w", ep.name, from, err))
+	}
+	ep.pending[from] = m
+	return m
+}
+
+// iterate tells the connection that the participant starts the iteration
+// (from 1) of the foreach loop ID, or exits the loop if iteration is 0.
+func (ep *endpoint) iterate(loop, iteration int) {
+	if o, ok := ep.conn.(transport.LoopObserver); ok {
+		o.Iterate(loop, iteration)
+	}
+}
+
+// recv receives the next message from the participant from in state,
+// which must have the given label, or it panics with ErrUnexpectedLabel.
+func (ep *endpoint) recv(state int, from, label string) []interface{} {
+	m := ep.peek(from)
+	delete(ep.pending, from)
+	if m.Label != label {
+		panic(fmt.Errorf("%s: %w from %s: expected %s but got %s", ep.name, ErrUnexpectedLabel, from, label, m.Label))
+	}
+	Trace.Record(trace.Event{Kind: trace.Recv, State: state, From: from, To: ep.name, Label: label, Payload: formatPayload(m.Payload)})
+	return m.Payload
+}
+
+// formatPayload returns the payload of a message in a trace, e.g. 1, x.
+func formatPayload(payload []interface{}) string {
+	var b []byte
+	for i, v := range payload {
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+		b = fmt.Append(b, v)
+	}
+	return string(b)
+}
+
+// New returns the initial state of Coordinator,
+// conn is the connection of Coordinator to the other participants.
+// It returns an error if the protocol parameters are not set correctly, or
+// if the other participants run a different protocol (see Fingerprint).
+func New(conn transport.Conn) (*S0, error) {
+	if err := checkParams(); err != nil {
+		return nil, err
+	}
+	name := "Coordinator"
+	if conn == nil {
+		return nil, fmt.Errorf("Rounds: %s has no connection", name)
+	}
+	if err := transport.Handshake(conn, hello(name), peers(name)); err != nil {
+		return nil, err
+	}
+	ep := &endpoint{name: name, conn: conn, pending: make(map[string]transport.Message), sstack: newStack()}
+	return &S0{ep: ep}, nil
+}
+
+// S0 is the init state of foreach A[i:1..k] (loop ID 0).
+type S0 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S0) ID() int { return 0 }
+
+// Foreach runs bodyFn for each i in 1..k, then moves to S3.
+func (s *S0) Foreach(bodyFn func(*S1) *S8) *S3 {
+	s.Use()
+	sstack := s.ep.sstack
+	if sstack.isEmpty() || sstack.top().ID != 0 {
+		// first time enter loop
+		sstack.push(0, 1, ProtoParam["k"])
+	} else if sstack.top().ID == 0 {
+		// re-enter loop
+		sstack.top().increment()
+	} else {
+		panic("shouldn't get here")
+	}
+
+	for n := 1; sstack.top().canEnter(); n++ {
+		s.ep.iterate(0, n)
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: 0, Loop: 0, Index: "i", Value: sstack.top().curr})
+		bodyFn(&S1{ep: s.ep}).end()
+	}
+	s.ep.iterate(0, 0)
+	Trace.Record(trace.Event{Kind: trace.Exit, State: 0, Loop: 0})
+	sstack.pop()
+	return &S3{ep: s.ep}
+}
+
+// S1 is the state before work(int) to A[i].
+type S1 struct {
+	resource
+	ep *endpoint
+}
+
+// Send_Ai_work sends work to A[i], then moves to S2.
+func (s *S1) Send_Ai_work(v int) *S2 {
+	s.Use()
+	s.ep.send(1, transport.Name("A", s.ep.sstack.find(0).curr), "work", v)
+	return &S2{ep: s.ep}
+}
+
+// S2 is the state before result(int) from A[i].
+type S2 struct {
+	resource
+	ep *endpoint
+}
+
+// Recv_Ai_result receives result from A[i], then moves to S8.
+func (s *S2) Recv_Ai_result() (int, *S8) {
+	s.Use()
+	payload := s.ep.recv(2, transport.Name("A", s.ep.sstack.find(0).curr), "result")
+	return payload[0].(int), &S8{ep: s.ep}
+}
+
+// S3 is a choice at Coordinator, each branch is a method of S3.
+type S3 struct {
+	resource
+	ep *endpoint
+}
+
+// Foreach_more runs bodyFn for each i in 1..k, then moves to S0.
+func (s *S3) Foreach_more(bodyFn func(*S5) *S9) *S0 {
+	s.Use()
+	sstack := s.ep.sstack
+	if sstack.isEmpty() || sstack.top().ID != 4 {
+		// first time enter loop
+		sstack.push(4, 1, ProtoParam["k"])
+	} else if sstack.top().ID == 4 {
+		// re-enter loop
+		sstack.top().increment()
+	} else {
+		panic("shouldn't get here")
+	}
+
+	for n := 1; sstack.top().canEnter(); n++ {
+		s.ep.iterate(4, n)
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: 4, Loop: 4, Index: "i", Value: sstack.top().curr})
+		bodyFn(&S5{ep: s.ep}).end()
+	}
+	s.ep.iterate(4, 0)
+	Trace.Record(trace.Event{Kind: trace.Exit, State: 4, Loop: 4})
+	sstack.pop()
+	return &S0{ep: s.ep}
+}
+
+// Foreach_stop runs bodyFn for each i in 1..k, then moves to SEnd.
+func (s *S3) Foreach_stop(bodyFn func(*S7) *S10) *SEnd {
+	s.Use()
+	sstack := s.ep.sstack
+	if sstack.isEmpty() || sstack.top().ID != 6 {
+		// first time enter loop
+		sstack.push(6, 1, ProtoParam["k"])
+	} else if sstack.top().ID == 6 {
+		// re-enter loop
+		sstack.top().increment()
+	} else {
+		panic("shouldn't get here")
+	}
+
+	for n := 1; sstack.top().canEnter(); n++ {
+		s.ep.iterate(6, n)
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: 6, Loop: 6, Index: "i", Value: sstack.top().curr})
+		bodyFn(&S7{ep: s.ep}).end()
+	}
+	s.ep.iterate(6, 0)
+	Trace.Record(trace.Event{Kind: trace.Exit, State: 6, Loop: 6})
+	sstack.pop()
+	return &SEnd{ep: s.ep}
+}
+
+// S5 is the state before more() to A[i].
+type S5 struct {
+	resource
+	ep *endpoint
+}
+
+// Send_Ai_more sends more to A[i], then moves to S9.
+func (s *S5) Send_Ai_more() *S9 {
+	s.Use()
+	s.ep.send(5, transport.Name("A", s.ep.sstack.find(4).curr), "more")
+	return &S9{ep: s.ep}
+}
+
+// S7 is the state before stop() to A[i].
+type S7 struct {
+	resource
+	ep *endpoint
+}
+
+// Send_Ai_stop sends stop to A[i], then moves to S10.
+func (s *S7) Send_Ai_stop() *S10 {
+	s.Use()
+	s.ep.send(7, transport.Name("A", s.ep.sstack.find(6).curr), "stop")
+	return &S10{ep: s.ep}
+}
+
+// S8 is the ending state of foreach loop ID 0.
+type S8 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S8) end() {
+	s.Use()
+	s.ep.sstack.top().increment()
+}
+
+// S9 is the ending state of foreach loop ID 4.
+type S9 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S9) end() {
+	s.Use()
+	s.ep.sstack.top().increment()
+}
+
+// S10 is the ending state of foreach loop ID 6.
+type S10 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S10) end() {
+	s.Use()
+	s.ep.sstack.top().increment()
+}
+
+// SEnd is the usual final state of a protocol.
+type SEnd struct {
+	resource
+	ep *endpoint
+}
+
+// End closes the connection to the other participants.
+func (s *SEnd) End() {
+	s.Use()
+	if err := s.ep.conn.Close(); err != nil {
+		panic(fmt.Errorf("%s: cannot close connection: %w", s.ep.name, err))
+	}
+	Trace.Record(trace.Event{Kind: trace.End})
+}
@@ -0,0 +1,77 @@
+package coordinator
+
+import (
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// participant replies to every work from the Coordinator until stop,
+// without using the API of A.
+func participant(t *testing.T, self int, conn transport.Conn) {
+	hello := transport.Hello{
+		Protocol:    "Rounds",
+		Participant: transport.Name("A", self),
+		Fingerprint: Fingerprint,
+		Params:      map[string]int{"k": ProtoParam["k"]},
+	}
+	if err := transport.Handshake(conn, hello, []string{"Coordinator"}); err != nil {
+		t.Error(err)
+		return
+	}
+	for {
+		m, err := conn.Recv("Coordinator")
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		switch m.Label {
+		case "work":
+			conn.Send("Coordinator", transport.Message{Label: "result", Payload: m.Payload})
+		case "stop":
+			conn.Close()
+			return
+		}
+	}
+}
+
+// TestRoundsStack runs rounds of the foreach in a recursion, and checks that
+// the foreach stack is reset every round without leaking stack entries.
+func TestRoundsStack(t *testing.T) {
+	const k, rounds = 3, 5
+	ProtoParam["k"] = k
+	tr := transport.NewChan(0)
+	for i := 1; i <= k; i++ {
+		go participant(t, i, tr.Conn(transport.Name("A", i)))
+	}
+
+	s, err := New(tr.Conn("Coordinator"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sstack := s.ep.sstack
+	body := func(s *S1) *S8 {
+		if len(sstack.stack) != 1 || sstack.top().ID != 0 {
+			t.Fatalf("expected only loop 0 on the stack but got %v", sstack)
+		}
+		_, end := s.Send_Ai_work(sstack.top().curr).Recv_Ai_result()
+		return end
+	}
+	for round := 1; ; round++ {
+		choice := s.Foreach(body)
+		if !sstack.isEmpty() {
+			t.Fatalf("round %d: expected empty stack after foreach but got %v", round, sstack)
+		}
+		if round == rounds {
+			choice.Foreach_stop(func(s *S7) *S10 { return s.Send_Ai_stop() }).End()
+			break
+		}
+		s = choice.Foreach_more(func(s *S5) *S9 { return s.Send_Ai_more() })
+		if !sstack.isEmpty() {
+			t.Fatalf("round %d: expected empty stack after choice but got %v", round, sstack)
+		}
+	}
+	if !sstack.isEmpty() || cap(sstack.stack) > 1 {
+		t.Fatalf("expected empty stack without growing but got %v (cap %d)", sstack, cap(sstack.stack))
+	}
+}
@@ -0,0 +1,5 @@
+// Package rounds contains the generated APIs of the example protocol in
+// rounds.scr, a foreach repeated in every round of a recursion.
+package rounds
+
+//go:generate go run ../../cmd/scribblegen rounds.scr
@@ -0,0 +1,71 @@
+package rounds_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/example/rounds/a"
+	"github.com/nickng/scribble-foreach-experiment/example/rounds/coordinator"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// TestRounds runs the Coordinator and the participants for several rounds,
+// the participants follow the Coordinator until it stops.
+func TestRounds(t *testing.T) {
+	const k, rounds = 2, 4
+	coordinator.ProtoParam["k"] = k
+	a.ProtoParam["k"] = k
+	tr := transport.NewChan(0)
+
+	var wg sync.WaitGroup
+	works := make([]int, k+1)
+	for self := 1; self <= k; self++ {
+		wg.Add(1)
+		go func(self int) {
+			defer wg.Done()
+			s, err := a.New(self, tr.Conn(transport.Name("A", self)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			for {
+				work, s1 := s.Recv_Coordinator_work()
+				works[self]++
+				choice := s1.Send_Coordinator_result(work * self)
+				if choice.Branch() == "stop" {
+					choice.Recv_Coordinator_stop().End()
+					return
+				}
+				s = choice.Recv_Coordinator_more()
+			}
+		}(self)
+	}
+
+	s, err := coordinator.New(tr.Conn("Coordinator"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for round := 1; ; round++ {
+		sum := 0
+		choice := s.Foreach(func(s *coordinator.S1) *coordinator.S8 {
+			result, end := s.Send_Ai_work(round).Recv_Ai_result()
+			sum += result
+			return end
+		})
+		if expected := round * k * (k + 1) / 2; sum != expected {
+			t.Errorf("round %d: expected sum of results %d but got %d", round, expected, sum)
+		}
+		if round == rounds {
+			choice.Foreach_stop(func(s *coordinator.S7) *coordinator.S10 { return s.Send_Ai_stop() }).End()
+			break
+		}
+		s = choice.Foreach_more(func(s *coordinator.S5) *coordinator.S9 { return s.Send_Ai_more() })
+	}
+	wg.Wait()
+
+	for self := 1; self <= k; self++ {
+		if works[self] != rounds {
+			t.Errorf("A[%d] expected %d rounds of work but got %d", self, rounds, works[self])
+		}
+	}
+}
@@ -0,0 +1,5 @@
+// Package scatter contains the generated APIs of the example protocol in
+// scatter.scr, with workers and reducers ranging over separate parameters.
+package scatter
+
+//go:generate go run ../../cmd/scribblegen scatter.scr
@@ -0,0 +1,105 @@
+package scatter_test
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/example/scatter/master"
+	"github.com/nickng/scribble-foreach-experiment/example/scatter/r"
+	"github.com/nickng/scribble-foreach-experiment/example/scatter/w"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// TestParams runs every participant with n workers and m reducers, and
+// checks that each loop iterates over the range of its own parameter and
+// addresses the participant of its index.
+func TestParams(t *testing.T) {
+	const n, m = 2, 3
+	for _, params := range []map[string]int{master.ProtoParam, w.ProtoParam, r.ProtoParam} {
+		params["n"], params["m"] = n, m
+	}
+	tr := transport.NewChan(0)
+
+	var wg sync.WaitGroup
+	for self := 1; self <= n; self++ {
+		wg.Add(1)
+		go func(self int) {
+			defer wg.Done()
+			s0, err := w.New(self, tr.Conn(transport.Name("W", self)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			partials := 0
+			task, s1 := s0.Recv_Master_task()
+			s1.Foreach(func(s *w.S2) *w.S3 {
+				partials++
+				return s.Send_Rj_partial(task * partials) // task*j to R[j]
+			}).End()
+			if partials != m {
+				t.Errorf("W[%d] expected %d partials but got %d", self, m, partials)
+			}
+		}(self)
+	}
+	for self := 1; self <= m; self++ {
+		wg.Add(1)
+		go func(self int) {
+			defer wg.Done()
+			s0, err := r.New(self, tr.Conn(transport.Name("R", self)))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			partials, sum := 0, 0
+			s0.Foreach(func(s *r.S1) *r.S3 {
+				partials++
+				partial, end := s.Recv_Wi_partial()
+				sum += partial
+				return end
+			}).Send_Master_reduced(sum).End()
+			if partials != n {
+				t.Errorf("R[%d] expected %d partials but got %d", self, n, partials)
+			}
+		}(self)
+	}
+
+	s0, err := master.New(tr.Conn("Master"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tasks, reduced := 0, 0
+	s0.Foreach(func(s *master.S1) *master.S4 {
+		tasks++
+		return s.Send_Wi_task(tasks) // i to W[i]
+	}).Foreach(func(s *master.S3) *master.S5 {
+		reduced++
+		sum, end := s.Recv_Rj_reduced()
+		if expected := reduced * n * (n + 1) / 2; sum != expected {
+			t.Errorf("expected %d from R[%d] but got %d", expected, reduced, sum)
+		}
+		return end
+	}).End()
+	wg.Wait()
+	if tasks != n || reduced != m {
+		t.Errorf("Master expected %d tasks and %d reduced but got %d and %d", n, m, tasks, reduced)
+	}
+}
+
+// TestMissingParam checks that a session does not start without all the
+// protocol parameters.
+func TestMissingParam(t *testing.T) {
+	r.ProtoParam["n"] = 2
+	delete(r.ProtoParam, "m")
+	defer func() { r.ProtoParam["m"] = 3 }()
+	if _, err := r.New(1, transport.NewChan(0).Conn("R[1]")); err == nil || err.Error() != "ScatterGather: protocol parameter m is not set" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+// TestParticipantOutOfRange checks that R[self] is within 1..m.
+func TestParticipantOutOfRange(t *testing.T) {
+	r.ProtoParam["n"], r.ProtoParam["m"] = 2, 3
+	if _, err := r.New(4, transport.NewChan(0).Conn("R[4]")); err == nil || err.Error() != "ScatterGather: participant R[4] is not in range 1..m (1..3)" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
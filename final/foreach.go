@@ -62,10 +62,11 @@ package final
 import (
 	"errors"
 	"fmt"
-	"log"
 )
 
+// Misuse of the API panics with one of these errors.
 var (
+	ErrResourceUsed  = errors.New("resource used")
 	ErrPopEmptyStack = errors.New("cannot pop: stack empty")
 )
 
@@ -97,7 +98,7 @@ func newStack() *fsmStack {
 }
 
 func (s *fsmStack) top() *foreachState {
-	if s.stack != nil {
+	if len(s.stack) > 0 { // s.index is -1 after popping the last state
 		return s.stack[s.index]
 	}
 	return nil
@@ -117,9 +118,10 @@ func (s *fsmStack) push(ID, rangeLen int) {
 func (s *fsmStack) pop() {
 	stacksize := len(s.stack) // don't rely on s.index
 	if stacksize > 0 {
+		s.stack[stacksize-1] = nil // don't keep the popped state in the backing array
 		s.stack, s.index = s.stack[:stacksize-1], stacksize-2
 	} else {
-		log.Fatal(ErrPopEmptyStack)
+		panic(ErrPopEmptyStack)
 	}
 }
 
@@ -1,8 +1,10 @@
 package final
 
 import (
-	"log"
-	"os"
+	"fmt"
+
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/transport"
 )
 
 type resource struct {
@@ -11,8 +13,7 @@ type resource struct {
 
 func (res *resource) Use() {
 	if res.used {
-		log.Fatal("Resource used")
-		os.Exit(1)
+		panic(ErrResourceUsed)
 	}
 	res.used = true
 }
@@ -22,6 +23,25 @@ var ProtoParam = map[string]int{
 	"k": 2, // role A(k=2)
 }
 
+// Trace records the transitions of the session if not nil.
+var Trace *trace.Recorder
+
+// Conn is the connection of the Coordinator to the participants A[1..k].
+// Messages are discarded if Conn is nil.
+var Conn transport.Conn
+
+// send sends a message to the participant A[index], it panics with the
+// error of the connection if the message cannot be sent.
+func send(index int, label string, payload ...interface{}) {
+	if Conn == nil {
+		return
+	}
+	to := transport.Name("A", index)
+	if err := Conn.Send(to, transport.Message{Label: label, Payload: payload}); err != nil {
+		panic(fmt.Errorf("cannot send %s to %s: %w", label, to, err))
+	}
+}
+
 // Example protocol - nested one-to-many:
 //
 // foreach A[i:1..k] {
@@ -40,6 +60,10 @@ var ProtoParam = map[string]int{
 // sstack is the shared foreach stack.
 var sstack = newStack()
 
+// Reset empties the shared foreach stack, so a session can start again from
+// new(S0) after a session violating the protocol.
+func Reset() { sstack = newStack() }
+
 // S0 is the initial state.
 // It is also the outer foreach init state.
 //
@@ -70,9 +94,11 @@ func (s *S0) Foreach(bodyFn func(*S1) *S4) *SEnd {
 
 	// Run at least once (range is never empty)
 	for sstack.top().canEnter() {
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: s.ID(), Loop: s.ID(), Index: "i", Value: sstack.top().curr + 1})
 		bodyFn(new(S1)).end()
 	}
 	sstack.pop()
+	Trace.Record(trace.Event{Kind: trace.Exit, State: s.ID(), Loop: s.ID()})
 	return new(SEnd)
 }
 
@@ -108,9 +134,11 @@ func (s *S1) Foreach(bodyFn func(*S2) *S5) *S3 {
 
 	// Run at least once (range is never empty)
 	for sstack.top().canEnter() {
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: s.ID(), Loop: s.ID(), Index: "j", Value: sstack.top().curr + 1})
 		bodyFn(new(S2)).end()
 	}
 	sstack.pop()
+	Trace.Record(trace.Event{Kind: trace.Exit, State: s.ID(), Loop: s.ID()})
 	return new(S3)
 }
 
@@ -124,6 +152,8 @@ type S2 struct {
 // As the last statement of inner foreach, always go back to s1 (inner foreach init).
 func (s *S2) Send_Aj_foo(v int) *S5 {
 	s.Use()
+	Trace.Record(trace.Event{Kind: trace.Send, State: 2, From: "Coordinator", To: fmt.Sprintf("A[%d]", sstack.top().curr+1), Label: "foo", Payload: fmt.Sprint(v)})
+	send(sstack.top().curr+1, "foo", v) // top is the inner foreach j, from 0
 	return new(S5)
 }
 
@@ -136,6 +166,8 @@ type S3 struct {
 // As the last statement of outer foreach, always go back to s0 (outer foreach init).
 func (s *S3) Send_Ai_bar(v string) *S4 {
 	s.Use()
+	Trace.Record(trace.Event{Kind: trace.Send, State: 3, From: "Coordinator", To: fmt.Sprintf("A[%d]", sstack.top().curr+1), Label: "bar", Payload: fmt.Sprint(v)})
+	send(sstack.top().curr+1, "bar", v) // top is the outer foreach i, from 0
 	return new(S4)
 }
 
@@ -156,5 +188,10 @@ type SEnd struct {
 
 func (s *SEnd) End() {
 	s.Use()
-	// Close channels etc.
+	Trace.Record(trace.Event{Kind: trace.End})
+	if Conn != nil {
+		if err := Conn.Close(); err != nil {
+			panic(fmt.Errorf("cannot close connection: %w", err))
+		}
+	}
 }
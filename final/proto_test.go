@@ -0,0 +1,68 @@
+package final
+
+import (
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/mockpeer"
+	"github.com/nickng/scribble-foreach-experiment/panictest"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+func TestMisuse(t *testing.T) {
+	ProtoParam["k"] = 2
+	inner := func(s *S2) *S5 { return s.Send_Aj_foo(1) }
+	outer := func(s *S1) *S4 { return s.Foreach(inner).Send_Ai_bar("") }
+	panictest.Run(t, Reset, panictest.Cases{
+		{"Good", func() {
+			new(S0).Foreach(outer).End()
+		}, nil},
+		{"UseTwice", func() {
+			s := new(S0)
+			s.Foreach(outer)
+			s.Foreach(outer)
+		}, ErrResourceUsed},
+		{"SendTwice", func() {
+			new(S0).Foreach(func(s *S1) *S4 {
+				return s.Foreach(func(s *S2) *S5 {
+					s.Send_Aj_foo(1)
+					return s.Send_Aj_foo(2)
+				}).Send_Ai_bar("")
+			})
+		}, ErrResourceUsed},
+		{"StaleBodyEnd", func() {
+			// The inner body returns the end state of its first iteration.
+			var first *S5
+			new(S0).Foreach(func(s *S1) *S4 {
+				return s.Foreach(func(s *S2) *S5 {
+					if end := s.Send_Aj_foo(1); first == nil {
+						first = end
+					}
+					return first
+				}).Send_Ai_bar("")
+			})
+		}, ErrResourceUsed},
+		{"OuterStateInInner", func() {
+			new(S0).Foreach(func(s1 *S1) *S4 {
+				return s1.Foreach(func(s *S2) *S5 {
+					s1.Foreach(inner)
+					return s.Send_Aj_foo(1)
+				}).Send_Ai_bar("")
+			})
+		}, ErrResourceUsed},
+		{"SendClosed", func() {
+			conn := mockpeer.New(t)
+			conn.Close()
+			Conn = conn
+			defer func() { Conn = nil }()
+			new(S0).Foreach(outer).End()
+		}, transport.ErrClosed},
+		{"CloseClosed", func() {
+			conn := mockpeer.New(t)
+			Conn = conn
+			defer func() { Conn = nil }()
+			s := new(S0).Foreach(outer)
+			conn.Close()
+			s.End()
+		}, transport.ErrClosed},
+	})
+}
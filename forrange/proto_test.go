@@ -0,0 +1,44 @@
+package forrange
+
+import (
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/panictest"
+)
+
+func TestMisuse(t *testing.T) {
+	ProtoParam["k"] = 2
+	panictest.Run(t, Reset, panictest.Cases{
+		{"Good", func() {
+			loop0, end0 := new(S0).Foreach()
+			for s1 := range loop0 {
+				loop1, end1 := s1.Foreach()
+				for s2 := range loop1 {
+					s2.Send_Aj_foo(1).End()
+				}
+				end1.Send_Ai_bar("").End()
+			}
+			end0.End()
+		}, nil},
+		{"UseTwice", func() {
+			loop0, _ := new(S0).Foreach()
+			s1 := <-loop0
+			s1.Foreach()
+			s1.Foreach()
+		}, ErrResourceUsed},
+		{"SendTwice", func() {
+			loop0, _ := new(S0).Foreach()
+			loop1, _ := (<-loop0).Foreach()
+			s2 := <-loop1
+			s2.Send_Aj_foo(1)
+			s2.Send_Aj_foo(2)
+		}, ErrResourceUsed},
+		{"EndTwice", func() {
+			loop0, _ := new(S0).Foreach()
+			loop1, _ := (<-loop0).Foreach()
+			end := (<-loop1).Send_Aj_foo(1)
+			end.End()
+			end.End()
+		}, ErrResourceUsed},
+	})
+}
@@ -1,9 +1,19 @@
 package fused
 
 import (
+	"errors"
 	"fmt"
-	"log"
-	"os"
+
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// Misuse of the API panics with an error wrapping one of these errors.
+var (
+	ErrResourceUsed  = errors.New("resource used")
+	ErrPopEmptyStack = errors.New("cannot pop: stack empty")
+	ErrNoForeach     = errors.New("no foreach to end here")
+	ErrPrematureExit = errors.New("premature exit of foreach")
 )
 
 type resource struct {
@@ -12,8 +22,7 @@ type resource struct {
 
 func (res *resource) Use() {
 	if res.used {
-		log.Fatal("Resource used")
-		os.Exit(1)
+		panic(ErrResourceUsed)
 	}
 	res.used = true
 }
@@ -23,6 +32,25 @@ var ProtoParam = map[string]int{
 	"k": 2, // role A(k=2)
 }
 
+// Trace records the transitions of the session if not nil.
+var Trace *trace.Recorder
+
+// Conn is the connection of the Coordinator to the participants A[1..k].
+// Messages are discarded if Conn is nil.
+var Conn transport.Conn
+
+// send sends a message to the participant A[index], it panics with the
+// error of the connection if the message cannot be sent.
+func send(index int, label string, payload ...interface{}) {
+	if Conn == nil {
+		return
+	}
+	to := transport.Name("A", index)
+	if err := Conn.Send(to, transport.Message{Label: label, Payload: payload}); err != nil {
+		panic(fmt.Errorf("cannot send %s to %s: %w", label, to, err))
+	}
+}
+
 // Example protocol - nested one-to-many:
 //
 // foreach A[i:1..k] {
@@ -61,7 +89,7 @@ type foreachStack struct {
 }
 
 func (fes *foreachStack) top() *foreachState {
-	if fes.stack != nil {
+	if len(fes.stack) > 0 { // fes.index is -1 after popping the last state
 		return fes.stack[fes.index]
 	}
 	return nil
@@ -82,10 +110,11 @@ func (fes *foreachStack) push(ID, rangeLen int) {
 func (fes *foreachStack) pop() {
 	stacksize := len(fes.stack)
 	if stacksize > 0 {
+		fes.stack[stacksize-1] = nil // don't keep the popped state in the backing array
 		fes.stack = fes.stack[:stacksize-1]
 		fes.index = stacksize - 2 // could be -1
 	} else {
-		log.Fatalf("Cannot pop empty foreach-stack")
+		panic(ErrPopEmptyStack)
 	}
 }
 
@@ -100,6 +129,10 @@ func (fes foreachStack) String() string {
 // fes is the shared foreach stack.
 var fes = new(foreachStack)
 
+// Reset empties the shared foreach stack, so a session can start again from
+// new(S0) after a session violating the protocol.
+func Reset() { fes = new(foreachStack) }
+
 /// --- end of common code ---------------------------------------------------
 
 // S0 is the initial state.
@@ -118,7 +151,8 @@ type S0 struct {
 
 func (s *S0) ID() int { return 0 } // Generate as method returning constant so immutable
 
-// Foreach moves s0 → s1, where s1 is the body of outer foreach i.e. inner foreach
+// Foreach moves s0 → s1, where s1 is the body of outer foreach i.e. inner foreach,
+// it returns false past the last index instead.
 func (s *S0) Foreach() (*S1, bool) {
 	s.Use()
 	if fes.isEmpty() || fes.top().ID != s.ID() {
@@ -131,9 +165,9 @@ func (s *S0) Foreach() (*S1, bool) {
 		panic("shouldn't get here")
 	}
 	if !fes.top().bodyOK() {
-		log.Printf("Cannot enter body (ID: %d, index: %d/%d)", s.ID(), fes.top().curr, fes.top().last)
 		return nil, false
 	}
+	Trace.Record(trace.Event{Kind: trace.Iterate, State: s.ID(), Loop: s.ID(), Index: "i", Value: fes.top().curr + 1})
 	return new(S1), true
 }
 
@@ -144,16 +178,17 @@ func (s *S0) EndForeach() *SEnd {
 	s.Use()
 	if fes.isEmpty() || fes.top().ID != s.ID() {
 		// Range cannot be 0, so must enter loop at least once
-		log.Fatalf("No foreach (ID: %d) to end here!", s.ID())
+		panic(fmt.Errorf("%w (ID: %d)", ErrNoForeach, s.ID()))
 	} else if fes.top().ID == s.ID() {
 		if !fes.top().hasNext() {
 			fes.pop()
 		} else {
-			log.Fatalf("Premature exit of foreach (ID: %d)", s.ID())
+			panic(fmt.Errorf("%w (ID: %d)", ErrPrematureExit, s.ID()))
 		}
 	} else {
 		panic("shouldn't get here")
 	}
+	Trace.Record(trace.Event{Kind: trace.Exit, State: s.ID(), Loop: s.ID()})
 	return new(SEnd)
 }
 
@@ -164,7 +199,8 @@ type S1 struct {
 
 func (s *S1) ID() int { return 1 } // Generate as method returning constant so immutable
 
-// Foreach moves s1 → s2, where s2 is the body of inner foreach
+// Foreach moves s1 → s2, where s2 is the body of inner foreach, it returns
+// false past the last index instead.
 func (s *S1) Foreach() (*S2, bool) {
 	s.Use()
 	if fes.isEmpty() || fes.top().ID != s.ID() {
@@ -178,9 +214,9 @@ func (s *S1) Foreach() (*S2, bool) {
 	}
 	// bodyOK check after increment
 	if !fes.top().bodyOK() {
-		log.Printf("Cannot enter body (ID: %d, index: %d/%d)", s.ID(), fes.top().curr, fes.top().last)
 		return nil, false
 	}
+	Trace.Record(trace.Event{Kind: trace.Iterate, State: s.ID(), Loop: s.ID(), Index: "j", Value: fes.top().curr + 1})
 	return new(S2), true
 }
 
@@ -189,16 +225,17 @@ func (s *S1) EndForeach() *S3 {
 	s.Use()
 	if fes.isEmpty() || fes.top().ID != s.ID() {
 		// Range cannot be 0, so must enter loop at least once
-		log.Fatalf("No foreach (ID: %d) to end here!", s.ID())
+		panic(fmt.Errorf("%w (ID: %d)", ErrNoForeach, s.ID()))
 	} else if fes.top().ID == s.ID() {
 		if !fes.top().hasNext() {
 			fes.pop()
 		} else {
-			log.Fatalf("Premature exit of foreach (ID: %d)", s.ID())
+			panic(fmt.Errorf("%w (ID: %d)", ErrPrematureExit, s.ID()))
 		}
 	} else {
 		panic("shouldn't get here")
 	}
+	Trace.Record(trace.Event{Kind: trace.Exit, State: s.ID(), Loop: s.ID()})
 	return new(S3)
 }
 
@@ -212,6 +249,8 @@ type S2 struct {
 // As the last statement of inner foreach, always go back to s1 (inner foreach init).
 func (s *S2) Send_Aj_foo(v int) *S1 {
 	s.Use()
+	Trace.Record(trace.Event{Kind: trace.Send, State: 2, From: "Coordinator", To: fmt.Sprintf("A[%d]", fes.top().curr+1), Label: "foo", Payload: fmt.Sprint(v)})
+	send(fes.top().curr+1, "foo", v) // top is the foreach j, from 0
 	return new(S1)
 }
 
@@ -224,6 +263,8 @@ type S3 struct {
 // As the last statement of outer foreach, always go back to s0 (outer foreach init).
 func (s *S3) Send_Ai_bar(v string) *S0 {
 	s.Use()
+	Trace.Record(trace.Event{Kind: trace.Send, State: 3, From: "Coordinator", To: fmt.Sprintf("A[%d]", fes.top().curr+1), Label: "bar", Payload: fmt.Sprint(v)})
+	send(fes.top().curr+1, "bar", v) // top is the foreach i, from 0
 	return new(S0)
 }
 
@@ -234,5 +275,10 @@ type SEnd struct {
 
 func (s *SEnd) End() {
 	s.Use()
-	// Close channels etc.
+	Trace.Record(trace.Event{Kind: trace.End})
+	if Conn != nil {
+		if err := Conn.Close(); err != nil {
+			panic(fmt.Errorf("cannot close connection: %w", err))
+		}
+	}
 }
@@ -0,0 +1,52 @@
+package fused
+
+import (
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/panictest"
+)
+
+func TestMisuse(t *testing.T) {
+	ProtoParam["k"] = 2
+	panictest.Run(t, Reset, panictest.Cases{
+		{"Good", func() {
+			s := new(S0)
+			for i := 1; i <= 2; i++ {
+				s1, _ := s.Foreach()
+				for j := 1; j <= 2; j++ {
+					s2, _ := s1.Foreach()
+					s1 = s2.Send_Aj_foo(1)
+				}
+				s = s1.EndForeach().Send_Ai_bar("")
+			}
+			s.EndForeach().End()
+		}, nil},
+		{"UseTwice", func() {
+			s := new(S0)
+			s.Foreach()
+			s.Foreach()
+		}, ErrResourceUsed},
+		{"EndBeforeExhausted", func() {
+			s1, _ := new(S0).Foreach()
+			s2, _ := s1.Foreach()
+			s2.Send_Aj_foo(1).EndForeach()
+		}, ErrPrematureExit},
+		{"EndBeforeForeach", func() {
+			new(S0).EndForeach()
+		}, ErrNoForeach},
+		{"EndOuterInInner", func() {
+			s1, _ := new(S0).Foreach()
+			s1.Foreach()
+			new(S0).EndForeach()
+		}, ErrNoForeach},
+		{"ForeachPastLast", func() {
+			// Foreach reports the exhausted range instead of panicking.
+			s1, _ := new(S0).Foreach()
+			s2, _ := s1.Foreach()
+			s2, _ = s2.Send_Aj_foo(1).Foreach()
+			if _, ok := s2.Send_Aj_foo(2).Foreach(); ok {
+				t.Error("ForeachPastLast: expected Foreach past the last index to fail")
+			}
+		}, nil},
+	})
+}
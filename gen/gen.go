@@ -0,0 +1,610 @@
+// Package gen generates foreach APIs from projected protocols.
+//
+// The generated API follows the design of the final package: each state of
+// the FSM is a type, foreach init states have a Foreach method which takes
+// the loop body as a function, and foreach loops are tracked at runtime by a
+// stack of foreach states.
+package gen
+
+import (
+	"bytes"
+	"fmt"
+	"go/format"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"github.com/nickng/scribble-foreach-experiment/scribble"
+)
+
+var runtimeTmpl = template.Must(template.New("runtime").Parse(runtime))
+
+// Generate generates the API of the local type l as package pkg.
+// It returns the generated Go source files keyed by file name.
+func Generate(l *scribble.Local, pkg string) (map[string][]byte, error) {
+	if len(l.Body) == 0 {
+		return nil, fmt.Errorf("role %s is not involved in protocol %s", l.Role.Name, l.Protocol.Name)
+	}
+	var rt bytes.Buffer
+	if err := runtimeTmpl.Execute(&rt, struct{ Package string }{pkg}); err != nil {
+		return nil, err
+	}
+	fingerprint, err := scribble.Fingerprint(l.Protocol)
+	if err != nil {
+		return nil, err
+	}
+	g := &generator{local: l, fsm: scribble.NewFSM(l), fingerprint: fingerprint, merged: make(map[*scribble.State]bool)}
+	for _, s := range g.fsm.States {
+		for _, branch := range s.Branches {
+			g.merged[branch] = true
+		}
+	}
+	g.header(pkg)
+	for _, s := range g.fsm.States {
+		if !g.merged[s] {
+			g.state(s)
+		}
+	}
+	if g.mod {
+		g.printf("// mod returns x mod y, which is always in 0..y-1 as in the protocol.\n")
+		g.printf("func mod(x, y int) int {\n\tif m := x %% y; m < 0 {\n\t\treturn m + y\n\t}\n\treturn x %% y\n}\n")
+	}
+	if g.err != nil {
+		return nil, g.err
+	}
+	files := map[string][]byte{"foreach.go": rt.Bytes()}
+	src, err := format.Source(g.buf.Bytes())
+	if err != nil {
+		return nil, fmt.Errorf("cannot format generated code: %v", err)
+	}
+	files["proto.go"] = src
+	return files, nil
+}
+
+// PackageName returns the default package name for the API of role.
+func PackageName(role string) string {
+	return strings.ToLower(role)
+}
+
+type generator struct {
+	local       *scribble.Local
+	fsm         *scribble.FSM
+	fingerprint string                   // fingerprint is the fingerprint of the protocol
+	merged      map[*scribble.State]bool // merged are the first states of choice branches
+	mod         bool                     // mod is true if the generated code uses the mod function
+	indices     map[string]bool          // indices are the index variables declared by checkParams
+	buf         bytes.Buffer
+	err         error
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.buf, format, args...)
+}
+
+func (g *generator) header(pkg string) {
+	g.printf("// Code generated by scribblegen. DO NOT EDIT.\n\n")
+	g.printf("// Package %s is the API of role %s in protocol %s.\n", pkg, g.local.Role.Name, g.local.Protocol.Name)
+	g.printf("//\n// Local protocol:\n//\n")
+	for _, line := range strings.Split(strings.TrimSpace(g.local.String()), "\n") {
+		g.printf("//\t%s\n", line)
+	}
+	g.printf("package %s\n\n", pkg)
+	g.printf("import (\n\t\"fmt\"\n\n\t\"%s\"\n\t\"%s\"\n)\n\n", tracePkg, transportPkg)
+
+	params := g.local.Protocol.Params
+	g.printf("// ProtoParam is the lookup table for protocol parameters")
+	names := make([]string, len(params))
+	for i, param := range params {
+		names[i] = param.Name
+	}
+	if len(params) > 0 {
+		g.printf(" (%s)", strings.Join(names, ", "))
+	}
+	g.printf(".\n// Parameters must be set before the session starts.\n")
+	g.printf("var ProtoParam = make(map[string]int)\n\n")
+	g.printf("// Trace records the transitions of the participants if not nil.\n")
+	g.printf("var Trace *trace.Recorder\n\n")
+	if len(params) > 0 {
+		g.checkParams(names)
+	}
+	g.handshake(names)
+
+	g.printf("// endpoint is a participant of the session.\n")
+	g.printf("// The foreach stack is kept per participant so that the participants of\n")
+	g.printf("// an indexed role can run side by side.\n")
+	g.printf("type endpoint struct {\n")
+	if g.local.Role.Indexed() {
+		g.printf("\tself    int // self is the index of this participant\n")
+	}
+	g.printf("\tname    string         // name is the name of this participant in the transport\n")
+	g.printf("\tconn    transport.Conn // conn is the connection to the other participants\n")
+	g.printf("\tpending map[string]transport.Message // pending are the messages received by Branch\n")
+	g.printf("\tsstack  *fsmStack                    // sstack is the foreach stack of this participant\n}\n\n")
+	g.printf("%s", endpointMethods)
+
+	initial := g.name(g.fsm.Initial)
+	if role := g.local.Role; role.Indexed() {
+		g.printf("// New returns the initial state of participant %s[self], %s <= self <= %s,\n", role.Name, role.Lo, role.Hi)
+		g.printf("// conn is the connection of %s[self] to the other participants.\n", role.Name)
+		g.printf("// It returns an error if the protocol parameters are not set correctly, or\n")
+		g.printf("// if the other participants run a different protocol (see Fingerprint).\n")
+		g.printf("func New(self int, conn transport.Conn) (*%s, error) {\n", initial)
+		if len(params) > 0 {
+			g.printf("\tif err := checkParams(); err != nil {\n\t\treturn nil, err\n\t}\n")
+		}
+		g.printf("\tif lo, hi := %s, %s; self < lo || self > hi {\n", g.expr(nil, role.Lo), g.expr(nil, role.Hi))
+		g.printf("\t\treturn nil, fmt.Errorf(\"%s: participant %s[%%d] is not in range %s..%s (%%d..%%d)\", self, lo, hi)\n\t}\n",
+			g.local.Protocol.Name, role.Name, role.Lo, role.Hi)
+		g.printf("\tname := transport.Name(%q, self)\n", role.Name)
+	} else {
+		g.printf("// New returns the initial state of %s,\n", role.Name)
+		g.printf("// conn is the connection of %s to the other participants.\n", role.Name)
+		g.printf("// It returns an error if the protocol parameters are not set correctly, or\n")
+		g.printf("// if the other participants run a different protocol (see Fingerprint).\n")
+		g.printf("func New(conn transport.Conn) (*%s, error) {\n", initial)
+		if len(params) > 0 {
+			g.printf("\tif err := checkParams(); err != nil {\n\t\treturn nil, err\n\t}\n")
+		}
+		g.printf("\tname := %q\n", role.Name)
+	}
+	g.printf("\tif conn == nil {\n\t\treturn nil, fmt.Errorf(\"%s: %%s has no connection\", name)\n\t}\n", g.local.Protocol.Name)
+	g.printf("\tif err := transport.Handshake(conn, hello(name), peers(name)); err != nil {\n\t\treturn nil, err\n\t}\n")
+	g.printf("\tep := &endpoint{")
+	if g.local.Role.Indexed() {
+		g.printf("self: self, ")
+	}
+	g.printf("name: name, conn: conn, pending: make(map[string]transport.Message), sstack: newStack()}\n")
+	g.printf("\treturn &%s{ep: ep}, nil\n}\n\n", initial)
+}
+
+// transportPkg and tracePkg are the import paths of the transport and the
+// trace used by generated APIs.
+const (
+	transportPkg = "github.com/nickng/scribble-foreach-experiment/transport"
+	tracePkg     = "github.com/nickng/scribble-foreach-experiment/trace"
+)
+
+// endpointMethods are the methods of endpoint for sending and receiving.
+const endpointMethods = `// send sends a message to the participant to from state, it panics with
+// the error of the connection if the message cannot be sent.
+func (ep *endpoint) send(state int, to, label string, payload ...interface{}) {
+	if err := ep.conn.Send(to, transport.Message{Label: label, Payload: payload}); err != nil {
+		panic(fmt.Errorf("%s: cannot send %s to %s: %w", ep.name, label, to, err))
+	}
+	Trace.Record(trace.Event{Kind: trace.Send, State: state, From: ep.name, To: to, Label: label, Payload: formatPayload(payload)})
+}
+
+// peek returns the next message from the participant from without
+// consuming it, it panics with the error of the connection if no message
+// can be received.
+func (ep *endpoint) peek(from string) transport.Message {
+	if m, ok := ep.pending[from]; ok {
+		return m
+	}
+	m, err := ep.conn.Recv(from)
+	if err != nil {
+		panic(fmt.Errorf("%s: cannot receive from %s: %w", ep.name, from, err))
+	}
+	ep.pending[from] = m
+	return m
+}
+
+// iterate tells the connection that the participant starts the iteration
+// (from 1) of the foreach loop ID, or exits the loop if iteration is 0.
+func (ep *endpoint) iterate(loop, iteration int) {
+	if o, ok := ep.conn.(transport.LoopObserver); ok {
+		o.Iterate(loop, iteration)
+	}
+}
+
+// recv receives the next message from the participant from in state,
+// which must have the given label, or it panics with ErrUnexpectedLabel.
+func (ep *endpoint) recv(state int, from, label string) []interface{} {
+	m := ep.peek(from)
+	delete(ep.pending, from)
+	if m.Label != label {
+		panic(fmt.Errorf("%s: %w from %s: expected %s but got %s", ep.name, ErrUnexpectedLabel, from, label, m.Label))
+	}
+	Trace.Record(trace.Event{Kind: trace.Recv, State: state, From: from, To: ep.name, Label: label, Payload: formatPayload(m.Payload)})
+	return m.Payload
+}
+
+// formatPayload returns the payload of a message in a trace, e.g. 1, x.
+func formatPayload(payload []interface{}) string {
+	var b []byte
+	for i, v := range payload {
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+		b = fmt.Append(b, v)
+	}
+	return string(b)
+}
+
+`
+
+// checkParams prints the check of the protocol parameters, the parameters
+// must all be set and satisfy the assumptions of the protocol.
+func (g *generator) checkParams(names []string) {
+	proto := g.local.Protocol
+	g.printf("// checkParams returns an error if a protocol parameter is not set, or if\n")
+	g.printf("// a range of the protocol is empty.\n")
+	g.printf("func checkParams() error {\n")
+	quoted := make([]string, len(names))
+	for i, name := range names {
+		quoted[i] = strconv.Quote(name)
+	}
+	g.printf("\tfor _, name := range []string{%s} {\n", strings.Join(quoted, ", "))
+	g.printf("\t\tif _, ok := ProtoParam[name]; !ok {\n")
+	g.printf("\t\t\treturn fmt.Errorf(\"%s: protocol parameter %%s is not set\", name)\n\t\t}\n\t}\n", proto.Name)
+	for _, a := range scribble.Assumptions(proto) {
+		if a.From != nil {
+			g.distinct(a)
+			continue
+		}
+		g.printf("\tif lo, hi := %s, %s; lo > hi {\n", g.expr(nil, a.Lo), g.expr(nil, a.Hi))
+		g.printf("\t\treturn fmt.Errorf(\"%s: range %s..%s is empty (%%d..%%d)\", lo, hi)\n\t}\n", proto.Name, a.Lo, a.Hi)
+	}
+	g.printf("\treturn nil\n}\n\n")
+}
+
+// distinct prints the check of the assumption a that an interaction is not
+// sent by a participant to itself, for every value of its index variables.
+func (g *generator) distinct(a *scribble.Assumption) {
+	g.indices = make(map[string]bool)
+	defer func() { g.indices = nil }()
+	when, args := "", ""
+	for i, loop := range a.Loops {
+		g.printf("\tfor %s, hi := %s, %s; %s <= hi; %s++ {\n", loop.Index, g.expr(nil, loop.Lo), g.expr(nil, loop.Hi), loop.Index, loop.Index)
+		g.indices[loop.Index] = true
+		if i == 0 {
+			when += " when "
+		} else {
+			when += ", "
+		}
+		when += loop.Index + " = %d"
+		args += loop.Index + ", "
+	}
+	g.printf("\tif from, to := %s, %s; from == to {\n", g.expr(nil, a.From.Index), g.expr(nil, a.To.Index))
+	g.printf("\t\treturn fmt.Errorf(\"%s: %s sends to itself%s (%s[%%d])\", %sfrom)\n\t}\n",
+		g.local.Protocol.Name, a.From, when, a.From.Name, args)
+	g.printf("%s", strings.Repeat("\t}\n", len(a.Loops)))
+}
+
+// handshake prints the fingerprint of the protocol, and the announcement
+// and the peers of a participant in the handshake. The peers are all the
+// participants of the roles in the local type, which are the participants
+// with the role of this participant in their local types.
+func (g *generator) handshake(names []string) {
+	proto := g.local.Protocol
+	g.printf("// Fingerprint is the hash of protocol %s, a session only starts if all\n", proto.Name)
+	g.printf("// participants have the same fingerprint and protocol parameters.\n")
+	g.printf("const Fingerprint = %q\n\n", g.fingerprint)
+
+	g.printf("// hello returns the announcement of participant name in the handshake.\n")
+	g.printf("func hello(name string) transport.Hello {\n")
+	g.printf("\treturn transport.Hello{Protocol: %q, Participant: name, Fingerprint: Fingerprint", proto.Name)
+	if len(names) > 0 {
+		values := make([]string, len(names))
+		for i, name := range names {
+			values[i] = fmt.Sprintf("%q: ProtoParam[%q]", name, name)
+		}
+		g.printf(", Params: map[string]int{%s}", strings.Join(values, ", "))
+	}
+	g.printf("}\n}\n\n")
+
+	peers := peerRoles(g.local)
+	var fixed []string
+	for _, role := range peers {
+		if !role.Indexed() {
+			fixed = append(fixed, strconv.Quote(role.Name))
+		}
+	}
+	g.printf("// peers returns the participants other than name in the handshake.\n")
+	g.printf("func peers(name string) []string {\n")
+	if len(fixed) == len(peers) {
+		g.printf("\treturn []string{%s}\n}\n\n", strings.Join(fixed, ", "))
+		return
+	}
+	if len(fixed) > 0 {
+		g.printf("\tnames := []string{%s}\n", strings.Join(fixed, ", "))
+	} else {
+		g.printf("\tvar names []string\n")
+	}
+	for _, role := range peers {
+		if role.Indexed() {
+			g.printf("\tfor i, hi := %s, %s; i <= hi; i++ {\n", g.expr(nil, role.Lo), g.expr(nil, role.Hi))
+			g.printf("\t\tif peer := transport.Name(%q, i); peer != name {\n", role.Name)
+			g.printf("\t\t\tnames = append(names, peer)\n\t\t}\n\t}\n")
+		}
+	}
+	g.printf("\treturn names\n}\n\n")
+}
+
+// peerRoles returns the roles other than the participant itself in the
+// actions of l, in declaration order. An indexed role is a peer of its own
+// participants if they interact with each other.
+func peerRoles(l *scribble.Local) []*scribble.Role {
+	used := make(map[string]bool)
+	var walk func([]scribble.LocalStmt)
+	walk = func(stmts []scribble.LocalStmt) {
+		for _, s := range stmts {
+			switch s := s.(type) {
+			case *scribble.Send:
+				used[s.To.Name] = true
+			case *scribble.Recv:
+				used[s.From.Name] = true
+			case *scribble.LocalForeach:
+				walk(s.Body)
+			case *scribble.If:
+				walk(s.Body)
+			case *scribble.LocalChoice:
+				for _, branch := range s.Branches {
+					walk(branch)
+				}
+			case *scribble.LocalRec:
+				walk(s.Body)
+			}
+		}
+	}
+	walk(l.Body)
+	var roles []*scribble.Role
+	for _, role := range l.Protocol.Roles {
+		if used[role.Name] && (role.Indexed() || role.Name != l.Role.Name) {
+			roles = append(roles, role)
+		}
+	}
+	return roles
+}
+
+// next returns the expression of a new state s using the same endpoint.
+func (g *generator) next(s *scribble.State) string {
+	return fmt.Sprintf("&%s{ep: s.ep}", g.name(s))
+}
+
+// stateType prints the type declaration of a state.
+func (g *generator) stateType(name string) {
+	g.printf("type %s struct {\n\tresource\n\tep *endpoint\n}\n\n", name)
+}
+
+// name returns the type name of state s.
+func (g *generator) name(s *scribble.State) string {
+	if s.Kind == scribble.EndState {
+		return "SEnd"
+	}
+	return "S" + strconv.Itoa(s.ID)
+}
+
+func (g *generator) state(s *scribble.State) {
+	name := g.name(s)
+	switch s.Kind {
+	case scribble.ForeachState:
+		g.foreach(name, s)
+	case scribble.BodyEndState:
+		g.printf("// %s is the ending state of foreach loop ID %d.\n", name, s.Next.ID)
+		g.stateType(name)
+		g.printf("func (s *%s) end() {\n\ts.Use()\n\ts.ep.sstack.top().increment()\n}\n\n", name)
+	case scribble.SendState:
+		g.send(name, s)
+	case scribble.RecvState:
+		g.recv(name, s)
+	case scribble.IfState:
+		g.guard(name, s)
+	case scribble.ChoiceState:
+		g.choice(name, s)
+	case scribble.EndState:
+		g.printf("// %s is the usual final state of a protocol.\n", name)
+		g.stateType(name)
+		g.printf("// End closes the connection to the other participants.\n")
+		g.printf("func (s *%s) End() {\n\ts.Use()\n", name)
+		g.printf("\tif err := s.ep.conn.Close(); err != nil {\n\t\tpanic(fmt.Errorf(\"%%s: cannot close connection: %%w\", s.ep.name, err))\n\t}\n")
+		g.printf("\tTrace.Record(trace.Event{Kind: trace.End})\n}\n\n")
+	}
+}
+
+func (g *generator) foreach(name string, s *scribble.State) {
+	loop := s.Stmt.(*scribble.LocalForeach)
+	g.printf("// %s is the init state of foreach %s[%s:%s..%s] (loop ID %d).\n", name, loop.Role, loop.Index, loop.Lo, loop.Hi, s.ID)
+	g.stateType(name)
+	g.printf("func (s *%s) ID() int { return %d }\n\n", name, s.ID)
+	g.foreachMethod(name, "Foreach", s)
+}
+
+// foreachMethod prints the foreach method of state s with receiver type name.
+func (g *generator) foreachMethod(name, method string, s *scribble.State) {
+	loop := s.Stmt.(*scribble.LocalForeach)
+	g.printf("// %s runs bodyFn for each %s in %s..%s, then moves to %s.\n", method, loop.Index, loop.Lo, loop.Hi, g.name(s.Next))
+	g.printf("func (s *%s) %s(bodyFn func(*%s) *%s) *%s {\n", name, method, g.name(s.Body), g.name(s.End), g.name(s.Next))
+	g.printf(`	s.Use()
+	sstack := s.ep.sstack
+	if sstack.isEmpty() || sstack.top().ID != %[1]d {
+		// first time enter loop
+		sstack.push(%[1]d, %[2]s, %[3]s)
+	} else if sstack.top().ID == %[1]d {
+		// re-enter loop
+		sstack.top().increment()
+	} else {
+		panic("shouldn't get here")
+	}
+
+	for n := 1; sstack.top().canEnter(); n++ {
+		s.ep.iterate(%[1]d, n)
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: %[1]d, Loop: %[1]d, Index: %[4]q, Value: sstack.top().curr})
+		bodyFn(%[5]s).end()
+	}
+	s.ep.iterate(%[1]d, 0)
+	Trace.Record(trace.Event{Kind: trace.Exit, State: %[1]d, Loop: %[1]d})
+	sstack.pop()
+	return %[6]s
+}
+
+`, s.ID, g.expr(s, loop.Lo), g.expr(s, loop.Hi), loop.Index, g.next(s.Body), g.next(s.Next))
+}
+
+func (g *generator) send(name string, s *scribble.State) {
+	send := s.Stmt.(*scribble.Send)
+	g.printf("// %s is the state before %s(%s) to %s.\n", name, send.Label, strings.Join(send.Payloads, ", "), send.To)
+	g.stateType(name)
+	g.sendMethod(name, s)
+}
+
+// sendMethod prints the send method of state s with receiver type name.
+func (g *generator) sendMethod(name string, s *scribble.State) {
+	send := s.Stmt.(*scribble.Send)
+	method := "Send_" + roleName(send.To) + "_" + send.Label
+	g.printf("// %s sends %s to %s, then moves to %s.\n", method, send.Label, send.To, g.name(s.Next))
+	g.printf("func (s *%s) %s(%s) *%s {\n", name, method, params(send.Payloads), g.name(s.Next))
+	args := []string{strconv.Itoa(s.ID), g.participant(s, send.To), strconv.Quote(send.Label)}
+	for i := range send.Payloads {
+		args = append(args, payloadName(i, len(send.Payloads)))
+	}
+	g.printf("\ts.Use()\n\ts.ep.send(%s)\n\treturn %s\n}\n\n", strings.Join(args, ", "), g.next(s.Next))
+}
+
+func (g *generator) recv(name string, s *scribble.State) {
+	recv := s.Stmt.(*scribble.Recv)
+	g.printf("// %s is the state before %s(%s) from %s.\n", name, recv.Label, strings.Join(recv.Payloads, ", "), recv.From)
+	g.stateType(name)
+	g.recvMethod(name, s)
+}
+
+// recvMethod prints the receive method of state s with receiver type name.
+func (g *generator) recvMethod(name string, s *scribble.State) {
+	recv := s.Stmt.(*scribble.Recv)
+	method := "Recv_" + roleName(recv.From) + "_" + recv.Label
+	results := append(append([]string(nil), recv.Payloads...), "*"+g.name(s.Next))
+	g.printf("// %s receives %s from %s, then moves to %s.\n", method, recv.Label, recv.From, g.name(s.Next))
+	g.printf("func (s *%s) %s() (%s) {\n", name, method, strings.Join(results, ", "))
+	g.printf("\ts.Use()\n")
+	if len(recv.Payloads) == 0 {
+		g.printf("\ts.ep.recv(%d, %s, %q)\n", s.ID, g.participant(s, recv.From), recv.Label)
+	} else {
+		g.printf("\tpayload := s.ep.recv(%d, %s, %q)\n", s.ID, g.participant(s, recv.From), recv.Label)
+	}
+	vals := make([]string, 0, len(recv.Payloads)+1)
+	for i, typ := range recv.Payloads {
+		vals = append(vals, fmt.Sprintf("payload[%d].(%s)", i, typ))
+	}
+	g.printf("\treturn %s\n}\n\n", strings.Join(append(vals, g.next(s.Next)), ", "))
+}
+
+func (g *generator) guard(name string, s *scribble.State) {
+	guard := s.Stmt.(*scribble.If)
+	role := g.local.Role.Name
+	cond := fmt.Sprintf("%s <= s.ep.self && s.ep.self <= %s", g.expr(s, guard.Lo), g.expr(s, guard.Hi))
+	desc := fmt.Sprintf("%s[self] for self in %s..%s", role, guard.Lo, guard.Hi)
+	if guard.Lo.String() == guard.Hi.String() {
+		cond = fmt.Sprintf("s.ep.self == %s", g.expr(s, guard.Lo))
+		desc = fmt.Sprintf("%s[%s]", role, guard.Lo)
+	}
+	g.printf("// %s is a guard on the index of this participant.\n", name)
+	g.stateType(name)
+	g.printf("// IfSelf runs thenFn if this participant is %s, otherwise it skips to %s.\n", desc, g.name(s.Next))
+	g.printf("func (s *%s) IfSelf(thenFn func(*%s) *%s) *%s {\n", name, g.name(s.Body), g.name(s.Next), g.name(s.Next))
+	g.printf("\ts.Use()\n\tif %s {\n\t\treturn thenFn(%s)\n\t}\n\treturn %s\n}\n\n", cond, g.next(s.Body), g.next(s.Next))
+}
+
+// choice prints a choice state with one method for each branch.
+// The first state of each branch is merged into the choice state.
+func (g *generator) choice(name string, s *scribble.State) {
+	choice := s.Stmt.(*scribble.LocalChoice)
+	g.printf("// %s is a choice at %s, each branch is a method of %s.\n", name, choice.At, name)
+	g.stateType(name)
+	if s.Branches[0].Kind == scribble.RecvState {
+		labels := make([]string, len(s.Branches))
+		for i, branch := range s.Branches {
+			labels[i] = branch.Stmt.(*scribble.Recv).Label
+		}
+		g.printf("// Branch returns the label of the branch chosen by %s (%s),\n", choice.At, strings.Join(labels, " or "))
+		g.printf("// the message is received by the method of the branch.\n")
+		g.printf("func (s *%s) Branch() string {\n\treturn s.ep.peek(%s).Label\n}\n\n", name, g.participant(s, choice.At))
+	}
+	for _, branch := range s.Branches {
+		switch branch.Kind {
+		case scribble.SendState:
+			g.sendMethod(name, branch)
+		case scribble.RecvState:
+			g.recvMethod(name, branch)
+		case scribble.ForeachState:
+			// The branch sends its first message to every index of a role.
+			if first := branch.Body; first.Kind == scribble.SendState {
+				g.foreachMethod(name, "Foreach_"+first.Stmt.(*scribble.Send).Label, branch)
+				continue
+			}
+			fallthrough
+		default:
+			g.err = fmt.Errorf("%s: unsupported branch of choice at %s", branch.Stmt.Position(), choice.At)
+		}
+	}
+}
+
+// expr returns the Go expression of e in state s.
+// s is nil outside of the states, where e only references parameters.
+func (g *generator) expr(s *scribble.State, e scribble.Expr) string {
+	switch e := e.(type) {
+	case *scribble.Num:
+		return strconv.Itoa(e.Value)
+	case *scribble.Var:
+		if e.Name == scribble.Self {
+			return "s.ep.self"
+		}
+		if g.indices[e.Name] {
+			return e.Name
+		}
+		if s != nil {
+			if loop := s.Loop(e.Name); loop != nil {
+				return fmt.Sprintf("s.ep.sstack.find(%d).curr", loop.ID)
+			}
+		}
+		return fmt.Sprintf("ProtoParam[%q]", e.Name)
+	case *scribble.BinExpr:
+		if e.Op == "mod" {
+			g.mod = true
+			return fmt.Sprintf("mod(%s, %s)", g.expr(s, e.X), g.expr(s, e.Y))
+		}
+		return fmt.Sprintf("(%s %s %s)", g.expr(s, e.X), e.Op, g.expr(s, e.Y))
+	}
+	panic(fmt.Sprintf("unknown expression %T", e))
+}
+
+// participant returns the Go expression of the name of the participant ref
+// in state s, e.g. transport.Name("A", j) for A[j].
+func (g *generator) participant(s *scribble.State, ref *scribble.RoleRef) string {
+	if ref.Index == nil {
+		return strconv.Quote(ref.Name)
+	}
+	return fmt.Sprintf("transport.Name(%q, %s)", ref.Name, g.expr(s, ref.Index))
+}
+
+// roleName returns the role reference as an identifier, e.g. A[j] is Aj and
+// A[(i mod k)+1] is AiModkPlus1.
+func roleName(ref *scribble.RoleRef) string {
+	if ref.Index == nil {
+		return ref.Name
+	}
+	return ref.Name + indexName(ref.Index)
+}
+
+var opNames = map[string]string{"+": "Plus", "-": "Minus", "mod": "Mod"}
+
+func indexName(e scribble.Expr) string {
+	if e, ok := e.(*scribble.BinExpr); ok {
+		return indexName(e.X) + opNames[e.Op] + indexName(e.Y)
+	}
+	return e.String()
+}
+
+func params(types []string) string {
+	ps := make([]string, len(types))
+	for i, typ := range types {
+		ps[i] = payloadName(i, len(types)) + " " + typ
+	}
+	return strings.Join(ps, ", ")
+}
+
+func payloadName(i, n int) string {
+	if n == 1 {
+		return "v"
+	}
+	return "v" + strconv.Itoa(i+1)
+}
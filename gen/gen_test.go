@@ -0,0 +1,217 @@
+package gen
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/scribble"
+)
+
+const exampleDir = "../example"
+
+func project(t *testing.T, filename, role string) *scribble.Local {
+	t.Helper()
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := scribble.Parse(filename, string(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := scribble.Check(p); err != nil {
+		t.Fatal(err)
+	}
+	l, err := scribble.Project(p, role)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return l
+}
+
+// TestExampleUpToDate checks the generated example is the same as the
+// output of the generator, run go generate in example/nested if not.
+func TestExampleUpToDate(t *testing.T) {
+	examples := []struct {
+		name  string
+		roles []string
+	}{
+		{"nested", []string{"Coordinator", "A"}},
+		{"branching", []string{"Coordinator", "A"}},
+		{"rounds", []string{"Coordinator", "A"}},
+		{"scatter", []string{"Master", "W", "R"}},
+		{"ring", []string{"Coordinator", "A"}},
+	}
+	for _, ex := range examples {
+		example := ex.name
+		for _, role := range ex.roles {
+			pkg := PackageName(role)
+			dir := filepath.Join(exampleDir, example)
+			files, err := Generate(project(t, filepath.Join(dir, example+".scr"), role), pkg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for name, src := range files {
+				committed, err := ioutil.ReadFile(filepath.Join(dir, pkg, name))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(src, committed) {
+					t.Errorf("%s/%s/%s is out of date, run go generate", example, pkg, name)
+				}
+			}
+		}
+	}
+}
+
+func TestGenerateSignatures(t *testing.T) {
+	tests := []struct {
+		example    string
+		role       string
+		signatures []string
+	}{
+		{
+			example: "nested",
+			role:    "Coordinator",
+			signatures: []string{
+				"func New(conn transport.Conn) (*S0, error)",
+				"func (s *S0) Foreach(bodyFn func(*S1) *S4) *SEnd",
+				"func (s *S1) Foreach(bodyFn func(*S2) *S5) *S3",
+				"func (s *S2) Send_Aj_foo(v int) *S5",
+				`s.ep.send(2, transport.Name("A", s.ep.sstack.find(1).curr), "foo", v)`,
+				`Trace.Record(trace.Event{Kind: trace.Iterate, State: 1, Loop: 1, Index: "j", Value: sstack.top().curr})`,
+				"func (s *S3) Send_Ai_bar(v string) *S4",
+			},
+		},
+		{
+			example: "nested",
+			role:    "A",
+			signatures: []string{
+				"func New(self int, conn transport.Conn) (*S0, error)",
+				"func (s *S0) Foreach(bodyFn func(*S1) *S4) *SEnd",
+				"func (s *S1) Recv_Coordinator_foo() (int, *S2)",
+				`payload := s.ep.recv(1, "Coordinator", "foo")`,
+				"return payload[0].(int), &S2{ep: s.ep}",
+				"func (s *S2) IfSelf(thenFn func(*S3) *S4) *S4",
+				"if s.ep.self == s.ep.sstack.find(0).curr {",
+				"func (s *S3) Recv_Coordinator_bar() (string, *S4)",
+			},
+		},
+		{
+			example: "branching",
+			role:    "Coordinator",
+			signatures: []string{
+				"func (s *S1) Foreach(bodyFn func(*S2) *S7) *S5",
+				"func (s *S2) Send_Aj_ok(v int) *S7",
+				"func (s *S2) Send_Aj_fail(v string) *S7",
+			},
+		},
+		{
+			example: "rounds",
+			role:    "Coordinator",
+			signatures: []string{
+				"func (s *S0) Foreach(bodyFn func(*S1) *S8) *S3",
+				"func (s *S3) Foreach_more(bodyFn func(*S5) *S9) *S0",
+				"func (s *S3) Foreach_stop(bodyFn func(*S7) *S10) *SEnd",
+			},
+		},
+		{
+			example: "branching",
+			role:    "A",
+			signatures: []string{
+				"func (s *S0) Foreach(bodyFn func(*S1) *S6) *SEnd",
+				"func (s *S1) Branch() string",
+				"func (s *S1) Recv_Coordinator_ok() (int, *S4)",
+				"func (s *S1) Recv_Coordinator_fail() (string, *S4)",
+			},
+		},
+		{
+			example: "scatter",
+			role:    "R",
+			signatures: []string{
+				"func New(self int, conn transport.Conn) (*S0, error)",
+				`for _, name := range []string{"n", "m"} {`,
+				`if lo, hi := 1, ProtoParam["m"]; self < lo || self > hi {`,
+				`sstack.push(0, 1, ProtoParam["n"])`,
+				"func (s *S1) Recv_Wi_partial() (int, *S3)",
+			},
+		},
+		{
+			example: "ring",
+			role:    "A",
+			signatures: []string{
+				"func (s *S4) Send_AiModkPlus1_token(v int) *S5",
+				`if s.ep.self == (mod(s.ep.sstack.find(2).curr, ProtoParam["k"]) + 1) {`,
+				"func (s *S9) Send_AiPlus1_value(v int) *S10",
+				"if s.ep.self == (s.ep.sstack.find(7).curr + 1) {",
+				"func mod(x, y int) int {",
+			},
+		},
+		{
+			example: "scatter",
+			role:    "W",
+			signatures: []string{
+				`sstack.push(1, 1, ProtoParam["m"])`,
+				"func (s *S2) Send_Rj_partial(v int) *S3",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.example+"/"+test.role, func(t *testing.T) {
+			filename := filepath.Join(exampleDir, test.example, test.example+".scr")
+			files, err := Generate(project(t, filename, test.role), PackageName(test.role))
+			if err != nil {
+				t.Fatal(err)
+			}
+			src := string(files["proto.go"])
+			for _, sig := range test.signatures {
+				if !strings.Contains(src, sig) {
+					t.Errorf("expected %q in generated code:\n%s", sig, src)
+				}
+			}
+		})
+	}
+}
+
+// TestRuntime generates the runtime of every API into a temporary package
+// with the tests in testdata/runtime, and runs them.
+func TestRuntime(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go test")
+	}
+	goTool, err := exec.LookPath("go")
+	if err != nil {
+		t.Skip(err)
+	}
+	// The package must be in the module to import stacktest, _ hides it
+	// from ./...
+	dir, err := ioutil.TempDir(".", "_runtime")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	var rt bytes.Buffer
+	if err := runtimeTmpl.Execute(&rt, struct{ Package string }{"runtime"}); err != nil {
+		t.Fatal(err)
+	}
+	test, err := ioutil.ReadFile(filepath.Join("testdata", "runtime", "foreach_test.go"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "foreach.go"), rt.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "foreach_test.go"), test, 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(goTool, "test", ".")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("%v:\n%s", err, out)
+	}
+}
@@ -0,0 +1,110 @@
+package gen
+
+// runtime is the common code for nested FSM tracking in generated APIs.
+//
+// It is the same as final/foreach.go, except that foreach states keep the
+// index values of the loop (rather than counting iterations from 0) so that
+// index variables can be looked up by generated code with find.
+const runtime = `// Code generated by scribblegen. DO NOT EDIT.
+
+package {{.Package}}
+
+// This file contains common code for nested FSM tracking.
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Misuse of the API, or a peer which does not follow the protocol, panics
+// with an error wrapping one of these errors or the error of the connection.
+var (
+	ErrResourceUsed    = errors.New("resource used")
+	ErrPopEmptyStack   = errors.New("cannot pop: stack empty")
+	ErrNoForeach       = errors.New("foreach not on the stack")
+	ErrUnexpectedLabel = errors.New("unexpected label")
+)
+
+type resource struct {
+	used bool
+}
+
+func (res *resource) Use() {
+	if res.used {
+		panic(ErrResourceUsed)
+	}
+	res.used = true
+}
+
+// foreachState keeps track of foreach loop index in code.
+type foreachState struct {
+	ID         int // ID is the unique sub-FSM ID
+	curr, last int // curr/last is the current/last index of the foreach
+}
+
+// canEnter returns true if the current index is within foreach bounds.
+func (state *foreachState) canEnter() bool {
+	return state.curr <= state.last
+}
+
+func (state *foreachState) increment() { state.curr++ }
+
+func (state *foreachState) String() string {
+	return fmt.Sprintf("{%d: %d/%d}", state.ID, state.curr, state.last)
+}
+
+// fsmStack is a data structure shared between the states.
+type fsmStack struct {
+	index int             // top of stack, i.e. the current stack element
+	stack []*foreachState // the stack of states
+}
+
+func newStack() *fsmStack {
+	return new(fsmStack)
+}
+
+func (s *fsmStack) top() *foreachState {
+	if len(s.stack) > 0 { // s.index is -1 after popping the last state
+		return s.stack[s.index]
+	}
+	return nil
+}
+
+// find returns the innermost foreach state of the sub-FSM ID.
+func (s *fsmStack) find(ID int) *foreachState {
+	for i := len(s.stack) - 1; i >= 0; i-- {
+		if s.stack[i].ID == ID {
+			return s.stack[i]
+		}
+	}
+	panic(fmt.Errorf("%w (ID: %d) in %v", ErrNoForeach, ID, s))
+}
+
+func (s *fsmStack) push(ID, first, last int) {
+	newForeach := foreachState{
+		ID:   ID,
+		curr: first,
+		last: last,
+	}
+	s.stack = append(s.stack, &newForeach)
+	s.index = len(s.stack) - 1 // cached top index
+}
+
+func (s *fsmStack) pop() {
+	stacksize := len(s.stack) // don't rely on s.index
+	if stacksize > 0 {
+		s.stack[stacksize-1] = nil // don't keep the popped state in the backing array
+		s.stack, s.index = s.stack[:stacksize-1], stacksize-2
+	} else {
+		panic(ErrPopEmptyStack)
+	}
+}
+
+func (s fsmStack) isEmpty() bool {
+	return s.stack == nil || len(s.stack) == 0
+}
+
+func (s fsmStack) String() string {
+	return fmt.Sprintf("stack %v@%d", s.stack, s.index)
+}
+`
@@ -0,0 +1,86 @@
+// TestRuntime in package gen generates foreach.go from the runtime template
+// next to this file and runs these tests.
+package runtime
+
+import (
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/panictest"
+	"github.com/nickng/scribble-foreach-experiment/stacktest"
+)
+
+// stack adapts fsmStack to the reference model of stacktest.
+type stack struct{ *fsmStack }
+
+func newAdapter() stacktest.Stack { return stack{newStack()} }
+
+func (s stack) Push(ID, first, last int) { s.push(ID, first, last) }
+func (s stack) Increment()               { s.top().increment() }
+func (s stack) Pop()                     { s.pop() }
+func (s stack) CanEnter() bool           { return s.top().canEnter() }
+
+func (s stack) Find(ID int) int {
+	state := s.find(ID)
+	for i := range s.stack {
+		if s.stack[i] == state {
+			return i
+		}
+	}
+	return -1
+}
+
+func (s stack) Snapshot() stacktest.Snapshot {
+	snap := stacktest.Snapshot{Empty: s.isEmpty(), Index: s.index, Top: -1}
+	top := s.top()
+	for i, state := range s.stack {
+		snap.States = append(snap.States, stacktest.State{ID: state.ID, Curr: state.curr, Last: state.last})
+		if state == top {
+			snap.Top = i
+		}
+	}
+	for _, state := range s.stack[len(s.stack):cap(s.stack)] {
+		if state != nil {
+			snap.Spare++
+		}
+	}
+	return snap
+}
+
+func TestStackEmpty(t *testing.T) {
+	s := newStack()
+	if !s.isEmpty() || s.top() != nil {
+		t.Fatalf("expected new stack to be empty but got %v", s)
+	}
+	s.push(1, 1, 2)
+	s.pop()
+	if !s.isEmpty() || s.top() != nil {
+		t.Fatalf("expected stack to be empty after pop but got %v", s)
+	}
+	// push reuses the backing array of the popped state.
+	s.push(2, 1, 3)
+	if top := s.top(); top == nil || *top != (foreachState{ID: 2, curr: 1, last: 3}) {
+		t.Fatalf("expected {2: 1/3} on top after push but got %v", s)
+	}
+}
+
+func TestStackQuick(t *testing.T) { stacktest.Quick(t, newAdapter) }
+
+func FuzzStack(f *testing.F) { stacktest.Fuzz(f, newAdapter) }
+
+func TestMisuse(t *testing.T) {
+	panictest.Run(t, nil, panictest.Cases{
+		{"UseTwice", func() {
+			var res resource
+			res.Use()
+			res.Use()
+		}, ErrResourceUsed},
+		{"PopEmpty", func() {
+			newStack().pop()
+		}, ErrPopEmptyStack},
+		{"FindMissing", func() {
+			s := newStack()
+			s.push(1, 1, 2)
+			s.find(2)
+		}, ErrNoForeach},
+	})
+}
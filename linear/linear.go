@@ -0,0 +1,853 @@
+// Package linear defines an Analyzer that checks that the states of the
+// foreach APIs are used linearly, i.e. exactly once.
+//
+// A state of an API (proto, fused, nested, recur, forrange, final, value or
+// a package generated by scribblegen) is a struct embedding the resource of
+// its package, and a method uses up its state if it calls Use on it, e.g.
+// Foreach and Send_Aj_foo but not HasNext or Branch. Using a state twice
+// panics with ErrResourceUsed at run time; the analyzer reports at compile
+// time
+//
+//   - a state which may be used more than once, e.g. in a loop without being
+//     reassigned,
+//   - a state which may be dropped without being used, including the result
+//     of a method which is discarded, and
+//   - a state used by a closure which may run more than once, e.g. a foreach
+//     body using a state of the enclosing function.
+//
+// Passing a state to a function, returning it or assigning it to another
+// variable moves the state, which counts as a use. A switch on the label
+// returned by Branch with a case for every label of the choice (each
+// Recv_<role>_<label> method of the state) always runs a case. The analysis is per
+// function and only follows local variables; the methods of the states
+// themselves are not checked.
+package linear
+
+import (
+	"fmt"
+	"go/ast"
+	"go/constant"
+	"go/token"
+	"go/types"
+	"sort"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/ctrlflow"
+	"golang.org/x/tools/go/cfg"
+)
+
+// Analyzer reports states of the foreach APIs which are not used exactly
+// once.
+var Analyzer = &analysis.Analyzer{
+	Name:      "linear",
+	Doc:       "check that the states of the foreach APIs are used exactly once",
+	Requires:  []*analysis.Analyzer{ctrlflow.Analyzer},
+	Run:       run,
+	FactTypes: []analysis.Fact{new(usesState)},
+}
+
+// usesState is the fact that a method uses up its state.
+type usesState struct{}
+
+func (*usesState) AFact()         {}
+func (*usesState) String() string { return "usesState" }
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	c := &checker{
+		pass:     pass,
+		cfgs:     pass.ResultOf[ctrlflow.Analyzer].(*ctrlflow.CFGs),
+		results:  make(map[*types.Var]bool),
+		captured: make(map[*ast.FuncLit]*captures),
+		once:     make(map[*ast.FuncLit]bool),
+		labels:   make(map[*types.Var]types.Type),
+		assigned: make(map[*types.Var]bool),
+		reported: make(map[diagnostic]bool),
+	}
+	// The facts are exported first, as the tests of an API are in the
+	// package of its states.
+	for _, file := range pass.Files {
+		for _, decl := range file.Decls {
+			if fn, ok := decl.(*ast.FuncDecl); ok && c.usesReceiver(fn) {
+				pass.ExportObjectFact(pass.TypesInfo.Defs[fn.Name], new(usesState))
+			}
+		}
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncType:
+				if n.Results == nil {
+					break
+				}
+				for _, field := range n.Results.List {
+					for _, name := range field.Names {
+						if v, ok := pass.TypesInfo.Defs[name].(*types.Var); ok {
+							c.results[v] = true
+						}
+					}
+				}
+			case *ast.CallExpr:
+				if lit, ok := ast.Unparen(n.Fun).(*ast.FuncLit); ok {
+					c.once[lit] = true
+				}
+			case *ast.AssignStmt:
+				c.labelVars(n)
+			}
+			return true
+		})
+	}
+	for _, file := range pass.Files {
+		ast.Inspect(file, func(n ast.Node) bool {
+			switch n := n.(type) {
+			case *ast.FuncDecl:
+				if n.Body == nil || c.isStateMethod(n) {
+					return false
+				}
+				c.checkFunc(n, n.Type, c.cfgs.FuncDecl(n))
+			case *ast.FuncLit:
+				c.checkFunc(n, n.Type, c.cfgs.FuncLit(n))
+			}
+			return true
+		})
+	}
+	return nil, nil
+}
+
+// isState returns true if t is a state or a pointer to a state, i.e. a
+// named struct embedding a resource with a Use method.
+func isState(t types.Type) bool {
+	if p, ok := t.(*types.Pointer); ok {
+		t = p.Elem()
+	}
+	named, ok := t.(*types.Named)
+	if !ok {
+		return false
+	}
+	st, ok := named.Underlying().(*types.Struct)
+	if !ok {
+		return false
+	}
+	for i := 0; i < st.NumFields(); i++ {
+		if f := st.Field(i); f.Embedded() && f.Name() == "resource" {
+			use, _, _ := types.LookupFieldOrMethod(f.Type(), true, f.Pkg(), "Use")
+			_, ok := use.(*types.Func)
+			return ok
+		}
+	}
+	return false
+}
+
+// checker checks the functions of a package.
+type checker struct {
+	pass     *analysis.Pass
+	cfgs     *ctrlflow.CFGs
+	results  map[*types.Var]bool // results are the named results, which are not followed
+	captured map[*ast.FuncLit]*captures
+	once     map[*ast.FuncLit]bool     // once are the closures called where they are defined
+	labels   map[*types.Var]types.Type // labels are the variables defined by label := s.Branch(), with the type of s
+	assigned map[*types.Var]bool       // assigned are the variables assigned after their definition
+	reported map[diagnostic]bool
+}
+
+type diagnostic struct {
+	pos token.Pos
+	msg string
+}
+
+func (c *checker) reportf(pos token.Pos, format string, args ...interface{}) {
+	d := diagnostic{pos, fmt.Sprintf(format, args...)}
+	if !c.reported[d] {
+		c.reported[d] = true
+		c.pass.Reportf(pos, "%s", d.msg)
+	}
+}
+
+// receiver returns the receiver of a method declaration, or nil.
+func (c *checker) receiver(fn *ast.FuncDecl) *types.Var {
+	obj, ok := c.pass.TypesInfo.Defs[fn.Name].(*types.Func)
+	if !ok {
+		return nil
+	}
+	return obj.Type().(*types.Signature).Recv()
+}
+
+// isStateMethod returns true if fn is a method of a state.
+func (c *checker) isStateMethod(fn *ast.FuncDecl) bool {
+	recv := c.receiver(fn)
+	return recv != nil && isState(recv.Type())
+}
+
+// usesReceiver returns true if fn is the Use method of a resource, or a
+// method of a state calling Use on its receiver.
+func (c *checker) usesReceiver(fn *ast.FuncDecl) bool {
+	recv := c.receiver(fn)
+	if recv == nil || fn.Body == nil {
+		return false
+	}
+	if fn.Name.Name == "Use" {
+		t := recv.Type()
+		if p, ok := t.(*types.Pointer); ok {
+			t = p.Elem()
+		}
+		if named, ok := t.(*types.Named); ok && named.Obj().Name() == "resource" {
+			return true
+		}
+	}
+	if !isState(recv.Type()) {
+		return false
+	}
+	uses := false
+	ast.Inspect(fn.Body, func(n ast.Node) bool {
+		if call, ok := n.(*ast.CallExpr); ok {
+			if sel, ok := call.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == "Use" {
+				if id, ok := ast.Unparen(sel.X).(*ast.Ident); ok && c.pass.TypesInfo.Uses[id] == recv {
+					uses = true
+				}
+			}
+		}
+		return !uses
+	})
+	return uses
+}
+
+// tracked returns true if v is a local variable holding a state.
+func (c *checker) tracked(v *types.Var) bool {
+	return v != nil && !v.IsField() && v.Parent() != nil && v.Parent() != c.pass.Pkg.Scope() &&
+		!c.results[v] && isState(v.Type())
+}
+
+// usesState returns true if the method selected by sel uses up its state.
+func (c *checker) usesState(sel *ast.SelectorExpr) bool {
+	selection, ok := c.pass.TypesInfo.Selections[sel]
+	if !ok || selection.Kind() != types.MethodVal {
+		return false
+	}
+	return c.pass.ImportObjectFact(selection.Obj(), new(usesState))
+}
+
+// checkFunc checks the states used in the function fn, its parameters must
+// be used before it returns.
+func (c *checker) checkFunc(fn ast.Node, typ *ast.FuncType, g *cfg.CFG) {
+	c.follow(fn, typ, g, true, nil)
+}
+
+// follow follows the states through the blocks of the function fn to a
+// fixed point, then goes through each block once to report, or to collect
+// the captures of a closure in cs.
+func (c *checker) follow(fn ast.Node, typ *ast.FuncType, g *cfg.CFG, report bool, cs *captures) {
+	if g == nil || len(g.Blocks) == 0 {
+		return
+	}
+	fc := &flowChecker{checker: c, fn: fn, errs: make(map[*types.Var][]*types.Var)}
+	entry := newFlow()
+	if typ.Params != nil {
+		for _, field := range typ.Params.List {
+			for _, name := range field.Names {
+				if v, ok := c.pass.TypesInfo.Defs[name].(*types.Var); ok && c.tracked(v) {
+					entry.pending[v] = map[token.Pos]bool{name.Pos(): true}
+				}
+			}
+		}
+	}
+
+	// The flow at the entry of each block is computed to a fixed point,
+	// then each block is checked once.
+	in := make([]*flow, len(g.Blocks))
+	in[0] = entry
+	for changed := true; changed; {
+		changed = false
+		for _, b := range g.Blocks {
+			if !b.Live || in[b.Index] == nil || c.exhaustive(b) {
+				continue
+			}
+			out := fc.block(b, in[b.Index].copy(), false)
+			for _, succ := range b.Succs {
+				if merged := out.merge(in[succ.Index]); !merged.equal(in[succ.Index]) {
+					in[succ.Index] = merged
+					changed = true
+				}
+			}
+		}
+	}
+	fc.cs = cs
+	for _, b := range g.Blocks {
+		if b.Live && in[b.Index] != nil && !c.exhaustive(b) {
+			fc.block(b, in[b.Index].copy(), report)
+		}
+	}
+}
+
+// labelVars records the variables of as holding the label of a Branch, and
+// the variables assigned again.
+func (c *checker) labelVars(as *ast.AssignStmt) {
+	for _, e := range as.Lhs {
+		if id, ok := ast.Unparen(e).(*ast.Ident); ok {
+			if v, ok := c.pass.TypesInfo.Uses[id].(*types.Var); ok {
+				c.assigned[v] = true
+			}
+		}
+	}
+	if as.Tok != token.DEFINE || len(as.Lhs) != 1 || len(as.Rhs) != 1 {
+		return
+	}
+	id, ok := as.Lhs[0].(*ast.Ident)
+	if !ok {
+		return
+	}
+	if v, ok := c.pass.TypesInfo.Defs[id].(*types.Var); ok {
+		if t := c.branchOf(as.Rhs[0]); t != nil {
+			c.labels[v] = t
+		}
+	}
+}
+
+// branchOf returns the type of the state s if e is s.Branch(), or the
+// variable of a label := s.Branch() which is not assigned again.
+func (c *checker) branchOf(e ast.Expr) types.Type {
+	switch e := ast.Unparen(e).(type) {
+	case *ast.Ident:
+		if v, ok := c.pass.TypesInfo.Uses[e].(*types.Var); ok && !c.assigned[v] {
+			return c.labels[v]
+		}
+	case *ast.CallExpr:
+		sel, ok := ast.Unparen(e.Fun).(*ast.SelectorExpr)
+		if !ok || sel.Sel.Name != "Branch" || len(e.Args) != 0 {
+			return nil
+		}
+		if t := c.pass.TypesInfo.TypeOf(sel.X); t != nil && isState(t) {
+			return t
+		}
+	}
+	return nil
+}
+
+// exhaustive returns true if b is the block after the last case of a
+// switch on the label of a Branch, which is never run as the switch has a
+// case for every label of the choice.
+func (c *checker) exhaustive(b *cfg.Block) bool {
+	if b.Kind != cfg.KindSwitchNextCase || len(b.Nodes) > 0 || len(b.Succs) != 1 || b.Succs[0].Kind != cfg.KindSwitchDone {
+		return false
+	}
+	sw, ok := b.Succs[0].Stmt.(*ast.SwitchStmt)
+	if !ok || sw.Tag == nil {
+		return false
+	}
+	t := c.branchOf(sw.Tag)
+	if t == nil {
+		return false
+	}
+	cases := make(map[string]bool)
+	for _, clause := range sw.Body.List {
+		for _, e := range clause.(*ast.CaseClause).List {
+			if tv := c.pass.TypesInfo.Types[e]; tv.Value != nil && tv.Value.Kind() == constant.String {
+				cases[constant.StringVal(tv.Value)] = true
+			}
+		}
+	}
+	labels := 0
+	ms := types.NewMethodSet(t)
+	for i := 0; i < ms.Len(); i++ {
+		if parts := strings.SplitN(ms.At(i).Obj().Name(), "_", 3); len(parts) == 3 && parts[0] == "Recv" {
+			if !cases[parts[2]] {
+				return false
+			}
+			labels++
+		}
+	}
+	return labels > 0
+}
+
+// flow is what is known of the states at a point of a function.
+type flow struct {
+	used    map[*types.Var]token.Pos          // used are the states which may have been used, at
+	pending map[*types.Var]map[token.Pos]bool // pending are the states which may not be used, assigned at
+}
+
+func newFlow() *flow {
+	return &flow{used: make(map[*types.Var]token.Pos), pending: make(map[*types.Var]map[token.Pos]bool)}
+}
+
+func (f *flow) copy() *flow {
+	return f.merge(nil)
+}
+
+// merge returns the union of f and g, g may be nil.
+func (f *flow) merge(g *flow) *flow {
+	m := newFlow()
+	for _, from := range []*flow{f, g} {
+		if from == nil {
+			continue
+		}
+		for v, pos := range from.used {
+			if at, ok := m.used[v]; !ok || pos < at {
+				m.used[v] = pos
+			}
+		}
+		for v, sites := range from.pending {
+			if m.pending[v] == nil {
+				m.pending[v] = make(map[token.Pos]bool)
+			}
+			for pos := range sites {
+				m.pending[v][pos] = true
+			}
+		}
+	}
+	return m
+}
+
+func (f *flow) equal(g *flow) bool {
+	if g == nil || len(f.used) != len(g.used) || len(f.pending) != len(g.pending) {
+		return false
+	}
+	for v, pos := range f.used {
+		if at, ok := g.used[v]; !ok || at != pos {
+			return false
+		}
+	}
+	for v, sites := range f.pending {
+		if len(sites) != len(g.pending[v]) {
+			return false
+		}
+		for pos := range sites {
+			if !g.pending[v][pos] {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// flowChecker follows the states through the blocks of a function.
+type flowChecker struct {
+	*checker
+	fn     ast.Node                    // fn is the *ast.FuncDecl or *ast.FuncLit checked
+	errs   map[*types.Var][]*types.Var // errs are the states assigned with each error
+	cs     *captures                   // cs collects the captures if fn is a closure
+	f      *flow
+	report bool
+}
+
+// block returns the flow at the end of b given the flow f at its entry.
+func (fc *flowChecker) block(b *cfg.Block, f *flow, report bool) *flow {
+	fc.f, fc.report = f, report
+	if err := fc.failed(b); err != nil {
+		// The states returned with a non-nil error are nil.
+		for _, v := range fc.errs[err] {
+			delete(f.pending, v)
+		}
+	}
+	w := &walker{checker: fc.checker, v: fc}
+	w.block(b)
+	if b.Return() != nil {
+		for _, v := range sortedVars(f.pending) {
+			if !fc.local(v) {
+				if fc.cs != nil {
+					fc.cs.fresh[v] = true
+				}
+				continue
+			}
+			for _, pos := range sortedPos(f.pending[v]) {
+				fc.reportf(pos, "%s may be dropped without being used", v.Name())
+			}
+		}
+		// A closure which may run again must leave the states it captures
+		// unused, e.g. by assigning the next state.
+		if lit, ok := fc.fn.(*ast.FuncLit); ok && !fc.once[lit] {
+			var captured []*types.Var
+			for v := range f.used {
+				if !fc.local(v) {
+					captured = append(captured, v)
+				}
+			}
+			sort.Slice(captured, func(i, j int) bool { return f.used[captured[i]] < f.used[captured[j]] })
+			for _, v := range captured {
+				fc.reportf(f.used[v], "%s is used in a closure which may run more than once", v.Name())
+			}
+		}
+	}
+	return f
+}
+
+// failed returns the error variable which is not nil in b, if b is the
+// branch of if err != nil (or the else branch of if err == nil).
+func (fc *flowChecker) failed(b *cfg.Block) *types.Var {
+	stmt, ok := b.Stmt.(*ast.IfStmt)
+	if !ok || b.Kind != cfg.KindIfThen && b.Kind != cfg.KindIfElse {
+		return nil
+	}
+	cond, ok := ast.Unparen(stmt.Cond).(*ast.BinaryExpr)
+	if !ok || (cond.Op == token.NEQ) != (b.Kind == cfg.KindIfThen) || cond.Op != token.NEQ && cond.Op != token.EQL {
+		return nil
+	}
+	x, y := cond.X, cond.Y
+	if isNil(fc.pass.TypesInfo, x) {
+		x, y = y, x
+	}
+	if id, ok := ast.Unparen(x).(*ast.Ident); ok && isNil(fc.pass.TypesInfo, y) {
+		v, _ := fc.pass.TypesInfo.Uses[id].(*types.Var)
+		return v
+	}
+	return nil
+}
+
+// local returns true if v is declared in the function checked, rather than
+// captured from an enclosing function.
+func (fc *flowChecker) local(v *types.Var) bool {
+	return fc.fn.Pos() <= v.Pos() && v.Pos() < fc.fn.End()
+}
+
+func (fc *flowChecker) reportf(pos token.Pos, format string, args ...interface{}) {
+	if fc.report {
+		fc.checker.reportf(pos, format, args...)
+	}
+}
+
+func (fc *flowChecker) use(v *types.Var, at token.Pos) {
+	if !fc.tracked(v) {
+		return
+	}
+	if first, ok := fc.f.used[v]; ok {
+		if first == at {
+			fc.reportf(at, "%s is used again in the next iteration of the loop", v.Name())
+		} else {
+			fc.reportf(at, "%s may be used more than once (already used at line %d)", v.Name(), fc.pass.Fset.Position(first).Line)
+		}
+	} else {
+		fc.f.used[v] = at
+	}
+	delete(fc.f.pending, v)
+	if fc.cs != nil && !fc.local(v) {
+		if first, ok := fc.cs.uses[v]; !ok || at < first {
+			fc.cs.uses[v] = at
+		}
+	}
+}
+
+func (fc *flowChecker) returnedWith(err *types.Var, states []*types.Var) {
+	fc.errs[err] = states
+}
+
+func (fc *flowChecker) assign(v *types.Var, at token.Pos, fresh bool) {
+	if !fc.tracked(v) {
+		return
+	}
+	if len(fc.f.pending[v]) > 0 {
+		fc.reportf(at, "%s is reassigned before it is used", v.Name())
+	}
+	delete(fc.f.used, v)
+	delete(fc.f.pending, v)
+	if fresh {
+		fc.f.pending[v] = map[token.Pos]bool{at: true}
+	}
+}
+
+// captures are the states of the enclosing functions used by a closure.
+type captures struct {
+	uses  map[*types.Var]token.Pos // uses are the states used, at their first use
+	fresh map[*types.Var]bool      // fresh are the states which may be assigned but not used when it returns
+}
+
+// captures returns the captures of the closure lit.
+func (c *checker) captures(lit *ast.FuncLit) *captures {
+	if cs, ok := c.captured[lit]; ok {
+		return cs
+	}
+	cs := &captures{uses: make(map[*types.Var]token.Pos), fresh: make(map[*types.Var]bool)}
+	c.captured[lit] = cs
+	c.follow(lit, lit.Type, c.cfgs.FuncLit(lit), false, cs)
+	return cs
+}
+
+// walker walks the nodes of a block in the order they are evaluated.
+type walker struct {
+	*checker
+	v *flowChecker
+}
+
+func (w *walker) block(b *cfg.Block) {
+	if b.Kind == cfg.KindRangeBody {
+		rs := b.Stmt.(*ast.RangeStmt)
+		for _, e := range []ast.Expr{rs.Key, rs.Value} {
+			if id, ok := e.(*ast.Ident); ok {
+				if v := w.variable(id); v != nil {
+					w.v.assign(v, id.Pos(), isState(v.Type()))
+				}
+			}
+		}
+	}
+	for _, n := range b.Nodes {
+		w.node(n)
+	}
+}
+
+func (w *walker) node(n ast.Node) {
+	switch n := n.(type) {
+	case *ast.AssignStmt:
+		if n.Tok != token.DEFINE && n.Tok != token.ASSIGN {
+			w.exprs(n.Rhs)
+			w.exprs(n.Lhs)
+			return
+		}
+		w.assign(n.Lhs, n.Rhs)
+	case *ast.ValueSpec:
+		lhs := make([]ast.Expr, len(n.Names))
+		for i, name := range n.Names {
+			lhs[i] = name
+		}
+		w.assign(lhs, n.Values)
+	case *ast.ExprStmt:
+		w.expr(n.X)
+		if call, ok := ast.Unparen(n.X).(*ast.CallExpr); ok && w.returnsState(call) {
+			w.v.reportf(call.Pos(), "state returned by %s is dropped without being used", callee(call))
+		}
+	case *ast.ReturnStmt:
+		for _, r := range n.Results {
+			w.expr(r)
+			w.move(r)
+		}
+	case *ast.SendStmt:
+		w.expr(n.Chan)
+		w.expr(n.Value)
+		w.move(n.Value)
+	case *ast.IncDecStmt:
+		w.expr(n.X)
+	case *ast.GoStmt:
+		w.expr(n.Call)
+	case *ast.DeferStmt:
+		w.expr(n.Call)
+	case ast.Expr:
+		w.expr(n)
+	}
+}
+
+// assign assigns rhs to lhs, rhs may be empty in a var declaration.
+func (w *walker) assign(lhs, rhs []ast.Expr) {
+	w.exprs(rhs)
+	if len(lhs) == len(rhs) {
+		for _, e := range rhs {
+			w.move(e)
+		}
+	}
+	// The states returned with an error, e.g. by New, are nil if the
+	// error is not.
+	var (
+		err    *types.Var
+		states []*types.Var
+	)
+	var tuple *types.Tuple
+	if len(rhs) == 1 && len(lhs) > 1 {
+		tuple, _ = w.pass.TypesInfo.TypeOf(rhs[0]).(*types.Tuple)
+	}
+	for i, e := range lhs {
+		id, ok := ast.Unparen(e).(*ast.Ident)
+		if !ok {
+			w.expr(e)
+			continue
+		}
+		var t types.Type
+		fresh := true
+		switch {
+		case len(rhs) == 0:
+			fresh = false
+		case tuple == nil:
+			t = w.pass.TypesInfo.TypeOf(rhs[i])
+			fresh = !isNil(w.pass.TypesInfo, rhs[i])
+		case i < tuple.Len():
+			t = tuple.At(i).Type()
+		}
+		if id.Name == "_" {
+			if t != nil && isState(t) && !returnsError(tuple) {
+				w.v.reportf(id.Pos(), "state assigned to _ is dropped without being used")
+			}
+			continue
+		}
+		v := w.variable(id)
+		if v == nil {
+			continue
+		}
+		w.v.assign(v, id.Pos(), fresh)
+		if tuple != nil && types.Identical(t, errorType) {
+			err = v
+		} else if tuple != nil && isState(t) {
+			states = append(states, v)
+		}
+	}
+	if err != nil && len(states) > 0 {
+		w.v.returnedWith(err, states)
+	}
+}
+
+var errorType = types.Universe.Lookup("error").Type()
+
+// returnsError returns true if a result of tuple is an error.
+func returnsError(tuple *types.Tuple) bool {
+	for i := 0; tuple != nil && i < tuple.Len(); i++ {
+		if types.Identical(tuple.At(i).Type(), errorType) {
+			return true
+		}
+	}
+	return false
+}
+
+// variable returns the variable defined or assigned by id.
+func (w *walker) variable(id *ast.Ident) *types.Var {
+	if v, ok := w.pass.TypesInfo.Defs[id].(*types.Var); ok {
+		return v
+	}
+	v, _ := w.pass.TypesInfo.Uses[id].(*types.Var)
+	return v
+}
+
+func (w *walker) exprs(es []ast.Expr) {
+	for _, e := range es {
+		w.expr(e)
+	}
+}
+
+func (w *walker) expr(e ast.Expr) {
+	if e == nil {
+		return
+	}
+	ast.Inspect(e, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			w.closure(n)
+			return false
+		case *ast.CallExpr:
+			w.call(n)
+			return false
+		case *ast.CompositeLit:
+			for _, elt := range n.Elts {
+				if kv, ok := elt.(*ast.KeyValueExpr); ok {
+					w.expr(kv.Key)
+					elt = kv.Value
+				}
+				w.expr(elt)
+				w.move(elt)
+			}
+			return false
+		}
+		return true
+	})
+}
+
+// call walks the receiver and the arguments of call before the call uses
+// its receiver; an argument passed as a state is moved.
+func (w *walker) call(call *ast.CallExpr) {
+	sel, isMethod := ast.Unparen(call.Fun).(*ast.SelectorExpr)
+	if lit, ok := ast.Unparen(call.Fun).(*ast.FuncLit); ok {
+		w.closure(lit)
+	} else if isMethod {
+		w.expr(sel.X)
+	} else {
+		w.expr(call.Fun)
+	}
+	sig, _ := w.pass.TypesInfo.TypeOf(call.Fun).(*types.Signature)
+	for i, arg := range call.Args {
+		w.expr(arg)
+		if sig != nil && isState(paramType(sig, i)) {
+			w.move(arg)
+		}
+	}
+	if isMethod && w.usesState(sel) {
+		w.move(sel.X)
+	}
+}
+
+// closure moves the captured states used by lit into lit, and the states
+// lit leaves fresh out of it.
+func (w *walker) closure(lit *ast.FuncLit) {
+	cs := w.captures(lit)
+	var used, fresh []*types.Var
+	for v := range cs.uses {
+		used = append(used, v)
+	}
+	for v := range cs.fresh {
+		fresh = append(fresh, v)
+	}
+	sort.Slice(used, func(i, j int) bool { return cs.uses[used[i]] < cs.uses[used[j]] })
+	sort.Slice(fresh, func(i, j int) bool { return fresh[i].Pos() < fresh[j].Pos() })
+	for _, v := range used {
+		w.v.use(v, lit.Pos())
+	}
+	for _, v := range fresh {
+		w.v.assign(v, lit.Pos(), true)
+	}
+}
+
+// move uses the state e if e is a variable.
+func (w *walker) move(e ast.Expr) {
+	if id, ok := ast.Unparen(e).(*ast.Ident); ok {
+		if v, ok := w.pass.TypesInfo.Uses[id].(*types.Var); ok {
+			w.v.use(v, id.Pos())
+		}
+	}
+}
+
+// returnsState returns true if call returns a state.
+func (w *walker) returnsState(call *ast.CallExpr) bool {
+	switch t := w.pass.TypesInfo.TypeOf(call).(type) {
+	case nil:
+		return false
+	case *types.Tuple:
+		for i := 0; i < t.Len(); i++ {
+			if isState(t.At(i).Type()) {
+				return true
+			}
+		}
+		return false
+	default:
+		return isState(t)
+	}
+}
+
+// paramType returns the type of the i-th argument of a call to sig.
+func paramType(sig *types.Signature, i int) types.Type {
+	params := sig.Params()
+	if sig.Variadic() && i >= params.Len()-1 {
+		if s, ok := params.At(params.Len() - 1).Type().(*types.Slice); ok {
+			return s.Elem()
+		}
+	}
+	if i < params.Len() {
+		return params.At(i).Type()
+	}
+	return types.Typ[types.Invalid]
+}
+
+func isNil(info *types.Info, e ast.Expr) bool {
+	id, ok := ast.Unparen(e).(*ast.Ident)
+	if !ok {
+		return false
+	}
+	_, ok = info.Uses[id].(*types.Nil)
+	return ok
+}
+
+// callee returns the name of the function or method called.
+func callee(call *ast.CallExpr) string {
+	switch fun := ast.Unparen(call.Fun).(type) {
+	case *ast.SelectorExpr:
+		return fun.Sel.Name
+	case *ast.Ident:
+		return fun.Name
+	}
+	return "call"
+}
+
+func sortedVars(m map[*types.Var]map[token.Pos]bool) []*types.Var {
+	vars := make([]*types.Var, 0, len(m))
+	for v := range m {
+		vars = append(vars, v)
+	}
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Pos() < vars[j].Pos() })
+	return vars
+}
+
+func sortedPos(m map[token.Pos]bool) []token.Pos {
+	pos := make([]token.Pos, 0, len(m))
+	for p := range m {
+		pos = append(pos, p)
+	}
+	sort.Slice(pos, func(i, j int) bool { return pos[i] < pos[j] })
+	return pos
+}
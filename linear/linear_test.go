@@ -0,0 +1,12 @@
+package linear_test
+
+import (
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/linear"
+	"golang.org/x/tools/go/analysis/analysistest"
+)
+
+func TestAnalyzer(t *testing.T) {
+	analysistest.Run(t, analysistest.TestData(), linear.Analyzer, "a")
+}
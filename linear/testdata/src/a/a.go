@@ -0,0 +1,189 @@
+package a
+
+import "states"
+
+func good() {
+	s := new(states.S0)
+	for s.HasNext() {
+		s1, _ := s.Next()
+		s = s1.Send_foo(1).Again()
+	}
+	s.EndForeach().End()
+}
+
+func goodCallback() {
+	new(states.S0).Foreach(func(s *states.S1) *states.S2 {
+		_, end := s.Recv_bar()
+		return end
+	}).End()
+}
+
+func goodNamedBody() {
+	body := func(s *states.S1) *states.S2 {
+		end := s.Send_foo(1)
+		return end
+	}
+	new(states.S0).Foreach(body).End()
+}
+
+func goodNew() {
+	s, err := states.New(true)
+	if err != nil {
+		return
+	}
+	s.EndForeach().End()
+}
+
+func goodOnce() {
+	s := new(states.SEnd)
+	defer func() {
+		s.End()
+	}()
+}
+
+func goodValue() {
+	states.V{}.Next().End()
+}
+
+func goodMove(s *states.S0) {
+	end(s.EndForeach())
+}
+
+func end(s *states.SEnd) {
+	s.End()
+}
+
+// fused is the bug of fusedRun: s2 is not assigned in the loop.
+func fused(k int) {
+	s1 := new(states.S0)
+	s2, _ := s1.Next() // want `s2 may be dropped without being used`
+	for i := 0; i < k; i++ {
+		s2.Send_foo(i).Again().EndForeach().End() // want `s2 is used again in the next iteration of the loop`
+	}
+}
+
+func twice() {
+	s := new(states.S0)
+	s.EndForeach().End()
+	s.EndForeach().End() // want `s may be used more than once \(already used at line 67\)`
+}
+
+func twiceValue() {
+	v := states.V{}
+	v.End()
+	v.End() // want `v may be used more than once`
+}
+
+func dropped(ok bool) {
+	s := new(states.S0) // want `s may be dropped without being used`
+	if ok {
+		s.EndForeach().End()
+	}
+}
+
+func droppedParam(s *states.S1) { // want `s may be dropped without being used`
+}
+
+func droppedResult(s *states.S0) {
+	s.EndForeach() // want `state returned by EndForeach is dropped without being used`
+}
+
+func droppedBlank(s *states.S1) {
+	_, _ = s.Recv_bar() // want `state assigned to _ is dropped without being used`
+}
+
+func reassigned() {
+	s := new(states.SEnd)
+	s = new(states.SEnd) // want `s is reassigned before it is used`
+	s.End()
+}
+
+func droppedNew() {
+	s, err := states.New(true) // want `s may be dropped without being used`
+	if err == nil {
+		println(s.ID())
+	}
+}
+
+func captured() {
+	s := new(states.SEnd)
+	new(states.S0).Foreach(func(s1 *states.S1) *states.S2 {
+		s.End() // want `s is used in a closure which may run more than once`
+		return s1.Send_foo(1)
+	}).End()
+}
+
+func capturedAndUsed() {
+	s := new(states.SEnd)
+	func() {
+		s.End()
+	}()
+	s.End() // want `s may be used more than once`
+}
+
+// goodCaptured assigns the next state for the next run of the closure.
+func goodCaptured() {
+	s := new(states.S0)
+	new(states.S0).Foreach(func(s1 *states.S1) *states.S2 {
+		next, _ := s.Next()
+		s = next.Send_foo(1).Again()
+		return s1.Send_foo(1)
+	}).End()
+	s.EndForeach().End()
+}
+
+func staleBodyEnd() {
+	var first *states.S2
+	new(states.S0).Foreach(func(s *states.S1) *states.S2 {
+		if end := s.Send_foo(1); first == nil { // want `end may be dropped without being used`
+			first = end
+		}
+		return first // want `first is used in a closure which may run more than once`
+	}).End()
+}
+
+func goodBranch(s *states.C) *states.S2 {
+	var next *states.S2
+	label := s.Branch()
+	switch label {
+	case "ok":
+		_, next = s.Recv_A_ok()
+	case "fail":
+		_, next = s.Recv_A_fail()
+	}
+	return next
+}
+
+func goodBranchTag(s *states.C) *states.S2 {
+	switch s.Branch() {
+	case "fail":
+		_, next := s.Recv_A_fail()
+		return next
+	case "ok":
+		_, next := s.Recv_A_ok()
+		return next
+	}
+	return nil
+}
+
+func partialBranch(s *states.C) *states.S2 { // want `s may be dropped without being used`
+	var next *states.S2
+	switch s.Branch() {
+	case "ok":
+		_, next = s.Recv_A_ok()
+	}
+	return next
+}
+
+func reassignedLabel(s *states.C) *states.S2 { // want `s may be dropped without being used`
+	var next *states.S2
+	label := s.Branch()
+	label = "fail"
+	switch label {
+	case "ok":
+		_, next = s.Recv_A_ok()
+	case "fail":
+		_, next = s.Recv_A_fail()
+	}
+	return next
+}
@@ -0,0 +1,112 @@
+// Package states is an API in the style of the foreach APIs.
+package states
+
+import "errors"
+
+type resource struct {
+	used bool
+}
+
+func (res *resource) Use() {
+	if res.used {
+		panic(errors.New("resource used"))
+	}
+	res.used = true
+}
+
+// New returns the initial state, or an error.
+func New(ok bool) (*S0, error) {
+	if !ok {
+		return nil, errors.New("cannot start")
+	}
+	return new(S0), nil
+}
+
+type S0 struct {
+	resource
+}
+
+func (s *S0) ID() int { return 0 }
+
+// HasNext does not use the state.
+func (s *S0) HasNext() bool { return false }
+
+// Next is in the style of fused.
+func (s *S0) Next() (*S1, bool) {
+	s.Use()
+	return new(S1), true
+}
+
+// Foreach is in the style of final.
+func (s *S0) Foreach(bodyFn func(*S1) *S2) *SEnd {
+	s.Use()
+	bodyFn(new(S1)).end()
+	return new(SEnd)
+}
+
+func (s *S0) EndForeach() *SEnd {
+	s.Use()
+	return new(SEnd)
+}
+
+type S1 struct {
+	resource
+}
+
+func (s *S1) Send_foo(v int) *S2 {
+	s.Use()
+	return new(S2)
+}
+
+func (s *S1) Recv_bar() (string, *S2) {
+	s.Use()
+	return "", new(S2)
+}
+
+// C is a choice in the style of the generated APIs.
+type C struct {
+	resource
+}
+
+// Branch does not use the state.
+func (s *C) Branch() string { return "ok" }
+
+func (s *C) Recv_A_ok() (int, *S2) {
+	s.Use()
+	return 0, new(S2)
+}
+
+func (s *C) Recv_A_fail() (string, *S2) {
+	s.Use()
+	return "", new(S2)
+}
+
+type S2 struct {
+	resource
+}
+
+func (s *S2) end() { s.Use() }
+
+// Again is the end of a body in the style of proto.
+func (s *S2) Again() *S0 {
+	s.Use()
+	return new(S0)
+}
+
+type SEnd struct {
+	resource
+}
+
+func (s *SEnd) End() { s.Use() }
+
+// V is a value state in the style of value.
+type V struct {
+	resource
+}
+
+func (s V) Next() V {
+	s.Use()
+	return V{}
+}
+
+func (s V) End() { s.Use() }
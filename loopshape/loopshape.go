@@ -0,0 +1,367 @@
+// Package loopshape defines an Analyzer that checks the shape of the loops
+// driving the iterator style API of package proto.
+//
+// A foreach init state in the style of proto has the methods HasNext,
+// Foreach and EndForeach, which are only used correctly in the shape
+//
+//	for s.HasNext() {
+//		s1 := s.Foreach()
+//		...
+//		s = ...
+//	}
+//	s.EndForeach()
+//
+// The analyzer reports a Foreach which is not in the body of a loop on
+// HasNext of the same state, a loop on HasNext which does not call Foreach,
+// and an EndForeach which is not after the loop, e.g. inside it. Where the
+// shape can be fixed, the diagnostic suggests a fix which rewrites it to the
+// shape above:
+//
+//   - if s.HasNext() { ... } becomes a for loop,
+//   - the condition of another loop around s.Foreach becomes s.HasNext(),
+//   - the statements from s.Foreach to s.EndForeach are wrapped in a loop,
+//     and
+//   - s.EndForeach as the last statement of the loop body is moved after the
+//     loop.
+package loopshape
+
+import (
+	"go/ast"
+	"go/token"
+	"go/types"
+	"strings"
+
+	"golang.org/x/tools/go/analysis"
+	"golang.org/x/tools/go/analysis/passes/inspect"
+	"golang.org/x/tools/go/ast/inspector"
+)
+
+// Analyzer reports HasNext, Foreach and EndForeach of the proto style which
+// are not in the shape of a foreach loop.
+var Analyzer = &analysis.Analyzer{
+	Name:     "loopshape",
+	Doc:      "check the shape of the HasNext, Foreach and EndForeach loops of the proto style",
+	Requires: []*analysis.Analyzer{inspect.Analyzer},
+	Run:      run,
+}
+
+func run(pass *analysis.Pass) (interface{}, error) {
+	insp := pass.ResultOf[inspect.Analyzer].(*inspector.Inspector)
+	nodes := []ast.Node{(*ast.ForStmt)(nil), (*ast.CallExpr)(nil)}
+	insp.WithStack(nodes, func(n ast.Node, push bool, stack []ast.Node) bool {
+		if !push {
+			return true
+		}
+		switch n := n.(type) {
+		case *ast.ForStmt:
+			if v := hasNext(pass, n.Cond); v != nil && !callsForeach(pass, n.Body, v) {
+				pass.Reportf(n.Cond.Pos(), "loop on %s.HasNext() does not call %s.Foreach()", v.Name(), v.Name())
+			}
+		case *ast.CallExpr:
+			sel, ok := n.Fun.(*ast.SelectorExpr)
+			if !ok || len(n.Args) != 0 || !isIterator(pass.TypesInfo.TypeOf(sel.X)) {
+				break
+			}
+			switch sel.Sel.Name {
+			case "Foreach":
+				checkForeach(pass, n, sel, stack)
+			case "EndForeach":
+				checkEndForeach(pass, n, sel, stack)
+			}
+		}
+		return true
+	})
+	return nil, nil
+}
+
+// isIterator returns true if t is a foreach init state in the style of
+// proto, i.e. it has the methods HasNext() bool, Foreach() and EndForeach()
+// returning the next state.
+func isIterator(t types.Type) bool {
+	if t == nil {
+		return false
+	}
+	if _, ok := t.(*types.Pointer); !ok {
+		t = types.NewPointer(t)
+	}
+	mset := types.NewMethodSet(t)
+	for _, name := range []string{"HasNext", "Foreach", "EndForeach"} {
+		sel := mset.Lookup(nil, name)
+		if sel == nil {
+			return false
+		}
+		sig := sel.Type().(*types.Signature)
+		if sig.Params().Len() != 0 || sig.Results().Len() != 1 {
+			return false
+		}
+		if name == "HasNext" && !types.Identical(sig.Results().At(0).Type(), types.Typ[types.Bool]) {
+			return false
+		}
+	}
+	return true
+}
+
+// variable returns the variable e refers to, or nil.
+func variable(pass *analysis.Pass, e ast.Expr) *types.Var {
+	if id, ok := ast.Unparen(e).(*ast.Ident); ok {
+		v, _ := pass.TypesInfo.Uses[id].(*types.Var)
+		return v
+	}
+	return nil
+}
+
+// hasNext returns the state of cond if cond is s.HasNext(), or nil.
+func hasNext(pass *analysis.Pass, cond ast.Expr) *types.Var {
+	call, ok := ast.Unparen(cond).(*ast.CallExpr)
+	if !ok || len(call.Args) != 0 {
+		return nil
+	}
+	sel, ok := call.Fun.(*ast.SelectorExpr)
+	if !ok || sel.Sel.Name != "HasNext" || !isIterator(pass.TypesInfo.TypeOf(sel.X)) {
+		return nil
+	}
+	return variable(pass, sel.X)
+}
+
+// calls returns true if n calls v.method(), outside of closures.
+func calls(pass *analysis.Pass, n ast.Node, v *types.Var, method string) bool {
+	found := false
+	ast.Inspect(n, func(n ast.Node) bool {
+		switch n := n.(type) {
+		case *ast.FuncLit:
+			return false
+		case *ast.CallExpr:
+			if sel, ok := n.Fun.(*ast.SelectorExpr); ok && sel.Sel.Name == method && variable(pass, sel.X) == v {
+				found = true
+			}
+		}
+		return !found
+	})
+	return found
+}
+
+func callsForeach(pass *analysis.Pass, body *ast.BlockStmt, v *types.Var) bool {
+	return calls(pass, body, v, "Foreach")
+}
+
+func within(n, outer ast.Node) bool {
+	return outer != nil && outer.Pos() <= n.Pos() && n.End() <= outer.End()
+}
+
+// checkForeach checks that v.Foreach() is in the body of for v.HasNext(),
+// stack is the path to the call.
+func checkForeach(pass *analysis.Pass, call *ast.CallExpr, sel *ast.SelectorExpr, stack []ast.Node) {
+	v := variable(pass, sel.X)
+	if v == nil {
+		pass.Reportf(sel.Sel.Pos(), "Foreach is not called on a variable, so it cannot be guarded by HasNext")
+		return
+	}
+	name := v.Name()
+	for i := len(stack) - 2; i >= 0; i-- {
+		switch s := stack[i].(type) {
+		case *ast.FuncLit, *ast.FuncDecl:
+			i = 0 // the call is not in a loop of this function
+		case *ast.RangeStmt:
+			if within(call, s.Body) {
+				pass.Reportf(call.Pos(), "%s.Foreach() is in a range loop rather than in for %s.HasNext()", name, name)
+				return
+			}
+		case *ast.ForStmt:
+			if !within(call, s.Body) {
+				continue
+			}
+			if u := hasNext(pass, s.Cond); u == v {
+				return
+			} else if u != nil {
+				pass.Reportf(call.Pos(), "%s.Foreach() is in the loop on %s.HasNext() rather than %s.HasNext()", name, u.Name(), name)
+				return
+			}
+			d := analysis.Diagnostic{Pos: call.Pos(), Message: name + ".Foreach() is in a loop which is not on " + name + ".HasNext()"}
+			if edit, ok := loopOnHasNext(s, name); ok {
+				d.SuggestedFixes = []analysis.SuggestedFix{{Message: "Loop on " + name + ".HasNext()", TextEdits: []analysis.TextEdit{edit}}}
+			}
+			pass.Report(d)
+			return
+		case *ast.IfStmt:
+			if within(call, s.Body) && hasNext(pass, s.Cond) == v {
+				d := analysis.Diagnostic{Pos: s.Pos(), Message: name + ".Foreach() is guarded by if rather than for " + name + ".HasNext()"}
+				if s.Init == nil && s.Else == nil {
+					d.SuggestedFixes = []analysis.SuggestedFix{{
+						Message:   "Replace if with for",
+						TextEdits: []analysis.TextEdit{{Pos: s.If, End: s.If + token.Pos(len("if")), NewText: []byte("for")}},
+					}}
+				}
+				pass.Report(d)
+				return
+			}
+		}
+	}
+	d := analysis.Diagnostic{Pos: call.Pos(), Message: name + ".Foreach() is not guarded by for " + name + ".HasNext()"}
+	if edit, ok := wrapInLoop(pass, stack, v); ok {
+		d.SuggestedFixes = []analysis.SuggestedFix{{Message: "Wrap the foreach body in a loop on " + name + ".HasNext()", TextEdits: []analysis.TextEdit{edit}}}
+	}
+	pass.Report(d)
+}
+
+// loopOnHasNext returns the edit replacing the condition of loop with
+// v.HasNext(), the loop must have a condition or be an infinite loop.
+func loopOnHasNext(loop *ast.ForStmt, v string) (analysis.TextEdit, bool) {
+	switch {
+	case loop.Cond != nil:
+		return analysis.TextEdit{Pos: loop.Cond.Pos(), End: loop.Cond.End(), NewText: []byte(v + ".HasNext()")}, true
+	case loop.Init == nil && loop.Post == nil:
+		return analysis.TextEdit{Pos: loop.Body.Lbrace, End: loop.Body.Lbrace, NewText: []byte(v + ".HasNext() ")}, true
+	}
+	return analysis.TextEdit{}, false
+}
+
+// enclosing returns the statement list directly enclosing the innermost
+// node of stack, and the index of the statement in the list containing it.
+func enclosing(stack []ast.Node) ([]ast.Stmt, int) {
+	for i := len(stack) - 2; i >= 0; i-- {
+		var list []ast.Stmt
+		switch s := stack[i].(type) {
+		case *ast.FuncLit, *ast.FuncDecl:
+			return nil, -1
+		case *ast.BlockStmt:
+			list = s.List
+		case *ast.CaseClause:
+			list = s.Body
+		case *ast.CommClause:
+			list = s.Body
+		default:
+			continue
+		}
+		for j, stmt := range list {
+			if stmt == stack[i+1] {
+				return list, j
+			}
+		}
+	}
+	return nil, -1
+}
+
+// wrapInLoop returns the edit wrapping the statements from the one
+// containing the innermost node of stack, up to the statement calling
+// v.EndForeach(), in a loop on v.HasNext().
+func wrapInLoop(pass *analysis.Pass, stack []ast.Node, v *types.Var) (analysis.TextEdit, bool) {
+	list, first := enclosing(stack)
+	if first < 0 {
+		return analysis.TextEdit{}, false
+	}
+	for end := first + 1; end < len(list); end++ {
+		if !calls(pass, list[end], v, "EndForeach") {
+			continue
+		}
+		from, to := list[first].Pos(), list[end-1].End()
+		src, err := source(pass, from, to)
+		if err != nil {
+			return analysis.TextEdit{}, false
+		}
+		indent := indentation(pass, from)
+		var b strings.Builder
+		b.WriteString("for " + v.Name() + ".HasNext() {\n" + indent + "\t")
+		b.WriteString(strings.Replace(src, "\n", "\n\t", -1))
+		b.WriteString("\n" + indent + "}")
+		return analysis.TextEdit{Pos: from, End: to, NewText: []byte(b.String())}, true
+	}
+	return analysis.TextEdit{}, false
+}
+
+// checkEndForeach checks that v.EndForeach() is after a loop on
+// v.HasNext(), stack is the path to the call.
+func checkEndForeach(pass *analysis.Pass, call *ast.CallExpr, sel *ast.SelectorExpr, stack []ast.Node) {
+	v := variable(pass, sel.X)
+	if v == nil {
+		pass.Reportf(sel.Sel.Pos(), "EndForeach is not called on a variable, so it cannot be after a loop on HasNext")
+		return
+	}
+	name := v.Name()
+	for i := len(stack) - 2; i >= 0; i-- {
+		switch s := stack[i].(type) {
+		case *ast.FuncLit, *ast.FuncDecl:
+			i = 0
+		case *ast.ForStmt:
+			if within(call, s.Body) && hasNext(pass, s.Cond) == v {
+				d := analysis.Diagnostic{Pos: call.Pos(), Message: name + ".EndForeach() is inside the loop on " + name + ".HasNext(), it must be after the loop"}
+				if edits, ok := moveAfterLoop(pass, s, stack[i+1:]); ok {
+					d.SuggestedFixes = []analysis.SuggestedFix{{Message: "Move " + name + ".EndForeach() after the loop", TextEdits: edits}}
+				}
+				pass.Report(d)
+				return
+			}
+		}
+	}
+	for i := len(stack) - 2; i >= 0; i-- {
+		list, j := enclosing(stack[:i+2])
+		if j < 0 {
+			break
+		}
+		for _, stmt := range list[:j] {
+			if l, ok := stmt.(*ast.LabeledStmt); ok {
+				stmt = l.Stmt
+			}
+			if loop, ok := stmt.(*ast.ForStmt); ok && hasNext(pass, loop.Cond) == v {
+				return
+			}
+		}
+	}
+	pass.Reportf(call.Pos(), "%s.EndForeach() is not after a loop on %s.HasNext()", name, name)
+}
+
+// moveAfterLoop returns the edits moving the statement of path, the path
+// from the body of loop, after loop if it is a simple statement and the last
+// statement of the body.
+func moveAfterLoop(pass *analysis.Pass, loop *ast.ForStmt, path []ast.Node) ([]analysis.TextEdit, bool) {
+	body := loop.Body
+	if len(path) < 2 || path[0] != body || body.List[len(body.List)-1] != path[1] {
+		return nil, false
+	}
+	switch path[1].(type) {
+	case *ast.ExprStmt, *ast.AssignStmt:
+	default:
+		return nil, false
+	}
+	// The statement is moved with the comment after it on the same line, and
+	// removed with the line break and indentation before it.
+	stmt := path[1]
+	end := lineEnd(pass, stmt.End())
+	src, err := source(pass, stmt.Pos(), end)
+	if err != nil {
+		return nil, false
+	}
+	from := body.Lbrace + 1
+	if n := len(body.List); n > 1 {
+		from = lineEnd(pass, body.List[n-2].End())
+	}
+	return []analysis.TextEdit{
+		{Pos: from, End: end},
+		{Pos: loop.End(), End: loop.End(), NewText: []byte("\n" + indentation(pass, loop.Pos()) + src)},
+	}, true
+}
+
+// lineEnd returns the end of the line of pos, excluding the line break.
+func lineEnd(pass *analysis.Pass, pos token.Pos) token.Pos {
+	file := pass.Fset.File(pos)
+	line := file.Line(pos)
+	if line == file.LineCount() {
+		return token.Pos(file.Base() + file.Size())
+	}
+	return file.LineStart(line+1) - 1
+}
+
+// source returns the source code from pos to end.
+func source(pass *analysis.Pass, pos, end token.Pos) (string, error) {
+	file := pass.Fset.File(pos)
+	content, err := pass.ReadFile(file.Name())
+	if err != nil {
+		return "", err
+	}
+	return string(content[file.Offset(pos):file.Offset(end)]), nil
+}
+
+// indentation returns the indentation of the line of pos, the code is
+// formatted by gofmt so it is indented by tabs.
+func indentation(pass *analysis.Pass, pos token.Pos) string {
+	return strings.Repeat("\t", pass.Fset.Position(pos).Column-1)
+}
@@ -0,0 +1,12 @@
+package loopshape_test
+
+import (
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/loopshape"
+	"golang.org/x/tools/go/analysis/analysistest"
+)
+
+func TestAnalyzer(t *testing.T) {
+	analysistest.RunWithSuggestedFixes(t, analysistest.TestData(), loopshape.Analyzer, "a")
+}
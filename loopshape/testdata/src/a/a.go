@@ -0,0 +1,137 @@
+package a
+
+import "states"
+
+func good() {
+	s := states.New(2)
+	for s.HasNext() {
+		s1 := s.Foreach()
+		s = s1.Send_foo(1)
+	}
+	s.EndForeach().End()
+}
+
+func goodLabeled() {
+	s := states.New(2)
+outer:
+	for s.HasNext() {
+		s1 := s.Foreach()
+		if s = s1.Send_foo(1); s == nil {
+			break outer
+		}
+	}
+	s.EndForeach().End()
+}
+
+func ifHasNext() {
+	s := states.New(2)
+	if s.HasNext() { // want `s.Foreach\(\) is guarded by if rather than for s.HasNext\(\)`
+		s1 := s.Foreach()
+		s = s1.Send_foo(1)
+	}
+	s.EndForeach().End() // want `s.EndForeach\(\) is not after a loop on s.HasNext\(\)`
+}
+
+func ifElse() {
+	s := states.New(2)
+	if s.HasNext() { // want `s.Foreach\(\) is guarded by if rather than for s.HasNext\(\)`
+		s = s.Foreach().Send_foo(1)
+	} else {
+		s.EndForeach().End() // want `s.EndForeach\(\) is not after a loop on s.HasNext\(\)`
+	}
+}
+
+func countedLoop(k int) {
+	s := states.New(k)
+	for i := 0; i < k; i++ {
+		s = s.Foreach().Send_foo(i) // want `s.Foreach\(\) is in a loop which is not on s.HasNext\(\)`
+	}
+	s.EndForeach().End() // want `s.EndForeach\(\) is not after a loop on s.HasNext\(\)`
+}
+
+func whileLoop(k int) {
+	s := states.New(k)
+	for k > 0 {
+		s = s.Foreach().Send_foo(k) // want `s.Foreach\(\) is in a loop which is not on s.HasNext\(\)`
+		k--
+	}
+	s.EndForeach().End() // want `s.EndForeach\(\) is not after a loop on s.HasNext\(\)`
+}
+
+func infiniteLoop() {
+	s := states.New(2)
+	for {
+		s = s.Foreach().Send_foo(1) // want `s.Foreach\(\) is in a loop which is not on s.HasNext\(\)`
+	}
+}
+
+func rangeLoop(xs []int) {
+	s := states.New(len(xs))
+	for _, x := range xs {
+		s = s.Foreach().Send_foo(x) // want `s.Foreach\(\) is in a range loop rather than in for s.HasNext\(\)`
+	}
+	s.EndForeach().End() // want `s.EndForeach\(\) is not after a loop on s.HasNext\(\)`
+}
+
+func otherLoop() {
+	s, t := states.New(2), states.New(2)
+	for t.HasNext() {
+		s = s.Foreach().Send_foo(1) // want `s.Foreach\(\) is in the loop on t.HasNext\(\) rather than s.HasNext\(\)`
+		t = t.Foreach().Send_foo(1)
+	}
+	t.EndForeach().End()
+	s.EndForeach().End() // want `s.EndForeach\(\) is not after a loop on s.HasNext\(\)`
+}
+
+func unguarded() {
+	s := states.New(1)
+	s1 := s.Foreach() // want `s.Foreach\(\) is not guarded by for s.HasNext\(\)`
+	// The only iteration.
+	s = s1.Send_foo(1)
+	s.EndForeach().End() // want `s.EndForeach\(\) is not after a loop on s.HasNext\(\)`
+}
+
+func noEndForeach() *states.S0 {
+	s := states.New(1)
+	return s.Foreach().Send_foo(1) // want `s.Foreach\(\) is not guarded by for s.HasNext\(\)`
+}
+
+func chained() {
+	states.New(1).Foreach().Send_foo(1).EndForeach() // want `Foreach is not called on a variable, so it cannot be guarded by HasNext` `EndForeach is not called on a variable, so it cannot be after a loop on HasNext`
+}
+
+func endInside() {
+	s := states.New(2)
+	for s.HasNext() {
+		s1 := s.Foreach()
+		s = s1.Send_foo(1)
+		s.EndForeach().End() // want `s.EndForeach\(\) is inside the loop on s.HasNext\(\), it must be after the loop`
+	}
+}
+
+func endInsideIf() {
+	s := states.New(2)
+	for s.HasNext() {
+		s = s.Foreach().Send_foo(1)
+		if !s.HasNext() {
+			s.EndForeach().End() // want `s.EndForeach\(\) is inside the loop on s.HasNext\(\), it must be after the loop`
+		}
+	}
+}
+
+func noForeach() {
+	s := states.New(2)
+	for s.HasNext() { // want `loop on s.HasNext\(\) does not call s.Foreach\(\)`
+	}
+	s.EndForeach().End()
+}
+
+func inClosure() {
+	s := states.New(2)
+	for s.HasNext() { // want `loop on s.HasNext\(\) does not call s.Foreach\(\)`
+		func() {
+			s = s.Foreach().Send_foo(1) // want `s.Foreach\(\) is not guarded by for s.HasNext\(\)`
+		}()
+	}
+	s.EndForeach().End()
+}
@@ -0,0 +1,28 @@
+// Package states is an API in the iterator style of package proto.
+package states
+
+type S0 struct {
+	i, k int
+}
+
+// New returns the initial state of a foreach of k iterations.
+func New(k int) *S0 { return &S0{k: k} }
+
+func (s *S0) HasNext() bool { return s.i < s.k }
+
+func (s *S0) Foreach() *S1 {
+	s.i++
+	return &S1{s}
+}
+
+func (s *S0) EndForeach() *SEnd { return new(SEnd) }
+
+type S1 struct {
+	s *S0
+}
+
+func (s *S1) Send_foo(int) *S0 { return s.s }
+
+type SEnd struct{}
+
+func (s *SEnd) End() {}
@@ -1,14 +1,50 @@
+// Command scribble-foreach-experiment runs the example protocol with each
+// API style:
+//
+//	scribble-foreach-experiment list-styles
+//	scribble-foreach-experiment run [-style name] [-param k=5] [-trace file]
+//	scribble-foreach-experiment misuse -case name [-param k=5] [-trace file]
+//	scribble-foreach-experiment repl [-param k=5]
+//
+// run runs every style in turn, or only -style, and misuse runs one of the
+// misuses of the APIs listed by misuse -list. repl steps through a session
+// of the proto style interactively (see package repl). A -param sets a parameter of
+// the protocol, and -trace writes the session to a file in the format of its
+// extension (.jsonl, .mmd, .puml, or one event per line).
+//
+// The exit status is 1 if the session violates the protocol, i.e. an API
+// panics with one of its errors, or cannot be run (e.g. the trace cannot be
+// written or the input of repl cannot be read), and 2 if the command line
+// is invalid.
 package main
 
 import (
+	"bytes"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
 
+	"github.com/nickng/scribble-foreach-experiment/example/nested/a"
+	"github.com/nickng/scribble-foreach-experiment/example/nested/coordinator"
+	"github.com/nickng/scribble-foreach-experiment/final"
 	"github.com/nickng/scribble-foreach-experiment/forrange"
 	"github.com/nickng/scribble-foreach-experiment/fused"
 	"github.com/nickng/scribble-foreach-experiment/nested"
 	"github.com/nickng/scribble-foreach-experiment/proto"
 	"github.com/nickng/scribble-foreach-experiment/recur"
+	"github.com/nickng/scribble-foreach-experiment/repl"
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/transport"
 )
 
 // Example protocol - nested one-to-many:
@@ -26,30 +62,227 @@ func init() {
 	log.SetFlags(log.Llongfile)
 }
 
+const usage = `usage:
+	scribble-foreach-experiment list-styles
+	scribble-foreach-experiment run [-style name] [-param name=value] [-trace file]
+	scribble-foreach-experiment misuse -case name [-param name=value] [-trace file]
+	scribble-foreach-experiment repl [-param name=value]
+`
+
+// errUsage is returned by a subcommand if its command line is invalid, the
+// subcommand has already printed why.
+var errUsage = errors.New("invalid command line")
+
 func main() {
-	forrange.ProtoParam["k"] = 2
-	fmt.Println("---- for-range ----")
-	forrangeRun()
+	flag.Usage = func() { fmt.Fprint(flag.CommandLine.Output(), usage) }
+	flag.Parse()
+	if flag.NArg() == 0 {
+		flag.Usage()
+		os.Exit(2)
+	}
+	var err error
+	switch cmd, args := flag.Arg(0), flag.Args()[1:]; cmd {
+	case "list-styles":
+		err = listStyles(args)
+	case "run":
+		err = run(args)
+	case "misuse":
+		err = misuse(args)
+	case "repl":
+		err = interactive(args)
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", cmd)
+		flag.Usage()
+		err = errUsage
+	}
+	switch {
+	case err == errUsage:
+		os.Exit(2)
+	case err != nil:
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
 
-	nested.ProtoParam["k"] = 2
-	fmt.Println("---- nested FSM ----")
-	nestedRun()
+func listStyles(args []string) error {
+	fs := flag.NewFlagSet("list-styles", flag.ContinueOnError)
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	for _, st := range styles {
+		fmt.Fprintf(w, "%s\t%s\n", st.name, st.doc)
+	}
+	return w.Flush()
+}
 
-	recur.ProtoParam["k"] = 2
-	fmt.Println("---- recur foreach ----")
-	recurRun()
-	fmt.Println("---- recur foreach (inline) ----")
-	recurInlineRun()
+func run(args []string) error {
+	fs := flag.NewFlagSet("run", flag.ContinueOnError)
+	name := fs.String("style", "", "run only the style `name` (see list-styles)")
+	params := make(paramFlag)
+	fs.Var(params, "param", "set the protocol parameter `name=value`, k=2 by default (repeatable)")
+	traceFile := fs.String("trace", "", "write the session to `file` (needs -style)")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	run := styles
+	if *name != "" {
+		st, ok := lookupStyle(*name)
+		if !ok {
+			fmt.Fprintf(os.Stderr, "unknown style %q, see list-styles\n", *name)
+			return errUsage
+		}
+		run = []style{st}
+	} else if *traceFile != "" {
+		fmt.Fprintln(os.Stderr, "-trace needs -style to record a single session")
+		return errUsage
+	}
+	for _, st := range run {
+		if err := st.prepare(params, *traceFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return errUsage
+		}
+	}
+	for _, st := range run {
+		fmt.Printf("---- %s: %s ----\n", st.name, st.doc)
+		if err := st.session(st.run, *traceFile); err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	proto.ProtoParam["k"] = 2
-	fmt.Println("---- GOOD ----")
-	protoGood()
-	fmt.Println("---- BAD ----")
-	//protoBad()
+func misuse(args []string) error {
+	fs := flag.NewFlagSet("misuse", flag.ContinueOnError)
+	name := fs.String("case", "", "run the misuse `name` (see -list)")
+	list := fs.Bool("list", false, "list the misuses")
+	params := make(paramFlag)
+	fs.Var(params, "param", "set the protocol parameter `name=value`, k=2 by default (repeatable)")
+	traceFile := fs.String("trace", "", "write the session to `file`")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	if *list {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		for _, m := range misuses {
+			fmt.Fprintf(w, "%s\t%s\t%s\n", m.name, m.style, m.doc)
+		}
+		return w.Flush()
+	}
+	for _, m := range misuses {
+		if m.name != *name {
+			continue
+		}
+		st, _ := lookupStyle(m.style)
+		if err := st.prepare(params, *traceFile); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return errUsage
+		}
+		fmt.Printf("---- %s: %s ----\n", m.name, m.doc)
+		err := st.session(m.run, *traceFile)
+		if err == nil {
+			fmt.Println("no protocol violation with these parameters")
+		}
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "unknown misuse %q, see misuse -list\n", *name)
+	return errUsage
+}
+
+// interactive steps through a session of the proto style, reading the
+// methods to call from the standard input.
+func interactive(args []string) error {
+	fs := flag.NewFlagSet("repl", flag.ContinueOnError)
+	params := make(paramFlag)
+	fs.Var(params, "param", "set the protocol parameter `name=value`, k=2 by default (repeatable)")
+	if err := fs.Parse(args); err != nil || fs.NArg() != 0 {
+		return errUsage
+	}
+	st, _ := lookupStyle("proto")
+	if err := st.prepare(params, ""); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return errUsage
+	}
+	ss := repl.Session{
+		Start: func() interface{} {
+			proto.Reset()
+			return new(proto.S0)
+		},
+		Stack: proto.Stack,
+	}
+	return repl.Run(os.Stdin, os.Stdout, ss)
+}
 
-	fused.ProtoParam["k"] = 2
-	fmt.Println("---- fused foreach ----")
-	fusedRun() // fails linear usage check
+// paramFlag is the repeatable -param name=value flag.
+type paramFlag map[string]int
+
+func (p paramFlag) String() string {
+	var params []string
+	for name, v := range p {
+		params = append(params, name+"="+strconv.Itoa(v))
+	}
+	sort.Strings(params)
+	return strings.Join(params, ",")
+}
+
+func (p paramFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return fmt.Errorf("%q is not name=value", s)
+	}
+	v, err := strconv.Atoi(kv[1])
+	if err != nil {
+		return err
+	}
+	if v < 1 {
+		return fmt.Errorf("%s must be at least 1, foreach ranges are never empty", kv[0])
+	}
+	p[kv[0]] = v
+	return nil
+}
+
+// violation runs f and returns the error f panics with if it misuses an API,
+// wrapped as a protocol violation, or nil if f returns.
+func violation(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			var ok bool
+			if _, rt := r.(runtime.Error); rt {
+				panic(r)
+			}
+			if err, ok = r.(error); !ok {
+				panic(r)
+			}
+			err = fmt.Errorf("protocol violation: %w", err)
+		}
+	}()
+	f()
+	return nil
+}
+
+// writeTrace writes events to the file name in the format of its extension:
+// JSON lines (.jsonl), Mermaid (.mmd), PlantUML (.puml), or one event per
+// line.
+func writeTrace(name string, events []trace.Event) error {
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	switch filepath.Ext(name) {
+	case ".jsonl":
+		err = trace.JSON(f, events)
+	case ".mmd":
+		err = trace.Mermaid(f, events)
+	case ".puml":
+		err = trace.PlantUML(f, events)
+	default:
+		err = trace.Dump(f, events)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
 }
 
 func protoGood() {
@@ -243,3 +476,115 @@ func forrangeRun() {
 	}
 	end0.End()
 }
+
+func generatedRun() {
+	// This function runs both ends of the protocol with the generated APIs:
+	// the Coordinator and each participant A[1..k], connected in memory.
+	// The participants run in the background, as the session starts with a
+	// handshake between them, and their output is printed at the end.
+
+	tr := transport.NewChan(a.ProtoParam["k"] + 1)
+	wait := startParticipants(tr)
+	s0, err := coordinator.New(tr.Conn("Coordinator"))
+	if err != nil {
+		log.Fatal(err)
+	}
+	j := 0
+	s0.Foreach(
+		func(s *coordinator.S1) *coordinator.S4 {
+			j++
+			fmt.Println("Coordinator outer loop", j)
+			i := 0
+			return s.
+				Foreach(
+					func(s *coordinator.S2) *coordinator.S5 {
+						i++
+						fmt.Printf("Coordinator sends foo(%d) to A[%d]\n", i, i)
+						return s.Send_Aj_foo(i)
+					}).
+				Send_Ai_bar("outer foreach body")
+		}).End()
+	wait()
+}
+
+// startParticipants runs the participants A[1..k] with the generated API in
+// the background, wait waits for them and prints their output in order.
+func startParticipants(tr *transport.Chan) (wait func()) {
+	k := a.ProtoParam["k"]
+	outs := make([]bytes.Buffer, k+1)
+	var wg sync.WaitGroup
+	for self := 1; self <= k; self++ {
+		wg.Add(1)
+		go func(self int) {
+			defer wg.Done()
+			participantRun(&outs[self], self, tr.Conn(transport.Name("A", self)))
+		}(self)
+	}
+	return func() {
+		wg.Wait()
+		for self := 1; self <= k; self++ {
+			os.Stdout.Write(outs[self].Bytes())
+		}
+	}
+}
+
+// participantRun runs the participant A[self] with the generated API,
+// and writes what it receives to w.
+func participantRun(w io.Writer, self int, conn transport.Conn) {
+	s0, err := a.New(self, conn)
+	if err != nil {
+		log.Fatal(err)
+	}
+	i := 0
+	s0.Foreach(
+		func(s *a.S1) *a.S4 {
+			i++
+			foo, s2 := s.Recv_Coordinator_foo()
+			fmt.Fprintf(w, "A[%d] receives foo(%d) in loop %d\n", self, foo, i)
+			return s2.IfSelf(func(s *a.S3) *a.S4 {
+				bar, end := s.Recv_Coordinator_bar()
+				fmt.Fprintf(w, "A[%d] receives bar(%q) in loop %d\n", self, bar, i)
+				return end
+			})
+		}).End()
+}
+
+func finalRun() {
+	// This function runs the Coordinator with the final API, and each
+	// participant A[1..k] with the generated API, connected in memory.
+
+	tr := transport.NewChan(final.ProtoParam["k"] + 1)
+	final.Conn = tr.Conn("Coordinator")
+	wait := startParticipants(tr)
+
+	// The final API does not take part in the handshake by itself, the
+	// Coordinator announces that it runs the generated Nested protocol.
+	var peers []string
+	for self := 1; self <= final.ProtoParam["k"]; self++ {
+		peers = append(peers, transport.Name("A", self))
+	}
+	hello := transport.Hello{
+		Protocol:    "Nested",
+		Participant: "Coordinator",
+		Fingerprint: a.Fingerprint,
+		Params:      map[string]int{"k": final.ProtoParam["k"]},
+	}
+	if err := transport.Handshake(final.Conn, hello, peers); err != nil {
+		log.Fatal(err)
+	}
+	j := 0
+	new(final.S0).Foreach(
+		func(s *final.S1) *final.S4 {
+			j++
+			i := 0
+			return s.
+				Foreach(
+					func(s *final.S2) *final.S5 {
+						i++
+						return s.Send_Aj_foo(i)
+					}).
+				Send_Ai_bar(fmt.Sprintf("outer foreach body %d", j))
+		}).End()
+	final.Conn = nil
+	wait()
+}
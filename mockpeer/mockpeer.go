@@ -0,0 +1,226 @@
+// Package mockpeer provides scripted peers to unit test the code driving an
+// endpoint, e.g. final.S0.Foreach, without running the other participants.
+//
+// The messages each peer expects from the endpoint, and the messages each
+// peer sends to the endpoint, are scripted per peer:
+//
+//	conn := mockpeer.New(t)
+//	conn.Peer("A", 1).Expect("foo", 1).Expect("bar", mockpeer.Any)
+//	conn.Peer("A", 2).Expect("foo", 2)
+//	final.Conn = conn
+//	// ... drive the endpoint ...
+//	conn.Verify()
+//
+// Verify reports the difference between the expected and the sent messages
+// of each peer as a diff.
+package mockpeer
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// Any is an expected payload which matches any payload.
+var Any = anyPayload{}
+
+type anyPayload struct{}
+
+func (anyPayload) String() string { return "_" }
+
+// Conn is the connection of the endpoint under test to its mock peers.
+// It is safe for concurrent use.
+type Conn struct {
+	tb     testing.TB
+	mu     sync.Mutex
+	peers  map[string]*Peer
+	closed bool
+}
+
+var _ transport.Conn = (*Conn)(nil)
+
+// Peer is the script of a mock peer, which must be written before the
+// endpoint runs.
+type Peer struct {
+	name     string
+	expected []transport.Message // expected are the messages expected from the endpoint
+	sent     []transport.Message // sent are the messages sent by the endpoint
+	replies  []transport.Message // replies are the messages to the endpoint not yet received
+}
+
+// New returns a connection without peers, mismatches are reported to tb.
+func New(tb testing.TB) *Conn {
+	return &Conn{tb: tb, peers: make(map[string]*Peer)}
+}
+
+// Peer returns the script of the peer role[index], e.g. A[1].
+func (c *Conn) Peer(role string, index int) *Peer {
+	return c.Named(transport.Name(role, index))
+}
+
+// Named returns the script of the peer called name, e.g. Coordinator.
+func (c *Conn) Named(name string) *Peer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.peer(name)
+}
+
+// peer must be called with c.mu held.
+func (c *Conn) peer(name string) *Peer {
+	p, ok := c.peers[name]
+	if !ok {
+		p = &Peer{name: name}
+		c.peers[name] = p
+	}
+	return p
+}
+
+// Expect appends label(payload) to the messages the peer expects from the
+// endpoint, a payload of Any matches any payload.
+func (p *Peer) Expect(label string, payload ...interface{}) *Peer {
+	p.expected = append(p.expected, transport.Message{Label: label, Payload: payload})
+	return p
+}
+
+// Send appends label(payload) to the messages the peer sends to the
+// endpoint, which are received in order.
+func (p *Peer) Send(label string, payload ...interface{}) *Peer {
+	p.replies = append(p.replies, transport.Message{Label: label, Payload: payload})
+	return p
+}
+
+// Handshake scripts the handshake of the peer: the peer expects the hello of
+// the endpoint, and announces itself with the same protocol, fingerprint and
+// parameters, as in transport.Handshake.
+func (p *Peer) Handshake(protocol, fingerprint string, params map[string]int) *Peer {
+	p.Expect("hello", Any)
+	return p.Send("hello", transport.Hello{Protocol: protocol, Participant: p.name, Fingerprint: fingerprint, Params: params})
+}
+
+func (c *Conn) Send(to string, m transport.Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return transport.ErrClosed
+	}
+	p := c.peer(to)
+	p.sent = append(p.sent, m)
+	return nil
+}
+
+func (c *Conn) Recv(from string) (transport.Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p := c.peer(from)
+	if len(p.replies) == 0 {
+		c.tb.Errorf("mockpeer: %s has no scripted message to send", from)
+		return transport.Message{}, transport.ErrClosed
+	}
+	m := p.replies[0]
+	p.replies = p.replies[1:]
+	return m, nil
+}
+
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return transport.ErrClosed
+	}
+	c.closed = true
+	return nil
+}
+
+// Verify reports to tb the peers which were not sent exactly the expected
+// messages, and the scripted messages not received by the endpoint.
+func (c *Conn) Verify() {
+	c.tb.Helper()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	names := make([]string, 0, len(c.peers))
+	for name := range c.peers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		p := c.peers[name]
+		if d, ok := diff(p.expected, p.sent); !ok {
+			c.tb.Errorf("%s: messages differ (-expected +sent):\n%s", name, d)
+		}
+		if len(p.replies) > 0 {
+			lines := make([]string, len(p.replies))
+			for i, m := range p.replies {
+				lines[i] = "\t" + format(m)
+			}
+			c.tb.Errorf("%s: %d scripted messages not received:\n%s", name, len(p.replies), strings.Join(lines, "\n"))
+		}
+	}
+}
+
+// match returns true if the sent message m matches the expected message.
+func match(expected, m transport.Message) bool {
+	if expected.Label != m.Label {
+		return false
+	}
+	if len(expected.Payload) == 1 && expected.Payload[0] == Any {
+		return true
+	}
+	return reflect.DeepEqual(expected.Payload, m.Payload) || len(expected.Payload) == 0 && len(m.Payload) == 0
+}
+
+// format returns m as label(payload), e.g. bar("x").
+func format(m transport.Message) string {
+	payload := make([]string, len(m.Payload))
+	for i, v := range m.Payload {
+		if s, ok := v.(string); ok {
+			payload[i] = fmt.Sprintf("%q", s)
+		} else {
+			payload[i] = fmt.Sprintf("%v", v)
+		}
+	}
+	return fmt.Sprintf("%s(%s)", m.Label, strings.Join(payload, ", "))
+}
+
+// diff returns the diff of the expected and the sent messages as lines of
+// messages prefixed by - (missing), + (unexpected) or a space (matched),
+// ok is true if all messages match.
+func diff(expected, sent []transport.Message) (d string, ok bool) {
+	// lcs[i][j] is the longest common subsequence of expected[i:] and sent[j:].
+	lcs := make([][]int, len(expected)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(sent)+1)
+	}
+	for i := len(expected) - 1; i >= 0; i-- {
+		for j := len(sent) - 1; j >= 0; j-- {
+			switch {
+			case match(expected[i], sent[j]):
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var b strings.Builder
+	i, j := 0, 0
+	for i < len(expected) || j < len(sent) {
+		switch {
+		case i < len(expected) && j < len(sent) && match(expected[i], sent[j]):
+			fmt.Fprintf(&b, "\t  %s\n", format(sent[j]))
+			i, j = i+1, j+1
+		case j == len(sent) || i < len(expected) && lcs[i+1][j] >= lcs[i][j+1]:
+			fmt.Fprintf(&b, "\t- %s\n", format(expected[i]))
+			i++
+		default:
+			fmt.Fprintf(&b, "\t+ %s\n", format(sent[j]))
+			j++
+		}
+	}
+	return strings.TrimRight(b.String(), "\n"), lcs[0][0] == len(expected) && len(expected) == len(sent)
+}
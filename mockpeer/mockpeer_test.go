@@ -0,0 +1,105 @@
+package mockpeer_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/example/nested/a"
+	"github.com/nickng/scribble-foreach-experiment/final"
+	"github.com/nickng/scribble-foreach-experiment/mockpeer"
+)
+
+// recorder records the errors reported by Verify.
+type recorder struct {
+	testing.TB
+	errs []string
+}
+
+func (r *recorder) Helper() {}
+
+func (r *recorder) Errorf(format string, args ...interface{}) {
+	r.errs = append(r.errs, fmt.Sprintf(format, args...))
+}
+
+// runFinal drives the Coordinator of the final API with k = 2, sending
+// foo(10*i+j) to A[j] and bar("i") to A[i].
+func runFinal(conn *mockpeer.Conn) {
+	final.ProtoParam["k"] = 2
+	final.Conn = conn
+	defer func() { final.Conn = nil }()
+	i := 0
+	new(final.S0).Foreach(func(s *final.S1) *final.S4 {
+		i++
+		j := 0
+		return s.Foreach(func(s *final.S2) *final.S5 {
+			j++
+			return s.Send_Aj_foo(10*i + j)
+		}).Send_Ai_bar(fmt.Sprint(i))
+	}).End()
+}
+
+func TestFinal(t *testing.T) {
+	conn := mockpeer.New(t)
+	conn.Peer("A", 1).Expect("foo", 11).Expect("bar", "1").Expect("foo", 21)
+	conn.Peer("A", 2).Expect("foo", 12).Expect("foo", 22).Expect("bar", mockpeer.Any)
+	runFinal(conn)
+	conn.Verify()
+}
+
+func TestFinalMismatch(t *testing.T) {
+	r := &recorder{TB: t}
+	conn := mockpeer.New(r)
+	conn.Peer("A", 1).Expect("foo", 11).Expect("foo", 21).Expect("bar", "1")
+	conn.Peer("A", 2).Expect("foo", 12).Expect("bar", "2").Expect("foo", 23).Send("baz")
+	runFinal(conn)
+	conn.Verify()
+
+	expected := []string{
+		`A[1]: messages differ (-expected +sent):
+	  foo(11)
+	- foo(21)
+	  bar("1")
+	+ foo(21)`,
+		`A[2]: messages differ (-expected +sent):
+	  foo(12)
+	+ foo(22)
+	  bar("2")
+	- foo(23)`,
+		`A[2]: 1 scripted messages not received:
+	baz()`,
+	}
+	if got := strings.Join(r.errs, "\n\n"); got != strings.Join(expected, "\n\n") {
+		t.Errorf("expected errors:\n%s\nbut got:\n%s", strings.Join(expected, "\n\n"), got)
+	}
+}
+
+// TestGenerated tests A[2] of the generated API against a scripted
+// Coordinator, including the handshake.
+func TestGenerated(t *testing.T) {
+	a.ProtoParam["k"] = 2
+	conn := mockpeer.New(t)
+	conn.Named("Coordinator").
+		Handshake("Nested", a.Fingerprint, map[string]int{"k": 2}).
+		Send("foo", 2).
+		Send("foo", 2).
+		Send("bar", "to A[2]")
+	s0, err := a.New(2, conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	s0.Foreach(func(s *a.S1) *a.S4 {
+		foo, s2 := s.Recv_Coordinator_foo()
+		got = append(got, fmt.Sprint(foo))
+		return s2.IfSelf(func(s *a.S3) *a.S4 {
+			bar, end := s.Recv_Coordinator_bar()
+			got = append(got, bar)
+			return end
+		})
+	}).End()
+	conn.Verify()
+	if expected := "2 2 to A[2]"; strings.Join(got, " ") != expected {
+		t.Errorf("expected to receive %q but got %q", expected, strings.Join(got, " "))
+	}
+}
@@ -0,0 +1,637 @@
+// Package modelcheck explores every session of a protocol for concrete
+// parameter values.
+//
+// Each participant (e.g. Coordinator, A[1] and A[2] for k = 2) runs the FSM
+// of its local type, and messages are delivered through a FIFO queue for
+// each pair of participants. Check explores every interleaving of the
+// participants and every branch of the choices, and reports a
+// Counterexample if
+//
+//   - the session deadlocks, i.e. some participant cannot move and no other
+//     participant can,
+//   - a participant receives a message it does not expect, or ends while
+//     messages sent to it are not received,
+//   - a participant ends with a foreach on its stack, or
+//   - the session reaches a state from which it can never end, e.g. a
+//     foreach that never exits.
+//
+// The trace of a counterexample has the same events as the traces recorded
+// by the APIs (see package trace), so it can be compared with the trace of a
+// running participant.
+package modelcheck
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/nickng/scribble-foreach-experiment/scribble"
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// DefaultBound is the capacity of each queue if the bound given to Check is
+// not positive; a send blocks while the queue to its receiver is full.
+const DefaultBound = 8
+
+// Step is an event of a participant in a session.
+type Step struct {
+	Participant string
+	trace.Event
+}
+
+func (s Step) String() string { return fmt.Sprintf("%s: %s", s.Participant, s.Event) }
+
+// Counterexample is a violation found by Check, with the steps of the
+// session leading to it.
+type Counterexample struct {
+	Params map[string]int
+	Msg    string
+	Steps  []Step
+}
+
+func (c *Counterexample) Error() string {
+	return fmt.Sprintf("%s: %s", FormatParams(c.Params), c.Msg)
+}
+
+// Trace returns the events of participant in the counterexample, which are
+// the events recorded by the API of the participant.
+func (c *Counterexample) Trace(participant string) []trace.Event {
+	var events []trace.Event
+	for _, s := range c.Steps {
+		if s.Participant == participant {
+			events = append(events, s.Event)
+		}
+	}
+	return events
+}
+
+// Dump writes the steps of c to w, one per line, in the format of
+// trace.Dump prefixed by the participant.
+func (c *Counterexample) Dump(w io.Writer) error {
+	for _, s := range c.Steps {
+		if _, err := fmt.Fprintln(w, s); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FormatParams returns params as "m=1 n=2", sorted by name.
+func FormatParams(params map[string]int) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%s=%d", name, params[name])
+	}
+	return strings.Join(names, " ")
+}
+
+// Params returns every valuation of the parameters of p from 1 to limit,
+// e.g. k=1, k=2 and k=3 for limit 3.
+func Params(p *scribble.Protocol, limit int) []map[string]int {
+	all := []map[string]int{{}}
+	for _, param := range p.Params {
+		var next []map[string]int
+		for _, params := range all {
+			for v := 1; v <= limit; v++ {
+				values := map[string]int{param.Name: v}
+				for name, value := range params {
+					values[name] = value
+				}
+				next = append(next, values)
+			}
+		}
+		all = next
+	}
+	return all
+}
+
+// Check explores every session of the well-formed protocol p with the
+// parameter values params and queues of capacity bound, and returns the
+// number of states explored. A violation is returned as a *Counterexample.
+func Check(p *scribble.Protocol, params map[string]int, bound int) (int, error) {
+	for _, a := range scribble.Assumptions(p) {
+		if err := a.Check(params); err != nil {
+			return 0, err
+		}
+	}
+	locals := make([]*scribble.Local, 0, len(p.Roles))
+	for _, r := range p.Roles {
+		l, err := scribble.Project(p, r.Name)
+		if err != nil {
+			return 0, err
+		}
+		locals = append(locals, l)
+	}
+	return CheckLocals(locals, params, bound)
+}
+
+// CheckLocals is Check for the local types of each role, e.g. local types
+// written by hand rather than projected from a global protocol.
+func CheckLocals(locals []*scribble.Local, params map[string]int, bound int) (int, error) {
+	if bound <= 0 {
+		bound = DefaultBound
+	}
+	m := &model{params: params, bound: bound, index: make(map[string]int)}
+	for _, l := range locals {
+		if err := m.add(l); err != nil {
+			return 0, err
+		}
+	}
+	return m.explore()
+}
+
+// participant is a participant of a session running the FSM of its role.
+type participant struct {
+	name string
+	fsm  *scribble.FSM
+	env  map[string]int // env are the parameters and self
+}
+
+// model is the product of the FSMs of the participants.
+type model struct {
+	params       map[string]int
+	bound        int
+	participants []*participant
+	index        map[string]int // index maps names of participants to their index
+}
+
+// add adds the participants of the role of l.
+func (m *model) add(l *scribble.Local) error {
+	fsm := scribble.NewFSM(l)
+	role := l.Role
+	if !role.Indexed() {
+		m.addParticipant(role.Name, fsm, m.params)
+		return nil
+	}
+	lo, err := scribble.Eval(role.Lo, m.params)
+	if err != nil {
+		return err
+	}
+	hi, err := scribble.Eval(role.Hi, m.params)
+	if err != nil {
+		return err
+	}
+	for self := lo; self <= hi; self++ {
+		env := map[string]int{scribble.Self: self}
+		for name, value := range m.params {
+			env[name] = value
+		}
+		m.addParticipant(transport.Name(role.Name, self), fsm, env)
+	}
+	return nil
+}
+
+func (m *model) addParticipant(name string, fsm *scribble.FSM, env map[string]int) {
+	m.index[name] = len(m.participants)
+	m.participants = append(m.participants, &participant{name: name, fsm: fsm, env: env})
+}
+
+// message is a message in a queue.
+type message struct {
+	label, payload string
+}
+
+// channel is the queue from one participant to another.
+type channel struct{ from, to int }
+
+// local is the state of a participant in a session.
+type local struct {
+	state *scribble.State
+	env   map[string]int // env are the values of the index variables
+	stack []int          // stack are the IDs of the foreach loops entered
+	done  bool
+}
+
+// config is a state of a session.
+type config struct {
+	locals []local
+	queues map[channel][]message
+}
+
+func (c *config) clone() *config {
+	next := &config{locals: make([]local, len(c.locals)), queues: make(map[channel][]message, len(c.queues))}
+	copy(next.locals, c.locals)
+	for ch, q := range c.queues {
+		next.queues[ch] = q
+	}
+	return next
+}
+
+// key returns a string identifying the state of the session.
+func (c *config) key() string {
+	var b strings.Builder
+	for _, l := range c.locals {
+		fmt.Fprintf(&b, "S%d%v%v;", l.state.ID, l.env, l.stack) // maps are printed sorted by key
+	}
+	chans := make([]channel, 0, len(c.queues))
+	for ch, q := range c.queues {
+		if len(q) > 0 {
+			chans = append(chans, ch)
+		}
+	}
+	sort.Slice(chans, func(i, j int) bool {
+		return chans[i].from < chans[j].from || chans[i].from == chans[j].from && chans[i].to < chans[j].to
+	})
+	for _, ch := range chans {
+		fmt.Fprintf(&b, "%d>%d%v;", ch.from, ch.to, c.queues[ch])
+	}
+	return b.String()
+}
+
+// node is an explored state of the session, reached from its parent by steps.
+type node struct {
+	c      *config
+	parent int
+	steps  []Step
+	succ   []int
+}
+
+// move is a transition of the session.
+type move struct {
+	c     *config
+	steps []Step
+}
+
+// violation is a violation found in a config, with the steps of the move
+// to the config if it is found by after.
+type violation struct {
+	msg   string
+	steps []Step
+}
+
+func (m *model) explore() (int, error) {
+	init := &config{locals: make([]local, len(m.participants)), queues: make(map[channel][]message)}
+	var steps []Step
+	for i, p := range m.participants {
+		init.locals[i] = local{state: p.fsm.Initial, env: make(map[string]int)}
+		s, v, err := m.settle(init, i)
+		if err != nil {
+			return 0, err
+		}
+		steps = append(steps, s...)
+		if v != nil {
+			return 0, m.counterexample(nil, 0, steps, v.msg)
+		}
+	}
+	nodes := []*node{{c: init, parent: -1, steps: steps}}
+	visited := map[string]int{init.key(): 0}
+	for n := 0; n < len(nodes); n++ {
+		moves, v, err := m.moves(nodes[n].c)
+		if err != nil {
+			return 0, err
+		}
+		if v != nil {
+			return 0, m.counterexample(nodes, n, v.steps, v.msg)
+		}
+		if len(moves) == 0 {
+			if msg := m.stuck(nodes[n].c); msg != "" {
+				return 0, m.counterexample(nodes, n, nil, msg)
+			}
+		}
+		for _, mv := range moves {
+			key := mv.c.key()
+			next, ok := visited[key]
+			if !ok {
+				next = len(nodes)
+				visited[key] = next
+				nodes = append(nodes, &node{c: mv.c, parent: n, steps: mv.steps})
+			}
+			nodes[n].succ = append(nodes[n].succ, next)
+		}
+	}
+	if n := m.unending(nodes); n >= 0 {
+		return 0, m.counterexample(nodes, n, nil, "the session cannot end from here: "+m.describe(nodes[n].c))
+	}
+	return len(nodes), nil
+}
+
+// counterexample returns the counterexample of the steps to nodes[n]
+// followed by steps.
+func (m *model) counterexample(nodes []*node, n int, steps []Step, msg string) *Counterexample {
+	var path [][]Step
+	for ; nodes != nil && n >= 0; n = nodes[n].parent {
+		path = append(path, nodes[n].steps)
+	}
+	c := &Counterexample{Params: m.params, Msg: msg}
+	for i := len(path) - 1; i >= 0; i-- {
+		c.Steps = append(c.Steps, path[i]...)
+	}
+	c.Steps = append(c.Steps, steps...)
+	return c
+}
+
+// stuck returns the violation of a config without moves, or "" if every
+// participant ended and every message was received.
+func (m *model) stuck(c *config) string {
+	for _, l := range c.locals {
+		if !l.done {
+			return "deadlock: " + m.describe(c)
+		}
+	}
+	for ch, q := range c.queues {
+		if len(q) > 0 {
+			return fmt.Sprintf("%s from %s to %s is never received", q[0].label, m.participants[ch.from].name, m.participants[ch.to].name)
+		}
+	}
+	return ""
+}
+
+// unending returns the first node from which no node where every
+// participant ended is reachable, or -1.
+func (m *model) unending(nodes []*node) int {
+	pred := make([][]int, len(nodes))
+	var ends []int
+	for n, nd := range nodes {
+		for _, s := range nd.succ {
+			pred[s] = append(pred[s], n)
+		}
+		if len(nd.succ) == 0 {
+			ends = append(ends, n)
+		}
+	}
+	canEnd := make([]bool, len(nodes))
+	for len(ends) > 0 {
+		n := ends[len(ends)-1]
+		ends = ends[:len(ends)-1]
+		if canEnd[n] {
+			continue
+		}
+		canEnd[n] = true
+		ends = append(ends, pred[n]...)
+	}
+	for n := range nodes {
+		if !canEnd[n] {
+			return n
+		}
+	}
+	return -1
+}
+
+// describe returns what each participant which did not end waits for.
+func (m *model) describe(c *config) string {
+	var waits []string
+	for i, l := range c.locals {
+		if l.done {
+			continue
+		}
+		p := m.participants[i]
+		w := fmt.Sprintf("%s at S%d", p.name, l.state.ID)
+		switch s := l.state; s.Kind {
+		case scribble.SendState:
+			send := s.Stmt.(*scribble.Send)
+			if to, err := m.peer(p, l, send.To); err == nil {
+				w += fmt.Sprintf(" sends %s to %s", send.Label, m.participants[to].name)
+				if len(c.queues[channel{i, to}]) >= m.bound {
+					w += " (queue full)"
+				}
+			}
+		case scribble.RecvState:
+			recv := s.Stmt.(*scribble.Recv)
+			w += fmt.Sprintf(" waits for %s from %s", recv.Label, recv.From)
+		case scribble.ChoiceState:
+			w += fmt.Sprintf(" waits for %s from %s", strings.Join(labels(s), " or "), s.Stmt.(*scribble.LocalChoice).At)
+		}
+		if len(l.stack) > 0 {
+			w += fmt.Sprintf(" in foreach %v", l.stack)
+		}
+		waits = append(waits, w)
+	}
+	return strings.Join(waits, "; ")
+}
+
+// labels returns the labels of the branches of a choice received from
+// another participant.
+func labels(s *scribble.State) []string {
+	ls := make([]string, len(s.Branches))
+	for i, b := range s.Branches {
+		ls[i] = b.Stmt.(*scribble.Recv).Label
+	}
+	return ls
+}
+
+// eval evaluates e in the environment of the participant p in the state l.
+func (m *model) eval(p *participant, l local, e scribble.Expr) (int, error) {
+	env := make(map[string]int, len(p.env)+len(l.env))
+	for name, value := range p.env {
+		env[name] = value
+	}
+	for name, value := range l.env {
+		env[name] = value
+	}
+	return scribble.Eval(e, env)
+}
+
+// peer returns the index of the participant referenced by ref.
+func (m *model) peer(p *participant, l local, ref *scribble.RoleRef) (int, error) {
+	name := ref.Name
+	if ref.Index != nil {
+		index, err := m.eval(p, l, ref.Index)
+		if err != nil {
+			return 0, err
+		}
+		name = transport.Name(ref.Name, index)
+	}
+	i, ok := m.index[name]
+	if !ok {
+		return 0, fmt.Errorf("%s: %s at S%d references %s, which is not a participant", l.state.Stmt.Position(), p.name, l.state.ID, name)
+	}
+	return i, nil
+}
+
+// moves returns the moves of every participant in c.
+func (m *model) moves(c *config) ([]move, *violation, error) {
+	var moves []move
+	for i, l := range c.locals {
+		if l.done {
+			continue
+		}
+		p := m.participants[i]
+		switch s := l.state; s.Kind {
+		case scribble.SendState:
+			send := s.Stmt.(*scribble.Send)
+			to, err := m.peer(p, l, send.To)
+			if err != nil {
+				return nil, nil, err
+			}
+			ch := channel{i, to}
+			if len(c.queues[ch]) >= m.bound {
+				continue
+			}
+			next := c.clone()
+			msg := message{label: send.Label, payload: strings.Join(send.Payloads, ", ")}
+			next.queues[ch] = append(c.queues[ch][:len(c.queues[ch]):len(c.queues[ch])], msg)
+			next.locals[i].state = s.Next
+			step := Step{p.name, trace.Event{Kind: trace.Send, State: s.ID, From: p.name, To: m.participants[to].name, Label: msg.label, Payload: msg.payload}}
+			mv, v, err := m.after(next, i, step)
+			if err != nil || v != nil {
+				return nil, v, err
+			}
+			moves = append(moves, mv)
+		case scribble.RecvState:
+			recv := s.Stmt.(*scribble.Recv)
+			from, err := m.peer(p, l, recv.From)
+			if err != nil {
+				return nil, nil, err
+			}
+			q := c.queues[channel{from, i}]
+			if len(q) == 0 {
+				continue
+			}
+			if q[0].label != recv.Label {
+				return nil, &violation{msg: fmt.Sprintf("%s at S%d expects %s from %s but got %s", p.name, s.ID, recv.Label, m.participants[from].name, q[0].label)}, nil
+			}
+			next := c.clone()
+			next.queues[channel{from, i}] = q[1:]
+			next.locals[i].state = s.Next
+			step := Step{p.name, trace.Event{Kind: trace.Recv, State: s.ID, From: m.participants[from].name, To: p.name, Label: q[0].label, Payload: q[0].payload}}
+			mv, v, err := m.after(next, i, step)
+			if err != nil || v != nil {
+				return nil, v, err
+			}
+			moves = append(moves, mv)
+		case scribble.ChoiceState:
+			if s.Branches[0].Kind != scribble.RecvState {
+				// The participant makes the choice.
+				for _, b := range s.Branches {
+					next := c.clone()
+					next.locals[i].state = b
+					mv, v, err := m.after(next, i)
+					if err != nil || v != nil {
+						return nil, v, err
+					}
+					moves = append(moves, mv)
+				}
+				continue
+			}
+			// The participant learns the choice from the first message.
+			from, err := m.peer(p, l, s.Stmt.(*scribble.LocalChoice).At)
+			if err != nil {
+				return nil, nil, err
+			}
+			q := c.queues[channel{from, i}]
+			if len(q) == 0 {
+				continue
+			}
+			var branch *scribble.State
+			for _, b := range s.Branches {
+				if b.Stmt.(*scribble.Recv).Label == q[0].label {
+					branch = b
+				}
+			}
+			if branch == nil {
+				return nil, &violation{msg: fmt.Sprintf("%s at S%d expects %s from %s but got %s", p.name, s.ID, strings.Join(labels(s), " or "), m.participants[from].name, q[0].label)}, nil
+			}
+			next := c.clone()
+			next.locals[i].state = branch
+			mv, v, err := m.after(next, i)
+			if err != nil || v != nil {
+				return nil, v, err
+			}
+			moves = append(moves, mv)
+		}
+	}
+	return moves, nil, nil
+}
+
+// after returns the move to c, where the participant i made steps. The
+// steps of the move are kept in the violation found in c, if any, so the
+// counterexample ends with the failing step.
+func (m *model) after(c *config, i int, steps ...Step) (move, *violation, error) {
+	s, v, err := m.settle(c, i)
+	mv := move{c: c, steps: append(steps, s...)}
+	if v != nil {
+		v.steps = mv.steps
+	}
+	return mv, v, err
+}
+
+// settle makes the local steps of the participant i in c, which do not
+// depend on the other participants: entering, iterating and exiting
+// foreach loops, guards, and ending.
+func (m *model) settle(c *config, i int) ([]Step, *violation, error) {
+	p := m.participants[i]
+	l := &c.locals[i]
+	var steps []Step
+	// check enters the body of the foreach s, or exits it.
+	check := func(s *scribble.State) error {
+		loop := s.Stmt.(*scribble.LocalForeach)
+		hi, err := m.eval(p, *l, loop.Hi)
+		if err != nil {
+			return err
+		}
+		if l.env[loop.Index] <= hi {
+			steps = append(steps, Step{p.name, trace.Event{Kind: trace.Iterate, State: s.ID, Loop: s.ID, Index: loop.Index, Value: l.env[loop.Index]}})
+			l.state = s.Body
+			return nil
+		}
+		l.env = with(l.env, loop.Index, 0, false)
+		l.stack = l.stack[: len(l.stack)-1 : len(l.stack)-1]
+		steps = append(steps, Step{p.name, trace.Event{Kind: trace.Exit, State: s.ID, Loop: s.ID}})
+		l.state = s.Next
+		return nil
+	}
+	for {
+		var err error
+		switch s := l.state; s.Kind {
+		case scribble.ForeachState:
+			loop := s.Stmt.(*scribble.LocalForeach)
+			var lo int
+			if lo, err = m.eval(p, *l, loop.Lo); err == nil {
+				l.env = with(l.env, loop.Index, lo, true)
+				l.stack = append(l.stack[:len(l.stack):len(l.stack)], s.ID)
+				err = check(s)
+			}
+		case scribble.BodyEndState:
+			loop := s.Next.Stmt.(*scribble.LocalForeach)
+			if len(l.stack) == 0 || l.stack[len(l.stack)-1] != s.Next.ID {
+				return steps, &violation{msg: fmt.Sprintf("%s at S%d ends foreach %d but %v is on its stack", p.name, s.ID, s.Next.ID, l.stack)}, nil
+			}
+			l.env = with(l.env, loop.Index, l.env[loop.Index]+1, true)
+			err = check(s.Next)
+		case scribble.IfState:
+			guard := s.Stmt.(*scribble.If)
+			var lo, hi int
+			if lo, err = m.eval(p, *l, guard.Lo); err == nil {
+				if hi, err = m.eval(p, *l, guard.Hi); err == nil {
+					if self := p.env[scribble.Self]; lo <= self && self <= hi {
+						l.state = s.Body
+					} else {
+						l.state = s.Next
+					}
+				}
+			}
+		case scribble.EndState:
+			l.done = true
+			steps = append(steps, Step{p.name, trace.Event{Kind: trace.End}})
+			if len(l.stack) > 0 {
+				return steps, &violation{msg: fmt.Sprintf("%s ends with foreach %v on its stack", p.name, l.stack)}, nil
+			}
+			return steps, nil, nil
+		default:
+			return steps, nil, nil
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// with returns a copy of env with name set to value, or deleted if !set.
+func with(env map[string]int, name string, value int, set bool) map[string]int {
+	next := make(map[string]int, len(env)+1)
+	for k, v := range env {
+		next[k] = v
+	}
+	if set {
+		next[name] = value
+	} else {
+		delete(next, name)
+	}
+	return next
+}
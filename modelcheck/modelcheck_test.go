@@ -0,0 +1,205 @@
+package modelcheck
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/scribble"
+	"github.com/nickng/scribble-foreach-experiment/trace"
+)
+
+// assumed returns true if the ranges of p are not empty with params.
+func assumed(p *scribble.Protocol, params map[string]int) bool {
+	for _, a := range scribble.Assumptions(p) {
+		if a.Check(params) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+func TestExamples(t *testing.T) {
+	files, err := filepath.Glob("../example/*/*.scr")
+	if err != nil || len(files) == 0 {
+		t.Fatalf("expected example protocols but got %v, %v", files, err)
+	}
+	for _, file := range files {
+		src, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := scribble.Parse(file, string(src))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, params := range Params(p, 2) {
+			if !assumed(p, params) {
+				continue
+			}
+			if n, err := Check(p, params, 0); err != nil {
+				t.Errorf("%s: %v", file, err)
+			} else if n == 0 {
+				t.Errorf("%s %s: expected states to be explored", file, FormatParams(params))
+			}
+		}
+	}
+}
+
+func TestParams(t *testing.T) {
+	p, err := scribble.Parse("scatter.scr", `global protocol P(param n, param m, role M, role W[1..n], role R[1..m]) {
+	foreach W[i:1..n] { task(int) from M to W[i]; }
+	foreach R[j:1..m] { reduced(int) from R[j] to M; }
+}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, params := range Params(p, 2) {
+		got = append(got, FormatParams(params))
+	}
+	if expected := []string{"m=1 n=1", "m=2 n=1", "m=1 n=2", "m=2 n=2"}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v but got %v", expected, got)
+	}
+}
+
+// Local types written by hand for a protocol of C and A[1..k], which cannot
+// be projected from a well-formed global protocol.
+var (
+	c = &scribble.Role{Name: "C"}
+	a = &scribble.Role{Name: "A", Lo: &scribble.Num{Value: 1}, Hi: &scribble.Var{Name: "k"}}
+
+	toC  = &scribble.RoleRef{Name: "C"}
+	toA  = &scribble.RoleRef{Name: "A", Index: &scribble.Num{Value: 1}}
+	toAi = &scribble.RoleRef{Name: "A", Index: &scribble.Var{Name: "i"}}
+)
+
+func localType(role *scribble.Role, body ...scribble.LocalStmt) *scribble.Local {
+	p := &scribble.Protocol{Name: "Bad", Params: []*scribble.Param{{Name: "k"}}, Roles: []*scribble.Role{c, a}}
+	return &scribble.Local{Protocol: p, Role: role, Body: body}
+}
+
+func send(label string, to *scribble.RoleRef) *scribble.Send {
+	return &scribble.Send{Label: label, Payloads: []string{"int"}, To: to}
+}
+
+func recv(label string, from *scribble.RoleRef) *scribble.Recv {
+	return &scribble.Recv{Label: label, Payloads: []string{"int"}, From: from}
+}
+
+// loop is foreach A[i:1..k] { body }.
+func loop(body ...scribble.LocalStmt) *scribble.LocalForeach {
+	return &scribble.LocalForeach{Role: "A", Index: "i", Lo: &scribble.Num{Value: 1}, Hi: &scribble.Var{Name: "k"}, Body: body}
+}
+
+// forever is rec X { body continue X; }.
+func forever(body ...scribble.LocalStmt) *scribble.LocalRec {
+	return &scribble.LocalRec{Label: "X", Body: append(body, &scribble.LocalContinue{Label: "X"})}
+}
+
+func TestViolations(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		locals []*scribble.Local
+		msg    string
+	}{
+		{
+			"Deadlock",
+			[]*scribble.Local{localType(c, recv("x", toA)), localType(a, recv("y", toC))},
+			"deadlock: C at S0 waits for x from A[1]; A[1] at S0 waits for y from C",
+		},
+		{
+			"Unexpected",
+			[]*scribble.Local{localType(c, send("foo", toA)), localType(a, recv("bar", toC))},
+			"A[1] at S0 expects bar from C but got foo",
+		},
+		{
+			"NeverReceived",
+			[]*scribble.Local{localType(c, send("foo", toA)), localType(a)},
+			"foo from C to A[1] is never received",
+		},
+		{
+			"ForeachNeverExits",
+			[]*scribble.Local{localType(c, loop(forever(send("foo", toAi)))), localType(a, forever(recv("foo", toC)))},
+			"the session cannot end from here: C at S1 sends foo to A[1] in foreach [0]; A[1] at S0 waits for foo from C",
+		},
+	} {
+		_, err := CheckLocals(tc.locals, map[string]int{"k": 1}, 1)
+		if cex, ok := err.(*Counterexample); !ok || cex.Msg != tc.msg {
+			t.Errorf("%s: expected counterexample %q but got %v", tc.name, tc.msg, err)
+		}
+	}
+}
+
+func TestCounterexampleTrace(t *testing.T) {
+	locals := []*scribble.Local{
+		localType(c, loop(send("foo", toAi)), recv("bar", toA)),
+		localType(a, recv("foo", toC), recv("baz", toC)),
+	}
+	_, err := CheckLocals(locals, map[string]int{"k": 1}, 0)
+	cex, ok := err.(*Counterexample)
+	if !ok {
+		t.Fatalf("expected a counterexample but got %v", err)
+	}
+	if expected := "k=1: deadlock: C at S2 waits for bar from A[1]; A[1] at S1 waits for baz from C"; cex.Error() != expected {
+		t.Errorf("expected %q but got %q", expected, cex.Error())
+	}
+	var b strings.Builder
+	if err := cex.Dump(&b); err != nil {
+		t.Fatal(err)
+	}
+	expected := `C: S0 iterate foreach 0: i = 1
+C: S1 send C -> A[1]: foo(int)
+C: S0 exit foreach 0
+A[1]: S0 recv C -> A[1]: foo(int)
+`
+	if b.String() != expected {
+		t.Errorf("expected steps:\n%s\nbut got:\n%s", expected, b.String())
+	}
+	// The trace of a participant is in the format recorded by its API.
+	var tr strings.Builder
+	trace.Dump(&tr, cex.Trace("A[1]"))
+	if expected := "S0 recv C -> A[1]: foo(int)\n"; tr.String() != expected {
+		t.Errorf("expected trace of A[1]:\n%s\nbut got:\n%s", expected, tr.String())
+	}
+}
+
+// TestCounterexampleLastStep checks that a counterexample found after a move
+// ends with the steps of that move: C jumps out of a foreach with continue,
+// then sends stop and ends with the foreach on its stack.
+func TestCounterexampleLastStep(t *testing.T) {
+	locals := []*scribble.Local{
+		localType(c, &scribble.LocalRec{Label: "X", Body: []scribble.LocalStmt{
+			&scribble.LocalChoice{At: toC, Branches: [][]scribble.LocalStmt{
+				{loop(send("foo", toAi), &scribble.LocalContinue{Label: "X"})},
+				{send("stop", toA)},
+			}},
+		}}),
+		localType(a, &scribble.LocalRec{Label: "X", Body: []scribble.LocalStmt{
+			&scribble.LocalChoice{At: toC, Branches: [][]scribble.LocalStmt{
+				{recv("foo", toC), &scribble.LocalContinue{Label: "X"}},
+				{recv("stop", toC)},
+			}},
+		}}),
+	}
+	_, err := CheckLocals(locals, map[string]int{"k": 1}, 1)
+	cex, ok := err.(*Counterexample)
+	if !ok {
+		t.Fatalf("expected a counterexample but got %v", err)
+	}
+	if expected := "C ends with foreach [1] on its stack"; cex.Msg != expected {
+		t.Errorf("expected %q but got %q", expected, cex.Msg)
+	}
+	if len(cex.Steps) < 2 {
+		t.Fatalf("expected the steps to the end of C but got %v", cex.Steps)
+	}
+	last, send := cex.Steps[len(cex.Steps)-1], cex.Steps[len(cex.Steps)-2]
+	if last.Participant != "C" || last.Kind != trace.End {
+		t.Errorf("expected the trace to end with the end of C but got %v", last)
+	}
+	if send.Participant != "C" || send.Kind != trace.Send || send.Label != "stop" {
+		t.Errorf("expected stop sent by C before the end but got %v", send)
+	}
+}
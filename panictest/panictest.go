@@ -0,0 +1,60 @@
+// Package panictest runs the misuses of an API, which panic with an error,
+// in the tests of each style:
+//
+//	func TestMisuse(t *testing.T) {
+//		panictest.Run(t, Reset, panictest.Cases{
+//			{"UseTwice", func() { ... }, ErrResourceUsed},
+//		})
+//	}
+//
+// Which misuses a style can express depends on how it drives loops. With the
+// callback APIs (nested, recur, final and value) a loop body cannot exit
+// its foreach early or enter it past the last index, so only state reuse is
+// tested; forrange ranges over a channel which ends at the last index; proto
+// and fused leave the loop to the caller and test every misuse.
+package panictest
+
+import (
+	"errors"
+	"testing"
+)
+
+// Cases are misuses of an API, each runs Run which panics with an error
+// wrapping Err, or returns if Err is nil.
+type Cases []struct {
+	Name string
+	Run  func()
+	Err  error
+}
+
+// Run runs each case in a subtest after reset, which starts the API afresh
+// after the session of the previous case violated the protocol, or nil.
+func Run(t *testing.T, reset func(), cases Cases) {
+	t.Helper()
+	for _, tc := range cases {
+		t.Run(tc.Name, func(t *testing.T) {
+			if reset != nil {
+				reset()
+			}
+			if err := Recover(t, tc.Run); !errors.Is(err, tc.Err) {
+				t.Errorf("expected %v but got %v", tc.Err, err)
+			}
+		})
+	}
+}
+
+// Recover runs f and returns the error f panics with, or nil if f returns.
+// It fails the test if f panics with a value which is not an error.
+func Recover(tb testing.TB, f func()) (err error) {
+	tb.Helper()
+	defer func() {
+		if r := recover(); r != nil {
+			var ok bool
+			if err, ok = r.(error); !ok {
+				tb.Fatalf("expected to panic with an error but got %v", r)
+			}
+		}
+	}()
+	f()
+	return nil
+}
@@ -0,0 +1,6 @@
+// Package depth1 contains the generated API of the benchmark protocol in
+// depth1.scr, with a single foreach loop. Only the Coordinator is
+// generated, the participants A[1..k] are not run by the benchmarks.
+package depth1
+
+//go:generate go run ../../cmd/scribblegen -role Coordinator depth1.scr
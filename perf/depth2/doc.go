@@ -0,0 +1,6 @@
+// Package depth2 contains the generated API of the benchmark protocol in
+// depth2.scr, with 2 nested foreach loops. Only the Coordinator is
+// generated, the participants A[1..k] are not run by the benchmarks.
+package depth2
+
+//go:generate go run ../../cmd/scribblegen -role Coordinator depth2.scr
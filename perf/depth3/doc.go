@@ -0,0 +1,6 @@
+// Package depth3 contains the generated API of the benchmark protocol in
+// depth3.scr, with 3 nested foreach loops. Only the Coordinator is
+// generated, the participants A[1..k] are not run by the benchmarks.
+package depth3
+
+//go:generate go run ../../cmd/scribblegen -role Coordinator depth3.scr
@@ -0,0 +1,355 @@
+// Code generated by scribblegen. DO NOT EDIT.
+
+// Package coordinator is the API of role Coordinator in protocol Depth4.
+//
+// Local protocol:
+//
+//	local protocol Depth4 at Coordinator {
+//	  foreach A[i:1..k] {
+//	    foreach A[j:1..k] {
+//	      foreach A[l:1..k] {
+//	        foreach A[n:1..k] {
+//	          foo(int) to A[n];
+//	        }
+//	      }
+//	    }
+//	  }
+//	}
+package coordinator
+
+import (
+	"fmt"
+
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// ProtoParam is the lookup table for protocol parameters (k).
+// Parameters must be set before the session starts.
+var ProtoParam = make(map[string]int)
+
+// Trace records the transitions of the participants if not nil.
+var Trace *trace.Recorder
+
+// checkParams returns an error if a protocol parameter is not set, or if
+// a range of the protocol is empty.
+func checkParams() error {
+	for _, name := range []string{"k"} {
+		if _, ok := ProtoParam[name]; !ok {
+			return fmt.Errorf("Depth4: protocol parameter %s is not set", name)
+		}
+	}
+	if lo, hi := 1, ProtoParam["k"]; lo > hi {
+		return fmt.Errorf("Depth4: range 1..k is empty (%d..%d)", lo, hi)
+	}
+	return nil
+}
+
+// Fingerprint is the hash of protocol Depth4, a session only starts if all
+// participants have the same fingerprint and protocol parameters.
+const Fingerprint = "4752d7d8bc29e97c"
+
+// hello returns the announcement of participant name in the handshake.
+func hello(name string) transport.Hello {
+	return transport.Hello{Protocol: "Depth4", Participant: name, Fingerprint: Fingerprint, Params: map[string]int{"k": ProtoParam["k"]}}
+}
+
+// peers returns the participants other than name in the handshake.
+func peers(name string) []string {
+	var names []string
+	for i, hi := 1, ProtoParam["k"]; i <= hi; i++ {
+		if peer := transport.Name("A", i); peer != name {
+			names = append(names, peer)
+		}
+	}
+	return names
+}
+
+// endpoint is a participant of the session.
+// The foreach stack is kept per participant so that the participants of
+// an indexed role can run side by side.
+type endpoint struct {
+	name    string                       // name is the name of this participant in the transport
+	conn    transport.Conn               // conn is the connection to the other participants
+	pending map[string]transport.Message // pending are the messages received by Branch
+	sstack  *fsmStack                    // sstack is the foreach stack of this participant
+}
+
+// send sends a message to the participant to from state, it panics with
+// the error of the connection if the message cannot be sent.
+func (ep *endpoint) send(state int, to, label string, payload ...interface{}) {
+	if err := ep.conn.Send(to, transport.Message{Label: label, Payload: payload}); err != nil {
+		panic(fmt.Errorf("%s: cannot send %s to %s: %w", ep.name, label, to, err))
+	}
+	Trace.Record(trace.Event{Kind: trace.Send, State: state, From: ep.name, To: to, Label: label, Payload: formatPayload(payload)})
+}
+
+// peek returns the next message from the participant from without
+// consuming it, it panics with the error of the connection if no message
+// can be received.
+func (ep *endpoint) peek(from string) transport.Message {
+	if m, ok := ep.pending[from]; ok {
+		return m
+	}
+	m, err := ep.conn.Recv(from)
+	if err != nil {
+		panic(fmt.Errorf("%s: cannot receive from %s: %w", ep.name, from, err))
+	}
+	ep.pending[from] = m
+	return m
+}
+
+// iterate tells the connection that the participant starts the iteration
+// (from 1) of the foreach loop ID, or exits the loop if iteration is 0.
+func (ep *endpoint) iterate(loop, iteration int) {
+	if o, ok := ep.conn.(transport.LoopObserver); ok {
+		o.Iterate(loop, iteration)
+	}
+}
+
+// recv receives the next message from the participant from in state,
+// which must have the given label, or it panics with ErrUnexpectedLabel.
+func (ep *endpoint) recv(state int, from, label string) []interface{} {
+	m := ep.peek(from)
+	delete(ep.pending, from)
+	if m.Label != label {
+		panic(fmt.Errorf("%s: %w from %s: expected %s but got %s", ep.name, ErrUnexpectedLabel, from, label, m.Label))
+	}
+	Trace.Record(trace.Event{Kind: trace.Recv, State: state, From: from, To: ep.name, Label: label, Payload: formatPayload(m.Payload)})
+	return m.Payload
+}
+
+// formatPayload returns the payload of a message in a trace, e.g. 1, x.
+func formatPayload(payload []interface{}) string {
+	var b []byte
+	for i, v := range payload {
+		if i > 0 {
+			b = append(b, ", "...)
+		}
+		b = fmt.Append(b, v)
+	}
+	return string(b)
+}
+
+// New returns the initial state of Coordinator,
+// conn is the connection of Coordinator to the other participants.
+// It returns an error if the protocol parameters are not set correctly, or
+// if the other participants run a different protocol (see Fingerprint).
+func New(conn transport.Conn) (*S0, error) {
+	if err := checkParams(); err != nil {
+		return nil, err
+	}
+	name := "Coordinator"
+	if conn == nil {
+		return nil, fmt.Errorf("Depth4: %s has no connection", name)
+	}
+	if err := transport.Handshake(conn, hello(name), peers(name)); err != nil {
+		return nil, err
+	}
+	ep := &endpoint{name: name, conn: conn, pending: make(map[string]transport.Message), sstack: newStack()}
+	return &S0{ep: ep}, nil
+}
+
+// S0 is the init state of foreach A[i:1..k] (loop ID 0).
+type S0 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S0) ID() int { return 0 }
+
+// Foreach runs bodyFn for each i in 1..k, then moves to SEnd.
+func (s *S0) Foreach(bodyFn func(*S1) *S5) *SEnd {
+	s.Use()
+	sstack := s.ep.sstack
+	if sstack.isEmpty() || sstack.top().ID != 0 {
+		// first time enter loop
+		sstack.push(0, 1, ProtoParam["k"])
+	} else if sstack.top().ID == 0 {
+		// re-enter loop
+		sstack.top().increment()
+	} else {
+		panic("shouldn't get here")
+	}
+
+	for n := 1; sstack.top().canEnter(); n++ {
+		s.ep.iterate(0, n)
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: 0, Loop: 0, Index: "i", Value: sstack.top().curr})
+		bodyFn(&S1{ep: s.ep}).end()
+	}
+	s.ep.iterate(0, 0)
+	Trace.Record(trace.Event{Kind: trace.Exit, State: 0, Loop: 0})
+	sstack.pop()
+	return &SEnd{ep: s.ep}
+}
+
+// S1 is the init state of foreach A[j:1..k] (loop ID 1).
+type S1 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S1) ID() int { return 1 }
+
+// Foreach runs bodyFn for each j in 1..k, then moves to S5.
+func (s *S1) Foreach(bodyFn func(*S2) *S6) *S5 {
+	s.Use()
+	sstack := s.ep.sstack
+	if sstack.isEmpty() || sstack.top().ID != 1 {
+		// first time enter loop
+		sstack.push(1, 1, ProtoParam["k"])
+	} else if sstack.top().ID == 1 {
+		// re-enter loop
+		sstack.top().increment()
+	} else {
+		panic("shouldn't get here")
+	}
+
+	for n := 1; sstack.top().canEnter(); n++ {
+		s.ep.iterate(1, n)
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: 1, Loop: 1, Index: "j", Value: sstack.top().curr})
+		bodyFn(&S2{ep: s.ep}).end()
+	}
+	s.ep.iterate(1, 0)
+	Trace.Record(trace.Event{Kind: trace.Exit, State: 1, Loop: 1})
+	sstack.pop()
+	return &S5{ep: s.ep}
+}
+
+// S2 is the init state of foreach A[l:1..k] (loop ID 2).
+type S2 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S2) ID() int { return 2 }
+
+// Foreach runs bodyFn for each l in 1..k, then moves to S6.
+func (s *S2) Foreach(bodyFn func(*S3) *S7) *S6 {
+	s.Use()
+	sstack := s.ep.sstack
+	if sstack.isEmpty() || sstack.top().ID != 2 {
+		// first time enter loop
+		sstack.push(2, 1, ProtoParam["k"])
+	} else if sstack.top().ID == 2 {
+		// re-enter loop
+		sstack.top().increment()
+	} else {
+		panic("shouldn't get here")
+	}
+
+	for n := 1; sstack.top().canEnter(); n++ {
+		s.ep.iterate(2, n)
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: 2, Loop: 2, Index: "l", Value: sstack.top().curr})
+		bodyFn(&S3{ep: s.ep}).end()
+	}
+	s.ep.iterate(2, 0)
+	Trace.Record(trace.Event{Kind: trace.Exit, State: 2, Loop: 2})
+	sstack.pop()
+	return &S6{ep: s.ep}
+}
+
+// S3 is the init state of foreach A[n:1..k] (loop ID 3).
+type S3 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S3) ID() int { return 3 }
+
+// Foreach runs bodyFn for each n in 1..k, then moves to S7.
+func (s *S3) Foreach(bodyFn func(*S4) *S8) *S7 {
+	s.Use()
+	sstack := s.ep.sstack
+	if sstack.isEmpty() || sstack.top().ID != 3 {
+		// first time enter loop
+		sstack.push(3, 1, ProtoParam["k"])
+	} else if sstack.top().ID == 3 {
+		// re-enter loop
+		sstack.top().increment()
+	} else {
+		panic("shouldn't get here")
+	}
+
+	for n := 1; sstack.top().canEnter(); n++ {
+		s.ep.iterate(3, n)
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: 3, Loop: 3, Index: "n", Value: sstack.top().curr})
+		bodyFn(&S4{ep: s.ep}).end()
+	}
+	s.ep.iterate(3, 0)
+	Trace.Record(trace.Event{Kind: trace.Exit, State: 3, Loop: 3})
+	sstack.pop()
+	return &S7{ep: s.ep}
+}
+
+// S4 is the state before foo(int) to A[n].
+type S4 struct {
+	resource
+	ep *endpoint
+}
+
+// Send_An_foo sends foo to A[n], then moves to S8.
+func (s *S4) Send_An_foo(v int) *S8 {
+	s.Use()
+	s.ep.send(4, transport.Name("A", s.ep.sstack.find(3).curr), "foo", v)
+	return &S8{ep: s.ep}
+}
+
+// S5 is the ending state of foreach loop ID 0.
+type S5 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S5) end() {
+	s.Use()
+	s.ep.sstack.top().increment()
+}
+
+// S6 is the ending state of foreach loop ID 1.
+type S6 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S6) end() {
+	s.Use()
+	s.ep.sstack.top().increment()
+}
+
+// S7 is the ending state of foreach loop ID 2.
+type S7 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S7) end() {
+	s.Use()
+	s.ep.sstack.top().increment()
+}
+
+// S8 is the ending state of foreach loop ID 3.
+type S8 struct {
+	resource
+	ep *endpoint
+}
+
+func (s *S8) end() {
+	s.Use()
+	s.ep.sstack.top().increment()
+}
+
+// SEnd is the usual final state of a protocol.
+type SEnd struct {
+	resource
+	ep *endpoint
+}
+
+// End closes the connection to the other participants.
+func (s *SEnd) End() {
+	s.Use()
+	if err := s.ep.conn.Close(); err != nil {
+		panic(fmt.Errorf("%s: cannot close connection: %w", s.ep.name, err))
+	}
+	Trace.Record(trace.Event{Kind: trace.End})
+}
@@ -0,0 +1,6 @@
+// Package depth4 contains the generated API of the benchmark protocol in
+// depth4.scr, with 4 nested foreach loops. Only the Coordinator is
+// generated, the participants A[1..k] are not run by the benchmarks.
+package depth4
+
+//go:generate go run ../../cmd/scribblegen -role Coordinator depth4.scr
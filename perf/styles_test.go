@@ -0,0 +1,244 @@
+package perf_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/example/nested/coordinator"
+	"github.com/nickng/scribble-foreach-experiment/final"
+	"github.com/nickng/scribble-foreach-experiment/forrange"
+	"github.com/nickng/scribble-foreach-experiment/fused"
+	"github.com/nickng/scribble-foreach-experiment/nested"
+	depth1 "github.com/nickng/scribble-foreach-experiment/perf/depth1/coordinator"
+	depth2 "github.com/nickng/scribble-foreach-experiment/perf/depth2/coordinator"
+	depth3 "github.com/nickng/scribble-foreach-experiment/perf/depth3/coordinator"
+	depth4 "github.com/nickng/scribble-foreach-experiment/perf/depth4/coordinator"
+	"github.com/nickng/scribble-foreach-experiment/proto"
+	"github.com/nickng/scribble-foreach-experiment/recur"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+	"github.com/nickng/scribble-foreach-experiment/value"
+)
+
+// ks are the numbers of participants A[1..k] benchmarked.
+var ks = []int{1, 10, 1000}
+
+// maxIterations bounds the iterations of the innermost loop of a session,
+// i.e. k^depth, the benchmarks of k = 1000 past depth 2 are skipped.
+const maxIterations = 1000000
+
+// nullConn is a connection which discards the messages sent, and answers
+// the handshake of every peer as a participant of protocol.
+type nullConn struct {
+	protocol, fingerprint string
+	k                     int
+}
+
+func (c *nullConn) Send(to string, m transport.Message) error { return nil }
+
+func (c *nullConn) Recv(from string) (transport.Message, error) {
+	hello := transport.Hello{Protocol: c.protocol, Participant: from, Fingerprint: c.fingerprint, Params: map[string]int{"k": c.k}}
+	return transport.Message{Label: "hello", Payload: []interface{}{hello}}, nil
+}
+
+func (c *nullConn) Close() error { return nil }
+
+// A style runs a session of the Coordinator of the nested example with
+// k participants, the loop bodies are inline.
+type style struct {
+	name  string
+	param map[string]int
+	run   func(b *testing.B, k int)
+}
+
+var valueSession = new(value.Session)
+
+var styles = []style{
+	{"proto", proto.ProtoParam, func(b *testing.B, k int) {
+		s := new(proto.S0)
+		for s.HasNext() {
+			s1 := s.Foreach()
+			for s1.HasNext() {
+				s1 = s1.Foreach().Send_Aj_foo(1)
+			}
+			s = s1.EndForeach().Send_Ai_bar("bar")
+		}
+		s.EndForeach().End()
+	}},
+	{"fused", fused.ProtoParam, func(b *testing.B, k int) {
+		s := new(fused.S0)
+		for i := 1; i <= k; i++ {
+			s1, _ := s.Foreach()
+			for j := 1; j <= k; j++ {
+				s2, _ := s1.Foreach()
+				s1 = s2.Send_Aj_foo(1)
+			}
+			s = s1.EndForeach().Send_Ai_bar("bar")
+		}
+		s.EndForeach().End()
+	}},
+	{"nested", nested.ProtoParam, func(b *testing.B, k int) {
+		new(nested.S0).Foreach(func(s *nested.S1) *nested.S4 {
+			return s.Foreach(func(s *nested.S2) *nested.S5 {
+				return s.Send_Aj_foo(1)
+			}).Send_Ai_bar("bar")
+		}).End()
+	}},
+	{"recur", recur.ProtoParam, func(b *testing.B, k int) {
+		new(recur.S0).Foreach(func(s *recur.S1) *recur.S0 {
+			return s.Foreach(func(s *recur.S2) *recur.S1 {
+				return s.Send_Aj_foo(1)
+			}).Send_Ai_bar("bar")
+		}).End()
+	}},
+	{"forrange", forrange.ProtoParam, func(b *testing.B, k int) {
+		loop0, end0 := new(forrange.S0).Foreach()
+		for s1 := range loop0 {
+			loop1, end1 := s1.Foreach()
+			for s2 := range loop1 {
+				s2.Send_Aj_foo(1).End()
+			}
+			end1.Send_Ai_bar("bar").End()
+		}
+		end0.End()
+	}},
+	{"final", final.ProtoParam, func(b *testing.B, k int) {
+		new(final.S0).Foreach(func(s *final.S1) *final.S4 {
+			return s.Foreach(func(s *final.S2) *final.S5 {
+				return s.Send_Aj_foo(1)
+			}).Send_Ai_bar("bar")
+		}).End()
+	}},
+	{"value", value.ProtoParam, func(b *testing.B, k int) {
+		// The session is started again, reusing its foreach stack.
+		valueSession.Start().Foreach(func(s value.S1) value.S4 {
+			return s.Foreach(func(s value.S2) value.S5 {
+				return s.Send_Aj_foo(1)
+			}).Send_Ai_bar("bar")
+		}).End()
+	}},
+	{"generated", coordinator.ProtoParam, func(b *testing.B, k int) {
+		b.StopTimer()
+		s, err := coordinator.New(&nullConn{"Nested", coordinator.Fingerprint, k})
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		s.Foreach(func(s *coordinator.S1) *coordinator.S4 {
+			return s.Foreach(func(s *coordinator.S2) *coordinator.S5 {
+				return s.Send_Aj_foo(1)
+			}).Send_Ai_bar("bar")
+		}).End()
+	}},
+}
+
+// BenchmarkStyles runs a session of the nested example (depth 2) in each
+// API style, without a transport. The generated API sends to a connection
+// which discards the messages, and the handshake is not timed. The
+// hand-written styles only implement the nested example, so they are not
+// benchmarked at other depths.
+func BenchmarkStyles(b *testing.B) {
+	for _, st := range styles {
+		for _, k := range ks {
+			st, k := st, k
+			b.Run(fmt.Sprintf("%s/k=%d", st.name, k), func(b *testing.B) {
+				st.param["k"] = k
+				b.ReportAllocs()
+				for n := 0; n < b.N; n++ {
+					st.run(b, k)
+				}
+			})
+		}
+	}
+}
+
+// depths run a session of the generated Coordinator with 1 to 4 nested
+// foreach loops, sending foo to A[1..k] in the innermost loop.
+var depths = []struct {
+	param       map[string]int
+	protocol    string
+	fingerprint string
+	run         func(b *testing.B, conn transport.Conn)
+}{
+	{depth1.ProtoParam, "Depth1", depth1.Fingerprint, func(b *testing.B, conn transport.Conn) {
+		b.StopTimer()
+		s, err := depth1.New(conn)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		s.Foreach(func(s *depth1.S1) *depth1.S2 {
+			return s.Send_Ai_foo(1)
+		}).End()
+	}},
+	{depth2.ProtoParam, "Depth2", depth2.Fingerprint, func(b *testing.B, conn transport.Conn) {
+		b.StopTimer()
+		s, err := depth2.New(conn)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		s.Foreach(func(s *depth2.S1) *depth2.S3 {
+			return s.Foreach(func(s *depth2.S2) *depth2.S4 {
+				return s.Send_Aj_foo(1)
+			})
+		}).End()
+	}},
+	{depth3.ProtoParam, "Depth3", depth3.Fingerprint, func(b *testing.B, conn transport.Conn) {
+		b.StopTimer()
+		s, err := depth3.New(conn)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		s.Foreach(func(s *depth3.S1) *depth3.S4 {
+			return s.Foreach(func(s *depth3.S2) *depth3.S5 {
+				return s.Foreach(func(s *depth3.S3) *depth3.S6 {
+					return s.Send_Al_foo(1)
+				})
+			})
+		}).End()
+	}},
+	{depth4.ProtoParam, "Depth4", depth4.Fingerprint, func(b *testing.B, conn transport.Conn) {
+		b.StopTimer()
+		s, err := depth4.New(conn)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.StartTimer()
+		s.Foreach(func(s *depth4.S1) *depth4.S5 {
+			return s.Foreach(func(s *depth4.S2) *depth4.S6 {
+				return s.Foreach(func(s *depth4.S3) *depth4.S7 {
+					return s.Foreach(func(s *depth4.S4) *depth4.S8 {
+						return s.Send_An_foo(1)
+					})
+				})
+			})
+		}).End()
+	}},
+}
+
+// BenchmarkDepth runs a session of the generated Coordinator of perf/depth1
+// to perf/depth4 for each k, it skips the sessions of more than
+// maxIterations iterations of the innermost loop. The handshake is not timed.
+func BenchmarkDepth(b *testing.B) {
+	for d, depth := range depths {
+		for _, k := range ks {
+			iterations := 1
+			for i := 0; i <= d; i++ {
+				iterations *= k
+			}
+			depth, k := depth, k
+			b.Run(fmt.Sprintf("depth=%d/k=%d", d+1, k), func(b *testing.B) {
+				if iterations > maxIterations {
+					b.Skipf("%d iterations of the innermost loop, more than %d", iterations, maxIterations)
+				}
+				depth.param["k"] = k
+				conn := &nullConn{depth.protocol, depth.fingerprint, k}
+				b.ReportAllocs()
+				for n := 0; n < b.N; n++ {
+					depth.run(b, conn)
+				}
+			})
+		}
+	}
+}
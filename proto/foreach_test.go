@@ -0,0 +1,56 @@
+package proto
+
+import (
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/stacktest"
+)
+
+// stack adapts foreachStack to the reference model of stacktest.
+type stack struct{ *foreachStack }
+
+func newAdapter() stacktest.Stack { return stack{new(foreachStack)} }
+
+func (s stack) Push(ID, first, last int) { s.push(ID, last-first+1) }
+func (s stack) Increment()               { s.top().curr++ }
+func (s stack) Pop()                     { s.pop() }
+func (s stack) CanEnter() bool           { return s.top().bodyOK() }
+func (s stack) HasNext() bool            { return s.top().hasNext() }
+
+func (s stack) Snapshot() stacktest.Snapshot {
+	snap := stacktest.Snapshot{Empty: s.isEmpty(), Index: s.index, Top: -1}
+	top := s.top()
+	for i, state := range s.stack {
+		snap.States = append(snap.States, stacktest.State{ID: state.ID, Curr: state.curr, Last: state.last})
+		if state == top {
+			snap.Top = i
+		}
+	}
+	for _, state := range s.stack[len(s.stack):cap(s.stack)] {
+		if state != nil {
+			snap.Spare++
+		}
+	}
+	return snap
+}
+
+func TestStackEmpty(t *testing.T) {
+	fes := new(foreachStack)
+	if !fes.isEmpty() || fes.top() != nil {
+		t.Fatalf("expected new stack to be empty but got %v", fes)
+	}
+	fes.push(1, 2)
+	fes.pop()
+	if !fes.isEmpty() || fes.top() != nil {
+		t.Fatalf("expected stack to be empty after pop but got %v", fes)
+	}
+	// push reuses the backing array of the popped state.
+	fes.push(2, 3)
+	if top := fes.top(); top == nil || *top != (foreachState{ID: 2, curr: 0, last: 2}) {
+		t.Fatalf("expected {2: 0/2} on top after push but got %v", fes)
+	}
+}
+
+func TestStackQuick(t *testing.T) { stacktest.Quick(t, newAdapter) }
+
+func FuzzStack(f *testing.F) { stacktest.Fuzz(f, newAdapter) }
@@ -0,0 +1,53 @@
+package proto
+
+import (
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/panictest"
+)
+
+func TestMisuse(t *testing.T) {
+	ProtoParam["k"] = 2
+	panictest.Run(t, Reset, panictest.Cases{
+		{"Good", func() {
+			s := new(S0)
+			for s.HasNext() {
+				s1 := s.Foreach()
+				for s1.HasNext() {
+					s1 = s1.Foreach().Send_Aj_foo(1)
+				}
+				s = s1.EndForeach().Send_Ai_bar("")
+			}
+			s.EndForeach().End()
+		}, nil},
+		{"UseTwice", func() {
+			s := new(S0)
+			s.Foreach()
+			s.Foreach()
+		}, ErrResourceUsed},
+		{"EmptyInnerBody", func() {
+			// protoBad in main.go
+			new(S0).
+				Foreach().
+				Foreach().Send_Aj_foo(1).Foreach().Send_Aj_foo(2).EndForeach().
+				Send_Ai_bar("").
+				Foreach().EndForeach()
+		}, ErrNoForeach},
+		{"EndBeforeExhausted", func() {
+			new(S0).Foreach().Foreach().Send_Aj_foo(1).EndForeach()
+		}, ErrPrematureExit},
+		{"EndBeforeForeach", func() {
+			new(S0).EndForeach()
+		}, ErrNoForeach},
+		{"EndOuterInInner", func() {
+			new(S0).Foreach().Foreach()
+			new(S0).EndForeach()
+		}, ErrNoForeach},
+		{"ForeachPastLast", func() {
+			s1 := new(S0).Foreach()
+			s1 = s1.Foreach().Send_Aj_foo(1)
+			s1 = s1.Foreach().Send_Aj_foo(2)
+			s1.Foreach()
+		}, ErrCannotEnter},
+	})
+}
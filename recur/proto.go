@@ -1,9 +1,17 @@
 package recur
 
 import (
+	"errors"
 	"fmt"
-	"log"
-	"os"
+
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// Misuse of the API panics with one of these errors.
+var (
+	ErrResourceUsed  = errors.New("resource used")
+	ErrPopEmptyStack = errors.New("cannot pop: stack empty")
 )
 
 type resource struct {
@@ -12,8 +20,7 @@ type resource struct {
 
 func (res *resource) Use() {
 	if res.used {
-		log.Fatal("Resource used")
-		os.Exit(1)
+		panic(ErrResourceUsed)
 	}
 	res.used = true
 }
@@ -23,6 +30,25 @@ var ProtoParam = map[string]int{
 	"k": 2, // role A(k=2)
 }
 
+// Trace records the transitions of the session if not nil.
+var Trace *trace.Recorder
+
+// Conn is the connection of the Coordinator to the participants A[1..k].
+// Messages are discarded if Conn is nil.
+var Conn transport.Conn
+
+// send sends a message to the participant A[index], it panics with the
+// error of the connection if the message cannot be sent.
+func send(index int, label string, payload ...interface{}) {
+	if Conn == nil {
+		return
+	}
+	to := transport.Name("A", index)
+	if err := Conn.Send(to, transport.Message{Label: label, Payload: payload}); err != nil {
+		panic(fmt.Errorf("cannot send %s to %s: %w", label, to, err))
+	}
+}
+
 // Example protocol - nested one-to-many:
 //
 // foreach A[i:1..k] {
@@ -61,7 +87,7 @@ type foreachStack struct {
 }
 
 func (fes *foreachStack) top() *foreachState {
-	if fes.stack != nil {
+	if len(fes.stack) > 0 { // fes.index is -1 after popping the last state
 		return fes.stack[fes.index]
 	}
 	return nil
@@ -82,10 +108,11 @@ func (fes *foreachStack) push(ID, rangeLen int) {
 func (fes *foreachStack) pop() {
 	stacksize := len(fes.stack)
 	if stacksize > 0 {
+		fes.stack[stacksize-1] = nil // don't keep the popped state in the backing array
 		fes.stack = fes.stack[:stacksize-1]
 		fes.index = stacksize - 2 // could be -1
 	} else {
-		log.Fatalf("Cannot pop empty foreach-stack")
+		panic(ErrPopEmptyStack)
 	}
 }
 
@@ -100,6 +127,10 @@ func (fes foreachStack) String() string {
 // fes is the shared foreach stack.
 var fes = new(foreachStack)
 
+// Reset empties the shared foreach stack, so a session can start again from
+// new(S0) after a session violating the protocol.
+func Reset() { fes = new(foreachStack) }
+
 /// --- end of common code ---------------------------------------------------
 
 // S0 is the initial state.
@@ -130,9 +161,11 @@ func (s *S0) Foreach(body func(*S1) *S0) *SEnd {
 		panic("shouldn't get here")
 	}
 
+	Trace.Record(trace.Event{Kind: trace.Iterate, State: s.ID(), Loop: s.ID(), Index: "i", Value: fes.top().curr + 1})
 	loopInit := body(new(S1))
 	if !fes.top().hasNext() {
 		fes.pop()
+		Trace.Record(trace.Event{Kind: trace.Exit, State: s.ID(), Loop: s.ID()})
 		return new(SEnd)
 	}
 	return loopInit.Foreach(body)
@@ -158,9 +191,11 @@ func (s *S1) Foreach(body func(*S2) *S1) *S3 {
 		panic("shouldn't get here")
 	}
 
+	Trace.Record(trace.Event{Kind: trace.Iterate, State: s.ID(), Loop: s.ID(), Index: "j", Value: fes.top().curr + 1})
 	loopInit := body(new(S2))
 	if !fes.top().hasNext() {
 		fes.pop()
+		Trace.Record(trace.Event{Kind: trace.Exit, State: s.ID(), Loop: s.ID()})
 		return new(S3)
 	}
 	return loopInit.Foreach(body)
@@ -176,6 +211,8 @@ type S2 struct {
 // As the last statement of inner foreach, always go back to s1 (inner foreach init).
 func (s *S2) Send_Aj_foo(v int) *S1 {
 	s.Use()
+	Trace.Record(trace.Event{Kind: trace.Send, State: 2, From: "Coordinator", To: fmt.Sprintf("A[%d]", fes.top().curr+1), Label: "foo", Payload: fmt.Sprint(v)})
+	send(fes.top().curr+1, "foo", v) // top is the foreach j, from 0
 	return new(S1)
 }
 
@@ -188,6 +225,8 @@ type S3 struct {
 // As the last statement of outer foreach, always go back to s0 (outer foreach init).
 func (s *S3) Send_Ai_bar(v string) *S0 {
 	s.Use()
+	Trace.Record(trace.Event{Kind: trace.Send, State: 3, From: "Coordinator", To: fmt.Sprintf("A[%d]", fes.top().curr+1), Label: "bar", Payload: fmt.Sprint(v)})
+	send(fes.top().curr+1, "bar", v) // top is the foreach i, from 0
 	return new(S0)
 }
 
@@ -198,5 +237,10 @@ type SEnd struct {
 
 func (s *SEnd) End() {
 	s.Use()
-	// Close channels etc.
+	Trace.Record(trace.Event{Kind: trace.End})
+	if Conn != nil {
+		if err := Conn.Close(); err != nil {
+			panic(fmt.Errorf("cannot close connection: %w", err))
+		}
+	}
 }
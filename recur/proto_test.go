@@ -0,0 +1,51 @@
+package recur
+
+import (
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/panictest"
+)
+
+func TestMisuse(t *testing.T) {
+	ProtoParam["k"] = 2
+	inner := func(s *S2) *S1 { return s.Send_Aj_foo(1) }
+	outer := func(s *S1) *S0 { return s.Foreach(inner).Send_Ai_bar("") }
+	panictest.Run(t, Reset, panictest.Cases{
+		{"Good", func() {
+			new(S0).Foreach(outer).End()
+		}, nil},
+		{"UseTwice", func() {
+			s := new(S0)
+			s.Foreach(outer)
+			s.Foreach(outer)
+		}, ErrResourceUsed},
+		{"SendTwice", func() {
+			new(S0).Foreach(func(s *S1) *S0 {
+				return s.Foreach(func(s *S2) *S1 {
+					s.Send_Aj_foo(1)
+					return s.Send_Aj_foo(2)
+				}).Send_Ai_bar("")
+			})
+		}, ErrResourceUsed},
+		{"StaleBodyEnd", func() {
+			// The inner body returns the loop state of its first iteration.
+			var first *S1
+			new(S0).Foreach(func(s *S1) *S0 {
+				return s.Foreach(func(s *S2) *S1 {
+					if end := s.Send_Aj_foo(1); first == nil {
+						first = end
+					}
+					return first
+				}).Send_Ai_bar("")
+			})
+		}, ErrResourceUsed},
+		{"OuterStateInInner", func() {
+			new(S0).Foreach(func(s1 *S1) *S0 {
+				return s1.Foreach(func(s *S2) *S1 {
+					s1.Foreach(inner)
+					return s.Send_Aj_foo(1)
+				}).Send_Ai_bar("")
+			})
+		}, ErrResourceUsed},
+	})
+}
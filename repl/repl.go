@@ -0,0 +1,251 @@
+// Package repl steps through a session of a foreach API interactively, one
+// method call at a time.
+//
+// The REPL shows the current state, the foreach stack and the methods of the
+// state, found by reflection, and calls the method typed at the prompt with
+// its payloads:
+//
+//	state *proto.S2
+//	stack [{0: 0/1} {1: 0/1}]@1
+//	  Send_Aj_foo(int) *proto.S1
+//	> Send_Aj_foo 1
+//
+// A method returning a value with methods moves to that value as the next
+// state, and the value of any other result is printed. Methods without
+// parameters returning a value which is not a state (e.g. HasNext and ID) do
+// not change the state, they are listed with their current value. If a method
+// panics, e.g. with proto.ErrPrematureExit, the error is printed and the
+// state is unchanged, so the state may have been used; restart starts the
+// session again.
+package repl
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Session is a session of a foreach API.
+type Session struct {
+	Start func() interface{} // Start starts the session and returns the initial state
+	Stack func() string      // Stack returns the foreach stack of the session
+}
+
+// hidden are the methods of a state which are not transitions, i.e. Use of
+// the resource embedded in every state.
+var hidden = map[string]bool{"Use": true}
+
+const help = `commands:
+  Method [payload...]  call a method of the state, e.g. Send_Aj_foo 1 or Send_Ai_bar "bar"
+  restart              start the session again
+  help                 print this help
+  quit                 quit
+`
+
+// Run reads commands from r and writes the session to w, until r ends or
+// quit is typed.
+func Run(r io.Reader, w io.Writer, ss Session) error {
+	state := ss.Start()
+	show(w, ss, state)
+	sc := bufio.NewScanner(r)
+	for {
+		fmt.Fprint(w, "> ")
+		if !sc.Scan() {
+			fmt.Fprintln(w)
+			return sc.Err()
+		}
+		fields, err := split(sc.Text())
+		if err != nil {
+			fmt.Fprintf(w, "error: %v\n", err)
+			continue
+		}
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "quit", "exit":
+			return nil
+		case "help":
+			fmt.Fprint(w, help)
+			continue
+		case "restart":
+			state = ss.Start()
+		default:
+			if state == nil {
+				fmt.Fprintln(w, "error: the session has ended, restart or quit")
+				continue
+			}
+			next, err := call(w, state, fields[0], fields[1:])
+			if err != nil {
+				// The method may have changed the foreach stack before
+				// panicking, so the state is shown again.
+				fmt.Fprintf(w, "error: %v\n", err)
+				break
+			}
+			state = next
+		}
+		show(w, ss, state)
+	}
+}
+
+// show writes the state, the foreach stack and the methods of the state.
+func show(w io.Writer, ss Session, state interface{}) {
+	if state == nil {
+		fmt.Fprintln(w, "session ended")
+		return
+	}
+	v := reflect.ValueOf(state)
+	fmt.Fprintf(w, "state %s\n", v.Type())
+	fmt.Fprintln(w, ss.Stack())
+	for i := 0; i < v.NumMethod(); i++ {
+		m := v.Type().Method(i)
+		if hidden[m.Name] {
+			continue
+		}
+		fmt.Fprintf(w, "  %s%s", m.Name, signature(v.Method(i).Type()))
+		if isQuery(v.Method(i).Type()) {
+			fmt.Fprintf(w, " = %v", v.Method(i).Call(nil)[0])
+		}
+		fmt.Fprintln(w)
+	}
+}
+
+// isState returns true if a value of t is a state, i.e. it has methods.
+func isState(t reflect.Type) bool {
+	return t.NumMethod() > 0
+}
+
+// isQuery returns true if a method of type t does not take parameters and
+// returns a value which is not a state.
+func isQuery(t reflect.Type) bool {
+	return t.NumIn() == 0 && t.NumOut() == 1 && !isState(t.Out(0))
+}
+
+// signature formats the parameters and results of a method of type t, e.g.
+// (int) *proto.S1.
+func signature(t reflect.Type) string {
+	var params, results []string
+	for i := 0; i < t.NumIn(); i++ {
+		params = append(params, t.In(i).String())
+	}
+	for i := 0; i < t.NumOut(); i++ {
+		results = append(results, t.Out(i).String())
+	}
+	sig := "(" + strings.Join(params, ", ") + ")"
+	switch len(results) {
+	case 0:
+		return sig
+	case 1:
+		return sig + " " + results[0]
+	}
+	return sig + " (" + strings.Join(results, ", ") + ")"
+}
+
+// call calls the method name of state with the payloads args, and returns the
+// next state. The error of a misuse is returned if the method panics.
+func call(w io.Writer, state interface{}, name string, args []string) (next interface{}, err error) {
+	m := reflect.ValueOf(state).MethodByName(name)
+	if !m.IsValid() || hidden[name] {
+		return nil, fmt.Errorf("%T has no method %s", state, name)
+	}
+	t := m.Type()
+	if len(args) != t.NumIn() {
+		return nil, fmt.Errorf("%s%s: expected %d payloads but got %d", name, signature(t), t.NumIn(), len(args))
+	}
+	in := make([]reflect.Value, len(args))
+	for i, arg := range args {
+		if in[i], err = parse(arg, t.In(i)); err != nil {
+			return nil, fmt.Errorf("payload %d of %s: %v", i+1, name, err)
+		}
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%v", r)
+		}
+	}()
+	next = state
+	for _, out := range m.Call(in) {
+		if isState(out.Type()) {
+			next = out.Interface()
+		} else {
+			fmt.Fprintf(w, "%s returned %v\n", name, out)
+		}
+	}
+	if t.NumOut() == 0 {
+		next = nil // e.g. End
+	}
+	return next, nil
+}
+
+// parse parses the payload arg as a value of type t.
+func parse(arg string, t reflect.Type) (reflect.Value, error) {
+	v := reflect.New(t).Elem()
+	switch t.Kind() {
+	case reflect.String:
+		if strings.HasPrefix(arg, `"`) {
+			s, err := strconv.Unquote(arg)
+			if err != nil {
+				return v, err
+			}
+			arg = s
+		}
+		v.SetString(arg)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		i, err := strconv.ParseInt(arg, 0, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u, err := strconv.ParseUint(arg, 0, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(arg, t.Bits())
+		if err != nil {
+			return v, err
+		}
+		v.SetFloat(f)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(arg)
+		if err != nil {
+			return v, err
+		}
+		v.SetBool(b)
+	default:
+		return v, fmt.Errorf("cannot read a payload of type %s", t)
+	}
+	return v, nil
+}
+
+// split splits a command line into fields separated by spaces, a quoted
+// string is one field.
+func split(line string) ([]string, error) {
+	var fields []string
+	for {
+		line = strings.TrimLeft(line, " \t")
+		if line == "" {
+			return fields, nil
+		}
+		if line[0] == '"' {
+			quoted, err := strconv.QuotedPrefix(line)
+			if err != nil {
+				return nil, fmt.Errorf("unterminated string %s", line)
+			}
+			fields = append(fields, quoted)
+			line = line[len(quoted):]
+			continue
+		}
+		end := strings.IndexAny(line, " \t")
+		if end < 0 {
+			end = len(line)
+		}
+		fields = append(fields, line[:end])
+		line = line[end:]
+	}
+}
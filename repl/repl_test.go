@@ -0,0 +1,99 @@
+package repl_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/proto"
+	"github.com/nickng/scribble-foreach-experiment/repl"
+)
+
+var session = repl.Session{
+	Start: func() interface{} {
+		proto.Reset()
+		return new(proto.S0)
+	},
+	Stack: proto.Stack,
+}
+
+// run runs the REPL with the commands, and returns the session.
+func run(t *testing.T, k int, commands ...string) string {
+	t.Helper()
+	proto.ProtoParam["k"] = k
+	var b strings.Builder
+	if err := repl.Run(strings.NewReader(strings.Join(commands, "\n")), &b, session); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestSession(t *testing.T) {
+	got := run(t, 1, "Foreach", "Foreach", "Send_Aj_foo 1", "EndForeach", `Send_Ai_bar "a bar"`, "EndForeach", "End", "quit")
+	expected := `state *proto.S0
+stack []@0
+  EndForeach() *proto.SEnd
+  Foreach() *proto.S1
+  HasNext() bool = true
+  ID() int = 0
+> state *proto.S1
+stack [{0: 0/0}]@0
+  EndForeach() *proto.S3
+  Foreach() *proto.S2
+  HasNext() bool = true
+  ID() int = 1
+> state *proto.S2
+stack [{0: 0/0} {1: 0/0}]@1
+  Send_Aj_foo(int) *proto.S1
+> state *proto.S1
+stack [{0: 0/0} {1: 0/0}]@1
+  EndForeach() *proto.S3
+  Foreach() *proto.S2
+  HasNext() bool = false
+  ID() int = 1
+> state *proto.S3
+stack [{0: 0/0}]@0
+  Send_Ai_bar(string) *proto.S0
+> state *proto.S0
+stack [{0: 0/0}]@0
+  EndForeach() *proto.SEnd
+  Foreach() *proto.S1
+  HasNext() bool = false
+  ID() int = 0
+> state *proto.SEnd
+stack []@-1
+  End()
+> session ended
+> `
+	if got != expected {
+		t.Errorf("expected session:\n%s\nbut got:\n%s", expected, got)
+	}
+}
+
+// TestErrors checks that invalid commands and transitions are printed, and
+// the session goes on.
+func TestErrors(t *testing.T) {
+	got := run(t, 2,
+		"Foreach", "Foreach", "Send_Aj_foo", "Send_Aj_foo one", "Send_Aj_foo 1",
+		"EndForeach", // premature exit, the state is used
+		"Foreach",
+		"Send_Ai_bar", "Use", `Send_Ai_bar "bar`,
+		"restart", "End")
+	for _, expected := range []string{
+		"error: Send_Aj_foo(int) *proto.S1: expected 1 payloads but got 0\n",
+		"error: payload 1 of Send_Aj_foo: strconv.ParseInt: parsing \"one\": invalid syntax\n",
+		"error: premature exit of foreach (ID: 1)\nstate *proto.S1\nstack [{0: 0/1} {1: 0/1}]@1\n",
+		"error: resource used\n",
+		"error: *proto.S1 has no method Send_Ai_bar\n",
+		"error: *proto.S1 has no method Use\n",
+		"error: unterminated string \"bar\n",
+		"> state *proto.S0\nstack []@0\n",
+		"error: *proto.S0 has no method End\n",
+	} {
+		if !strings.Contains(got, expected) {
+			t.Errorf("expected %q in session:\n%s", expected, got)
+		}
+	}
+	if !strings.HasSuffix(got, "> \n") {
+		t.Errorf("expected the session to end at the end of the commands but got:\n%s", got)
+	}
+}
@@ -0,0 +1,262 @@
+// Package scribble is the protocol model for the foreach experiment.
+//
+// A global protocol is written in a small Scribble-like syntax, e.g. the
+// nested one-to-many example used by all API styles in this repository:
+//
+//	global protocol Nested(param k, role Coordinator, role A[1..k]) {
+//	  foreach A[i:1..k] {
+//	    foreach A[j:1..k] {
+//	      foo(int) from Coordinator to A[j];
+//	    }
+//	    bar(string) from Coordinator to A[i];
+//	  }
+//	}
+//
+// Parse turns the source into a Protocol, and Check runs the static
+// well-formedness checks before any code is generated from it.
+package scribble
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// Pos is a position in the protocol source.
+type Pos struct {
+	Filename  string
+	Line, Col int // Line and Col start from 1
+}
+
+func (p Pos) String() string {
+	if p.Filename == "" {
+		return fmt.Sprintf("%d:%d", p.Line, p.Col)
+	}
+	return fmt.Sprintf("%s:%d:%d", p.Filename, p.Line, p.Col)
+}
+
+// Protocol is a parsed global protocol.
+type Protocol struct {
+	Pos    Pos
+	Name   string
+	Params []*Param
+	Roles  []*Role
+	Body   []Stmt
+}
+
+// Param returns the declared parameter called name, or nil.
+func (p *Protocol) Param(name string) *Param {
+	for _, param := range p.Params {
+		if param.Name == name {
+			return param
+		}
+	}
+	return nil
+}
+
+// Role returns the declared role called name, or nil.
+func (p *Protocol) Role(name string) *Role {
+	for _, role := range p.Roles {
+		if role.Name == name {
+			return role
+		}
+	}
+	return nil
+}
+
+// Param is a protocol parameter, e.g. k in A[1..k].
+type Param struct {
+	Pos  Pos
+	Name string
+}
+
+// Role is a declared role.
+// An indexed role (e.g. A[1..k]) has non-nil Lo and Hi.
+type Role struct {
+	Pos    Pos
+	Name   string
+	Lo, Hi Expr
+}
+
+// Indexed returns true if the role is a family of participants.
+func (r *Role) Indexed() bool { return r.Lo != nil }
+
+// Stmt is a statement in a protocol body.
+type Stmt interface {
+	Position() Pos
+	stmt()
+}
+
+// Interaction is a message exchange: label(payloads) from From to To.
+type Interaction struct {
+	Pos      Pos
+	Label    string
+	Payloads []string // Payloads are Go type names
+	From, To *RoleRef
+}
+
+// Foreach iterates Index over Lo..Hi (inclusive) of the indexed role Role.
+type Foreach struct {
+	Pos    Pos
+	Role   string
+	Index  string
+	Lo, Hi Expr
+	Body   []Stmt
+}
+
+// Choice is a choice at the role At between Branches.
+// The first statement of each branch is a message sent by At.
+type Choice struct {
+	Pos      Pos
+	At       *RoleRef
+	Branches [][]Stmt
+}
+
+// Rec is a recursion point Label, which is repeated by a Continue.
+type Rec struct {
+	Pos   Pos
+	Label string
+	Body  []Stmt
+}
+
+// Continue repeats the enclosing Rec with the same Label.
+type Continue struct {
+	Pos   Pos
+	Label string
+}
+
+func (s *Interaction) Position() Pos { return s.Pos }
+func (s *Foreach) Position() Pos     { return s.Pos }
+func (s *Choice) Position() Pos      { return s.Pos }
+func (s *Rec) Position() Pos         { return s.Pos }
+func (s *Continue) Position() Pos    { return s.Pos }
+
+func (*Interaction) stmt() {}
+func (*Foreach) stmt()     {}
+func (*Choice) stmt()      {}
+func (*Rec) stmt()         {}
+func (*Continue) stmt()    {}
+
+// RoleRef is a reference to a role, e.g. Coordinator or A[j].
+type RoleRef struct {
+	Pos   Pos
+	Name  string
+	Index Expr // Index is nil for non-indexed roles
+}
+
+func (r *RoleRef) String() string {
+	if r.Index == nil {
+		return r.Name
+	}
+	return fmt.Sprintf("%s[%s]", r.Name, r.Index)
+}
+
+// Expr is an integer expression over parameters and index variables.
+type Expr interface {
+	Position() Pos
+	String() string
+	expr()
+}
+
+// Num is an integer literal.
+type Num struct {
+	Pos   Pos
+	Value int
+}
+
+// Var is a reference to a parameter or index variable.
+type Var struct {
+	Pos  Pos
+	Name string
+}
+
+// BinExpr is a binary expression, Op is one of +, - or mod.
+type BinExpr struct {
+	Pos  Pos
+	Op   string
+	X, Y Expr
+}
+
+func (e *Num) Position() Pos     { return e.Pos }
+func (e *Var) Position() Pos     { return e.Pos }
+func (e *BinExpr) Position() Pos { return e.Pos }
+
+func (e *Num) String() string { return strconv.Itoa(e.Value) }
+func (e *Var) String() string { return e.Name }
+
+// String returns e in protocol syntax, operands of mod are parenthesised
+// in + and - for readability, e.g. (i mod k)+1.
+func (e *BinExpr) String() string {
+	x, y := e.X.String(), e.Y.String()
+	if _, ok := e.Y.(*BinExpr); ok {
+		y = "(" + y + ")"
+	}
+	if e.Op == "mod" {
+		if bin, ok := e.X.(*BinExpr); ok && bin.Op != "mod" {
+			x = "(" + x + ")"
+		}
+		return fmt.Sprintf("%s mod %s", x, y)
+	}
+	if bin, ok := e.X.(*BinExpr); ok && bin.Op == "mod" {
+		x = "(" + x + ")"
+	}
+	return x + e.Op + y
+}
+
+func (*Num) expr()     {}
+func (*Var) expr()     {}
+func (*BinExpr) expr() {}
+
+// Eval evaluates e with the given variable values.
+func Eval(e Expr, env map[string]int) (int, error) {
+	switch e := e.(type) {
+	case *Num:
+		return e.Value, nil
+	case *Var:
+		v, ok := env[e.Name]
+		if !ok {
+			return 0, fmt.Errorf("%s: %s is not defined", e.Pos, e.Name)
+		}
+		return v, nil
+	case *BinExpr:
+		x, err := Eval(e.X, env)
+		if err != nil {
+			return 0, err
+		}
+		y, err := Eval(e.Y, env)
+		if err != nil {
+			return 0, err
+		}
+		switch e.Op {
+		case "+":
+			return x + y, nil
+		case "-":
+			return x - y, nil
+		case "mod":
+			if y <= 0 {
+				return 0, fmt.Errorf("%s: %s is not positive (%d)", e.Pos, e.Y, y)
+			}
+			return mod(x, y), nil
+		}
+		return 0, fmt.Errorf("%s: unknown operator %s", e.Pos, e.Op)
+	}
+	return 0, fmt.Errorf("unknown expression %T", e)
+}
+
+// mod returns x mod y for y > 0, the result is always in 0..y-1.
+func mod(x, y int) int {
+	if m := x % y; m < 0 {
+		return m + y
+	}
+	return x % y
+}
+
+// vars returns the names of all variables referenced in e.
+func vars(e Expr) []*Var {
+	switch e := e.(type) {
+	case *Var:
+		return []*Var{e}
+	case *BinExpr:
+		return append(vars(e.X), vars(e.Y)...)
+	}
+	return nil
+}
@@ -0,0 +1,523 @@
+package scribble
+
+// This file contains the well-formedness checks of a global protocol.
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Error is a well-formedness error at a source position.
+type Error struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *Error) Error() string { return fmt.Sprintf("%s: %s", e.Pos, e.Msg) }
+
+// ErrorList is a list of errors sorted by position.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, err := range l {
+		msgs[i] = err.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Assumption is a non-empty range assumption Lo <= Hi, or the assumption
+// From != To that an interaction is not sent by a participant to itself.
+//
+// The foreach runtime requires every range to be non-empty (loop bodies are
+// entered at least once), so each range over parameters is an assumption
+// that must hold for the parameter values the session is started with. An
+// interaction between participants of the same role whose indices may be
+// equal, e.g. A[i] to A[(i mod k)+1] with k = 1, is also an assumption, for
+// every value of the index variables of Loops.
+type Assumption struct {
+	Pos    Pos
+	Lo, Hi Expr
+
+	From, To *RoleRef   // From and To are set for an interaction
+	Loops    []*Foreach // Loops are the foreach of the index variables of From and To
+}
+
+func (a *Assumption) String() string {
+	if a.From != nil {
+		return fmt.Sprintf("%s != %s", a.From, a.To)
+	}
+	return fmt.Sprintf("%s <= %s", a.Lo, a.Hi)
+}
+
+// Check evaluates the assumption with the parameter values.
+func (a *Assumption) Check(params map[string]int) error {
+	if a.From != nil {
+		env := make(map[string]int)
+		for name, value := range params {
+			env[name] = value
+		}
+		return a.distinct(env, a.Loops)
+	}
+	lo, err := Eval(a.Lo, params)
+	if err != nil {
+		return err
+	}
+	hi, err := Eval(a.Hi, params)
+	if err != nil {
+		return err
+	}
+	if lo > hi {
+		return fmt.Errorf("%s: range %s..%s is empty (%d..%d)", a.Pos, a.Lo, a.Hi, lo, hi)
+	}
+	return nil
+}
+
+// distinct checks that From and To are different participants for every
+// value of the index variables of loops in env.
+func (a *Assumption) distinct(env map[string]int, loops []*Foreach) error {
+	if len(loops) == 0 {
+		from, err := Eval(a.From.Index, env)
+		if err != nil {
+			return err
+		}
+		to, err := Eval(a.To.Index, env)
+		if err != nil {
+			return err
+		}
+		if from != to {
+			return nil
+		}
+		when := ""
+		for i, loop := range a.Loops {
+			if i == 0 {
+				when += " when "
+			} else {
+				when += ", "
+			}
+			when += fmt.Sprintf("%s = %d", loop.Index, env[loop.Index])
+		}
+		return fmt.Errorf("%s: %s sends to itself%s (%s[%d])", a.Pos, a.From, when, a.From.Name, from)
+	}
+	loop := loops[0]
+	lo, err := Eval(loop.Lo, env)
+	if err != nil {
+		return err
+	}
+	hi, err := Eval(loop.Hi, env)
+	if err != nil {
+		return err
+	}
+	defer delete(env, loop.Index)
+	for env[loop.Index] = lo; env[loop.Index] <= hi; env[loop.Index]++ {
+		if err := a.distinct(env, loops[1:]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Assumptions returns the non-empty range assumptions of p, then the
+// interactions which may be sent by a participant to itself, in source
+// order. Ranges with constant bounds are checked by Check and are not
+// included, as are interactions which are always or never sent by a
+// participant to itself.
+func Assumptions(p *Protocol) []*Assumption {
+	var (
+		as, sends []*Assumption
+		seen      = make(map[string]bool)
+	)
+	add := func(pos Pos, lo, hi Expr) {
+		if isConst(lo) && isConst(hi) {
+			return
+		}
+		a := &Assumption{Pos: pos, Lo: lo, Hi: hi}
+		if !seen[a.String()] {
+			seen[a.String()] = true
+			as = append(as, a)
+		}
+	}
+	for _, role := range p.Roles {
+		if role.Indexed() {
+			add(role.Pos, role.Lo, role.Hi)
+		}
+	}
+	walk(p.Body, func(s Stmt) {
+		if s, ok := s.(*Foreach); ok {
+			add(s.Pos, s.Lo, s.Hi)
+		}
+	})
+	c := &checker{proto: p, indices: make(map[string]*Foreach)}
+	var scoped func([]Stmt)
+	scoped = func(stmts []Stmt) {
+		for _, s := range stmts {
+			switch s := s.(type) {
+			case *Foreach:
+				c.indices[s.Index] = s
+				scoped(s.Body)
+				delete(c.indices, s.Index)
+			case *Choice:
+				for _, branch := range s.Branches {
+					scoped(branch)
+				}
+			case *Rec:
+				scoped(s.Body)
+			case *Interaction:
+				if _, maybe := c.sameParticipant(s.From, s.To); maybe {
+					sends = append(sends, &Assumption{Pos: s.Pos, From: s.From, To: s.To, Loops: c.loops(s.From.Index, s.To.Index)})
+				}
+			}
+		}
+	}
+	scoped(p.Body)
+	return append(as, sends...)
+}
+
+// sameParticipant returns always if from and to are the same participant
+// for every value of the index variables and parameters, or maybe if they
+// may be the same for some values, as far as their affine bounds show.
+func (c *checker) sameParticipant(from, to *RoleRef) (always, maybe bool) {
+	switch {
+	case from.Name != to.Name:
+		return false, false
+	case from.Index == nil || to.Index == nil:
+		return from.Index == nil && to.Index == nil, false
+	case from.Index.String() == to.Index.String():
+		return true, false
+	}
+	x, okX := linearOf(from.Index)
+	y, okY := linearOf(to.Index)
+	if d, ok := y.sub(x).constant(); okX && okY && ok {
+		return d == 0, false
+	}
+	lo, hi, ok := bounds(&BinExpr{Op: "-", X: to.Index, Y: from.Index}, c.indices)
+	if ok && (c.provable(lo.sub(linear{c: 1})) || c.provable(linear{c: -1}.sub(hi))) {
+		return false, false
+	}
+	return false, true
+}
+
+// loops returns the foreach in scope of the index variables of es, from the
+// outermost.
+func (c *checker) loops(es ...Expr) []*Foreach {
+	used := make(map[*Foreach]bool)
+	for _, e := range es {
+		for _, v := range vars(e) {
+			if loop, ok := c.indices[v.Name]; ok {
+				used[loop] = true
+			}
+		}
+	}
+	var loops []*Foreach
+	walk(c.proto.Body, func(s Stmt) {
+		if loop, ok := s.(*Foreach); ok && used[loop] {
+			loops = append(loops, loop)
+		}
+	})
+	return loops
+}
+
+// walk calls fn on every statement in stmts, parents before children.
+func walk(stmts []Stmt, fn func(Stmt)) {
+	for _, s := range stmts {
+		fn(s)
+		switch s := s.(type) {
+		case *Foreach:
+			walk(s.Body, fn)
+		case *Choice:
+			for _, branch := range s.Branches {
+				walk(branch, fn)
+			}
+		case *Rec:
+			walk(s.Body, fn)
+		}
+	}
+}
+
+// provable returns true if d >= 0 follows from the ranges of the roles and
+// of the enclosing foreach being non-empty, e.g. k-1 >= 0 follows from A[1..k].
+func (c *checker) provable(d linear) bool {
+	if nonNegative(d) {
+		return true
+	}
+	var ranges [][2]Expr
+	for _, role := range c.proto.Roles {
+		if role.Indexed() {
+			ranges = append(ranges, [2]Expr{role.Lo, role.Hi})
+		}
+	}
+	for _, loop := range c.indices {
+		ranges = append(ranges, [2]Expr{loop.Lo, loop.Hi})
+	}
+	for _, r := range ranges {
+		lo, okLo := linearOf(r[0])
+		hi, okHi := linearOf(r[1])
+		if okLo && okHi && nonNegative(d.sub(hi.sub(lo))) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkExpr calls fn on every binary expression in e.
+func walkExpr(e Expr, fn func(*BinExpr)) {
+	if e, ok := e.(*BinExpr); ok {
+		fn(e)
+		walkExpr(e.X, fn)
+		walkExpr(e.Y, fn)
+	}
+}
+
+func isConst(e Expr) bool { return len(vars(e)) == 0 }
+
+// checker keeps track of names in scope while checking a protocol.
+type checker struct {
+	proto   *Protocol
+	indices map[string]*Foreach // indices maps index variables in scope to their foreach
+	recs    map[string]int      // recs maps rec labels in scope to the foreach depth of the rec
+	depth   int                 // depth is the number of enclosing foreach
+	errs    ErrorList
+}
+
+func (c *checker) errorf(pos Pos, format string, args ...interface{}) {
+	c.errs = append(c.errs, &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+// Check checks that p is well-formed:
+//
+//   - parameter and role names are unique,
+//   - ranges only reference declared parameters and are not empty,
+//   - foreach ranges are within the range of the role,
+//   - foreach loops range over indexed roles, and do not shadow index variables,
+//   - role references use index variables of an enclosing foreach over the same role,
+//   - branches of a choice start with distinct messages from the choosing role,
+//   - continue is the last statement of a block and does not exit a foreach.
+//
+// The returned error is an ErrorList if p is not well-formed.
+func Check(p *Protocol) error {
+	c := &checker{proto: p, indices: make(map[string]*Foreach), recs: make(map[string]int)}
+	c.decls()
+	c.stmts(p.Body)
+	if len(c.errs) == 0 {
+		return nil
+	}
+	sort.SliceStable(c.errs, func(i, j int) bool {
+		pi, pj := c.errs[i].Pos, c.errs[j].Pos
+		return pi.Line < pj.Line || pi.Line == pj.Line && pi.Col < pj.Col
+	})
+	return c.errs
+}
+
+func (c *checker) decls() {
+	names := make(map[string]Pos)
+	declare := func(pos Pos, name string) {
+		if prev, ok := names[name]; ok {
+			c.errorf(pos, "%s redeclared (previous declaration at %s)", name, prev)
+			return
+		}
+		if name == Self {
+			c.errorf(pos, "%s is reserved for the index of a participant", Self)
+		}
+		names[name] = pos
+	}
+	for _, param := range c.proto.Params {
+		declare(param.Pos, param.Name)
+	}
+	for _, role := range c.proto.Roles {
+		declare(role.Pos, role.Name)
+		if role.Indexed() {
+			c.rangeExpr(role.Lo, role.Hi)
+		}
+	}
+}
+
+// rangeExpr checks that the range lo..hi only references parameters.
+func (c *checker) rangeExpr(lo, hi Expr) {
+	for _, e := range []Expr{lo, hi} {
+		for _, v := range vars(e) {
+			if _, ok := c.indices[v.Name]; ok {
+				c.errorf(v.Pos, "range cannot reference index variable %s", v.Name)
+			} else if c.proto.Param(v.Name) == nil {
+				c.errorf(v.Pos, "%s is not a declared parameter", v.Name)
+			}
+		}
+	}
+	if isConst(lo) && isConst(hi) {
+		l, _ := Eval(lo, nil)
+		h, _ := Eval(hi, nil)
+		if l > h {
+			c.errorf(lo.Position(), "range %s..%s is empty", lo, hi)
+		}
+	}
+}
+
+func (c *checker) stmts(stmts []Stmt) {
+	for i, s := range stmts {
+		switch s := s.(type) {
+		case *Foreach:
+			c.foreach(s)
+		case *Choice:
+			c.choice(s)
+		case *Rec:
+			c.rec(s)
+		case *Continue:
+			depth, ok := c.recs[s.Label]
+			switch {
+			case !ok:
+				c.errorf(s.Pos, "continue to undefined rec %s", s.Label)
+			case depth != c.depth:
+				c.errorf(s.Pos, "continue %s cannot exit a foreach", s.Label)
+			}
+			if i != len(stmts)-1 {
+				c.errorf(stmts[i+1].Position(), "unreachable statement after continue %s", s.Label)
+			}
+		case *Interaction:
+			c.roleRef(s.From)
+			c.roleRef(s.To)
+			if always, _ := c.sameParticipant(s.From, s.To); always {
+				c.errorf(s.Pos, "%s sends %s to itself", s.From, s.Label)
+			}
+		}
+	}
+}
+
+func (c *checker) foreach(s *Foreach) {
+	role := c.proto.Role(s.Role)
+	if role == nil {
+		c.errorf(s.Pos, "foreach over undeclared role %s", s.Role)
+	} else if !role.Indexed() {
+		c.errorf(s.Pos, "foreach over role %s which is not indexed", s.Role)
+	}
+	c.rangeExpr(s.Lo, s.Hi)
+	if role != nil && role.Indexed() && !(leq(role.Lo, s.Lo) && leq(s.Hi, role.Hi)) {
+		c.errorf(s.Lo.Position(), "range %s..%s is not within %s[%s..%s]", s.Lo, s.Hi, role.Name, role.Lo, role.Hi)
+	}
+	outer, shadowed := c.indices[s.Index]
+	if shadowed {
+		c.errorf(s.Pos, "index variable %s shadows index of foreach at %s", s.Index, outer.Pos)
+	} else if s.Index == Self || c.proto.Param(s.Index) != nil || c.proto.Role(s.Index) != nil {
+		c.errorf(s.Pos, "index variable %s shadows a declared name", s.Index)
+	}
+	if len(s.Body) == 0 {
+		c.errorf(s.Pos, "foreach body is empty")
+	}
+	if !shadowed { // otherwise keep the outer binding
+		c.indices[s.Index] = s
+		defer delete(c.indices, s.Index)
+	}
+	c.depth++
+	c.stmts(s.Body)
+	c.depth--
+}
+
+func (c *checker) rec(s *Rec) {
+	if _, ok := c.recs[s.Label]; ok {
+		c.errorf(s.Pos, "rec %s shadows an enclosing rec", s.Label)
+		c.stmts(s.Body)
+		return
+	}
+	if len(s.Body) == 0 {
+		c.errorf(s.Pos, "rec body is empty")
+	} else if _, ok := s.Body[0].(*Continue); ok {
+		c.errorf(s.Body[0].Position(), "rec %s cannot start with continue", s.Label)
+	}
+	c.recs[s.Label] = c.depth
+	c.stmts(s.Body)
+	delete(c.recs, s.Label)
+}
+
+// firstMessage returns the first message of a choice branch, a branch may
+// also start with a foreach to send the first message to every index.
+func firstMessage(branch []Stmt) *Interaction {
+	if len(branch) == 0 {
+		return nil
+	}
+	switch s := branch[0].(type) {
+	case *Interaction:
+		return s
+	case *Foreach:
+		return firstMessage(s.Body)
+	}
+	return nil
+}
+
+func (c *checker) choice(s *Choice) {
+	c.roleRef(s.At)
+	if len(s.Branches) < 2 {
+		c.errorf(s.Pos, "choice at %s has only one branch", s.At)
+	}
+	labels := make(map[string]bool)
+	for _, branch := range s.Branches {
+		if len(branch) == 0 {
+			c.errorf(s.Pos, "choice at %s has an empty branch", s.At)
+			continue
+		}
+		first := firstMessage(branch)
+		if first == nil || first.From.String() != s.At.String() {
+			c.errorf(branch[0].Position(), "branch of choice at %s must start with a message from %s", s.At, s.At)
+		} else if labels[first.Label] {
+			c.errorf(first.Pos, "branches of choice at %s start with the same label %s", s.At, first.Label)
+		} else {
+			labels[first.Label] = true
+		}
+		c.stmts(branch)
+	}
+}
+
+func (c *checker) roleRef(ref *RoleRef) {
+	role := c.proto.Role(ref.Name)
+	switch {
+	case role == nil:
+		c.errorf(ref.Pos, "undeclared role %s", ref.Name)
+		return
+	case role.Indexed() && ref.Index == nil:
+		c.errorf(ref.Pos, "role %s is indexed but used without an index", ref.Name)
+		return
+	case !role.Indexed() && ref.Index != nil:
+		c.errorf(ref.Pos, "role %s is not indexed", ref.Name)
+		return
+	case ref.Index == nil:
+		return
+	}
+	inScope := true
+	for _, v := range vars(ref.Index) {
+		loop, ok := c.indices[v.Name]
+		switch {
+		case ok && loop.Role != ref.Name:
+			c.errorf(v.Pos, "index variable %s ranges over %s, not %s", v.Name, loop.Role, ref.Name)
+			inScope = false
+		case !ok && c.proto.Param(v.Name) == nil:
+			c.errorf(v.Pos, "index variable %s is not in scope", v.Name)
+			inScope = false
+		}
+	}
+	if inScope {
+		c.indexRange(ref, role)
+	}
+}
+
+// indexRange checks that the index of ref stays within the range of role
+// for every value of the index variables.
+func (c *checker) indexRange(ref *RoleRef, role *Role) {
+	var divisor bool
+	walkExpr(ref.Index, func(e *BinExpr) {
+		if n, ok := e.Y.(*Num); ok && e.Op == "mod" && n.Value <= 0 {
+			c.errorf(e.Pos, "%s is not a positive divisor", n)
+			divisor = true
+		}
+	})
+	if divisor {
+		return
+	}
+	lo, hi, ok := bounds(ref.Index, c.indices)
+	roleLo, _ := linearOf(role.Lo)
+	roleHi, _ := linearOf(role.Hi)
+	switch {
+	case !ok:
+		c.errorf(ref.Pos, "cannot check that %s is within %s[%s..%s]", ref, role.Name, role.Lo, role.Hi)
+	case !c.provable(lo.sub(roleLo)) || !c.provable(roleHi.sub(hi)):
+		c.errorf(ref.Pos, "%s is not within %s[%s..%s], index %s ranges over %s..%s",
+			ref, role.Name, role.Lo, role.Hi, ref.Index, lo, hi)
+	}
+}
@@ -0,0 +1,233 @@
+package scribble
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+)
+
+func parseFile(t *testing.T, filename string) *Protocol {
+	t.Helper()
+	src, err := ioutil.ReadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := Parse(filename, string(src))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestCheckNested(t *testing.T) {
+	p := parseFile(t, "testdata/nested.scr")
+	if err := Check(p); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	as := Assumptions(p)
+	if len(as) != 1 || as[0].String() != "1 <= k" {
+		t.Fatalf("expected assumption [1 <= k] but got %v", as)
+	}
+	if err := as[0].Check(map[string]int{"k": 0}); err == nil {
+		t.Errorf("expected empty range error for k=0")
+	}
+	if err := as[0].Check(map[string]int{"k": 2}); err != nil {
+		t.Errorf("unexpected error for k=2: %v", err)
+	}
+}
+
+func TestCheckErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  string // err is the expected error including position
+	}{
+		{
+			name: "IndexNotInScope",
+			body: "foo(int) from C to A[j];",
+			err:  "3:22: index variable j is not in scope",
+		},
+		{
+			name: "IndexOutOfScope",
+			body: "foreach A[j:1..k] { foo(int) from C to A[j]; }\nbar() from C to A[j];",
+			err:  "4:19: index variable j is not in scope",
+		},
+		{
+			name: "IndexOfOtherRole",
+			body: "foreach B[i:1..k] { foo(int) from C to A[i]; }",
+			err:  "3:42: index variable i ranges over B, not A",
+		},
+		{
+			name: "Shadowing",
+			body: "foreach A[i:1..k] { foreach A[i:1..k] { foo(int) from C to A[i]; } }",
+			err:  "3:21: index variable i shadows index of foreach at 3:1",
+		},
+		{
+			name: "UndeclaredParam",
+			body: "foreach A[i:1..x] { foo(int) from C to A[i]; }",
+			err:  "3:16: x is not a declared parameter",
+		},
+		{
+			name: "RangeOutsideRole",
+			body: "foreach A[i:0..k] { foo(int) from C to A[i]; }",
+			err:  "3:13: range 0..k is not within A[1..k]",
+		},
+		{
+			name: "RangeOfOtherParam",
+			body: "foreach A[i:1..n] { foo(int) from C to A[i]; }",
+			err:  "3:13: range 1..n is not within A[1..k]",
+		},
+		{
+			name: "IndexAboveRange",
+			body: "foreach A[i:1..k] { foo(int) from C to A[i+1]; }",
+			err:  "3:40: A[i+1] is not within A[1..k], index i+1 ranges over 2..k+1",
+		},
+		{
+			name: "IndexBelowRange",
+			body: "foreach A[i:1..k] { foo(int) from C to A[i mod k]; }",
+			err:  "3:40: A[i mod k] is not within A[1..k], index i mod k ranges over 0..k-1",
+		},
+		{
+			name: "IndexOfOtherParam",
+			body: "foo(int) from C to A[n];",
+			err:  "3:20: A[n] is not within A[1..k], index n ranges over n..n",
+		},
+		{
+			name: "ModZero",
+			body: "foreach A[i:1..k] { foo(int) from C to A[(i mod 0)+1]; }",
+			err:  "3:45: 0 is not a positive divisor",
+		},
+		{
+			name: "RangeOverIndex",
+			body: "foreach A[i:1..k] { foreach B[j:1..i] { foo(int) from A[i] to B[j]; } }",
+			err:  "3:36: range cannot reference index variable i",
+		},
+		{
+			name: "EmptyConstRange",
+			body: "foreach A[i:2..1] { foo(int) from C to A[i]; }",
+			err:  "3:13: range 2..1 is empty",
+		},
+		{
+			name: "NotIndexed",
+			body: "foreach C[i:1..k] { foo(int) from C to A[i]; }",
+			err:  "3:1: foreach over role C which is not indexed",
+		},
+		{
+			name: "MissingIndex",
+			body: "foo(int) from C to A;",
+			err:  "3:20: role A is indexed but used without an index",
+		},
+		{
+			name: "SelfSend",
+			body: "foreach A[i:1..k] { foo(int) from A[i] to A[i]; }",
+			err:  "3:21: A[i] sends foo to itself",
+		},
+		{
+			name: "SelfSendAffine",
+			body: "foreach A[i:1..k] { foo(int) from A[i+1-1] to A[i]; }",
+			err:  "3:21: A[i+1-1] sends foo to itself",
+		},
+		{
+			name: "ChoiceNotFromChooser",
+			body: "foreach A[j:1..k] { choice at C { ok() from A[j] to C; } or { fail() from C to A[j]; } }",
+			err:  "3:35: branch of choice at C must start with a message from C",
+		},
+		{
+			name: "ChoiceSameLabel",
+			body: "choice at C { ok() from C to B[1]; } or { ok(int) from C to B[2]; }",
+			err:  "3:43: branches of choice at C start with the same label ok",
+		},
+		{
+			name: "ChoiceOneBranch",
+			body: "choice at C { ok() from C to B[1]; }",
+			err:  "3:1: choice at C has only one branch",
+		},
+		{
+			name: "ContinueUndefined",
+			body: "foo() from C to B[1]; continue X;",
+			err:  "3:23: continue to undefined rec X",
+		},
+		{
+			name: "ContinueExitsForeach",
+			body: "rec X { foreach A[i:1..k] { foo() from C to A[i]; continue X; } }",
+			err:  "3:51: continue X cannot exit a foreach",
+		},
+		{
+			name: "ContinueUnreachable",
+			body: "rec X { foo() from C to B[1]; continue X; bar() from C to B[1]; }",
+			err:  "3:43: unreachable statement after continue X",
+		},
+		{
+			name: "EmptyBody",
+			body: "foreach A[i:1..k] { }",
+			err:  "3:1: foreach body is empty",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			src := "global protocol P(param k, param n, role C, role A[1..k], role B[1..k]) {\n\n" + test.body + "\n}"
+			p, err := Parse("", src)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = Check(p)
+			if err == nil {
+				t.Fatalf("expected error %q but got none", test.err)
+			}
+			if !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("expected error %q but got:\n%v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestParseError(t *testing.T) {
+	_, err := Parse("bad.scr", "global protocol P(role C) {\n  foo(int) from C to;\n}")
+	if err == nil || err.Error() != `bad.scr:2:21: expected identifier but got ";"` {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestCheckIndexArithmetic(t *testing.T) {
+	p, err := Parse("", `global protocol P(param k, role C, role A[1..k]) {
+		foreach A[i:1..k] { token(int) from A[i] to A[(i mod k)+1]; }
+		foreach A[i:1..k-1] { value(int) from A[i] to A[i+1]; }
+		foreach A[i:2..k] { back(int) from A[i] to A[i-1]; }
+		result(int) from A[k] to C;
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(p); err != nil {
+		t.Fatal(err)
+	}
+	// Only the ring may send from A[1] to itself, the pipelines never do.
+	var sends []*Assumption
+	for _, a := range Assumptions(p) {
+		if a.From != nil {
+			sends = append(sends, a)
+		}
+	}
+	if len(sends) != 1 || sends[0].String() != "A[i] != A[(i mod k)+1]" {
+		t.Fatalf("expected assumption [A[i] != A[(i mod k)+1]] but got %v", sends)
+	}
+	ring := sends[0]
+	if err := ring.Check(map[string]int{"k": 1}); err == nil || err.Error() != "2:23: A[i] sends to itself when i = 1 (A[1])" {
+		t.Errorf("expected self-send error for k=1 but got %v", err)
+	}
+	if err := ring.Check(map[string]int{"k": 3}); err != nil {
+		t.Errorf("unexpected error for k=3: %v", err)
+	}
+}
+
+func TestExprString(t *testing.T) {
+	for _, src := range []string{"(i mod k)+1", "i-(j+1)", "(i+1) mod k", "i mod (k-1)", "k-1"} {
+		p, err := Parse("", "global protocol P(param k, role C, role A[1..k]) { foo() from C to A["+src+"]; }")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := p.Body[0].(*Interaction).To.Index.String(); got != src {
+			t.Errorf("expected %s but got %s", src, got)
+		}
+	}
+}
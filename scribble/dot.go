@@ -0,0 +1,146 @@
+package scribble
+
+// This file contains the Graphviz DOT export of FSMs.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dot returns the FSM in Graphviz DOT format.
+//
+// Each foreach sub-FSM is drawn as a cluster containing its init (entry)
+// state, its body and its body end state; the exit edge leaves the cluster.
+// Nodes are labelled by state ID as in the generated API, e.g. S0.
+func (f *FSM) Dot() string {
+	var b strings.Builder
+	role := f.Local.Role.Name
+	if f.Local.Role.Indexed() {
+		role = fmt.Sprintf("%s[%s]", role, Self)
+	}
+	fmt.Fprintf(&b, "digraph %q {\n", f.Local.Protocol.Name+" at "+role)
+	b.WriteString("  rankdir=LR;\n  node [shape=circle];\n")
+	f.writeCluster(&b, nil, 1)
+	for _, s := range f.States {
+		for _, e := range edges(s) {
+			fmt.Fprintf(&b, "  %s -> %s [label=%q", stateName(s), stateName(e.to), e.label)
+			if e.style != "" {
+				fmt.Fprintf(&b, ", style=%s", e.style)
+			}
+			b.WriteString("];\n")
+		}
+	}
+	b.WriteString("}\n")
+	return b.String()
+}
+
+// cluster returns the foreach init state of the innermost cluster of s,
+// or nil if s is not in a foreach.
+func cluster(s *State) *State {
+	if s.Kind == ForeachState {
+		return s
+	}
+	if len(s.Loops) == 0 {
+		return nil
+	}
+	return s.Loops[len(s.Loops)-1]
+}
+
+// writeCluster writes the states of the cluster of loop, and the nested
+// clusters of the foreach loops directly inside loop.
+func (f *FSM) writeCluster(b *strings.Builder, loop *State, depth int) {
+	indent := strings.Repeat("  ", depth)
+	for _, s := range f.States {
+		if cluster(s) != loop {
+			continue
+		}
+		label := stateName(s)
+		if kind := stateLabel(s); kind != "" {
+			label += "\n" + kind
+		}
+		shape := ""
+		if s.Kind == EndState {
+			shape = ", shape=doublecircle"
+		}
+		fmt.Fprintf(b, "%s%s [label=%q%s];\n", indent, stateName(s), label, shape)
+	}
+	for _, s := range f.States {
+		if s.Kind != ForeachState || s == loop {
+			continue
+		}
+		var parent *State
+		if len(s.Loops) > 0 {
+			parent = s.Loops[len(s.Loops)-1]
+		}
+		if parent != loop {
+			continue
+		}
+		foreach := s.Stmt.(*LocalForeach)
+		fmt.Fprintf(b, "%ssubgraph cluster_%d {\n", indent, s.ID)
+		fmt.Fprintf(b, "%s  label=%q;\n", indent, fmt.Sprintf("foreach %s[%s:%s..%s] (ID %d)", foreach.Role, foreach.Index, foreach.Lo, foreach.Hi, s.ID))
+		f.writeCluster(b, s, depth+1)
+		fmt.Fprintf(b, "%s}\n", indent)
+	}
+}
+
+func stateName(s *State) string {
+	if s.Kind == EndState {
+		return "SEnd"
+	}
+	return fmt.Sprintf("S%d", s.ID)
+}
+
+// stateLabel describes the role of s in its foreach loop.
+func stateLabel(s *State) string {
+	switch s.Kind {
+	case ForeachState:
+		return "entry"
+	case BodyEndState:
+		return "body end"
+	case IfState:
+		return "if"
+	case ChoiceState:
+		return "choice"
+	}
+	return "" // the state name and edge label are enough
+}
+
+type edge struct {
+	to    *State
+	label string
+	style string
+}
+
+// edges returns the outgoing edges of s.
+func edges(s *State) []edge {
+	switch s.Kind {
+	case SendState:
+		send := s.Stmt.(*Send)
+		return []edge{{to: s.Next, label: fmt.Sprintf("%s!%s(%s)", send.To, send.Label, strings.Join(send.Payloads, ", "))}}
+	case RecvState:
+		recv := s.Stmt.(*Recv)
+		return []edge{{to: s.Next, label: fmt.Sprintf("%s?%s(%s)", recv.From, recv.Label, strings.Join(recv.Payloads, ", "))}}
+	case ForeachState:
+		foreach := s.Stmt.(*LocalForeach)
+		return []edge{
+			{to: s.Body, label: fmt.Sprintf("%s <= %s", foreach.Index, foreach.Hi)},
+			{to: s.Next, label: "exit", style: "bold"},
+		}
+	case BodyEndState:
+		return []edge{{to: s.Next, label: s.Next.Stmt.(*LocalForeach).Index + "++", style: "dashed"}}
+	case IfState:
+		guard := s.Stmt.(*If)
+		cond := fmt.Sprintf("%s == %s", Self, guard.Lo)
+		if guard.Lo.String() != guard.Hi.String() {
+			cond = fmt.Sprintf("%s in %s..%s", Self, guard.Lo, guard.Hi)
+		}
+		return []edge{{to: s.Body, label: cond}, {to: s.Next, label: "else"}}
+	case ChoiceState:
+		es := make([]edge, len(s.Branches))
+		for i, branch := range s.Branches {
+			es[i] = edge{to: branch, label: fmt.Sprintf("branch %d", i+1), style: "dotted"}
+		}
+		return es
+	}
+	return nil
+}
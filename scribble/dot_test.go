@@ -0,0 +1,63 @@
+package scribble
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDot(t *testing.T) {
+	p := parseFile(t, "testdata/nested.scr")
+	l, err := Project(p, "Coordinator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `digraph "Nested at Coordinator" {
+  rankdir=LR;
+  node [shape=circle];
+  SEnd [label="SEnd", shape=doublecircle];
+  subgraph cluster_0 {
+    label="foreach A[i:1..k] (ID 0)";
+    S0 [label="S0\nentry"];
+    S3 [label="S3"];
+    S4 [label="S4\nbody end"];
+    subgraph cluster_1 {
+      label="foreach A[j:1..k] (ID 1)";
+      S1 [label="S1\nentry"];
+      S2 [label="S2"];
+      S5 [label="S5\nbody end"];
+    }
+  }
+  S0 -> S1 [label="i <= k"];
+  S0 -> SEnd [label="exit", style=bold];
+  S1 -> S2 [label="j <= k"];
+  S1 -> S3 [label="exit", style=bold];
+  S2 -> S5 [label="A[j]!foo(int)"];
+  S3 -> S4 [label="A[i]!bar(string)"];
+  S4 -> S0 [label="i++", style=dashed];
+  S5 -> S1 [label="j++", style=dashed];
+}
+`
+	if got := NewFSM(l).Dot(); got != expected {
+		t.Errorf("expected DOT:\n%s\nbut got:\n%s", expected, got)
+	}
+}
+
+func TestDotGuard(t *testing.T) {
+	p := parseFile(t, "testdata/nested.scr")
+	l, err := Project(p, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dot := NewFSM(l).Dot()
+	for _, line := range []string{
+		`digraph "Nested at A[self]" {`,
+		`    S2 [label="S2\nif"];`,
+		`  S2 -> S3 [label="self == i"];`,
+		`  S2 -> S4 [label="else"];`,
+		`  S1 -> S2 [label="Coordinator?foo(int)"];`,
+	} {
+		if !strings.Contains(dot, line+"\n") {
+			t.Errorf("expected %q in DOT:\n%s", line, dot)
+		}
+	}
+}
@@ -0,0 +1,60 @@
+package scribble
+
+// This file contains the fingerprint of protocols.
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Fingerprint returns a hash of the protocol p, which is the same for every
+// role of p. Participants compare fingerprints before a session starts to
+// notice that they implement different revisions of a protocol.
+//
+// The hash covers the parameters and roles of p, and the local type and the
+// FSM states (including the foreach structure) of each role. Positions,
+// comments and layout of the source are not part of the hash.
+func Fingerprint(p *Protocol) (string, error) {
+	var b strings.Builder
+	params := make([]string, len(p.Params))
+	for i, param := range p.Params {
+		params[i] = "param " + param.Name
+	}
+	roles := make([]string, len(p.Roles))
+	for i, role := range p.Roles {
+		roles[i] = "role " + role.Name
+		if role.Indexed() {
+			roles[i] += fmt.Sprintf("[%s..%s]", role.Lo, role.Hi)
+		}
+	}
+	fmt.Fprintf(&b, "global protocol %s(%s)\n", p.Name, strings.Join(append(params, roles...), ", "))
+	for _, role := range p.Roles {
+		l, err := Project(p, role.Name)
+		if err != nil {
+			return "", err
+		}
+		b.WriteString(l.String())
+		NewFSM(l).writeStates(&b)
+	}
+	sum := sha256.Sum256([]byte(b.String()))
+	return hex.EncodeToString(sum[:8]), nil
+}
+
+// writeStates writes the states of f with their transitions, one per line.
+func (f *FSM) writeStates(b *strings.Builder) {
+	for _, s := range f.States {
+		b.WriteString(stateName(s))
+		if label := stateLabel(s); label != "" {
+			fmt.Fprintf(b, " (%s)", label)
+		}
+		for _, loop := range s.Loops {
+			fmt.Fprintf(b, " in %s", stateName(loop))
+		}
+		for _, e := range edges(s) {
+			fmt.Fprintf(b, "; -> %s %s", stateName(e.to), e.label)
+		}
+		b.WriteString("\n")
+	}
+}
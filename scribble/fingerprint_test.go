@@ -0,0 +1,65 @@
+package scribble
+
+import "testing"
+
+func TestFingerprint(t *testing.T) {
+	fingerprint := func(src string) string {
+		t.Helper()
+		p, err := Parse("test.scr", src)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := Fingerprint(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	nested := fingerprint(`global protocol Nested(param k, role Coordinator, role A[1..k]) {
+  foreach A[i:1..k] {
+    foreach A[j:1..k] {
+      foo(int) from Coordinator to A[j];
+    }
+    bar(string) from Coordinator to A[i];
+  }
+}`)
+	if len(nested) != 16 {
+		t.Errorf("expected a fingerprint of 16 hex digits but got %q", nested)
+	}
+	same := fingerprint(`// Example protocol - nested one-to-many.
+global protocol Nested(param k, role Coordinator, role A[1..k]) {
+	foreach A[i:1..k] { foreach A[j:1..k] { foo(int) from Coordinator to A[j]; }
+	bar(string) from Coordinator to A[i]; }
+}`)
+	if same != nested {
+		t.Errorf("expected the same fingerprint regardless of layout but got %s and %s", nested, same)
+	}
+
+	for _, tc := range []struct {
+		name, src string
+	}{
+		{"Payload", `global protocol Nested(param k, role Coordinator, role A[1..k]) {
+  foreach A[i:1..k] { foreach A[j:1..k] { foo(string) from Coordinator to A[j]; } bar(string) from Coordinator to A[i]; }
+}`},
+		{"Label", `global protocol Nested(param k, role Coordinator, role A[1..k]) {
+  foreach A[i:1..k] { foreach A[j:1..k] { foo(int) from Coordinator to A[j]; } baz(string) from Coordinator to A[i]; }
+}`},
+		{"Foreach", `global protocol Nested(param k, role Coordinator, role A[1..k]) {
+  foreach A[i:1..k] { foreach A[j:1..k] { foo(int) from Coordinator to A[j]; } }
+  foreach A[i:1..k] { bar(string) from Coordinator to A[i]; }
+}`},
+		{"Range", `global protocol Nested(param k, role Coordinator, role A[1..k]) {
+  foreach A[i:1..k] { foreach A[j:2..k] { foo(int) from Coordinator to A[j]; } bar(string) from Coordinator to A[i]; }
+}`},
+		{"Params", `global protocol Nested(param k, param n, role Coordinator, role A[1..k]) {
+  foreach A[i:1..k] { foreach A[j:1..k] { foo(int) from Coordinator to A[j]; } bar(string) from Coordinator to A[i]; }
+}`},
+		{"Name", `global protocol Nested2(param k, role Coordinator, role A[1..k]) {
+  foreach A[i:1..k] { foreach A[j:1..k] { foo(int) from Coordinator to A[j]; } bar(string) from Coordinator to A[i]; }
+}`},
+	} {
+		if f := fingerprint(tc.src); f == nested {
+			t.Errorf("%s: expected a different fingerprint from %s", tc.name, nested)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+package scribble
+
+// This file contains the FSM construction of local types.
+
+// StateKind is the kind of a state, i.e. the action taken from it.
+type StateKind int
+
+const (
+	SendState    StateKind = iota // SendState sends a message
+	RecvState                     // RecvState receives a message
+	ForeachState                  // ForeachState is a foreach init state
+	BodyEndState                  // BodyEndState is the end of a foreach body
+	IfState                       // IfState is a guard on the participant index
+	ChoiceState                   // ChoiceState is a choice between branches
+	EndState                      // EndState is the final state
+)
+
+// State is a state in the FSM of a local type.
+//
+// A foreach init state is the entry of a sub-FSM: Body is the first state
+// of the loop body, End is the body end state which goes back to the foreach
+// init state, and Next is the state after the loop exits.
+type State struct {
+	ID   int
+	Kind StateKind
+	Stmt LocalStmt // Stmt is nil for body end and end states
+
+	Next     *State   // Next is the successor, the loop exit or the join of a guard or choice
+	Body     *State   // Body is the first state of a foreach or guard body
+	End      *State   // End is the body end state of a foreach
+	Branches []*State // Branches are the first states of each branch of a choice
+	Loops    []*State // Loops are the enclosing foreach init states, outermost first
+}
+
+// Loop returns the enclosing foreach init state binding the index variable,
+// or nil if the variable is not an index variable.
+func (s *State) Loop(index string) *State {
+	for i := len(s.Loops) - 1; i >= 0; i-- {
+		if s.Loops[i].Stmt.(*LocalForeach).Index == index {
+			return s.Loops[i]
+		}
+	}
+	return nil
+}
+
+// FSM is the state machine of a local type.
+// Foreach loops are kept as nested sub-FSMs rather than unrolled.
+type FSM struct {
+	Local   *Local
+	States  []*State // States are ordered by ID
+	Initial *State
+
+	recs map[string]*State // recs maps rec labels to the first state of the rec body
+}
+
+// NewFSM builds the FSM of a local type.
+//
+// States are numbered in the order of the statements in the local type, then
+// the body end states in the order of their loops, and the end state is last.
+// The numbering of the nested example is the same as the final package.
+//
+// A rec does not have a state of its own, a continue goes back to the first
+// state of the body of its rec.
+func NewFSM(l *Local) *FSM {
+	f := &FSM{Local: l, recs: make(map[string]*State)}
+	stmts := make(map[LocalStmt]*State)
+	f.alloc(l.Body, stmts)
+	for _, s := range f.States {
+		if s.Kind == ForeachState {
+			s.End = &State{ID: len(f.States), Kind: BodyEndState, Next: s}
+			f.States = append(f.States, s.End)
+		}
+	}
+	end := f.newState(EndState, nil)
+	f.Initial = f.link(l.Body, end, stmts)
+	return f
+}
+
+func (f *FSM) newState(kind StateKind, stmt LocalStmt) *State {
+	s := &State{ID: len(f.States), Kind: kind, Stmt: stmt}
+	f.States = append(f.States, s)
+	return s
+}
+
+// alloc allocates a state for each statement in pre-order.
+func (f *FSM) alloc(stmts []LocalStmt, states map[LocalStmt]*State) {
+	for _, stmt := range stmts {
+		switch stmt := stmt.(type) {
+		case *Send:
+			states[stmt] = f.newState(SendState, stmt)
+		case *Recv:
+			states[stmt] = f.newState(RecvState, stmt)
+		case *LocalForeach:
+			states[stmt] = f.newState(ForeachState, stmt)
+			f.alloc(stmt.Body, states)
+		case *If:
+			states[stmt] = f.newState(IfState, stmt)
+			f.alloc(stmt.Body, states)
+		case *LocalChoice:
+			states[stmt] = f.newState(ChoiceState, stmt)
+			for _, branch := range stmt.Branches {
+				f.alloc(branch, states)
+			}
+		case *LocalRec:
+			f.alloc(stmt.Body, states)
+		}
+	}
+}
+
+// entry returns the first state of stmts, which is not empty.
+func (f *FSM) entry(stmts []LocalStmt, states map[LocalStmt]*State) *State {
+	switch stmt := stmts[0].(type) {
+	case *LocalRec:
+		return f.entry(stmt.Body, states)
+	case *LocalContinue:
+		return f.recs[stmt.Label]
+	}
+	return states[stmts[0]]
+}
+
+// link connects the states of stmts, where next is the state after stmts.
+// It returns the first state of stmts.
+func (f *FSM) link(stmts []LocalStmt, next *State, states map[LocalStmt]*State) *State {
+	for i := len(stmts) - 1; i >= 0; i-- {
+		switch stmt := stmts[i].(type) {
+		case *LocalContinue:
+			next = f.recs[stmt.Label]
+			continue
+		case *LocalRec:
+			f.recs[stmt.Label] = f.entry(stmt.Body, states)
+			next = f.link(stmt.Body, next, states)
+			continue
+		}
+		s := states[stmts[i]]
+		s.Next = next
+		switch stmt := stmts[i].(type) {
+		case *LocalForeach:
+			s.End.Loops = append(s.Loops[:len(s.Loops):len(s.Loops)], s)
+			f.scope(stmt.Body, s.End.Loops, states)
+			s.Body = f.link(stmt.Body, s.End, states)
+		case *If:
+			f.scope(stmt.Body, s.Loops, states)
+			s.Body = f.link(stmt.Body, next, states)
+		case *LocalChoice:
+			s.Branches = make([]*State, len(stmt.Branches))
+			for i, branch := range stmt.Branches {
+				f.scope(branch, s.Loops, states)
+				s.Branches[i] = f.link(branch, next, states)
+			}
+		}
+		next = s
+	}
+	return next
+}
+
+// scope sets the enclosing loops of the states of stmts (not recursively).
+func (f *FSM) scope(stmts []LocalStmt, loops []*State, states map[LocalStmt]*State) {
+	for _, stmt := range stmts {
+		switch stmt := stmt.(type) {
+		case *LocalRec:
+			f.scope(stmt.Body, loops, states)
+		case *LocalContinue:
+		default:
+			states[stmt].Loops = loops
+		}
+	}
+}
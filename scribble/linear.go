@@ -0,0 +1,147 @@
+package scribble
+
+// This file contains affine expressions for comparing ranges statically.
+
+import (
+	"sort"
+	"strconv"
+)
+
+// linear is an affine expression c + Σ coef[v]*v.
+type linear struct {
+	c    int
+	coef map[string]int
+}
+
+// linearOf returns the affine form of e, or false if e is not affine.
+func linearOf(e Expr) (linear, bool) {
+	switch e := e.(type) {
+	case *Num:
+		return linear{c: e.Value}, true
+	case *Var:
+		return linear{coef: map[string]int{e.Name: 1}}, true
+	case *BinExpr:
+		x, okX := linearOf(e.X)
+		y, okY := linearOf(e.Y)
+		switch e.Op {
+		case "+":
+			return x.add(y), okX && okY
+		case "-":
+			return x.sub(y), okX && okY
+		}
+	}
+	return linear{}, false
+}
+
+func (l linear) add(m linear) linear {
+	d := linear{c: l.c + m.c, coef: make(map[string]int)}
+	for v, c := range l.coef {
+		d.coef[v] += c
+	}
+	for v, c := range m.coef {
+		d.coef[v] += c
+	}
+	return d
+}
+
+// sub returns l - m.
+func (l linear) sub(m linear) linear {
+	d := linear{c: l.c - m.c, coef: make(map[string]int)}
+	for v, c := range l.coef {
+		d.coef[v] += c
+	}
+	for v, c := range m.coef {
+		d.coef[v] -= c
+	}
+	return d
+}
+
+// constant returns the value of l if it does not depend on any variable.
+func (l linear) constant() (int, bool) {
+	for _, c := range l.coef {
+		if c != 0 {
+			return 0, false
+		}
+	}
+	return l.c, true
+}
+
+// String returns l in protocol syntax, e.g. k+1.
+func (l linear) String() string {
+	var names []string
+	for v, c := range l.coef {
+		if c != 0 {
+			names = append(names, v)
+		}
+	}
+	sort.Strings(names)
+	s := ""
+	for _, v := range names {
+		c := l.coef[v]
+		switch {
+		case c == 1 && s == "":
+		case c == 1:
+			s += "+"
+		case c == -1:
+			s += "-"
+		case c > 0 && s != "":
+			s += "+" + strconv.Itoa(c) + "*"
+		default:
+			s += strconv.Itoa(c) + "*"
+		}
+		s += v
+	}
+	switch {
+	case s == "":
+		return strconv.Itoa(l.c)
+	case l.c > 0:
+		return s + "+" + strconv.Itoa(l.c)
+	case l.c < 0:
+		return s + strconv.Itoa(l.c)
+	}
+	return s
+}
+
+// leq returns true if x <= y for all values of the variables.
+func leq(x, y Expr) bool {
+	lx, okX := linearOf(x)
+	ly, okY := linearOf(y)
+	return okX && okY && nonNegative(ly.sub(lx))
+}
+
+func nonNegative(l linear) bool {
+	d, ok := l.constant()
+	return ok && d >= 0
+}
+
+// bounds returns the smallest and largest values of e in terms of the
+// protocol parameters, where index variables range over their foreach.
+// It returns false if the bounds cannot be expressed as affine expressions.
+func bounds(e Expr, indices map[string]*Foreach) (lo, hi linear, ok bool) {
+	switch e := e.(type) {
+	case *Num:
+		return linear{c: e.Value}, linear{c: e.Value}, true
+	case *Var:
+		loop, isIndex := indices[e.Name]
+		if !isIndex {
+			l, _ := linearOf(e)
+			return l, l, true
+		}
+		lo, okLo := linearOf(loop.Lo)
+		hi, okHi := linearOf(loop.Hi)
+		return lo, hi, okLo && okHi
+	case *BinExpr:
+		xlo, xhi, okX := bounds(e.X, indices)
+		ylo, yhi, okY := bounds(e.Y, indices)
+		switch e.Op {
+		case "+":
+			return xlo.add(ylo), xhi.add(yhi), okX && okY
+		case "-":
+			return xlo.sub(yhi), xhi.sub(ylo), okX && okY
+		case "mod":
+			// x mod y is in 0..y-1 for any x.
+			return linear{}, yhi.sub(linear{c: 1}), okY
+		}
+	}
+	return linear{}, linear{}, false
+}
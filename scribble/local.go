@@ -0,0 +1,156 @@
+package scribble
+
+// This file contains the local types of a projected protocol.
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Self is the name of the index variable bound to the index of the
+// participant in a local type projected onto an indexed role.
+const Self = "self"
+
+// Local is the local type of a protocol projected onto a role.
+type Local struct {
+	Protocol *Protocol
+	Role     *Role // Role is the projected role
+	Body     []LocalStmt
+}
+
+// LocalStmt is a statement in a local type.
+type LocalStmt interface {
+	Position() Pos
+	localStmt()
+}
+
+// Send is a local send action: label(payloads) to To.
+type Send struct {
+	Pos      Pos
+	Label    string
+	Payloads []string
+	To       *RoleRef
+}
+
+// Recv is a local receive action: label(payloads) from From.
+type Recv struct {
+	Pos      Pos
+	Label    string
+	Payloads []string
+	From     *RoleRef
+}
+
+// LocalForeach is a foreach loop kept in the local type.
+// Role and Index are the same as the global foreach.
+type LocalForeach struct {
+	Pos    Pos
+	Role   string
+	Index  string
+	Lo, Hi Expr
+	Body   []LocalStmt
+}
+
+// If is a guard on the index of the participant:
+// Body is only followed if Lo <= self <= Hi.
+type If struct {
+	Pos    Pos
+	Lo, Hi Expr
+	Body   []LocalStmt
+}
+
+// LocalChoice is a choice at the role At.
+// The first statement of each branch is a Send if the projected role is the
+// role making the choice, or a Recv from At otherwise.
+type LocalChoice struct {
+	Pos      Pos
+	At       *RoleRef
+	Branches [][]LocalStmt
+}
+
+// LocalRec is a recursion point in a local type.
+type LocalRec struct {
+	Pos   Pos
+	Label string
+	Body  []LocalStmt
+}
+
+// LocalContinue repeats the enclosing LocalRec with the same Label.
+type LocalContinue struct {
+	Pos   Pos
+	Label string
+}
+
+func (s *Send) Position() Pos          { return s.Pos }
+func (s *Recv) Position() Pos          { return s.Pos }
+func (s *LocalForeach) Position() Pos  { return s.Pos }
+func (s *If) Position() Pos            { return s.Pos }
+func (s *LocalChoice) Position() Pos   { return s.Pos }
+func (s *LocalRec) Position() Pos      { return s.Pos }
+func (s *LocalContinue) Position() Pos { return s.Pos }
+
+func (*Send) localStmt()          {}
+func (*Recv) localStmt()          {}
+func (*LocalForeach) localStmt()  {}
+func (*If) localStmt()            {}
+func (*LocalChoice) localStmt()   {}
+func (*LocalRec) localStmt()      {}
+func (*LocalContinue) localStmt() {}
+
+// String returns the local type in protocol syntax.
+func (l *Local) String() string {
+	var b strings.Builder
+	role := l.Role.Name
+	if l.Role.Indexed() {
+		role = fmt.Sprintf("%s[%s:%s..%s]", role, Self, l.Role.Lo, l.Role.Hi)
+	}
+	fmt.Fprintf(&b, "local protocol %s at %s {\n", l.Protocol.Name, role)
+	writeLocal(&b, l.Body, 1)
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func writeLocal(b *strings.Builder, stmts []LocalStmt, depth int) {
+	indent := strings.Repeat("  ", depth)
+	for _, s := range stmts {
+		switch s := s.(type) {
+		case *Send:
+			fmt.Fprintf(b, "%s%s(%s) to %s;\n", indent, s.Label, strings.Join(s.Payloads, ", "), s.To)
+		case *Recv:
+			fmt.Fprintf(b, "%s%s(%s) from %s;\n", indent, s.Label, strings.Join(s.Payloads, ", "), s.From)
+		case *LocalForeach:
+			fmt.Fprintf(b, "%sforeach %s[%s:%s..%s] {\n", indent, s.Role, s.Index, s.Lo, s.Hi)
+			writeLocal(b, s.Body, depth+1)
+			fmt.Fprintf(b, "%s}\n", indent)
+		case *If:
+			if s.Lo.String() == s.Hi.String() {
+				fmt.Fprintf(b, "%sif %s == %s {\n", indent, Self, s.Lo)
+			} else {
+				fmt.Fprintf(b, "%sif %s in %s..%s {\n", indent, Self, s.Lo, s.Hi)
+			}
+			writeLocal(b, s.Body, depth+1)
+			fmt.Fprintf(b, "%s}\n", indent)
+		case *LocalChoice:
+			fmt.Fprintf(b, "%schoice at %s {\n", indent, s.At)
+			for i, branch := range s.Branches {
+				if i > 0 {
+					fmt.Fprintf(b, "%s} or {\n", indent)
+				}
+				writeLocal(b, branch, depth+1)
+			}
+			fmt.Fprintf(b, "%s}\n", indent)
+		case *LocalRec:
+			fmt.Fprintf(b, "%srec %s {\n", indent, s.Label)
+			writeLocal(b, s.Body, depth+1)
+			fmt.Fprintf(b, "%s}\n", indent)
+		case *LocalContinue:
+			fmt.Fprintf(b, "%scontinue %s;\n", indent, s.Label)
+		}
+	}
+}
+
+// localString returns stmts in protocol syntax.
+func localString(stmts []LocalStmt) string {
+	var b strings.Builder
+	writeLocal(&b, stmts, 0)
+	return b.String()
+}
@@ -0,0 +1,467 @@
+package scribble
+
+// This file contains the lexer and recursive descent parser.
+
+import (
+	"fmt"
+	"strconv"
+	"unicode"
+)
+
+type tokenKind int
+
+const (
+	tEOF tokenKind = iota
+	tIdent
+	tInt
+	tPunct // punctuation, including the range operator ".."
+)
+
+type token struct {
+	kind tokenKind
+	text string
+	pos  Pos
+}
+
+func (t token) String() string {
+	if t.kind == tEOF {
+		return "end of file"
+	}
+	return strconv.Quote(t.text)
+}
+
+// lex splits src into tokens, skipping whitespace and comments.
+func lex(filename, src string) ([]token, error) {
+	var (
+		tokens    []token
+		line, col = 1, 1
+		rs        = []rune(src)
+	)
+	advance := func(n int) {
+		for ; n > 0; n-- {
+			if rs[0] == '\n' {
+				line, col = line+1, 1
+			} else {
+				col++
+			}
+			rs = rs[1:]
+		}
+	}
+	for len(rs) > 0 {
+		pos := Pos{Filename: filename, Line: line, Col: col}
+		switch r := rs[0]; {
+		case unicode.IsSpace(r):
+			advance(1)
+		case r == '/' && len(rs) > 1 && rs[1] == '/':
+			for len(rs) > 0 && rs[0] != '\n' {
+				advance(1)
+			}
+		case r == '/' && len(rs) > 1 && rs[1] == '*':
+			advance(2)
+			for len(rs) > 1 && !(rs[0] == '*' && rs[1] == '/') {
+				advance(1)
+			}
+			if len(rs) < 2 {
+				return nil, fmt.Errorf("%s: comment not terminated", pos)
+			}
+			advance(2)
+		case unicode.IsLetter(r) || r == '_':
+			n := 1
+			for n < len(rs) && (unicode.IsLetter(rs[n]) || unicode.IsDigit(rs[n]) || rs[n] == '_') {
+				n++
+			}
+			tokens = append(tokens, token{kind: tIdent, text: string(rs[:n]), pos: pos})
+			advance(n)
+		case unicode.IsDigit(r):
+			n := 1
+			for n < len(rs) && unicode.IsDigit(rs[n]) {
+				n++
+			}
+			tokens = append(tokens, token{kind: tInt, text: string(rs[:n]), pos: pos})
+			advance(n)
+		case r == '.' && len(rs) > 1 && rs[1] == '.':
+			tokens = append(tokens, token{kind: tPunct, text: "..", pos: pos})
+			advance(2)
+		case r == '(' || r == ')' || r == '[' || r == ']' || r == '{' || r == '}' ||
+			r == ',' || r == ';' || r == ':' || r == '+' || r == '-':
+			tokens = append(tokens, token{kind: tPunct, text: string(r), pos: pos})
+			advance(1)
+		default:
+			return nil, fmt.Errorf("%s: unexpected character %q", pos, r)
+		}
+	}
+	tokens = append(tokens, token{kind: tEOF, pos: Pos{Filename: filename, Line: line, Col: col}})
+	return tokens, nil
+}
+
+// parser is a recursive descent parser over the token stream.
+type parser struct {
+	tokens []token
+	next   int
+}
+
+// Parse parses a global protocol from src.
+// filename is only used for reporting positions.
+func Parse(filename, src string) (*Protocol, error) {
+	tokens, err := lex(filename, src)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	proto, err := p.protocol()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tEOF {
+		return nil, fmt.Errorf("%s: unexpected %s after protocol", tok.pos, tok)
+	}
+	return proto, nil
+}
+
+func (p *parser) peek() token { return p.tokens[p.next] }
+
+func (p *parser) advance() token {
+	tok := p.tokens[p.next]
+	if tok.kind != tEOF {
+		p.next++
+	}
+	return tok
+}
+
+// is returns true if the next token is the keyword or punctuation text.
+func (p *parser) is(text string) bool {
+	tok := p.peek()
+	return tok.kind != tEOF && tok.text == text
+}
+
+func (p *parser) expect(text string) (token, error) {
+	tok := p.advance()
+	if tok.kind == tEOF || tok.text != text {
+		return tok, fmt.Errorf("%s: expected %q but got %s", tok.pos, text, tok)
+	}
+	return tok, nil
+}
+
+func (p *parser) ident() (token, error) {
+	tok := p.advance()
+	if tok.kind != tIdent {
+		return tok, fmt.Errorf("%s: expected identifier but got %s", tok.pos, tok)
+	}
+	return tok, nil
+}
+
+// protocol := 'global' 'protocol' IDENT '(' decl (',' decl)* ')' block
+func (p *parser) protocol() (*Protocol, error) {
+	tok, err := p.expect("global")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect("protocol"); err != nil {
+		return nil, err
+	}
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	proto := &Protocol{Pos: tok.pos, Name: name.text}
+	if _, err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.decl(proto); err != nil {
+			return nil, err
+		}
+		if !p.is(",") {
+			break
+		}
+		p.advance()
+	}
+	if _, err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if proto.Body, err = p.block(); err != nil {
+		return nil, err
+	}
+	return proto, nil
+}
+
+// decl := 'param' IDENT | 'role' IDENT [ '[' expr '..' expr ']' ]
+func (p *parser) decl(proto *Protocol) error {
+	switch tok := p.advance(); tok.text {
+	case "param":
+		name, err := p.ident()
+		if err != nil {
+			return err
+		}
+		proto.Params = append(proto.Params, &Param{Pos: name.pos, Name: name.text})
+		return nil
+	case "role":
+		name, err := p.ident()
+		if err != nil {
+			return err
+		}
+		role := &Role{Pos: name.pos, Name: name.text}
+		if p.is("[") {
+			p.advance()
+			if role.Lo, role.Hi, err = p.rangeExpr(); err != nil {
+				return err
+			}
+			if _, err := p.expect("]"); err != nil {
+				return err
+			}
+		}
+		proto.Roles = append(proto.Roles, role)
+		return nil
+	default:
+		return fmt.Errorf("%s: expected param or role declaration but got %s", tok.pos, tok)
+	}
+}
+
+// block := '{' stmt* '}'
+func (p *parser) block() ([]Stmt, error) {
+	if _, err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	var stmts []Stmt
+	for !p.is("}") {
+		if p.peek().kind == tEOF {
+			return nil, fmt.Errorf("%s: expected \"}\" but got %s", p.peek().pos, p.peek())
+		}
+		stmt, err := p.stmt()
+		if err != nil {
+			return nil, err
+		}
+		stmts = append(stmts, stmt)
+	}
+	p.advance()
+	return stmts, nil
+}
+
+func (p *parser) stmt() (Stmt, error) {
+	switch {
+	case p.is("foreach"):
+		return p.foreach()
+	case p.is("choice"):
+		return p.choice()
+	case p.is("rec"):
+		return p.rec()
+	case p.is("continue"):
+		return p.cont()
+	}
+	return p.interaction()
+}
+
+// rec := 'rec' IDENT block
+func (p *parser) rec() (Stmt, error) {
+	tok := p.advance()
+	label, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	s := &Rec{Pos: tok.pos, Label: label.text}
+	if s.Body, err = p.block(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// continue := 'continue' IDENT ';'
+func (p *parser) cont() (Stmt, error) {
+	tok := p.advance()
+	label, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	return &Continue{Pos: tok.pos, Label: label.text}, nil
+}
+
+// choice := 'choice' 'at' roleref block ('or' block)*
+func (p *parser) choice() (Stmt, error) {
+	tok := p.advance()
+	if _, err := p.expect("at"); err != nil {
+		return nil, err
+	}
+	at, err := p.roleRef()
+	if err != nil {
+		return nil, err
+	}
+	s := &Choice{Pos: tok.pos, At: at}
+	for {
+		branch, err := p.block()
+		if err != nil {
+			return nil, err
+		}
+		s.Branches = append(s.Branches, branch)
+		if !p.is("or") {
+			return s, nil
+		}
+		p.advance()
+	}
+}
+
+// foreach := 'foreach' IDENT '[' IDENT ':' expr '..' expr ']' block
+func (p *parser) foreach() (Stmt, error) {
+	tok := p.advance()
+	role, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect("["); err != nil {
+		return nil, err
+	}
+	index, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(":"); err != nil {
+		return nil, err
+	}
+	s := &Foreach{Pos: tok.pos, Role: role.text, Index: index.text}
+	if s.Lo, s.Hi, err = p.rangeExpr(); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect("]"); err != nil {
+		return nil, err
+	}
+	if s.Body, err = p.block(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// interaction := IDENT '(' [ IDENT (',' IDENT)* ] ')' 'from' roleref 'to' roleref ';'
+func (p *parser) interaction() (Stmt, error) {
+	label, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	s := &Interaction{Pos: label.pos, Label: label.text}
+	if _, err := p.expect("("); err != nil {
+		return nil, err
+	}
+	for !p.is(")") {
+		typ, err := p.ident()
+		if err != nil {
+			return nil, err
+		}
+		s.Payloads = append(s.Payloads, typ.text)
+		if !p.is(",") {
+			break
+		}
+		p.advance()
+	}
+	if _, err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect("from"); err != nil {
+		return nil, err
+	}
+	if s.From, err = p.roleRef(); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect("to"); err != nil {
+		return nil, err
+	}
+	if s.To, err = p.roleRef(); err != nil {
+		return nil, err
+	}
+	if _, err := p.expect(";"); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// roleref := IDENT [ '[' expr ']' ]
+func (p *parser) roleRef() (*RoleRef, error) {
+	name, err := p.ident()
+	if err != nil {
+		return nil, err
+	}
+	ref := &RoleRef{Pos: name.pos, Name: name.text}
+	if p.is("[") {
+		p.advance()
+		if ref.Index, err = p.expr(); err != nil {
+			return nil, err
+		}
+		if _, err := p.expect("]"); err != nil {
+			return nil, err
+		}
+	}
+	return ref, nil
+}
+
+// rangeExpr := expr '..' expr
+func (p *parser) rangeExpr() (lo, hi Expr, err error) {
+	if lo, err = p.expr(); err != nil {
+		return nil, nil, err
+	}
+	if _, err = p.expect(".."); err != nil {
+		return nil, nil, err
+	}
+	if hi, err = p.expr(); err != nil {
+		return nil, nil, err
+	}
+	return lo, hi, nil
+}
+
+// expr := term (('+' | '-') term)*
+func (p *parser) expr() (Expr, error) {
+	x, err := p.term()
+	if err != nil {
+		return nil, err
+	}
+	for p.is("+") || p.is("-") {
+		op := p.advance()
+		y, err := p.term()
+		if err != nil {
+			return nil, err
+		}
+		x = &BinExpr{Pos: op.pos, Op: op.text, X: x, Y: y}
+	}
+	return x, nil
+}
+
+// term := operand ('mod' operand)*
+func (p *parser) term() (Expr, error) {
+	x, err := p.operand()
+	if err != nil {
+		return nil, err
+	}
+	for p.is("mod") {
+		op := p.advance()
+		y, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		x = &BinExpr{Pos: op.pos, Op: op.text, X: x, Y: y}
+	}
+	return x, nil
+}
+
+// operand := INT | IDENT | '(' expr ')'
+func (p *parser) operand() (Expr, error) {
+	tok := p.advance()
+	switch {
+	case tok.kind == tInt:
+		n, err := strconv.Atoi(tok.text)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", tok.pos, err)
+		}
+		return &Num{Pos: tok.pos, Value: n}, nil
+	case tok.kind == tIdent && tok.text != "mod":
+		return &Var{Pos: tok.pos, Name: tok.text}, nil
+	case tok.text == "(":
+		x, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if _, err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return x, nil
+	}
+	return nil, fmt.Errorf("%s: expected expression but got %s", tok.pos, tok)
+}
@@ -0,0 +1,221 @@
+package scribble
+
+// This file contains the projection of global protocols onto roles.
+
+import "fmt"
+
+// projector keeps track of index substitutions during projection.
+type projector struct {
+	role  *Role
+	subst map[string]Expr // subst maps eliminated index variables to self
+}
+
+// Project projects the well-formed protocol p onto role.
+//
+// For an indexed role A[lo..hi], the local type is the view of a participant
+// A[self], and only keeps the iterations that involve it:
+//
+//   - a foreach A[j:..] where A is only referenced as A[j] is eliminated,
+//     the body is kept once with j replaced by self,
+//   - other references to A[e] are guarded by "if self == e".
+func Project(p *Protocol, role string) (*Local, error) {
+	r := p.Role(role)
+	if r == nil {
+		return nil, fmt.Errorf("%s: role %s is not declared in protocol %s", p.Pos, role, p.Name)
+	}
+	pj := &projector{role: r, subst: make(map[string]Expr)}
+	body, err := pj.stmts(p.Body)
+	if err != nil {
+		return nil, err
+	}
+	return &Local{Protocol: p, Role: r, Body: body}, nil
+}
+
+func (pj *projector) stmts(stmts []Stmt) ([]LocalStmt, error) {
+	var local []LocalStmt
+	for _, s := range stmts {
+		switch s := s.(type) {
+		case *Interaction:
+			from, to := pj.roleRef(s.From), pj.roleRef(s.To)
+			if ok, guard := pj.involves(from); ok {
+				send := &Send{Pos: s.Pos, Label: s.Label, Payloads: s.Payloads, To: to}
+				local = append(local, guarded(guard, send))
+			}
+			if ok, guard := pj.involves(to); ok {
+				recv := &Recv{Pos: s.Pos, Label: s.Label, Payloads: s.Payloads, From: from}
+				local = append(local, guarded(guard, recv))
+			}
+		case *Foreach:
+			if s.Role == pj.role.Name && pj.onlyVia(s.Body, s.Index) {
+				pj.subst[s.Index] = &Var{Pos: s.Pos, Name: Self}
+				body, err := pj.stmts(s.Body)
+				delete(pj.subst, s.Index)
+				if err != nil {
+					return nil, err
+				}
+				if len(body) == 0 {
+					continue
+				}
+				if s.Lo.String() == pj.role.Lo.String() && s.Hi.String() == pj.role.Hi.String() {
+					local = append(local, body...) // every participant is in range
+					continue
+				}
+				local = append(local, &If{Pos: s.Pos, Lo: s.Lo, Hi: s.Hi, Body: body})
+				continue
+			}
+			body, err := pj.stmts(s.Body)
+			if err != nil {
+				return nil, err
+			}
+			if len(body) > 0 {
+				local = append(local, &LocalForeach{Pos: s.Pos, Role: s.Role, Index: s.Index, Lo: s.Lo, Hi: s.Hi, Body: body})
+			}
+		case *Choice:
+			choice, err := pj.choice(s)
+			if err != nil {
+				return nil, err
+			}
+			local = append(local, choice...)
+		case *Rec:
+			body, err := pj.stmts(s.Body)
+			if err != nil {
+				return nil, err
+			}
+			if hasAction(body) {
+				local = append(local, &LocalRec{Pos: s.Pos, Label: s.Label, Body: body})
+			}
+		case *Continue:
+			local = append(local, &LocalContinue{Pos: s.Pos, Label: s.Label})
+		}
+	}
+	return local, nil
+}
+
+// hasAction returns true if stmts send or receive any message.
+func hasAction(stmts []LocalStmt) bool {
+	for _, s := range stmts {
+		switch s := s.(type) {
+		case *Send, *Recv:
+			return true
+		case *LocalForeach:
+			if hasAction(s.Body) {
+				return true
+			}
+		case *If:
+			if hasAction(s.Body) {
+				return true
+			}
+		case *LocalChoice:
+			for _, branch := range s.Branches {
+				if hasAction(branch) {
+					return true
+				}
+			}
+		case *LocalRec:
+			if hasAction(s.Body) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// choice projects a choice, the projected role either makes the choice,
+// learns the choice from the first message of each branch, or follows the
+// same local type in every branch.
+func (pj *projector) choice(s *Choice) ([]LocalStmt, error) {
+	branches := make([][]LocalStmt, len(s.Branches))
+	for i, branch := range s.Branches {
+		var err error
+		if branches[i], err = pj.stmts(branch); err != nil {
+			return nil, err
+		}
+	}
+	at := pj.roleRef(s.At)
+	if ok, guard := pj.involves(at); ok {
+		if guard != nil {
+			return nil, fmt.Errorf("%s: cannot project choice at %s onto %s[%s]", s.Pos, at, pj.role.Name, Self)
+		}
+		for _, branch := range branches {
+			switch branch[0].(type) {
+			case *Send, *LocalForeach:
+			default:
+				return nil, fmt.Errorf("%s: branch of choice at %s must start with a send or a foreach", branch[0].Position(), at)
+			}
+		}
+		return []LocalStmt{&LocalChoice{Pos: s.Pos, At: at, Branches: branches}}, nil
+	}
+	same := true
+	for _, branch := range branches[1:] {
+		same = same && localString(branch) == localString(branches[0])
+	}
+	if same {
+		return branches[0], nil // also when not involved in any branch
+	}
+	for _, branch := range branches {
+		if len(branch) == 0 {
+			return nil, fmt.Errorf("%s: %s is not informed of the choice at %s", s.Pos, pj.role.Name, at)
+		}
+		if recv, ok := branch[0].(*Recv); !ok || recv.From.String() != at.String() {
+			return nil, fmt.Errorf("%s: %s is not informed of the choice at %s", branch[0].Position(), pj.role.Name, at)
+		}
+	}
+	return []LocalStmt{&LocalChoice{Pos: s.Pos, At: at, Branches: branches}}, nil
+}
+
+// involves returns true if ref refers to the projected role, and the guard
+// on self needed if ref is an indexed reference other than A[self].
+func (pj *projector) involves(ref *RoleRef) (bool, Expr) {
+	if ref.Name != pj.role.Name {
+		return false, nil
+	}
+	if v, ok := ref.Index.(*Var); ref.Index == nil || ok && v.Name == Self {
+		return true, nil
+	}
+	return true, ref.Index
+}
+
+func guarded(guard Expr, s LocalStmt) LocalStmt {
+	if guard == nil {
+		return s
+	}
+	return &If{Pos: s.Position(), Lo: guard, Hi: guard, Body: []LocalStmt{s}}
+}
+
+// onlyVia returns true if every reference to the projected role in stmts
+// is indexed by exactly the index variable index.
+func (pj *projector) onlyVia(stmts []Stmt, index string) bool {
+	ok := true
+	walk(stmts, func(s Stmt) {
+		if s, isInteraction := s.(*Interaction); isInteraction {
+			for _, ref := range []*RoleRef{s.From, s.To} {
+				if ref.Name != pj.role.Name {
+					continue
+				}
+				if v, isVar := ref.Index.(*Var); !isVar || v.Name != index {
+					ok = false
+				}
+			}
+		}
+	})
+	return ok
+}
+
+func (pj *projector) roleRef(ref *RoleRef) *RoleRef {
+	if ref.Index == nil {
+		return ref
+	}
+	return &RoleRef{Pos: ref.Pos, Name: ref.Name, Index: pj.expr(ref.Index)}
+}
+
+func (pj *projector) expr(e Expr) Expr {
+	switch e := e.(type) {
+	case *Var:
+		if sub, ok := pj.subst[e.Name]; ok {
+			return sub
+		}
+	case *BinExpr:
+		return &BinExpr{Pos: e.Pos, Op: e.Op, X: pj.expr(e.X), Y: pj.expr(e.Y)}
+	}
+	return e
+}
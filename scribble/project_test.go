@@ -0,0 +1,220 @@
+package scribble
+
+import "testing"
+
+func TestProjectNested(t *testing.T) {
+	p := parseFile(t, "testdata/nested.scr")
+	tests := []struct {
+		role  string
+		local string
+	}{
+		{
+			role: "Coordinator",
+			local: `local protocol Nested at Coordinator {
+  foreach A[i:1..k] {
+    foreach A[j:1..k] {
+      foo(int) to A[j];
+    }
+    bar(string) to A[i];
+  }
+}
+`,
+		},
+		{
+			role: "A",
+			local: `local protocol Nested at A[self:1..k] {
+  foreach A[i:1..k] {
+    foo(int) from Coordinator;
+    if self == i {
+      bar(string) from Coordinator;
+    }
+  }
+}
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.role, func(t *testing.T) {
+			l, err := Project(p, test.role)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := l.String(); got != test.local {
+				t.Errorf("expected local type:\n%s\nbut got:\n%s", test.local, got)
+			}
+		})
+	}
+}
+
+func TestProjectPartialRange(t *testing.T) {
+	p, err := Parse("", `global protocol P(param k, role C, role A[1..k]) {
+		foreach A[i:2..k] { ping() from C to A[i]; }
+		pong() from C to A[1];
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := Project(p, "A")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `local protocol P at A[self:1..k] {
+  if self in 2..k {
+    ping() from C;
+  }
+  if self == 1 {
+    pong() from C;
+  }
+}
+`
+	if got := l.String(); got != expected {
+		t.Errorf("expected local type:\n%s\nbut got:\n%s", expected, got)
+	}
+}
+
+func TestProjectChoice(t *testing.T) {
+	p, err := Parse("", `global protocol P(param k, role C, role A[1..k], role B) {
+		foreach A[j:1..k] {
+			choice at C {
+				ok(int) from C to A[j];
+				done() from C to B;
+			} or {
+				fail(string) from C to A[j];
+				done() from C to B;
+			}
+		}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		role  string
+		local string
+	}{
+		{
+			role: "C",
+			local: `local protocol P at C {
+  foreach A[j:1..k] {
+    choice at C {
+      ok(int) to A[j];
+      done() to B;
+    } or {
+      fail(string) to A[j];
+      done() to B;
+    }
+  }
+}
+`,
+		},
+		{
+			role: "A",
+			local: `local protocol P at A[self:1..k] {
+  choice at C {
+    ok(int) from C;
+  } or {
+    fail(string) from C;
+  }
+}
+`,
+		},
+		{
+			role: "B", // same local type in both branches
+			local: `local protocol P at B {
+  foreach A[j:1..k] {
+    done() from C;
+  }
+}
+`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.role, func(t *testing.T) {
+			l, err := Project(p, test.role)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := l.String(); got != test.local {
+				t.Errorf("expected local type:\n%s\nbut got:\n%s", test.local, got)
+			}
+		})
+	}
+}
+
+func TestProjectChoiceNotInformed(t *testing.T) {
+	p, err := Parse("", `global protocol P(role C, role B, role D) {
+		choice at C {
+			ok() from C to B;
+			done() from B to D;
+		} or {
+			fail() from C to B;
+			abort() from B to D;
+		}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Project(p, "D"); err == nil || err.Error() != "4:4: D is not informed of the choice at C" {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if _, err := Project(p, "B"); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+}
+
+func TestRecFSM(t *testing.T) {
+	p, err := Parse("", `global protocol P(param k, role C, role A[1..k]) {
+		rec X {
+			foreach A[i:1..k] { foo() from C to A[i]; }
+			choice at C { more() from C to A[1]; continue X; } or { stop() from C to A[1]; }
+		}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Check(p); err != nil {
+		t.Fatal(err)
+	}
+	l, err := Project(p, "C")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewFSM(l)
+	loop := f.Initial
+	if loop.Kind != ForeachState || loop.Next.Kind != ChoiceState {
+		t.Fatalf("expected foreach then choice but got %+v", loop)
+	}
+	more, stop := loop.Next.Branches[0], loop.Next.Branches[1]
+	if more.Next != loop {
+		t.Errorf("expected continue to go back to foreach but got %+v", more.Next)
+	}
+	if stop.Next.Kind != EndState {
+		t.Errorf("expected stop to end but got %+v", stop.Next)
+	}
+}
+
+func TestNewFSM(t *testing.T) {
+	p := parseFile(t, "testdata/nested.scr")
+	l, err := Project(p, "Coordinator")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := NewFSM(l)
+	// Same state numbering as the final package.
+	s0 := f.States[0]
+	if f.Initial != s0 || s0.Kind != ForeachState || s0.Body.ID != 1 || s0.End.ID != 4 || s0.Next.Kind != EndState {
+		t.Errorf("unexpected outer foreach state %+v", s0)
+	}
+	s1 := f.States[1]
+	if s1.Kind != ForeachState || s1.Body.ID != 2 || s1.End.ID != 5 || s1.Next.ID != 3 {
+		t.Errorf("unexpected inner foreach state %+v", s1)
+	}
+	if s2 := f.States[2]; s2.Kind != SendState || s2.Next != s1.End || s2.Loop("i") != s0 || s2.Loop("j") != s1 {
+		t.Errorf("unexpected inner body state %+v", s2)
+	}
+	if s3 := f.States[3]; s3.Kind != SendState || s3.Next != s0.End || s3.Loop("j") != nil {
+		t.Errorf("unexpected outer body state %+v", s3)
+	}
+	if s4 := f.States[4]; s4.Kind != BodyEndState || s4.Next != s0 {
+		t.Errorf("unexpected body end state %+v", s4)
+	}
+}
@@ -0,0 +1,171 @@
+// Package stacktest checks the foreach stacks of the API styles against a
+// reference model, a slice of states with the top last.
+//
+// Each style adapts its stack to Stack in its tests, and runs the same
+// operations on both with testing/quick and fuzzing:
+//
+//	func TestStackQuick(t *testing.T) { stacktest.Quick(t, newAdapter) }
+//	func FuzzStack(f *testing.F)      { stacktest.Fuzz(f, newAdapter) }
+package stacktest
+
+import (
+	"fmt"
+	"testing"
+	"testing/quick"
+)
+
+// State is a foreach state: the current and last index of the foreach ID.
+type State struct {
+	ID, Curr, Last int
+}
+
+func (state State) String() string {
+	return fmt.Sprintf("{%d: %d/%d}", state.ID, state.Curr, state.Last)
+}
+
+// Snapshot is the content of a stack after an operation.
+type Snapshot struct {
+	Empty  bool    // Empty is the result of isEmpty
+	States []State // States are the states from the bottom of the stack
+	Index  int     // Index is the cached index of the top state
+	Top    int     // Top is the position of the state returned by top, -1 if nil
+	Spare  int     // Spare is the number of states kept past the top in the backing array
+}
+
+// Stack is the foreach stack of an API style.
+type Stack interface {
+	// Push pushes the foreach ID iterating from first to last, first is
+	// always 0 unless the stack is Indexed.
+	Push(ID, first, last int)
+	Increment() // Increment increments the top state
+	Pop()
+	CanEnter() bool // CanEnter is true if the body of the top state can be entered
+	Snapshot() Snapshot
+	String() string
+}
+
+// Indexed is a stack keeping the index values of each foreach (as the
+// generated APIs) rather than counting iterations from 0.
+type Indexed interface {
+	Stack
+	// Find returns the position of the innermost state of the foreach ID.
+	Find(ID int) int
+}
+
+// Iterator is a stack with the hasNext test of the proto style.
+type Iterator interface {
+	Stack
+	HasNext() bool // HasNext is true if the top state has another iteration
+}
+
+// Run applies the operations encoded in ops to s and to the reference
+// model, and returns the first operation after which the stack differs from
+// the model or breaks an invariant. Each pair of bytes is an operation and
+// its argument:
+//
+//	0: push(arg%4, first, last) where first, last is arg/4%4, first+arg/16%4
+//	   if s is Indexed, or 0, arg/4%4 otherwise
+//	1: increment the top state (skipped on an empty stack)
+//	2: pop (skipped on an empty stack)
+//	3: find(arg%4) (skipped if s is not Indexed or no state has the ID)
+func Run(s Stack, ops []byte) error {
+	indexed, isIndexed := s.(Indexed)
+	var model []State
+	for n := 0; n+1 < len(ops); n += 2 {
+		op, arg := ops[n]%4, int(ops[n+1])
+		switch {
+		case op == 0:
+			first, last := 0, arg/4%4
+			if isIndexed {
+				first = arg / 4 % 4
+				last = first + arg/16%4
+			}
+			s.Push(arg%4, first, last)
+			model = append(model, State{ID: arg % 4, Curr: first, Last: last})
+		case op == 1 && len(model) > 0:
+			s.Increment()
+			model[len(model)-1].Curr++
+		case op == 2 && len(model) > 0:
+			s.Pop()
+			model = model[:len(model)-1]
+		case op == 3 && isIndexed:
+			for i := len(model) - 1; i >= 0; i-- {
+				if model[i].ID == arg%4 {
+					if found := indexed.Find(arg % 4); found != i {
+						return fmt.Errorf("op %d: expected find(%d) to be state %d but got %d in %v", n/2, arg%4, i, found, s)
+					}
+					break
+				}
+			}
+		}
+		if err := check(s, model); err != nil {
+			return fmt.Errorf("op %d (%d, %d): %v", n/2, op, arg, err)
+		}
+	}
+	return nil
+}
+
+// check returns an error if s is not the stack of states in model.
+func check(s Stack, model []State) error {
+	snap := s.Snapshot()
+	if snap.Empty != (len(model) == 0) {
+		return fmt.Errorf("expected isEmpty %t for %v", len(model) == 0, s)
+	}
+	if len(snap.States) != len(model) {
+		return fmt.Errorf("expected %d states but got %v", len(model), s)
+	}
+	for i, state := range snap.States {
+		if state != model[i] {
+			return fmt.Errorf("expected state %d to be %v but got %v", i, model[i], state)
+		}
+	}
+	if len(model) == 0 {
+		if snap.Top != -1 {
+			return fmt.Errorf("expected no top of empty %v but got state %d", s, snap.Top)
+		}
+	} else {
+		top := model[len(model)-1]
+		if snap.Index != len(model)-1 || snap.Top != len(model)-1 {
+			return fmt.Errorf("expected top at %d but got %v", len(model)-1, s)
+		}
+		if s.CanEnter() != (top.Curr <= top.Last) {
+			return fmt.Errorf("expected canEnter %t for %v", top.Curr <= top.Last, top)
+		}
+		if it, ok := s.(Iterator); ok && it.HasNext() != (top.Curr < top.Last) {
+			return fmt.Errorf("expected hasNext %t for %v", top.Curr < top.Last, top)
+		}
+	}
+	// Popped states must not be kept in the backing array reused by push.
+	if snap.Spare > 0 {
+		return fmt.Errorf("expected no state past the top but got %d in %v", snap.Spare, s)
+	}
+	return nil
+}
+
+// Quick runs random operations on stacks made by newStack.
+func Quick(t *testing.T, newStack func() Stack) {
+	f := func(ops []byte) bool {
+		if err := Run(newStack(), ops); err != nil {
+			t.Log(err)
+			return false
+		}
+		return true
+	}
+	if err := quick.Check(f, &quick.Config{MaxCount: 1000}); err != nil {
+		t.Error(err)
+	}
+}
+
+// Fuzz fuzzes the operations on stacks made by newStack.
+func Fuzz(f *testing.F, newStack func() Stack) {
+	f.Add([]byte{})
+	f.Add([]byte{0, 1, 2, 0, 1, 0, 2, 0})             // pop to empty, then top
+	f.Add([]byte{0, 1, 0, 2, 2, 0, 0, 3, 1, 0, 2, 0}) // push after pop reuses the slice
+	f.Add([]byte{0, 4, 1, 0, 1, 0, 0, 8, 1, 0, 2, 0, 1, 0, 2, 0})
+	f.Add([]byte{0, 1, 0, 2, 0, 1, 3, 1, 3, 2, 2, 0, 3, 1})
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		if err := Run(newStack(), ops); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
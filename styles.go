@@ -0,0 +1,166 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/nickng/scribble-foreach-experiment/example/nested/a"
+	"github.com/nickng/scribble-foreach-experiment/example/nested/coordinator"
+	"github.com/nickng/scribble-foreach-experiment/final"
+	"github.com/nickng/scribble-foreach-experiment/forrange"
+	"github.com/nickng/scribble-foreach-experiment/fused"
+	"github.com/nickng/scribble-foreach-experiment/nested"
+	"github.com/nickng/scribble-foreach-experiment/proto"
+	"github.com/nickng/scribble-foreach-experiment/recur"
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/value"
+)
+
+// style runs the example protocol with an API style.
+type style struct {
+	name, doc string
+	params    []map[string]int // params are the ProtoParam of the APIs the style runs
+	trace     **trace.Recorder // trace is the Trace of the API, nil if it is not traced
+	run       func()
+}
+
+// styles are run in this order by run.
+var styles = []style{
+	{"forrange", "for-range over the bodies of each foreach", []map[string]int{forrange.ProtoParam}, &forrange.Trace, forrangeRun},
+	{"nested", "nested FSM, foreach bodies are callbacks", []map[string]int{nested.ProtoParam}, &nested.Trace, nestedRun},
+	{"recur", "recur foreach, foreach bodies are named callbacks", []map[string]int{recur.ProtoParam}, &recur.Trace, recurRun},
+	{"recur-inline", "recur foreach, foreach bodies are inline callbacks", []map[string]int{recur.ProtoParam}, &recur.Trace, recurInlineRun},
+	{"proto", "iterator with HasNext, Foreach and EndForeach", []map[string]int{proto.ProtoParam}, &proto.Trace, protoGood},
+	{"generated", "generated APIs of both ends", []map[string]int{coordinator.ProtoParam, a.ProtoParam}, &coordinator.Trace, generatedRun},
+	{"final", "final API of the Coordinator, generated API of A[1..k]", []map[string]int{final.ProtoParam, a.ProtoParam}, &final.Trace, finalRun},
+	{"fused", "fused Foreach entering the body if there is a next index", []map[string]int{fused.ProtoParam}, &fused.Trace, fusedGood},
+	{"value", "final API with value-typed states", []map[string]int{value.ProtoParam}, &value.Trace, valueRun},
+}
+
+func lookupStyle(name string) (style, bool) {
+	for _, st := range styles {
+		if st.name == name {
+			return st, true
+		}
+	}
+	return style{}, false
+}
+
+// defaultParams are the parameters of the example protocol, set for every
+// style unless they are set by -param.
+var defaultParams = map[string]int{"k": 2}
+
+// prepare sets the parameters of the style, and checks that the style can be
+// traced if traceFile is set.
+func (st style) prepare(params paramFlag, traceFile string) error {
+	if traceFile != "" && st.trace == nil {
+		return fmt.Errorf("style %s does not record a trace", st.name)
+	}
+	for name := range params {
+		if _, ok := defaultParams[name]; !ok {
+			return fmt.Errorf("the protocol has no parameter %s", name)
+		}
+	}
+	for _, p := range st.params {
+		for name, v := range defaultParams {
+			p[name] = v
+		}
+		for name, v := range params {
+			p[name] = v
+		}
+	}
+	return nil
+}
+
+// session runs f with the style, and returns the error f panics with if it
+// violates the protocol. The trace of the session is written to traceFile if
+// it is set, also if f violates the protocol.
+func (st style) session(f func(), traceFile string) error {
+	if traceFile == "" {
+		return violation(f)
+	}
+	*st.trace = new(trace.Recorder)
+	defer func() { *st.trace = nil }()
+	err := violation(f)
+	if werr := writeTrace(traceFile, (*st.trace).Events()); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// misuseCase is a misuse of the API of style.
+type misuseCase struct {
+	name, style, doc string
+	run              func()
+}
+
+var misuses = []misuseCase{
+	{"use-twice", "proto", "use the initial state twice", func() {
+		s := new(proto.S0)
+		s.Foreach()
+		s.Foreach()
+	}},
+	{"empty-inner-body", "proto", "protoBad, enter the inner foreach again with an empty body", protoBad},
+	{"premature-exit", "proto", "end the inner foreach after its first iteration (k > 1)", func() {
+		new(proto.S0).Foreach().Foreach().Send_Aj_foo(1).EndForeach()
+	}},
+	{"end-before-foreach", "proto", "end the outer foreach before entering it", func() {
+		new(proto.S0).EndForeach()
+	}},
+	{"foreach-past-last", "proto", "enter the inner foreach k+1 times", func() {
+		s1 := new(proto.S0).Foreach()
+		for j := 1; j <= proto.ProtoParam["k"]+1; j++ {
+			s1 = s1.Foreach().Send_Aj_foo(j)
+		}
+	}},
+	{"fused-loop", "fused", "fusedRun, loop on the result of Foreach without calling it again", fusedRun},
+}
+
+func fusedGood() {
+	// This function is the good use of foreach in the fused API design
+	// The result of Foreach cannot end the loop, as a state is used by the
+	// call which does not enter the body, so each body is entered k times.
+
+	k := fused.ProtoParam["k"]
+	s := new(fused.S0)
+	for j := 1; j <= k; j++ {
+		fmt.Println("Outer loop", j)
+		s1, _ := s.Foreach()
+		for i := 1; i <= k; i++ {
+			fmt.Println("Inner loop", i)
+			s2, _ := s1.Foreach()
+			s1 = s2.Send_Aj_foo(i)
+			fmt.Println("Inner loop end", i)
+		}
+		fmt.Println("End inner foreach, jump back to inner foreach init")
+		s = s1.EndForeach().Send_Ai_bar("outer foreach body")
+		fmt.Println("End of outer foreach")
+		fmt.Println("Outer loop end", j)
+	}
+	s.EndForeach().End()
+}
+
+func valueRun() {
+	// This function is the good use of foreach in the final API design
+	// with value-typed states
+
+	j := 0
+	new(value.Session).Start().Foreach(
+		func(s value.S1) value.S4 {
+			j++
+			fmt.Println("Outer loop", j)
+			i := 0
+			outerBodyEnd := s.
+				Foreach(
+					func(s value.S2) value.S5 {
+						i++
+						fmt.Println("Inner loop", i)
+						innerBodyEnd := s.Send_Aj_foo(i)
+						fmt.Println("Inner loop end", i)
+						return innerBodyEnd
+					}).
+				Send_Ai_bar("outer foreach body")
+			fmt.Println("End of outer foreach")
+			fmt.Println("Outer loop end", j)
+			return outerBodyEnd
+		}).End()
+}
@@ -0,0 +1,144 @@
+package trace
+
+// This file contains the sequence diagram rendering of recorded events.
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"unicode"
+)
+
+// syntax is the syntax of a sequence diagram language.
+type syntax struct {
+	header, footer string
+	participant    func(id, name string) string
+	message        func(from, to, msg string) string
+	loop           func(label string) string
+	end            string
+	indent         string
+}
+
+var mermaid = syntax{
+	header: "sequenceDiagram\n",
+	participant: func(id, name string) string {
+		if id == name {
+			return "participant " + id
+		}
+		return fmt.Sprintf("participant %s as %s", id, name)
+	},
+	message: func(from, to, msg string) string {
+		// ; and # end a message in Mermaid, write them as entity codes.
+		msg = strings.NewReplacer("#", "#35;", ";", "#59;").Replace(msg)
+		return fmt.Sprintf("%s->>%s: %s", from, to, msg)
+	},
+	loop:   func(label string) string { return "loop " + label },
+	end:    "end",
+	indent: "    ",
+}
+
+var plantUML = syntax{
+	header: "@startuml\n",
+	footer: "@enduml\n",
+	participant: func(id, name string) string {
+		if id == name {
+			return "participant " + id
+		}
+		return fmt.Sprintf("participant %q as %s", name, id)
+	},
+	message: func(from, to, msg string) string {
+		return fmt.Sprintf("%s -> %s : %s", from, to, msg)
+	},
+	loop:   func(label string) string { return "loop " + label },
+	end:    "end",
+	indent: "  ",
+}
+
+// Mermaid writes events as a Mermaid sequence diagram.
+// Each iteration of a foreach is a loop box labelled with the index value.
+func Mermaid(w io.Writer, events []Event) error {
+	return render(w, mermaid, events)
+}
+
+// PlantUML writes events as a PlantUML sequence diagram.
+// Each iteration of a foreach is a loop box labelled with the index value.
+func PlantUML(w io.Writer, events []Event) error {
+	return render(w, plantUML, events)
+}
+
+// render writes the diagram of events in syntax.
+//
+// Messages are drawn from Send events; a Recv is only drawn if its sender
+// was not recorded, so recording both ends of a session does not draw each
+// message twice.
+func render(w io.Writer, syn syntax, events []Event) error {
+	var (
+		b       strings.Builder
+		names   []string
+		ids     = make(map[string]string)
+		senders = make(map[string]bool)
+	)
+	participant := func(name string) {
+		if _, ok := ids[name]; !ok {
+			ids[name] = participantID(name)
+			names = append(names, name)
+		}
+	}
+	for _, e := range events {
+		if e.Kind == Send {
+			senders[e.From] = true
+		}
+		if e.Kind == Send || e.Kind == Recv {
+			participant(e.From)
+			participant(e.To)
+		}
+	}
+
+	b.WriteString(syn.header)
+	for _, name := range names {
+		fmt.Fprintf(&b, "%s%s\n", syn.indent, syn.participant(ids[name], name))
+	}
+	var loops []int // loops are the foreach IDs of the open loop boxes
+	line := func(s string) {
+		fmt.Fprintf(&b, "%s%s\n", strings.Repeat(syn.indent, len(loops)+1), s)
+	}
+	closeLoop := func() {
+		loops = loops[:len(loops)-1]
+		line(syn.end)
+	}
+	for _, e := range events {
+		switch e.Kind {
+		case Iterate:
+			if len(loops) > 0 && loops[len(loops)-1] == e.Loop {
+				closeLoop() // next iteration of the same loop
+			}
+			line(syn.loop(fmt.Sprintf("%s = %d", e.Index, e.Value)))
+			loops = append(loops, e.Loop)
+		case Exit:
+			if len(loops) > 0 && loops[len(loops)-1] == e.Loop {
+				closeLoop()
+			}
+		case Send, Recv:
+			if e.Kind == Recv && senders[e.From] {
+				continue
+			}
+			line(syn.message(ids[e.From], ids[e.To], fmt.Sprintf("%s(%s)", e.Label, e.Payload)))
+		}
+	}
+	for len(loops) > 0 {
+		closeLoop()
+	}
+	b.WriteString(syn.footer)
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// participantID returns name as an identifier, e.g. A[1] is A1.
+func participantID(name string) string {
+	return strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_' {
+			return r
+		}
+		return -1
+	}, name)
+}
@@ -0,0 +1,105 @@
+package trace
+
+// This file contains the expected trace of an FSM.
+
+import (
+	"fmt"
+
+	"github.com/nickng/scribble-foreach-experiment/scribble"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// Payload returns the payload sent by label, given the values of the
+// protocol parameters and index variables in env.
+type Payload func(label string, env map[string]int) string
+
+// Expected returns the trace of a session of the reference FSM f, with
+// the protocol parameters params and the payloads of payload. For an indexed
+// role, params must also have the index of the participant as scribble.Self.
+//
+// The trace is the events an API records for the same session: an Iterate
+// for each iteration of a foreach, an Exit when a foreach exits, a Send or
+// Recv for each message, then End.
+func Expected(f *scribble.FSM, params map[string]int, payload Payload) ([]Event, error) {
+	env := make(map[string]int)
+	for name, value := range params {
+		env[name] = value
+	}
+	eval := func(e scribble.Expr) (int, error) { return scribble.Eval(e, env) }
+	role := f.Local.Role
+	self := role.Name
+	if role.Indexed() {
+		self = transport.Name(role.Name, env[scribble.Self])
+	}
+	participant := func(ref *scribble.RoleRef) (string, error) {
+		if ref.Index == nil {
+			return ref.Name, nil
+		}
+		index, err := eval(ref.Index)
+		return transport.Name(ref.Name, index), err
+	}
+
+	var events []Event
+	// check enters the body of the foreach s, or exits it.
+	check := func(s *scribble.State) (*scribble.State, error) {
+		loop := s.Stmt.(*scribble.LocalForeach)
+		hi, err := eval(loop.Hi)
+		if err != nil {
+			return nil, err
+		}
+		if env[loop.Index] <= hi {
+			events = append(events, Event{Kind: Iterate, State: s.ID, Loop: s.ID, Index: loop.Index, Value: env[loop.Index]})
+			return s.Body, nil
+		}
+		delete(env, loop.Index)
+		events = append(events, Event{Kind: Exit, State: s.ID, Loop: s.ID})
+		return s.Next, nil
+	}
+
+	s := f.Initial
+	for s.Kind != scribble.EndState {
+		var err error
+		switch s.Kind {
+		case scribble.ForeachState:
+			loop := s.Stmt.(*scribble.LocalForeach)
+			if env[loop.Index], err = eval(loop.Lo); err == nil {
+				s, err = check(s)
+			}
+		case scribble.BodyEndState:
+			env[s.Next.Stmt.(*scribble.LocalForeach).Index]++
+			s, err = check(s.Next)
+		case scribble.SendState:
+			send := s.Stmt.(*scribble.Send)
+			var to string
+			if to, err = participant(send.To); err == nil {
+				events = append(events, Event{Kind: Send, State: s.ID, From: self, To: to, Label: send.Label, Payload: payload(send.Label, env)})
+				s = s.Next
+			}
+		case scribble.RecvState:
+			recv := s.Stmt.(*scribble.Recv)
+			var from string
+			if from, err = participant(recv.From); err == nil {
+				events = append(events, Event{Kind: Recv, State: s.ID, From: from, To: self, Label: recv.Label, Payload: payload(recv.Label, env)})
+				s = s.Next
+			}
+		case scribble.IfState:
+			guard := s.Stmt.(*scribble.If)
+			var lo, hi int
+			if lo, err = eval(guard.Lo); err == nil {
+				if hi, err = eval(guard.Hi); err == nil {
+					if lo <= env[scribble.Self] && env[scribble.Self] <= hi {
+						s = s.Body
+					} else {
+						s = s.Next
+					}
+				}
+			}
+		default:
+			return nil, fmt.Errorf("S%d: cannot choose a branch of a choice", s.ID)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return append(events, Event{Kind: End}), nil
+}
@@ -0,0 +1,141 @@
+// Package trace records the transitions made by the foreach APIs, and renders
+// recorded sessions as sequence diagrams.
+//
+// A Recorder is attached to an API (e.g. proto.Trace) to record a session:
+//
+//	rec := new(trace.Recorder)
+//	proto.Trace = rec
+//	protoGood()
+//	trace.Mermaid(os.Stdout, rec.Events())
+//
+// The same events are printed one per line by Dump for debugging, or written
+// as JSON lines by JSON for other tools.
+package trace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// Kind is the kind of a transition.
+type Kind int
+
+const (
+	Iterate Kind = iota // Iterate enters a foreach body with the next index
+	Exit                // Exit leaves a foreach
+	Send                // Send sends a message
+	Recv                // Recv receives a message
+	End                 // End is the end of the protocol
+)
+
+var kindNames = [...]string{"iterate", "exit", "send", "recv", "end"}
+
+func (k Kind) String() string {
+	if int(k) < len(kindNames) {
+		return kindNames[k]
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// MarshalText encodes k by its name, e.g. "iterate".
+func (k Kind) MarshalText() ([]byte, error) {
+	if int(k) < len(kindNames) {
+		return []byte(kindNames[k]), nil
+	}
+	return nil, fmt.Errorf("unknown kind %d", int(k))
+}
+
+// UnmarshalText decodes a kind by its name.
+func (k *Kind) UnmarshalText(text []byte) error {
+	for i, name := range kindNames {
+		if name == string(text) {
+			*k = Kind(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown kind %q", text)
+}
+
+// Event is a transition made from a state of an API.
+type Event struct {
+	Kind  Kind `json:"kind"`
+	State int  `json:"state"` // State is the ID of the state the transition is made from, except for End
+
+	// Loop, Index and Value are the foreach ID, index variable and index value
+	// of an Iterate, e.g. foreach 1 with j = 2, only Loop is set for Exit.
+	// Loop 0 is omitted in JSON as in the events without a loop.
+	Loop  int    `json:"loop,omitempty"`
+	Index string `json:"index,omitempty"`
+	Value int    `json:"value,omitempty"`
+
+	// From, To, Label and Payload are the message of a Send or Recv, e.g.
+	// Coordinator to A[2] foo(2).
+	From    string `json:"from,omitempty"`
+	To      string `json:"to,omitempty"`
+	Label   string `json:"label,omitempty"`
+	Payload string `json:"payload,omitempty"`
+}
+
+func (e Event) String() string {
+	switch e.Kind {
+	case Iterate:
+		return fmt.Sprintf("S%d iterate foreach %d: %s = %d", e.State, e.Loop, e.Index, e.Value)
+	case Exit:
+		return fmt.Sprintf("S%d exit foreach %d", e.State, e.Loop)
+	case Send, Recv:
+		return fmt.Sprintf("S%d %s %s -> %s: %s(%s)", e.State, e.Kind, e.From, e.To, e.Label, e.Payload)
+	case End:
+		return "SEnd end"
+	}
+	return fmt.Sprintf("S%d %s", e.State, e.Kind)
+}
+
+// Recorder records events, it is safe for concurrent use.
+// A nil *Recorder discards all events, so APIs can record unconditionally.
+type Recorder struct {
+	mu     sync.Mutex
+	events []Event
+}
+
+// Record appends e to the recorded events.
+func (r *Recorder) Record(e Event) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	r.events = append(r.events, e)
+	r.mu.Unlock()
+}
+
+// Events returns a copy of the recorded events in order, or nil if r is nil.
+func (r *Recorder) Events() []Event {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]Event(nil), r.events...)
+}
+
+// Dump writes events to w, one per line.
+func Dump(w io.Writer, events []Event) error {
+	for _, e := range events {
+		if _, err := fmt.Fprintln(w, e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// JSON writes events to w as JSON, one event per line.
+func JSON(w io.Writer, events []Event) error {
+	enc := json.NewEncoder(w)
+	for _, e := range events {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
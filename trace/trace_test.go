@@ -0,0 +1,157 @@
+package trace_test
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/proto"
+	"github.com/nickng/scribble-foreach-experiment/trace"
+)
+
+// record runs the proto API as in protoGood with k = 2.
+func record(t *testing.T) []trace.Event {
+	t.Helper()
+	rec := new(trace.Recorder)
+	proto.ProtoParam["k"] = 2
+	proto.Trace = rec
+	defer func() { proto.Trace = nil }()
+
+	s := new(proto.S0)
+	for s.HasNext() {
+		s1 := s.Foreach()
+		i := 0
+		for s1.HasNext() {
+			i++
+			s1 = s1.Foreach().Send_Aj_foo(i)
+		}
+		s = s1.EndForeach().Send_Ai_bar("bar")
+	}
+	s.EndForeach().End()
+	return rec.Events()
+}
+
+func TestMermaid(t *testing.T) {
+	var b strings.Builder
+	if err := trace.Mermaid(&b, record(t)); err != nil {
+		t.Fatal(err)
+	}
+	expected := `sequenceDiagram
+    participant Coordinator
+    participant A1 as A[1]
+    participant A2 as A[2]
+    loop i = 1
+        loop j = 1
+            Coordinator->>A1: foo(1)
+        end
+        loop j = 2
+            Coordinator->>A2: foo(2)
+        end
+        Coordinator->>A1: bar(bar)
+    end
+    loop i = 2
+        loop j = 1
+            Coordinator->>A1: foo(1)
+        end
+        loop j = 2
+            Coordinator->>A2: foo(2)
+        end
+        Coordinator->>A2: bar(bar)
+    end
+`
+	if got := b.String(); got != expected {
+		t.Errorf("expected diagram:\n%s\nbut got:\n%s", expected, got)
+	}
+}
+
+func TestPlantUML(t *testing.T) {
+	var b strings.Builder
+	if err := trace.PlantUML(&b, record(t)); err != nil {
+		t.Fatal(err)
+	}
+	got := b.String()
+	for _, line := range []string{
+		"@startuml\n",
+		"  participant \"A[1]\" as A1\n",
+		"  loop i = 2\n    loop j = 1\n      Coordinator -> A1 : foo(1)\n    end\n",
+		"    Coordinator -> A2 : bar(bar)\n  end\n@enduml\n",
+	} {
+		if !strings.Contains(got, line) {
+			t.Errorf("expected %q in diagram:\n%s", line, got)
+		}
+	}
+}
+
+func TestDump(t *testing.T) {
+	var b strings.Builder
+	if err := trace.Dump(&b, record(t)[:3]); err != nil {
+		t.Fatal(err)
+	}
+	expected := "S0 iterate foreach 0: i = 1\nS1 iterate foreach 1: j = 1\nS2 send Coordinator -> A[1]: foo(1)\n"
+	if got := b.String(); got != expected {
+		t.Errorf("expected events:\n%s\nbut got:\n%s", expected, got)
+	}
+}
+
+func TestJSON(t *testing.T) {
+	events := record(t)
+	var b strings.Builder
+	if err := trace.JSON(&b, events[:3]); err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"kind":"iterate","state":0,"index":"i","value":1}
+{"kind":"iterate","state":1,"loop":1,"index":"j","value":1}
+{"kind":"send","state":2,"from":"Coordinator","to":"A[1]","label":"foo","payload":"1"}
+`
+	if got := b.String(); got != expected {
+		t.Errorf("expected events:\n%s\nbut got:\n%s", expected, got)
+	}
+
+	// Every event is read back as it was recorded.
+	b.Reset()
+	if err := trace.JSON(&b, events); err != nil {
+		t.Fatal(err)
+	}
+	dec := json.NewDecoder(strings.NewReader(b.String()))
+	for i, e := range events {
+		var got trace.Event
+		if err := dec.Decode(&got); err != nil {
+			t.Fatalf("event %d: %v", i, err)
+		}
+		if got != e {
+			t.Errorf("event %d: expected %v but got %v", i, e, got)
+		}
+	}
+}
+
+func TestNilRecorder(t *testing.T) {
+	var rec *trace.Recorder
+	rec.Record(trace.Event{Kind: trace.End})
+	if events := rec.Events(); events != nil {
+		t.Errorf("expected no events from a nil recorder but got %v", events)
+	}
+}
+
+// TestRecvBothEnds checks that a message recorded by both ends is drawn once,
+// and a message only recorded by the receiver is still drawn.
+func TestRecvBothEnds(t *testing.T) {
+	events := []trace.Event{
+		{Kind: trace.Send, From: "C", To: "A[1]", Label: "foo", Payload: "1"},
+		{Kind: trace.Recv, From: "C", To: "A[1]", Label: "foo", Payload: "1"},
+		{Kind: trace.Recv, From: "B", To: "A[1]", Label: "baz", Payload: "a;b"},
+	}
+	var b strings.Builder
+	if err := trace.Mermaid(&b, events); err != nil {
+		t.Fatal(err)
+	}
+	expected := `sequenceDiagram
+    participant C
+    participant A1 as A[1]
+    participant B
+    C->>A1: foo(1)
+    B->>A1: baz(a#59;b)
+`
+	if got := b.String(); got != expected {
+		t.Errorf("expected diagram:\n%s\nbut got:\n%s", expected, got)
+	}
+}
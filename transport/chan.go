@@ -0,0 +1,90 @@
+package transport
+
+// This file contains the in-memory transport.
+
+import "sync"
+
+// Chan is an in-memory transport for participants in the same process.
+// Each ordered pair of participants is connected by a buffered Go channel.
+type Chan struct {
+	mu     sync.Mutex
+	buffer int
+	chans  map[link]chan Message
+	closed map[string]bool // closed are the participants which closed their Conn
+}
+
+// link is a direction between two participants.
+type link struct{ from, to string }
+
+// NewChan returns an in-memory transport, buffer is the number of messages
+// that can be sent from one participant to another before Send blocks. With
+// a buffer of 0, Send waits for the message to be received.
+func NewChan(buffer int) *Chan {
+	return &Chan{
+		buffer: buffer,
+		chans:  make(map[link]chan Message),
+		closed: make(map[string]bool),
+	}
+}
+
+// Conn returns the connection of participant self.
+func (t *Chan) Conn(self string) Conn {
+	return &chanConn{t: t, self: self}
+}
+
+// ch returns the channel from one participant to another.
+func (t *Chan) ch(from, to string) chan Message {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	l := link{from: from, to: to}
+	ch, ok := t.chans[l]
+	if !ok {
+		ch = make(chan Message, t.buffer)
+		t.chans[l] = ch
+		if t.closed[from] {
+			close(ch)
+		}
+	}
+	return ch
+}
+
+func (t *Chan) close(self string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.closed[self] {
+		return ErrClosed
+	}
+	t.closed[self] = true
+	for l, ch := range t.chans {
+		if l.from == self {
+			close(ch)
+		}
+	}
+	return nil
+}
+
+type chanConn struct {
+	t    *Chan
+	self string
+}
+
+func (c *chanConn) Send(to string, m Message) error {
+	c.t.mu.Lock()
+	closed := c.t.closed[c.self]
+	c.t.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	c.t.ch(c.self, to) <- m
+	return nil
+}
+
+func (c *chanConn) Recv(from string) (Message, error) {
+	m, ok := <-c.t.ch(from, c.self)
+	if !ok {
+		return Message{}, ErrClosed
+	}
+	return m, nil
+}
+
+func (c *chanConn) Close() error { return c.t.close(c.self) }
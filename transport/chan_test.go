@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestChanOrder(t *testing.T) {
+	tr := NewChan(0)
+	c := tr.Conn("C")
+
+	var wg sync.WaitGroup
+	got := make([][]interface{}, 3)
+	for j := 1; j <= 2; j++ {
+		wg.Add(1)
+		go func(j int, conn Conn) {
+			defer wg.Done()
+			for {
+				m, err := conn.Recv("C")
+				if err == ErrClosed {
+					return
+				} else if err != nil {
+					t.Error(err)
+					return
+				}
+				got[j] = append(got[j], m.Payload...)
+			}
+		}(j, tr.Conn(Name("A", j)))
+	}
+	for i := 1; i <= 3; i++ {
+		for j := 1; j <= 2; j++ {
+			if err := c.Send(Name("A", j), Message{Label: "foo", Payload: []interface{}{10*j + i}}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	wg.Wait()
+
+	for j, expected := range [][]interface{}{1: {11, 12, 13}, 2: {21, 22, 23}} {
+		if len(got[j]) != len(expected) {
+			t.Fatalf("A[%d] expected %v but got %v", j, expected, got[j])
+		}
+		for i := range expected {
+			if got[j][i] != expected[i] {
+				t.Errorf("A[%d] expected %v but got %v", j, expected, got[j])
+			}
+		}
+	}
+}
+
+func TestChanClosed(t *testing.T) {
+	tr := NewChan(1)
+	c, a := tr.Conn("C"), tr.Conn("A")
+	if err := c.Send("A", Message{Label: "last"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send("A", Message{Label: "foo"}); err != ErrClosed {
+		t.Errorf("expected %v but got %v", ErrClosed, err)
+	}
+	if err := c.Close(); err != ErrClosed {
+		t.Errorf("expected %v but got %v", ErrClosed, err)
+	}
+	// Pending messages are still delivered after close.
+	if m, err := a.Recv("C"); err != nil || m.Label != "last" {
+		t.Errorf("expected last but got %v, %v", m, err)
+	}
+	if _, err := a.Recv("C"); err != ErrClosed {
+		t.Errorf("expected %v but got %v", ErrClosed, err)
+	}
+	// A participant closed before the link is used.
+	b := tr.Conn("B")
+	b.Close()
+	if _, err := a.Recv("B"); err != ErrClosed {
+		t.Errorf("expected %v but got %v", ErrClosed, err)
+	}
+}
@@ -0,0 +1,411 @@
+package transport
+
+// This file contains the codecs of messages on the wire.
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sync"
+)
+
+// Codec encodes and decodes messages on the wire.
+//
+// Payloads keep their Go types through a codec: a payload decoded by the
+// receiver has the same type as the payload sent, e.g. an int is decoded as
+// an int (not a float64), as long as the type is registered with Register
+// by both sides.
+type Codec interface {
+	Marshal(m Message) ([]byte, error)
+	Unmarshal(data []byte) (Message, error)
+}
+
+var (
+	// Gob encodes messages with encoding/gob, for Go-only sessions.
+	Gob Codec = gobCodec{}
+
+	// JSON encodes messages as JSON, with the type name of each payload,
+	// e.g. {"label":"foo","payload":[{"type":"int","value":1}]}.
+	JSON Codec = jsonCodec{}
+
+	// Binary is a compact binary encoding of messages. It supports payloads
+	// of booleans, numbers, strings, and slices and structs of these.
+	Binary Codec = binaryCodec{}
+)
+
+// registry maps the names of payload types to their types.
+var registry = struct {
+	sync.RWMutex
+	types map[string]reflect.Type
+}{types: make(map[string]reflect.Type)}
+
+// basics are the payload types registered by default, the index of a type
+// is its tag in the Binary codec.
+var basics = []interface{}{
+	int(0), int8(0), int16(0), int32(0), int64(0),
+	uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+	float32(0), float64(0), "", false,
+}
+
+func init() {
+	for _, v := range basics {
+		Register(v)
+	}
+}
+
+// Register records the type of value as a payload type, so that payloads
+// of the type can be decoded. Basic types are registered by default.
+func Register(value interface{}) {
+	t := reflect.TypeOf(value)
+	registry.Lock()
+	registry.types[t.String()] = t
+	registry.Unlock()
+	gob.Register(value)
+}
+
+func lookupType(name string) (reflect.Type, error) {
+	registry.RLock()
+	defer registry.RUnlock()
+	t, ok := registry.types[name]
+	if !ok {
+		return nil, fmt.Errorf("transport: payload type %s is not registered", name)
+	}
+	return t, nil
+}
+
+type gobCodec struct{}
+
+func (gobCodec) Marshal(m Message) ([]byte, error) {
+	for i := range m.Payload {
+		if err := nilPayload(m, i); err != nil {
+			return nil, err
+		}
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(m); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gobCodec) Unmarshal(data []byte) (Message, error) {
+	var m Message
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&m)
+	return m, err
+}
+
+type jsonCodec struct{}
+
+type jsonMessage struct {
+	Label   string        `json:"label"`
+	Payload []jsonPayload `json:"payload,omitempty"`
+}
+
+type jsonPayload struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// nilPayload returns an error if the payload i of m is nil, which has no
+// type to decode it with.
+func nilPayload(m Message, i int) error {
+	if m.Payload[i] == nil {
+		return fmt.Errorf("transport: payload %d of %s is nil", i+1, m.Label)
+	}
+	return nil
+}
+
+func (jsonCodec) Marshal(m Message) ([]byte, error) {
+	jm := jsonMessage{Label: m.Label, Payload: make([]jsonPayload, len(m.Payload))}
+	for i, v := range m.Payload {
+		if err := nilPayload(m, i); err != nil {
+			return nil, err
+		}
+		value, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		jm.Payload[i] = jsonPayload{Type: reflect.TypeOf(v).String(), Value: value}
+	}
+	return json.Marshal(jm)
+}
+
+func (jsonCodec) Unmarshal(data []byte) (Message, error) {
+	var jm jsonMessage
+	if err := json.Unmarshal(data, &jm); err != nil {
+		return Message{}, err
+	}
+	m := Message{Label: jm.Label}
+	for _, p := range jm.Payload {
+		t, err := lookupType(p.Type)
+		if err != nil {
+			return Message{}, err
+		}
+		v := reflect.New(t)
+		if err := json.Unmarshal(p.Value, v.Interface()); err != nil {
+			return Message{}, err
+		}
+		m.Payload = append(m.Payload, v.Elem().Interface())
+	}
+	return m, nil
+}
+
+// binaryCodec encodes a message as the label, the number of payloads, then
+// each payload as its type and value. The type is the index of a basic type
+// plus one, or 0 followed by the registered type name. Lengths and integers
+// are varints.
+type binaryCodec struct{}
+
+var errShortData = errors.New("transport: binary message too short")
+
+// maxBinarySlice is the maximum length of a slice decoded by Binary, which
+// also bounds slices of elements encoded in 0 bytes, e.g. struct{}.
+const maxBinarySlice = 1 << 20
+
+func (binaryCodec) Marshal(m Message) ([]byte, error) {
+	var e binaryEncoder
+	e.string(m.Label)
+	e.uvarint(uint64(len(m.Payload)))
+	for i, v := range m.Payload {
+		if err := nilPayload(m, i); err != nil {
+			return nil, err
+		}
+		t := reflect.TypeOf(v)
+		if tag := basicTag(t); tag > 0 {
+			e.uvarint(uint64(tag))
+		} else {
+			e.uvarint(0)
+			e.string(t.String())
+		}
+		if err := e.value(reflect.ValueOf(v)); err != nil {
+			return nil, err
+		}
+	}
+	return e.buf, nil
+}
+
+func (binaryCodec) Unmarshal(data []byte) (Message, error) {
+	d := binaryDecoder{buf: data}
+	var m Message
+	m.Label = d.string()
+	n := d.uvarint()
+	for i := uint64(0); i < n && d.err == nil; i++ {
+		var t reflect.Type
+		if tag := d.uvarint(); tag > 0 && tag <= uint64(len(basics)) {
+			t = reflect.TypeOf(basics[tag-1])
+		} else if tag > 0 {
+			return Message{}, fmt.Errorf("transport: unknown binary type tag %d", tag)
+		} else {
+			var err error
+			if t, err = lookupType(d.string()); err != nil {
+				return Message{}, err
+			}
+		}
+		v := reflect.New(t).Elem()
+		d.value(v)
+		m.Payload = append(m.Payload, v.Interface())
+	}
+	if d.err != nil {
+		return Message{}, d.err
+	}
+	if len(d.buf) > 0 {
+		return Message{}, fmt.Errorf("transport: %d bytes after binary message", len(d.buf))
+	}
+	return m, nil
+}
+
+// basicTag returns the tag of a basic type t, or 0 if t is not basic.
+func basicTag(t reflect.Type) int {
+	for i, v := range basics {
+		if reflect.TypeOf(v) == t {
+			return i + 1
+		}
+	}
+	return 0
+}
+
+type binaryEncoder struct {
+	buf []byte
+}
+
+func (e *binaryEncoder) uvarint(x uint64) { e.buf = binary.AppendUvarint(e.buf, x) }
+func (e *binaryEncoder) varint(x int64)   { e.buf = binary.AppendVarint(e.buf, x) }
+
+func (e *binaryEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *binaryEncoder) value(v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Bool:
+		if v.Bool() {
+			e.buf = append(e.buf, 1)
+		} else {
+			e.buf = append(e.buf, 0)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.varint(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		e.uvarint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(v.Float()))
+	case reflect.String:
+		e.string(v.String())
+	case reflect.Slice:
+		e.uvarint(uint64(v.Len()))
+		for i := 0; i < v.Len(); i++ {
+			if err := e.value(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				if err := e.value(v.Field(i)); err != nil {
+					return err
+				}
+			}
+		}
+	default:
+		return fmt.Errorf("transport: cannot encode %s in binary", v.Type())
+	}
+	return nil
+}
+
+// binaryDecoder decodes from buf, and keeps the first error.
+type binaryDecoder struct {
+	buf []byte
+	err error
+}
+
+func (d *binaryDecoder) uvarint() uint64 {
+	x, n := binary.Uvarint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+func (d *binaryDecoder) varint() int64 {
+	x, n := binary.Varint(d.buf)
+	if n <= 0 {
+		d.fail()
+		return 0
+	}
+	d.buf = d.buf[n:]
+	return x
+}
+
+func (d *binaryDecoder) bytes(n uint64) []byte {
+	if uint64(len(d.buf)) < n {
+		d.fail()
+		return nil
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b
+}
+
+func (d *binaryDecoder) string() string { return string(d.bytes(d.uvarint())) }
+
+func (d *binaryDecoder) fail() {
+	if d.err == nil {
+		d.err = errShortData
+	}
+	d.buf = nil
+}
+
+// overflow fails decoding with the value x which does not fit in type t.
+func (d *binaryDecoder) overflow(x interface{}, t reflect.Type) {
+	if d.err == nil {
+		d.err = fmt.Errorf("transport: binary value %v overflows %s", x, t)
+	}
+	d.buf = nil
+}
+
+// value decodes into v, which has a type supported by binaryEncoder.
+func (d *binaryDecoder) value(v reflect.Value) {
+	if d.err != nil {
+		return
+	}
+	switch v.Kind() {
+	case reflect.Bool:
+		if b := d.bytes(1); b != nil {
+			v.SetBool(b[0] == 1)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if x := d.varint(); v.OverflowInt(x) {
+			d.overflow(x, v.Type())
+		} else {
+			v.SetInt(x)
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if x := d.uvarint(); v.OverflowUint(x) {
+			d.overflow(x, v.Type())
+		} else {
+			v.SetUint(x)
+		}
+	case reflect.Float32, reflect.Float64:
+		if b := d.bytes(8); b != nil {
+			if x := math.Float64frombits(binary.BigEndian.Uint64(b)); v.OverflowFloat(x) {
+				d.overflow(x, v.Type())
+			} else {
+				v.SetFloat(x)
+			}
+		}
+	case reflect.String:
+		v.SetString(d.string())
+	case reflect.Slice:
+		n := d.uvarint()
+		if n == 0 {
+			return // empty slices are decoded as nil, as in gob
+		}
+		if n > maxBinarySlice {
+			d.err = fmt.Errorf("transport: binary slice of %d elements, more than %d", n, maxBinarySlice)
+			return
+		}
+		if size := minSize(v.Type().Elem()); size > 0 && n > uint64(len(d.buf))/size {
+			d.fail()
+			return
+		}
+		s := reflect.MakeSlice(v.Type(), int(n), int(n))
+		for i := 0; i < int(n); i++ {
+			d.value(s.Index(i))
+		}
+		v.Set(s)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if v.Type().Field(i).IsExported() {
+				d.value(v.Field(i))
+			}
+		}
+	default:
+		d.err = fmt.Errorf("transport: cannot decode %s in binary", v.Type())
+	}
+}
+
+// minSize returns the minimum number of bytes of a value of type t encoded
+// by binaryEncoder.
+func minSize(t reflect.Type) uint64 {
+	switch t.Kind() {
+	case reflect.Float32, reflect.Float64:
+		return 8
+	case reflect.Struct:
+		var size uint64
+		for i := 0; i < t.NumField(); i++ {
+			if t.Field(i).IsExported() {
+				size += minSize(t.Field(i).Type)
+			}
+		}
+		return size
+	}
+	return 1 // a bool, a varint, or the length of a string or slice
+}
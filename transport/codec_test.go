@@ -0,0 +1,197 @@
+package transport
+
+import (
+	"encoding/binary"
+	"math"
+	"reflect"
+	"testing"
+)
+
+type point struct {
+	X, Y int
+	Name string
+	Tags []string
+}
+
+type segment struct {
+	From, To point
+	Weight   float64
+	Directed bool
+}
+
+func init() {
+	Register(point{})
+	Register(segment{})
+	Register([]struct{}{})
+}
+
+var codecs = []struct {
+	name  string
+	codec Codec
+}{
+	{"gob", Gob},
+	{"json", JSON},
+	{"binary", Binary},
+}
+
+var codecMessages = []Message{
+	{Label: "start"},
+	{Label: "foo", Payload: []interface{}{1}},
+	{Label: "foo", Payload: []interface{}{-42}},
+	{Label: "bar", Payload: []interface{}{"hello, A[2]"}},
+	{Label: "bar", Payload: []interface{}{""}},
+	{Label: "baz", Payload: []interface{}{3, "three", int64(1) << 40, uint8(7), true, 0.5}},
+	{Label: "point", Payload: []interface{}{point{X: 1, Y: -2, Name: "p", Tags: []string{"a", "b"}}}},
+	{Label: "segment", Payload: []interface{}{segment{From: point{X: 1}, To: point{Y: 2}, Weight: 1.5, Directed: true}, 2}},
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	for _, c := range codecs {
+		for _, m := range codecMessages {
+			data, err := c.codec.Marshal(m)
+			if err != nil {
+				t.Errorf("%s: cannot marshal %v: %v", c.name, m, err)
+				continue
+			}
+			got, err := c.codec.Unmarshal(data)
+			if err != nil {
+				t.Errorf("%s: cannot unmarshal %v: %v", c.name, m, err)
+				continue
+			}
+			if !reflect.DeepEqual(m, got) {
+				t.Errorf("%s: expected %#v but got %#v", c.name, m, got)
+			}
+		}
+	}
+}
+
+func TestCodecUnregistered(t *testing.T) {
+	type unregistered struct{ X int }
+	m := Message{Label: "foo", Payload: []interface{}{unregistered{1}}}
+	for _, c := range []struct {
+		name  string
+		codec Codec
+	}{{"json", JSON}, {"binary", Binary}} {
+		data, err := c.codec.Marshal(m)
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if _, err := c.codec.Unmarshal(data); err == nil {
+			t.Errorf("%s: expected error decoding unregistered type", c.name)
+		}
+	}
+}
+
+func TestBinaryCorrupt(t *testing.T) {
+	data, err := Binary.Marshal(Message{Label: "foo", Payload: []interface{}{point{X: 1, Tags: []string{"a"}}, 0.5}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < len(data); i++ {
+		if _, err := Binary.Unmarshal(data[:i]); err == nil {
+			t.Errorf("expected error decoding %d of %d bytes", i, len(data))
+		}
+	}
+	if _, err := Binary.Unmarshal(append(data, 0)); err == nil {
+		t.Error("expected error for trailing bytes")
+	}
+	if _, err := Binary.Marshal(Message{Label: "foo", Payload: []interface{}{map[string]int{}}}); err == nil {
+		t.Error("expected error encoding a map")
+	}
+}
+
+func TestCodecNilPayload(t *testing.T) {
+	m := Message{Label: "foo", Payload: []interface{}{1, nil}}
+	for _, c := range codecs {
+		if _, err := c.codec.Marshal(m); err == nil || err.Error() != "transport: payload 2 of foo is nil" {
+			t.Errorf("%s: expected error for a nil payload but got %v", c.name, err)
+		}
+	}
+}
+
+// TestBinarySliceLength checks that slices of elements encoded in 0 bytes
+// are decoded, and that the length of a slice is bounded.
+func TestBinarySliceLength(t *testing.T) {
+	m := Message{Label: "empty", Payload: []interface{}{make([]struct{}, 3)}}
+	data, err := Binary.Marshal(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := Binary.Unmarshal(data); err != nil || !reflect.DeepEqual(m, got) {
+		t.Errorf("expected %#v but got %#v, %v", m, got, err)
+	}
+	var e binaryEncoder
+	e.string("empty")
+	e.uvarint(1)
+	e.uvarint(0)
+	e.string("[]struct {}")
+	e.uvarint(maxBinarySlice + 1)
+	if _, err := Binary.Unmarshal(e.buf); err == nil {
+		t.Errorf("expected error for a slice of %d elements", maxBinarySlice+1)
+	}
+}
+
+// TestBinaryOverflow checks that a value which does not fit in its type is
+// not truncated.
+func TestBinaryOverflow(t *testing.T) {
+	for _, tc := range []struct {
+		tag    uint64 // tag is the index of the type in basics plus one
+		encode func(e *binaryEncoder)
+		err    string
+	}{
+		{2, func(e *binaryEncoder) { e.varint(300) }, "transport: binary value 300 overflows int8"},
+		{4, func(e *binaryEncoder) { e.varint(-1 << 40) }, "transport: binary value -1099511627776 overflows int32"},
+		{7, func(e *binaryEncoder) { e.uvarint(256) }, "transport: binary value 256 overflows uint8"},
+		{11, func(e *binaryEncoder) {
+			e.buf = binary.BigEndian.AppendUint64(e.buf, math.Float64bits(math.MaxFloat64))
+		}, "transport: binary value 1.7976931348623157e+308 overflows float32"},
+	} {
+		var e binaryEncoder
+		e.string("foo")
+		e.uvarint(1)
+		e.uvarint(tc.tag)
+		tc.encode(&e)
+		if _, err := Binary.Unmarshal(e.buf); err == nil || err.Error() != tc.err {
+			t.Errorf("expected %q but got %v", tc.err, err)
+		}
+	}
+}
+
+func TestBinaryCompact(t *testing.T) {
+	m := Message{Label: "foo", Payload: []interface{}{1}}
+	b, _ := Binary.Marshal(m)
+	g, _ := Gob.Marshal(m)
+	j, _ := JSON.Marshal(m)
+	if len(b) >= len(j) || len(b) >= len(g) {
+		t.Errorf("expected binary (%d bytes) smaller than json (%d bytes) and gob (%d bytes)", len(b), len(j), len(g))
+	}
+}
+
+func TestTCPCodec(t *testing.T) {
+	for _, c := range codecs {
+		sender, err := ListenTCP("C", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		receiver, err := ListenTCP("A[1]", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sender.SetCodec(c.codec)
+		receiver.SetCodec(c.codec)
+		sender.AddPeer("A[1]", receiver.Addr())
+		m := Message{Label: "point", Payload: []interface{}{point{X: 3, Name: c.name}, 4}}
+		if err := sender.Send("A[1]", m); err != nil {
+			t.Fatal(err)
+		}
+		got, err := receiver.Recv("C")
+		if err != nil {
+			t.Fatalf("%s: %v", c.name, err)
+		}
+		if !reflect.DeepEqual(m, got) {
+			t.Errorf("%s: expected %#v but got %#v", c.name, m, got)
+		}
+		sender.Close()
+		receiver.Close()
+	}
+}
@@ -0,0 +1,214 @@
+package transport
+
+// This file contains the fault-injecting transport for testing.
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// LoopObserver is implemented by connections which observe the foreach
+// loops of their participant, e.g. Faulty. The generated APIs call Iterate
+// at the start of each iteration of loop ID loop, counting iterations from 1,
+// and with iteration 0 when the loop exits.
+type LoopObserver interface {
+	Iterate(loop, iteration int)
+}
+
+// Fault is a misbehaviour injected into a message by Faulty.
+type Fault int
+
+const (
+	Drop       Fault = iota + 1 // Drop does not deliver the message
+	Delay                       // Delay waits for the delay of the rule before sending the message
+	Duplicate                   // Duplicate delivers the message twice
+	Reorder                     // Reorder delivers the message after the next message to the same peer
+	Disconnect                  // Disconnect closes the connection instead of sending the message
+)
+
+var faultNames = [...]string{Drop: "drop", Delay: "delay", Duplicate: "duplicate", Reorder: "reorder", Disconnect: "disconnect"}
+
+func (f Fault) String() string {
+	if f > 0 && int(f) < len(faultNames) {
+		return faultNames[f]
+	}
+	return fmt.Sprintf("Fault(%d)", int(f))
+}
+
+// Rule injects Fault into the sent messages which match all its conditions,
+// the zero value of a condition matches every message.
+//
+// For example, to disconnect on the 2nd iteration of loop ID 1:
+//
+//	transport.Rule{Fault: transport.Disconnect, Loop: 1, Iteration: 2}
+type Rule struct {
+	Fault Fault
+	To    string // To is the receiver of the message
+	Label string // Label is the label of the message
+
+	// Loop and Iteration match the messages sent in the Iteration-th
+	// iteration (from 1) of the foreach loop ID Loop, if Iteration > 0.
+	Loop, Iteration int
+
+	Nth   int           // Nth matches only the Nth message (from 1) matching the other conditions
+	Prob  float64       // Prob is the probability of the fault, drawn from the seeded source, if > 0
+	Delay time.Duration // Delay is the delay of a Delay fault
+}
+
+// Faulty is a connection which injects faults into the messages sent on
+// another connection, to test how participants behave when a peer
+// misbehaves.
+//
+// The faults are deterministic given the seed and the messages sent: a
+// message gets the fault of the first rule which matches it. Delayed
+// messages block the sender, and reordered messages are held back by
+// Faulty, so the order of the messages does not depend on timing. The
+// messages of Handshake are never faulted nor counted by the rules: they are
+// sent concurrently, so which one a rule matches would depend on scheduling,
+// and a dropped or reordered hello would deadlock the handshake.
+type Faulty struct {
+	conn  Conn
+	rules []Rule
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	matched  []int                // matched counts the messages matching each rule
+	loops    map[int]int          // loops are the current iterations of the foreach loops
+	held     map[string][]Message // held are the reordered messages by receiver
+	injected []string
+	down     bool // down is true after a Disconnect
+}
+
+// NewFaulty returns conn with the faults of rules injected, seed is the seed
+// of the probabilities of the rules.
+func NewFaulty(conn Conn, seed int64, rules ...Rule) *Faulty {
+	return &Faulty{
+		conn:    conn,
+		rules:   rules,
+		rng:     rand.New(rand.NewSource(seed)),
+		matched: make([]int, len(rules)),
+		loops:   make(map[int]int),
+		held:    make(map[string][]Message),
+	}
+}
+
+// Iterate records the current iteration of loop, see LoopObserver.
+func (f *Faulty) Iterate(loop, iteration int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.loops[loop] = iteration
+}
+
+// Injected returns the faults injected so far, e.g. "reorder foo to A[2]".
+func (f *Faulty) Injected() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.injected...)
+}
+
+// fault returns the rule for a message, or nil if the message is sent
+// normally. It must be called with f.mu held.
+func (f *Faulty) fault(to string, m Message) *Rule {
+	if m.Label == helloLabel {
+		return nil
+	}
+	var fired *Rule
+	for i := range f.rules {
+		r := &f.rules[i]
+		if r.To != "" && r.To != to || r.Label != "" && r.Label != m.Label {
+			continue
+		}
+		if r.Iteration > 0 && f.loops[r.Loop] != r.Iteration {
+			continue
+		}
+		f.matched[i]++
+		if r.Nth > 0 && f.matched[i] != r.Nth {
+			continue
+		}
+		if r.Prob > 0 && f.rng.Float64() >= r.Prob {
+			continue
+		}
+		if fired == nil {
+			fired = r
+		}
+	}
+	if fired != nil {
+		f.injected = append(f.injected, fmt.Sprintf("%s %s to %s", fired.Fault, m.Label, to))
+	}
+	return fired
+}
+
+func (f *Faulty) Send(to string, m Message) error {
+	f.mu.Lock()
+	if f.down {
+		f.mu.Unlock()
+		return ErrClosed
+	}
+	r := f.fault(to, m)
+	if r != nil && r.Fault == Reorder {
+		f.held[to] = append(f.held[to], m)
+		f.mu.Unlock()
+		return nil
+	}
+	if r != nil && r.Fault == Disconnect {
+		f.down = true
+		f.mu.Unlock()
+		f.conn.Close()
+		return ErrClosed
+	}
+	held := f.held[to]
+	delete(f.held, to)
+	f.mu.Unlock()
+
+	msgs := []Message{m}
+	if r != nil {
+		switch r.Fault {
+		case Drop:
+			msgs = nil
+		case Delay:
+			time.Sleep(r.Delay)
+		case Duplicate:
+			msgs = append(msgs, m)
+		}
+	}
+	for _, m := range append(msgs, held...) {
+		if err := f.conn.Send(to, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Faulty) Recv(from string) (Message, error) {
+	f.mu.Lock()
+	down := f.down
+	f.mu.Unlock()
+	if down {
+		return Message{}, ErrClosed
+	}
+	return f.conn.Recv(from)
+}
+
+// Close sends the reordered messages still held back, then closes the
+// connection.
+func (f *Faulty) Close() error {
+	f.mu.Lock()
+	if f.down {
+		f.mu.Unlock()
+		return ErrClosed
+	}
+	f.down = true
+	held := f.held
+	f.held = make(map[string][]Message)
+	f.mu.Unlock()
+	for to, msgs := range held {
+		for _, m := range msgs {
+			if err := f.conn.Send(to, m); err != nil {
+				return err
+			}
+		}
+	}
+	return f.conn.Close()
+}
@@ -0,0 +1,164 @@
+package transport
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// sendAll sends foo(1..n) to A[1] through f, then closes f, and returns the
+// payloads received by A[1].
+func sendAll(t *testing.T, tr *Chan, f *Faulty, n int) []interface{} {
+	t.Helper()
+	for i := 1; i <= n; i++ {
+		if err := f.Send("A[1]", Message{Label: "foo", Payload: []interface{}{i}}); err != nil {
+			t.Fatalf("foo(%d): %v", i, err)
+		}
+	}
+	f.Close()
+	var got []interface{}
+	a := tr.Conn("A[1]")
+	for {
+		m, err := a.Recv("C")
+		if err != nil {
+			return got
+		}
+		got = append(got, m.Payload...)
+	}
+}
+
+func TestFaulty(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		rule     Rule
+		expected []interface{}
+	}{
+		{"None", Rule{Fault: Drop, Label: "bar"}, []interface{}{1, 2, 3, 4}},
+		{"Drop", Rule{Fault: Drop, Nth: 2}, []interface{}{1, 3, 4}},
+		{"DropAll", Rule{Fault: Drop, To: "A[1]"}, nil},
+		{"Duplicate", Rule{Fault: Duplicate, Nth: 3}, []interface{}{1, 2, 3, 3, 4}},
+		{"Reorder", Rule{Fault: Reorder, Nth: 1}, []interface{}{2, 1, 3, 4}},
+		{"ReorderLast", Rule{Fault: Reorder, Nth: 4}, []interface{}{1, 2, 3, 4}},
+		{"Delay", Rule{Fault: Delay, Nth: 1, Delay: time.Millisecond}, []interface{}{1, 2, 3, 4}},
+	} {
+		tr := NewChan(16)
+		f := NewFaulty(tr.Conn("C"), 1, tc.rule)
+		if got := sendAll(t, tr, f, 4); !reflect.DeepEqual(got, tc.expected) {
+			t.Errorf("%s: expected %v but got %v", tc.name, tc.expected, got)
+		}
+	}
+}
+
+func TestFaultyDisconnect(t *testing.T) {
+	tr := NewChan(16)
+	f := NewFaulty(tr.Conn("C"), 1, Rule{Fault: Disconnect, Loop: 1, Iteration: 2})
+	f.Iterate(0, 1)
+	f.Iterate(1, 1)
+	if err := f.Send("A[1]", Message{Label: "foo", Payload: []interface{}{1}}); err != nil {
+		t.Fatal(err)
+	}
+	f.Iterate(1, 2)
+	if err := f.Send("A[1]", Message{Label: "foo", Payload: []interface{}{2}}); err != ErrClosed {
+		t.Fatalf("expected %v on the 2nd iteration of loop 1 but got %v", ErrClosed, err)
+	}
+	if _, err := f.Recv("A[1]"); err != ErrClosed {
+		t.Errorf("expected %v receiving after disconnect but got %v", ErrClosed, err)
+	}
+	a := tr.Conn("A[1]")
+	if m, err := a.Recv("C"); err != nil || m.Payload[0] != 1 {
+		t.Errorf("expected foo(1) but got %v, %v", m, err)
+	}
+	if _, err := a.Recv("C"); err != ErrClosed {
+		t.Errorf("expected peer to see %v but got %v", ErrClosed, err)
+	}
+	if expected := []string{"disconnect foo to A[1]"}; !reflect.DeepEqual(f.Injected(), expected) {
+		t.Errorf("expected injected %v but got %v", expected, f.Injected())
+	}
+}
+
+func TestFaultyLoop(t *testing.T) {
+	tr := NewChan(16)
+	f := NewFaulty(tr.Conn("C"), 1, Rule{Fault: Drop, Loop: 1, Iteration: 2})
+	for i := 1; i <= 2; i++ {
+		for j := 1; j <= 3; j++ {
+			f.Iterate(1, j)
+			f.Send("A[1]", Message{Label: "foo", Payload: []interface{}{10*i + j}})
+		}
+		f.Iterate(1, 0)
+		f.Send("A[1]", Message{Label: "foo", Payload: []interface{}{10 * i}})
+	}
+	if got, expected := sendAll(t, tr, f, 0), []interface{}{11, 13, 10, 21, 23, 20}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v but got %v", expected, got)
+	}
+}
+
+func TestFaultySeed(t *testing.T) {
+	run := func(seed int64) []string {
+		tr := NewChan(64)
+		f := NewFaulty(tr.Conn("C"), seed,
+			Rule{Fault: Drop, Prob: 0.2},
+			Rule{Fault: Duplicate, Prob: 0.2},
+			Rule{Fault: Reorder, Prob: 0.2},
+		)
+		sendAll(t, tr, f, 30)
+		return f.Injected()
+	}
+	first := run(42)
+	if len(first) == 0 {
+		t.Fatal("expected faults to be injected")
+	}
+	if again := run(42); !reflect.DeepEqual(first, again) {
+		t.Errorf("expected the same faults with the same seed but got\n%v\n%v", first, again)
+	}
+	if other := run(7); reflect.DeepEqual(first, other) {
+		t.Errorf("expected other faults with another seed but got %v", other)
+	}
+}
+
+// TestFaultySeedHandshake checks that the concurrent hellos of Handshake do
+// not change which messages rules without a label match.
+func TestFaultySeedHandshake(t *testing.T) {
+	peers := []string{"A[1]", "A[2]", "A[3]"}
+	run := func(seed int64) []string {
+		tr := NewChan(64)
+		f := NewFaulty(tr.Conn("C"), seed,
+			Rule{Fault: Drop, Prob: 0.3},
+			Rule{Fault: Reorder, Nth: 2},
+		)
+		hello := Hello{Protocol: "P", Participant: "C"}
+		done := make(chan error, len(peers))
+		for _, peer := range peers {
+			go func(peer string) {
+				h := hello
+				h.Participant = peer
+				done <- Handshake(tr.Conn(peer), h, []string{"C"})
+			}(peer)
+		}
+		if err := Handshake(f, hello, peers); err != nil {
+			t.Fatal(err)
+		}
+		for range peers {
+			if err := <-done; err != nil {
+				t.Fatal(err)
+			}
+		}
+		for i := 1; i <= 10; i++ {
+			for _, peer := range peers {
+				if err := f.Send(peer, Message{Label: "foo", Payload: []interface{}{i}}); err != nil {
+					t.Fatal(err)
+				}
+			}
+		}
+		f.Close()
+		return f.Injected()
+	}
+	first := run(42)
+	if len(first) == 0 {
+		t.Fatal("expected faults to be injected")
+	}
+	for i := 0; i < 20; i++ {
+		if again := run(42); !reflect.DeepEqual(first, again) {
+			t.Fatalf("expected the same faults with the same seed but got\n%v\n%v", first, again)
+		}
+	}
+}
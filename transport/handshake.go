@@ -0,0 +1,121 @@
+package transport
+
+// This file contains the handshake at the start of a session.
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Hello is the announcement of a participant at the start of a session.
+type Hello struct {
+	Protocol    string         // Protocol is the name of the protocol
+	Participant string         // Participant is the role and index of the participant, e.g. A[2]
+	Fingerprint string         // Fingerprint is the hash of the protocol (see scribble.Fingerprint)
+	Params      map[string]int // Params are the values of the protocol parameters
+}
+
+func init() {
+	Register(Hello{})
+}
+
+// helloLabel is the label of the handshake messages.
+const helloLabel = "hello"
+
+// HandshakeError is a mismatch between a participant and a peer found by
+// Handshake, the session must not start.
+type HandshakeError struct {
+	Peer string // Peer is the participant which does not match
+	Msg  string
+}
+
+func (e *HandshakeError) Error() string {
+	return fmt.Sprintf("transport: handshake with %s: %s", e.Peer, e.Msg)
+}
+
+// Handshake announces hello to peers and checks the announcements of the
+// peers against hello: the peers must run the same protocol with the same
+// fingerprint and parameters. Every peer must call Handshake with the
+// participant of hello as one of its peers.
+//
+// All the announcements are received before Handshake returns, so that every
+// participant finds a mismatch, and the first error is returned (a
+// *HandshakeError for a mismatch).
+func Handshake(conn Conn, hello Hello, peers []string) error {
+	sent := make(chan error, len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			sent <- conn.Send(peer, Message{Label: helloLabel, Payload: []interface{}{hello}})
+		}(peer)
+	}
+	var first error
+	for _, peer := range peers {
+		if err := recvHello(conn, hello, peer); err != nil && first == nil {
+			first = err
+		}
+	}
+	if first != nil {
+		return first // a peer may never receive its hello
+	}
+	for range peers {
+		if err := <-sent; err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// recvHello receives the announcement of peer and checks it against hello.
+func recvHello(conn Conn, hello Hello, peer string) error {
+	m, err := conn.Recv(peer)
+	if err != nil {
+		return err
+	}
+	mismatch := func(format string, args ...interface{}) error {
+		return &HandshakeError{Peer: peer, Msg: fmt.Sprintf(format, args...)}
+	}
+	if m.Label != helloLabel {
+		return mismatch("expected %s but got %s", helloLabel, m.Label)
+	}
+	var h Hello
+	if len(m.Payload) == 1 {
+		h, _ = m.Payload[0].(Hello)
+	}
+	switch {
+	case h.Participant != peer:
+		return mismatch("peer announced itself as %q", h.Participant)
+	case h.Protocol != hello.Protocol:
+		return mismatch("%s runs protocol %s but %s runs %s", peer, h.Protocol, hello.Participant, hello.Protocol)
+	case h.Fingerprint != hello.Fingerprint:
+		return mismatch("protocol %s has fingerprint %s at %s but %s at %s (different revisions of the protocol)",
+			hello.Protocol, h.Fingerprint, peer, hello.Fingerprint, hello.Participant)
+	}
+	names := make(map[string]bool)
+	for name := range h.Params {
+		names[name] = true
+	}
+	for name := range hello.Params {
+		names[name] = true
+	}
+	var sorted []string
+	for name := range names {
+		sorted = append(sorted, name)
+	}
+	sort.Strings(sorted)
+	for _, name := range sorted {
+		theirs, ok1 := h.Params[name]
+		ours, ok2 := hello.Params[name]
+		if theirs != ours || ok1 != ok2 {
+			return mismatch("parameter %s is %s at %s but %s at %s", name, param(theirs, ok1), peer, param(ours, ok2), hello.Participant)
+		}
+	}
+	return nil
+}
+
+// param returns the value of a parameter, or unset.
+func param(value int, ok bool) string {
+	if !ok {
+		return "unset"
+	}
+	return fmt.Sprint(value)
+}
@@ -0,0 +1,110 @@
+package transport
+
+import (
+	"strings"
+	"sync"
+	"testing"
+)
+
+// handshake runs the handshake of hellos between all of them, and returns
+// the error of each participant.
+func handshake(hellos []Hello) []error {
+	tr := NewChan(0)
+	errs := make([]error, len(hellos))
+	var wg sync.WaitGroup
+	for i, hello := range hellos {
+		var peers []string
+		for _, peer := range hellos {
+			if peer.Participant != hello.Participant {
+				peers = append(peers, peer.Participant)
+			}
+		}
+		wg.Add(1)
+		go func(i int, hello Hello) {
+			defer wg.Done()
+			errs[i] = Handshake(tr.Conn(hello.Participant), hello, peers)
+		}(i, hello)
+	}
+	wg.Wait()
+	return errs
+}
+
+func TestHandshake(t *testing.T) {
+	hello := func(name, fingerprint string, k int) Hello {
+		return Hello{Protocol: "Nested", Participant: name, Fingerprint: fingerprint, Params: map[string]int{"k": k}}
+	}
+	for _, tc := range []struct {
+		name   string
+		hellos []Hello
+		errs   []string // errs are the expected errors of each participant
+	}{
+		{
+			"Match",
+			[]Hello{hello("Coordinator", "abc", 2), hello("A[1]", "abc", 2), hello("A[2]", "abc", 2)},
+			[]string{"", "", ""},
+		},
+		{
+			"Fingerprint",
+			[]Hello{hello("Coordinator", "abc", 2), hello("A[1]", "abc", 2), hello("A[2]", "def", 2)},
+			[]string{
+				"transport: handshake with A[2]: protocol Nested has fingerprint def at A[2] but abc at Coordinator (different revisions of the protocol)",
+				"transport: handshake with A[2]: protocol Nested has fingerprint def at A[2] but abc at A[1] (different revisions of the protocol)",
+				"transport: handshake with Coordinator: protocol Nested has fingerprint abc at Coordinator but def at A[2] (different revisions of the protocol)",
+			},
+		},
+		{
+			"Params",
+			[]Hello{hello("Coordinator", "abc", 2), hello("A[1]", "abc", 3)},
+			[]string{
+				"transport: handshake with A[1]: parameter k is 3 at A[1] but 2 at Coordinator",
+				"transport: handshake with Coordinator: parameter k is 2 at Coordinator but 3 at A[1]",
+			},
+		},
+		{
+			"UnsetParam",
+			[]Hello{hello("Coordinator", "abc", 2), {Protocol: "Nested", Participant: "A[1]", Fingerprint: "abc"}},
+			[]string{
+				"transport: handshake with A[1]: parameter k is unset at A[1] but 2 at Coordinator",
+				"transport: handshake with Coordinator: parameter k is 2 at Coordinator but unset at A[1]",
+			},
+		},
+		{
+			"Protocol",
+			[]Hello{hello("Coordinator", "abc", 2), {Protocol: "Rounds", Participant: "A[1]", Fingerprint: "abc", Params: map[string]int{"k": 2}}},
+			[]string{
+				"transport: handshake with A[1]: A[1] runs protocol Rounds but Coordinator runs Nested",
+				"transport: handshake with Coordinator: Coordinator runs protocol Nested but A[1] runs Rounds",
+			},
+		},
+	} {
+		errs := handshake(tc.hellos)
+		for i, err := range errs {
+			got := ""
+			if err != nil {
+				got = err.Error()
+				if _, ok := err.(*HandshakeError); !ok {
+					t.Errorf("%s: expected a *HandshakeError but got %T", tc.name, err)
+				}
+			}
+			if got != tc.errs[i] {
+				t.Errorf("%s: %s expected error %q but got %q", tc.name, tc.hellos[i].Participant, tc.errs[i], got)
+			}
+		}
+	}
+}
+
+func TestHandshakeImpostor(t *testing.T) {
+	tr := NewChan(2)
+	a1 := tr.Conn("A[1]")
+	a1.Send("Coordinator", Message{Label: helloLabel, Payload: []interface{}{Hello{Protocol: "Nested", Participant: "A[2]"}}})
+	err := Handshake(tr.Conn("Coordinator"), Hello{Protocol: "Nested", Participant: "Coordinator"}, []string{"A[1]"})
+	if err == nil || !strings.Contains(err.Error(), `peer announced itself as "A[2]"`) {
+		t.Errorf("expected error for a peer announcing another name but got %v", err)
+	}
+
+	a1.Send("Coordinator", Message{Label: "foo", Payload: []interface{}{1}})
+	err = Handshake(tr.Conn("Coordinator"), Hello{Protocol: "Nested", Participant: "Coordinator"}, []string{"A[1]"})
+	if err == nil || !strings.Contains(err.Error(), "expected hello but got foo") {
+		t.Errorf("expected error for a peer without handshake but got %v", err)
+	}
+}
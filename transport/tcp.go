@@ -0,0 +1,309 @@
+package transport
+
+// This file contains the TCP transport.
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// inboxSize is the number of messages from a peer buffered by TCPConn
+// before the connection from the peer stops being read.
+const inboxSize = 64
+
+// TCPConn is the connection of a participant to the other participants over
+// TCP, for participants in different processes.
+//
+// Each participant listens on its own address, and dials the address of a
+// peer the first time it sends to the peer, so there is one TCP connection
+// for each direction between two participants. The first frame on a
+// connection is the name of the sender, and every other frame is a message.
+// Frames are prefixed by their length as a 4-byte big endian integer, and
+// messages are encoded with the codec of the connection, Gob by default, so
+// payload types other than the basic types must be registered with Register.
+type TCPConn struct {
+	self string
+	ln   net.Listener
+
+	mu     sync.Mutex
+	codec  Codec
+	peers  map[string]string // peers maps participant names to addresses
+	out    map[string]*tcpOut
+	in     map[string]*tcpIn
+	conns  map[net.Conn]bool // conns are the incoming connections being read
+	closed bool
+}
+
+// tcpIn is the inbox of the messages received from a peer. It is closed
+// once, when the first connection from the peer ends, with ErrClosed or the
+// error reading the connection, or when the TCPConn is closed; messages on
+// later connections from the peer are dropped.
+type tcpIn struct {
+	msgs chan Message
+	done chan struct{} // done is closed with err set
+	once sync.Once
+	err  error
+}
+
+// close closes the inbox with err, unless it is already closed.
+func (in *tcpIn) close(err error) {
+	in.once.Do(func() {
+		in.err = err
+		close(in.done)
+	})
+}
+
+// tcpOut is the connection to send to a peer.
+type tcpOut struct {
+	mu   sync.Mutex
+	conn net.Conn
+	w    *bufio.Writer
+}
+
+// ListenTCP returns the connection of participant self listening on addr,
+// e.g. 127.0.0.1:0 to listen on any port of the loopback interface.
+// The addresses of the peers are added with AddPeer.
+func ListenTCP(self, addr string) (*TCPConn, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &TCPConn{
+		self:  self,
+		ln:    ln,
+		codec: Gob,
+		peers: make(map[string]string),
+		out:   make(map[string]*tcpOut),
+		in:    make(map[string]*tcpIn),
+		conns: make(map[net.Conn]bool),
+	}
+	go c.accept()
+	return c, nil
+}
+
+// Addr returns the listening address of the participant.
+func (c *TCPConn) Addr() string { return c.ln.Addr().String() }
+
+// AddPeer sets the address of the participant name.
+func (c *TCPConn) AddPeer(name, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.peers[name] = addr
+}
+
+// SetCodec sets the codec of the messages sent and received, all the
+// participants of a session must use the same codec.
+func (c *TCPConn) SetCodec(codec Codec) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.codec = codec
+}
+
+func (c *TCPConn) getCodec() Codec {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.codec
+}
+
+func (c *TCPConn) accept() {
+	for {
+		conn, err := c.ln.Accept()
+		if err != nil {
+			return // listener closed
+		}
+		c.mu.Lock()
+		if c.closed {
+			c.mu.Unlock()
+			conn.Close()
+			return
+		}
+		c.conns[conn] = true
+		c.mu.Unlock()
+		go c.read(conn)
+	}
+}
+
+// read reads the messages of an incoming connection into the inbox of
+// the sender, until the sender closes the connection. The inbox is closed
+// with ErrClosed, or with the error of a frame which cannot be read or
+// decoded.
+func (c *TCPConn) read(conn net.Conn) {
+	defer func() {
+		c.mu.Lock()
+		delete(c.conns, conn)
+		c.mu.Unlock()
+		conn.Close()
+	}()
+	r := bufio.NewReader(conn)
+	hello, err := readFrame(r)
+	if err != nil {
+		return
+	}
+	from := string(hello)
+	inbox := c.inbox(from)
+	for {
+		frame, err := readFrame(r)
+		if err == io.EOF {
+			inbox.close(ErrClosed)
+			return
+		} else if err != nil {
+			inbox.close(fmt.Errorf("transport: cannot read frame from %s: %w", from, err))
+			return
+		}
+		m, err := c.getCodec().Unmarshal(frame)
+		if err != nil {
+			inbox.close(fmt.Errorf("transport: cannot decode message from %s: %w", from, err))
+			return
+		}
+		select {
+		case <-inbox.done:
+			return
+		default:
+		}
+		select {
+		case inbox.msgs <- m:
+		case <-inbox.done:
+			return
+		}
+	}
+}
+
+// inbox returns the inbox of messages received from the participant from.
+func (c *TCPConn) inbox(from string) *tcpIn {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	in, ok := c.in[from]
+	if !ok {
+		in = &tcpIn{msgs: make(chan Message, inboxSize), done: make(chan struct{})}
+		c.in[from] = in
+	}
+	return in
+}
+
+// dial returns the connection to the participant to, dialled on first use.
+func (c *TCPConn) dial(to string) (*tcpOut, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil, ErrClosed
+	}
+	if out, ok := c.out[to]; ok {
+		return out, nil
+	}
+	addr, ok := c.peers[to]
+	if !ok {
+		return nil, fmt.Errorf("transport: no address for participant %s", to)
+	}
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	out := &tcpOut{conn: conn, w: bufio.NewWriter(conn)}
+	if err := writeFrame(out.w, []byte(c.self)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	c.out[to] = out
+	return out, nil
+}
+
+func (c *TCPConn) Send(to string, m Message) error {
+	out, err := c.dial(to)
+	if err != nil {
+		return err
+	}
+	frame, err := c.getCodec().Marshal(m)
+	if err != nil {
+		return err
+	}
+	out.mu.Lock()
+	defer out.mu.Unlock()
+	if err := writeFrame(out.w, frame); err != nil {
+		return err
+	}
+	return out.w.Flush()
+}
+
+// Recv returns the next message from the participant from. After the
+// messages received before the peer closed its connection, it returns
+// ErrClosed, or the error of a corrupted frame. It returns ErrClosed once c
+// is closed.
+func (c *TCPConn) Recv(from string) (Message, error) {
+	c.mu.Lock()
+	closed := c.closed
+	c.mu.Unlock()
+	if closed {
+		return Message{}, ErrClosed
+	}
+	in := c.inbox(from)
+	select {
+	case m := <-in.msgs:
+		return m, nil
+	case <-in.done:
+	}
+	select {
+	case m := <-in.msgs:
+		return m, nil
+	default:
+		return Message{}, in.err
+	}
+}
+
+// Close closes the connections to and from the peers and stops listening.
+// The inboxes are closed with ErrClosed, dropping the messages not received.
+func (c *TCPConn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return ErrClosed
+	}
+	c.closed = true
+	err := c.ln.Close()
+	for _, in := range c.in {
+		in.close(ErrClosed)
+	}
+	for conn := range c.conns {
+		conn.Close() // the error is seen by read, which stops
+	}
+	for _, out := range c.out {
+		out.mu.Lock()
+		if cerr := out.conn.Close(); err == nil {
+			err = cerr
+		}
+		out.mu.Unlock()
+	}
+	return err
+}
+
+// maxFrame is the largest frame accepted, to reject corrupted lengths.
+const maxFrame = 1 << 24
+
+func writeFrame(w io.Writer, frame []byte) error {
+	var n [4]byte
+	binary.BigEndian.PutUint32(n[:], uint32(len(frame)))
+	if _, err := w.Write(n[:]); err != nil {
+		return err
+	}
+	_, err := w.Write(frame)
+	return err
+}
+
+func readFrame(r io.Reader) ([]byte, error) {
+	var n [4]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, err
+	}
+	size := binary.BigEndian.Uint32(n[:])
+	if size > maxFrame {
+		return nil, fmt.Errorf("transport: frame of %d bytes is too large", size)
+	}
+	frame := make([]byte, size)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		return nil, err
+	}
+	return frame, nil
+}
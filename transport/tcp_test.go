@@ -0,0 +1,187 @@
+package transport
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"testing"
+	"time"
+)
+
+func TestTCP(t *testing.T) {
+	c, err := ListenTCP("C", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, err := ListenTCP("A[1]", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.AddPeer("A[1]", a.Addr())
+	a.AddPeer("C", c.Addr())
+
+	for i := 1; i <= 3; i++ {
+		if err := c.Send("A[1]", Message{Label: "foo", Payload: []interface{}{i, "bar"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 3; i++ {
+		m, err := a.Recv("C")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Label != "foo" || len(m.Payload) != 2 || m.Payload[0] != i || m.Payload[1] != "bar" {
+			t.Errorf("expected foo(%d, bar) but got %v", i, m)
+		}
+	}
+	if _, err := a.Recv("C"); err != ErrClosed {
+		t.Errorf("expected %v but got %v", ErrClosed, err)
+	}
+	if err := c.Send("A[1]", Message{Label: "foo"}); err != ErrClosed {
+		t.Errorf("expected %v but got %v", ErrClosed, err)
+	}
+	if err := a.Send("B", Message{Label: "foo"}); err == nil {
+		t.Error("expected error sending to a participant without address")
+	}
+	a.Close()
+}
+
+// dialAs connects to c as the participant from, and writes the frames.
+func dialAs(t *testing.T, c *TCPConn, from string, frames ...[]byte) net.Conn {
+	t.Helper()
+	conn, err := net.Dial("tcp", c.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := bufio.NewWriter(conn)
+	for _, frame := range append([][]byte{[]byte(from)}, frames...) {
+		if err := writeFrame(w, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	return conn
+}
+
+// TestTCPReconnect checks that a second connection from a peer whose first
+// connection closed does not panic, and its messages are dropped.
+func TestTCPReconnect(t *testing.T) {
+	a, err := ListenTCP("A[1]", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	foo, err := Gob.Marshal(Message{Label: "foo", Payload: []interface{}{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dialAs(t, a, "C", foo).Close()
+	if m, err := a.Recv("C"); err != nil || m.Label != "foo" {
+		t.Fatalf("expected foo but got %v, %v", m, err)
+	}
+	if _, err := a.Recv("C"); err != ErrClosed {
+		t.Fatalf("expected %v but got %v", ErrClosed, err)
+	}
+	conn := dialAs(t, a, "C", foo)
+	// A[1] closes the connection after dropping foo.
+	if _, err := io.ReadAll(conn); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if _, err := a.Recv("C"); err != ErrClosed {
+		t.Errorf("expected %v after reconnecting but got %v", ErrClosed, err)
+	}
+}
+
+// TestTCPCorrupt checks that Recv returns the error of a frame which cannot
+// be decoded, after the messages before it.
+func TestTCPCorrupt(t *testing.T) {
+	a, err := ListenTCP("A[1]", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer a.Close()
+	a.SetCodec(Binary)
+	foo, err := Binary.Marshal(Message{Label: "foo", Payload: []interface{}{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dialAs(t, a, "C", foo, foo[:len(foo)-1]).Close()
+	if m, err := a.Recv("C"); err != nil || m.Label != "foo" {
+		t.Fatalf("expected foo but got %v, %v", m, err)
+	}
+	if _, err := a.Recv("C"); !errors.Is(err, errShortData) {
+		t.Errorf("expected %v but got %v", errShortData, err)
+	}
+}
+
+// TestTCPClose checks that Close stops reading a peer whose inbox is full,
+// and that Recv returns ErrClosed after Close.
+func TestTCPClose(t *testing.T) {
+	before := runtime.NumGoroutine()
+	a, err := ListenTCP("A[1]", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	foo, err := Gob.Marshal(Message{Label: "foo", Payload: []interface{}{1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	frames := make([][]byte, inboxSize+2)
+	for i := range frames {
+		frames[i] = foo
+	}
+	defer dialAs(t, a, "C", frames...).Close()
+	in := a.inbox("C")
+	for deadline := time.Now().Add(5 * time.Second); len(in.msgs) < inboxSize; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a full inbox but got %d messages", len(in.msgs))
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, from := range []string{"C", "B"} {
+		if _, err := a.Recv(from); err != ErrClosed {
+			t.Errorf("expected %v from %s after Close but got %v", ErrClosed, from, err)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); runtime.NumGoroutine() > before; {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d goroutines after Close but got %d", before, runtime.NumGoroutine())
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestFrame(t *testing.T) {
+	var buf bytes.Buffer
+	for _, frame := range []string{"A[1]", "", "foo"} {
+		if err := writeFrame(&buf, []byte(frame)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, expected := range []string{"A[1]", "", "foo"} {
+		frame, err := readFrame(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(frame) != expected {
+			t.Errorf("expected frame %q but got %q", expected, frame)
+		}
+	}
+	buf.Write([]byte{0xff, 0xff, 0xff, 0xff})
+	if _, err := readFrame(&buf); err == nil {
+		t.Error("expected error for too large frame")
+	}
+}
@@ -0,0 +1,50 @@
+// Package transport delivers the messages of a session between participants.
+//
+// Each participant of a session has a Conn to the other participants, which
+// are named by role, and by index for indexed roles (see Name):
+//
+//	t := transport.NewChan(16)
+//	coordinator := t.Conn("Coordinator")
+//	a1 := t.Conn(transport.Name("A", 1))
+//
+//	coordinator.Send("A[1]", transport.Message{Label: "foo", Payload: []interface{}{1}})
+//	m, err := a1.Recv("Coordinator")
+//
+// Messages between two participants are delivered in order. Send only waits
+// for the message to be received when the transport has no room left for it,
+// e.g. a Chan with buffer 0 is synchronous, and a TCPConn blocks once the
+// inbox of the receiver and the TCP buffers are full.
+package transport
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrClosed is returned when sending on a closed connection, or receiving
+// from a participant which closed its connection.
+var ErrClosed = errors.New("transport: connection closed")
+
+// Message is a message of a session.
+type Message struct {
+	Label   string
+	Payload []interface{}
+}
+
+// Conn is the connection of a participant to the other participants.
+type Conn interface {
+	// Send sends m to the participant to.
+	Send(to string, m Message) error
+
+	// Recv receives the next message from the participant from.
+	Recv(from string) (Message, error)
+
+	// Close closes the connection, pending messages can still be received
+	// by the other participants.
+	Close() error
+}
+
+// Name returns the name of the participant role[index], e.g. A[2].
+func Name(role string, index int) string {
+	return fmt.Sprintf("%s[%d]", role, index)
+}
@@ -0,0 +1,83 @@
+// Package value is the final design with value-typed states, which does not
+// allocate on the heap when moving between states.
+//
+// States are values referring to a Session, and every state carries the
+// generation of the session it was made in. The session moves to the next
+// generation whenever a state is used, so only the latest state is usable:
+// using a state twice, or a state of an earlier iteration, panics with
+// ErrResourceUsed as in the final package.
+//
+//	ss := new(value.Session)
+//	ss.Start().Foreach(func(s value.S1) value.S4 {
+//		return s.Foreach(func(s value.S2) value.S5 {
+//			return s.Send_Aj_foo(1)
+//		}).Send_Ai_bar("bar")
+//	}).End()
+//
+// The foreach stack keeps its states by value, and a Session can be started
+// again to reuse its stack, so that a session allocates nothing once the
+// stack has grown to the depth of the protocol.
+package value
+
+// This file contains common code for nested FSM tracking.
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Misuse of the API panics with one of these errors.
+var (
+	ErrResourceUsed  = errors.New("resource used")
+	ErrNoSession     = errors.New("state is not from a session")
+	ErrPopEmptyStack = errors.New("cannot pop: stack empty")
+)
+
+// foreachState keeps track of foreach loop index in code.
+type foreachState struct {
+	ID         int // ID is the unique sub-FSM ID
+	curr, last int // curr/last is the current/last index of the foreach
+}
+
+// canEnter returns true if the current index is within foreach bounds.
+func (state *foreachState) canEnter() bool {
+	return state.curr <= state.last
+}
+
+func (state *foreachState) increment() { state.curr++ }
+
+func (state foreachState) String() string {
+	return fmt.Sprintf("{%d: %d/%d}", state.ID, state.curr, state.last)
+}
+
+// fsmStack is a stack of foreach states kept by value, popped states leave
+// their space in the backing array for the next push.
+type fsmStack struct {
+	stack []foreachState
+}
+
+// top returns the current foreach state, which is valid until the next push.
+func (s *fsmStack) top() *foreachState {
+	if len(s.stack) == 0 {
+		return nil
+	}
+	return &s.stack[len(s.stack)-1]
+}
+
+func (s *fsmStack) push(ID, rangeLen int) {
+	// Pre: rangeLen > 0
+	s.stack = append(s.stack, foreachState{ID: ID, curr: 0, last: rangeLen - 1})
+}
+
+func (s *fsmStack) pop() {
+	if len(s.stack) == 0 {
+		panic(ErrPopEmptyStack)
+	}
+	s.stack = s.stack[:len(s.stack)-1]
+}
+
+func (s *fsmStack) reset() { s.stack = s.stack[:0] }
+
+func (s fsmStack) String() string {
+	return fmt.Sprintf("stack %v", s.stack)
+}
@@ -0,0 +1,193 @@
+package value
+
+import (
+	"fmt"
+
+	"github.com/nickng/scribble-foreach-experiment/trace"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+// ProtoParam is just a lookup table for protocol parameters
+var ProtoParam = map[string]int{
+	"k": 2, // role A(k=2)
+}
+
+// Trace records the transitions of the session if not nil.
+var Trace *trace.Recorder
+
+// Example protocol - nested one-to-many:
+//
+// foreach A[i:1..k] {
+//   foreach A[j:1..k] {
+//     foo(int) to A[j];
+//   }
+//   bar(string) to A[i];
+// }
+//
+
+// Session is a session of the Coordinator with the participants A[1..k].
+// Messages are discarded if Conn is nil.
+type Session struct {
+	Conn transport.Conn
+
+	gen    uint64   // gen is the generation of the only usable state
+	sstack fsmStack // sstack is the foreach stack of the session
+}
+
+// Start starts the session from its initial state S0, states of an earlier
+// run of the session are no longer usable.
+func (ss *Session) Start() S0 {
+	ss.gen++
+	ss.sstack.reset()
+	return S0{ss.state()}
+}
+
+// state returns the usable state of the current generation.
+func (ss *Session) state() resource {
+	return resource{ss: ss, gen: ss.gen}
+}
+
+// send sends a message to the participant A[index], it panics with the
+// error of the connection if the message cannot be sent.
+func (ss *Session) send(index int, label string, payload ...interface{}) {
+	to := transport.Name("A", index)
+	if err := ss.Conn.Send(to, transport.Message{Label: label, Payload: payload}); err != nil {
+		panic(fmt.Errorf("cannot send %s to %s: %w", label, to, err))
+	}
+}
+
+// resource is embedded in every state.
+type resource struct {
+	ss  *Session
+	gen uint64 // gen is the generation of the session the state was made in
+}
+
+// Use moves the session of the state to the next generation, the state must
+// be of the current generation.
+func (res resource) Use() *Session {
+	if res.ss == nil {
+		panic(ErrNoSession)
+	}
+	if res.gen != res.ss.gen {
+		panic(ErrResourceUsed)
+	}
+	res.ss.gen++
+	return res.ss
+}
+
+// S0 is the initial state.
+// It is also the outer foreach init state.
+type S0 struct {
+	resource
+}
+
+func (s S0) ID() int { return 0 } // Generate as method returning constant so immutable
+
+// Foreach moves S0 → S1, where S1 is the body of outer foreach i.e. inner foreach
+func (s S0) Foreach(bodyFn func(S1) S4) SEnd {
+	ss := s.Use()
+	ss.sstack.push(s.ID(), ProtoParam["k"]) // where k is the param of foreach
+
+	// Run at least once (range is never empty)
+	for ss.sstack.top().canEnter() {
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: s.ID(), Loop: s.ID(), Index: "i", Value: ss.sstack.top().curr + 1})
+		bodyFn(S1{ss.state()}).end()
+	}
+	ss.sstack.pop()
+	Trace.Record(trace.Event{Kind: trace.Exit, State: s.ID(), Loop: s.ID()})
+	return SEnd{ss.state()}
+}
+
+// S4 is the ending state of the outer foreach loop.
+type S4 struct {
+	resource
+}
+
+func (s S4) end() {
+	s.Use().sstack.top().increment()
+}
+
+// S1 is the inner foreach init state.
+type S1 struct {
+	resource
+}
+
+func (s S1) ID() int { return 1 } // Generate as method returning constant so immutable
+
+// Foreach moves s1 → s2, where s2 is the body of inner foreach
+func (s S1) Foreach(bodyFn func(S2) S5) S3 {
+	ss := s.Use()
+	ss.sstack.push(s.ID(), ProtoParam["k"]) // where k is the param of foreach
+
+	// Run at least once (range is never empty)
+	for ss.sstack.top().canEnter() {
+		Trace.Record(trace.Event{Kind: trace.Iterate, State: s.ID(), Loop: s.ID(), Index: "j", Value: ss.sstack.top().curr + 1})
+		bodyFn(S2{ss.state()}).end()
+	}
+	ss.sstack.pop()
+	Trace.Record(trace.Event{Kind: trace.Exit, State: s.ID(), Loop: s.ID()})
+	return S3{ss.state()}
+}
+
+// S2 is the body of inner foreach.
+// It is the first statement of inner foreach.
+type S2 struct {
+	resource
+}
+
+// Send_Aj_foo is first and last method of inner foreach body.
+// As the last statement of inner foreach, always go back to s1 (inner foreach init).
+func (s S2) Send_Aj_foo(v int) S5 {
+	ss := s.Use()
+	j := ss.sstack.top().curr + 1 // top is the inner foreach j, from 0
+	if Trace != nil {             // formatting the event allocates
+		Trace.Record(trace.Event{Kind: trace.Send, State: 2, From: "Coordinator", To: fmt.Sprintf("A[%d]", j), Label: "foo", Payload: fmt.Sprint(v)})
+	}
+	if ss.Conn != nil {
+		ss.send(j, "foo", v)
+	}
+	return S5{ss.state()}
+}
+
+// S3 is in the body of outer foreach (statement after inner foreach)
+type S3 struct {
+	resource
+}
+
+// Send_Ai_bar is the last method of outer foreach body.
+// As the last statement of outer foreach, always go back to s0 (outer foreach init).
+func (s S3) Send_Ai_bar(v string) S4 {
+	ss := s.Use()
+	i := ss.sstack.top().curr + 1 // top is the outer foreach i, from 0
+	if Trace != nil {
+		Trace.Record(trace.Event{Kind: trace.Send, State: 3, From: "Coordinator", To: fmt.Sprintf("A[%d]", i), Label: "bar", Payload: fmt.Sprint(v)})
+	}
+	if ss.Conn != nil {
+		ss.send(i, "bar", v)
+	}
+	return S4{ss.state()}
+}
+
+// S5 is the ending state of the inner foreach loop.
+type S5 struct {
+	resource
+}
+
+func (s S5) end() {
+	s.Use().sstack.top().increment()
+}
+
+// SEnd is the usual final state of a protocol.
+type SEnd struct {
+	resource
+}
+
+func (s SEnd) End() {
+	ss := s.Use()
+	Trace.Record(trace.Event{Kind: trace.End})
+	if ss.Conn != nil {
+		if err := ss.Conn.Close(); err != nil {
+			panic(fmt.Errorf("cannot close connection: %w", err))
+		}
+	}
+}
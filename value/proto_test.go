@@ -0,0 +1,89 @@
+package value
+
+import (
+	"testing"
+
+	"github.com/nickng/scribble-foreach-experiment/mockpeer"
+	"github.com/nickng/scribble-foreach-experiment/panictest"
+	"github.com/nickng/scribble-foreach-experiment/transport"
+)
+
+func TestMisuse(t *testing.T) {
+	ProtoParam["k"] = 2
+	inner := func(s S2) S5 { return s.Send_Aj_foo(1) }
+	outer := func(s S1) S4 { return s.Foreach(inner).Send_Ai_bar("") }
+	panictest.Run(t, nil, panictest.Cases{
+		{"Good", func() {
+			new(Session).Start().Foreach(outer).End()
+		}, nil},
+		{"UseTwice", func() {
+			s := new(Session).Start()
+			s.Foreach(outer)
+			s.Foreach(outer)
+		}, ErrResourceUsed},
+		{"SendTwice", func() {
+			new(Session).Start().Foreach(func(s S1) S4 {
+				return s.Foreach(func(s S2) S5 {
+					s.Send_Aj_foo(1)
+					return s.Send_Aj_foo(2)
+				}).Send_Ai_bar("")
+			})
+		}, ErrResourceUsed},
+		{"StaleBodyEnd", func() {
+			// The inner body returns the end state of its first iteration.
+			var first S5
+			new(Session).Start().Foreach(func(s S1) S4 {
+				return s.Foreach(func(s S2) S5 {
+					if end := s.Send_Aj_foo(1); first.ss == nil {
+						first = end
+					}
+					return first
+				}).Send_Ai_bar("")
+			})
+		}, ErrResourceUsed},
+		{"OuterStateInInner", func() {
+			new(Session).Start().Foreach(func(s1 S1) S4 {
+				return s1.Foreach(func(s S2) S5 {
+					s1.Foreach(inner)
+					return s.Send_Aj_foo(1)
+				}).Send_Ai_bar("")
+			})
+		}, ErrResourceUsed},
+		{"EarlierRun", func() {
+			ss := new(Session)
+			s := ss.Start()
+			ss.Start().Foreach(outer).End()
+			s.Foreach(outer)
+		}, ErrResourceUsed},
+		{"NoSession", func() {
+			S0{}.Foreach(outer)
+		}, ErrNoSession},
+		{"SendClosed", func() {
+			conn := mockpeer.New(t)
+			conn.Close()
+			(&Session{Conn: conn}).Start().Foreach(outer).End()
+		}, transport.ErrClosed},
+		{"CloseClosed", func() {
+			conn := mockpeer.New(t)
+			s := (&Session{Conn: conn}).Start().Foreach(outer)
+			conn.Close()
+			s.End()
+		}, transport.ErrClosed},
+	})
+}
+
+func TestAllocs(t *testing.T) {
+	inner := func(s S2) S5 { return s.Send_Aj_foo(1) }
+	outer := func(s S1) S4 { return s.Foreach(inner).Send_Ai_bar("bar") }
+	for _, k := range []int{1, 10} {
+		ProtoParam["k"] = k
+		ss := new(Session)
+		ss.Start().Foreach(outer).End() // grows the foreach stack
+		allocs := testing.AllocsPerRun(10, func() {
+			ss.Start().Foreach(outer).End()
+		})
+		if allocs != 0 {
+			t.Errorf("k=%d: expected no allocations per session but got %v", k, allocs)
+		}
+	}
+}